@@ -0,0 +1,55 @@
+// Command majorana runs RISC-V programs on the Majorana virtual processors.
+//
+// Usage:
+//
+//	majorana run [flags] program.asm|program.elf
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const usage = `Usage: majorana <command> [arguments]
+
+Commands:
+  run    run a program on a virtual processor
+`
+
+// exitError is returned when the program run exits with a non-zero code, the
+// code majorana exits with.
+type exitError int32
+
+func (e exitError) Error() string {
+	return fmt.Sprintf("exit code %d", int32(e))
+}
+
+func main() {
+	if err := execute(os.Args[1:], os.Stdin, os.Stdout, os.Stderr); err != nil {
+		var code exitError
+		if errors.As(err, &code) {
+			os.Exit(int(code))
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func execute(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return fmt.Errorf("missing command")
+	}
+	switch args[0] {
+	case "run":
+		return run(args[1:], stdin, stdout, stderr)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, usage)
+		return nil
+	default:
+		fmt.Fprint(stderr, usage)
+		return fmt.Errorf("unknown command: %s", args[0])
+	}
+}
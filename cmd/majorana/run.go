@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/teivah/majorana/common/trace"
+	"github.com/teivah/majorana/proc"
+	_ "github.com/teivah/majorana/proc/all"
+	"github.com/teivah/majorana/proc/comp"
+	"github.com/teivah/majorana/risc"
+)
+
+// state is the initial state of a run, it can be loaded from a JSON file:
+//
+//	{"registers": {"a0": 10}, "memory": {"0x100": 42}}
+//
+// Memory values are 32-bit little-endian words.
+type state struct {
+	Registers map[string]int32 `json:"registers"`
+	Memory    map[string]int32 `json:"memory"`
+}
+
+// memoryRange is a range of memory to print, written addr:length.
+type memoryRange struct {
+	addr   int32
+	length int32
+}
+
+// listFlag is a flag that can be repeated.
+type listFlag []string
+
+func (f *listFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *listFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: majorana run [flags] program.asm|program.elf")
+		fs.PrintDefaults()
+	}
+	var (
+		registers listFlag
+		memory    listFlag
+		dumps     listFlag
+	)
+	mvp := fs.String("mvp", "mvp6-1", "virtual processor: "+strings.Join(proc.Names(), ", "))
+	memoryBytes := fs.Int("memory", 4*1024, "memory size in bytes")
+	l1iSize := fs.Int("l1i", 0, "L1I size in bytes (default of the virtual processor if 0)")
+	l1dSize := fs.Int("l1d", 0, "L1D size in bytes (default of the virtual processor if 0)")
+	l1Ways := fs.Int("l1-ways", 0, "L1I and L1D associativity, a power of two (fully associative if 0)")
+	l1Replacement := fs.String("l1-replacement", comp.LRU.String(), "L1I and L1D replacement policy: lru, plru, fifo or random")
+	l1dWrite := fs.String("l1d-write", comp.WriteBack.String(), "L1D write policy: back or through")
+	l1dNoWriteAllocate := fs.Bool("l1d-no-write-allocate", false, "write the stores missing the L1D directly to the memory")
+	l1iPrefetch := fs.String("l1i-prefetch", comp.NoPrefetch.String(), "L1I prefetcher: none, next-line, stride or stream")
+	l1dPrefetch := fs.String("l1d-prefetch", comp.NoPrefetch.String(), "L1D prefetcher: none, next-line, stride or stream")
+	prefetchDegree := fs.Int("prefetch-degree", 1, "number of lines prefetched ahead")
+	l2Size := fs.Int("l2", 0, "unified L2 size in bytes (no L2 if 0)")
+	l2Latency := fs.Int("l2-latency", proc.DefaultL2Latency, "L2 access in cycles")
+	l2Ways := fs.Int("l2-ways", 0, "L2 associativity, a power of two (fully associative if 0)")
+	l3Size := fs.Int("l3", 0, "unified L3 size in bytes, requires an L2 (no L3 if 0)")
+	l3Latency := fs.Int("l3-latency", proc.DefaultL3Latency, "L3 access in cycles")
+	l3Ways := fs.Int("l3-ways", 0, "L3 associativity, a power of two (fully associative if 0)")
+	branchPrediction := fs.String("branch-prediction", comp.NotTaken.String(), "conditional branches predictor: not-taken, taken, btfn, bimodal, gshare or tournament")
+	btbEntries := fs.Int("btb-entries", comp.DefaultBTB.Entries, "BTB entries")
+	btbWays := fs.Int("btb-ways", comp.DefaultBTB.Ways, "BTB associativity (fully associative if 0)")
+	btbReplacement := fs.String("btb-replacement", comp.DefaultBTB.Policy.String(), "BTB replacement policy: lru, plru, fifo or random")
+	btbTagBits := fs.Int("btb-tag-bits", comp.DefaultBTB.TagBits, "BTB tag bits (full tags if 0)")
+	rasSize := fs.Int("ras-size", comp.DefaultReturnAddressStackSize, "return address stack size")
+	executeUnits := fs.Int("execute-units", 0, "MVP-6.1 execute units (2 if 0)")
+	deepSpeculation := fs.Bool("deep-speculation", false, "write the registers of the speculative instructions right away")
+	loadBarrier := fs.Bool("load-barrier", false, "stall the speculative loads until the branches before them are resolved")
+	noSpeculativeFill := fs.Bool("no-speculative-fill", false, "don't cache the lines missed by the speculative loads in the L1D")
+	memoryLatency := fs.Int("memory-latency", 0, "memory access in cycles replacing the DRAM model (DRAM if 0)")
+	frequency := fs.Int64("frequency", proc.DefaultClockFrequency, "clock frequency in Hz")
+	initFile := fs.String("init", "", "JSON file with the initial registers and memory")
+	debug := fs.Bool("debug", false, "print the execution of each cycle")
+	traceFile := fs.String("trace", "", "file receiving the events of the units as JSON Lines")
+	kanataFile := fs.String("kanata", "", "file receiving the pipeline in the Kanata format of the Konata viewer")
+	lockstep := fs.Bool("lockstep", false, "check each retired instruction against the reference model")
+	fs.Var(&registers, "reg", "initial register value, written reg=value (repeatable)")
+	fs.Var(&memory, "mem", "initial 32-bit memory word, written addr=value (repeatable)")
+	fs.Var(&dumps, "dump", "memory range to print, written addr:length (repeatable)")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected one program, got %d", fs.NArg())
+	}
+
+	initial := state{
+		Registers: make(map[string]int32),
+		Memory:    make(map[string]int32),
+	}
+	if *initFile != "" {
+		data, err := os.ReadFile(*initFile)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &initial); err != nil {
+			return fmt.Errorf("%s: %w", *initFile, err)
+		}
+	}
+	// Flags take precedence over the JSON file
+	if err := parseAssignments(registers, initial.Registers); err != nil {
+		return err
+	}
+	if err := parseAssignments(memory, initial.Memory); err != nil {
+		return err
+	}
+	ranges, err := parseRanges(dumps)
+	if err != nil {
+		return err
+	}
+
+	replacement, err := comp.ParseReplacementPolicy(*l1Replacement)
+	if err != nil {
+		return err
+	}
+	write, err := comp.ParseWritePolicy(*l1dWrite)
+	if err != nil {
+		return err
+	}
+	l1iPrefetcher, err := comp.ParsePrefetchPolicy(*l1iPrefetch)
+	if err != nil {
+		return err
+	}
+	l1dPrefetcher, err := comp.ParsePrefetchPolicy(*l1dPrefetch)
+	if err != nil {
+		return err
+	}
+	predictor, err := comp.ParsePredictorPolicy(*branchPrediction)
+	if err != nil {
+		return err
+	}
+	btbPolicy, err := comp.ParseReplacementPolicy(*btbReplacement)
+	if err != nil {
+		return err
+	}
+
+	app, err := load(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	opts := proc.Options{
+		MemoryBytes:        *memoryBytes,
+		L1ICacheSize:       *l1iSize,
+		L1DCacheSize:       *l1dSize,
+		L1Associativity:    *l1Ways,
+		L1Replacement:      replacement,
+		L1DWritePolicy:     write,
+		L1DNoWriteAllocate: *l1dNoWriteAllocate,
+		L1IPrefetch:        l1iPrefetcher,
+		L1DPrefetch:        l1dPrefetcher,
+		PrefetchDegree:     *prefetchDegree,
+		L2:                 proc.CacheLevelOptions{Size: *l2Size, Latency: *l2Latency, Associativity: *l2Ways},
+		L3:                 proc.CacheLevelOptions{Size: *l3Size, Latency: *l3Latency, Associativity: *l3Ways},
+		MemoryLatency:      *memoryLatency,
+		BranchPrediction:   predictor,
+		BTB: comp.BTBConfig{
+			Entries: *btbEntries,
+			Ways:    *btbWays,
+			Policy:  btbPolicy,
+			TagBits: *btbTagBits,
+		},
+		ReturnAddressStackSize: *rasSize,
+		ExecuteUnits:           *executeUnits,
+		Speculation: proc.SpeculationOptions{
+			Deep:              *deepSpeculation,
+			LoadBarrier:       *loadBarrier,
+			NoSpeculativeFill: *noSpeculativeFill,
+		},
+		ClockFrequency: *frequency,
+	}
+	if *debug {
+		opts.Debug = stdout
+	}
+	var (
+		tracers     trace.Tracers
+		traceWriter *bufio.Writer
+		tracer      *trace.JSONLines
+		kanata      *trace.Kanata
+	)
+	if *traceFile != "" {
+		f, err := os.Create(*traceFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		traceWriter = bufio.NewWriter(f)
+		tracer = trace.NewJSONLines(traceWriter)
+		tracers = append(tracers, tracer)
+	}
+	if *kanataFile != "" {
+		f, err := os.Create(*kanataFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		kanata = trace.NewKanata(f)
+		tracers = append(tracers, kanata)
+	}
+	if len(tracers) != 0 {
+		opts.Tracer = tracers
+	}
+	vm, err := proc.New(*mvp, opts)
+	if err != nil {
+		return err
+	}
+	ctx := vm.Context()
+	ctx.Stdin = stdin
+	if err := initialize(ctx, initial); err != nil {
+		return err
+	}
+	for _, r := range ranges {
+		if r.addr < 0 || int(r.addr)+int(r.length) > len(ctx.Memory) {
+			return fmt.Errorf("memory range %d:%d exceeds memory size %d", r.addr, r.length, len(ctx.Memory))
+		}
+	}
+
+	var cycles int
+	if *lockstep {
+		cycles, err = proc.RunLockstep(vm, app)
+	} else {
+		cycles, err = vm.Run(app)
+	}
+	if err != nil {
+		return err
+	}
+	if tracer != nil {
+		if err := cmp.Or(tracer.Err(), traceWriter.Flush()); err != nil {
+			return fmt.Errorf("%s: %w", *traceFile, err)
+		}
+	}
+	if kanata != nil {
+		if err := kanata.Close(); err != nil {
+			return fmt.Errorf("%s: %w", *kanataFile, err)
+		}
+	}
+	if _, err := ctx.Stdout.WriteTo(stdout); err != nil {
+		return err
+	}
+	if _, err := ctx.Stderr.WriteTo(stderr); err != nil {
+		return err
+	}
+	report(stdout, vm, opts, cycles, ranges)
+	if code := vm.ExitCode(); code != 0 {
+		return exitError(code)
+	}
+	return nil
+}
+
+// load parses an ELF executable or an assembly source file.
+func load(filename string) (risc.Application, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return risc.Application{}, err
+	}
+	if bytes.HasPrefix(data, []byte("\x7fELF")) {
+		app, err := risc.ParseELF(bytes.NewReader(data))
+		if err != nil {
+			return risc.Application{}, fmt.Errorf("%s: %w", filename, err)
+		}
+		return app, nil
+	}
+	app, err := risc.Parse(string(data))
+	if err != nil {
+		return risc.Application{}, fmt.Errorf("%s: %w", filename, err)
+	}
+	return app, nil
+}
+
+// parseAssignments parses key=value assignments into values.
+func parseAssignments(assignments []string, values map[string]int32) error {
+	for _, assignment := range assignments {
+		key, value, found := strings.Cut(assignment, "=")
+		if !found {
+			return fmt.Errorf("invalid assignment %q, expected key=value", assignment)
+		}
+		v, err := parseInt(value)
+		if err != nil {
+			return fmt.Errorf("invalid assignment %q: %w", assignment, err)
+		}
+		values[strings.TrimSpace(key)] = v
+	}
+	return nil
+}
+
+func parseRanges(dumps []string) ([]memoryRange, error) {
+	var ranges []memoryRange
+	for _, dump := range dumps {
+		addr, length, found := strings.Cut(dump, ":")
+		if !found {
+			return nil, fmt.Errorf("invalid memory range %q, expected addr:length", dump)
+		}
+		a, err := parseInt(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid memory range %q: %w", dump, err)
+		}
+		l, err := parseInt(length)
+		if err != nil {
+			return nil, fmt.Errorf("invalid memory range %q: %w", dump, err)
+		}
+		if l < 0 {
+			return nil, fmt.Errorf("invalid memory range %q: negative length", dump)
+		}
+		ranges = append(ranges, memoryRange{addr: a, length: l})
+	}
+	return ranges, nil
+}
+
+// parseInt parses a decimal, hexadecimal (0x), octal (0o) or binary (0b)
+// 32-bit integer. Unsigned values such as 0xffffffff are accepted.
+func parseInt(s string) (int32, error) {
+	s = strings.TrimSpace(s)
+	if v, err := strconv.ParseInt(s, 0, 32); err == nil {
+		return int32(v), nil
+	}
+	v, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid 32-bit integer %q", s)
+	}
+	return int32(v), nil
+}
+
+func initialize(ctx *risc.Context, initial state) error {
+	for name, v := range initial.Registers {
+		register, err := risc.ParseRegister(name)
+		if err != nil {
+			return err
+		}
+		if register == risc.Zero {
+			return fmt.Errorf("register zero can't be initialized")
+		}
+		ctx.Registers[register] = v
+	}
+	for addr, v := range initial.Memory {
+		a, err := parseInt(addr)
+		if err != nil {
+			return fmt.Errorf("invalid memory address: %w", err)
+		}
+		if a < 0 || int(a)+4 > len(ctx.Memory) {
+			return fmt.Errorf("memory address %d exceeds memory size %d", a, len(ctx.Memory))
+		}
+		word := risc.BytesFromLowBits(v)
+		copy(ctx.Memory[a:], word[:])
+	}
+	return nil
+}
+
+func report(w io.Writer, vm proc.Machine, opts proc.Options, cycles int, ranges []memoryRange) {
+	ctx := vm.Context()
+	fmt.Fprintf(w, "cycles: %d\n", cycles)
+	fmt.Fprintf(w, "duration: %v\n", opts.Duration(cycles))
+	fmt.Fprintf(w, "exit code: %d\n", vm.ExitCode())
+
+	fmt.Fprintln(w, "stats:")
+	vm.Stats().Write(w)
+
+	fmt.Fprintln(w, "registers:")
+	for register := risc.Zero; register <= risc.T6; register++ {
+		v := ctx.Registers[register]
+		fmt.Fprintf(w, "  %-4s %11d  0x%08x\n", strings.ToLower(register.String()), v, uint32(v))
+	}
+
+	if len(ranges) != 0 {
+		fmt.Fprintln(w, "memory:")
+	}
+	for _, r := range ranges {
+		for addr := r.addr; addr < r.addr+r.length; addr += 16 {
+			end := min(addr+16, r.addr+r.length)
+			values := make([]string, 0, end-addr)
+			for _, v := range ctx.Memory[addr:end] {
+				values = append(values, fmt.Sprintf("%02x", uint8(v)))
+			}
+			fmt.Fprintf(w, "  0x%08x: %s\n", addr, strings.Join(values, " "))
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teivah/majorana/proc"
+)
+
+func TestRun(t *testing.T) {
+	for _, mvp := range proc.Names() {
+		t.Run(mvp, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			err := execute([]string{"run", "-mvp", mvp, "-memory", "256", "-mem", "0=42", "-dump", "0:4",
+				"../../res/print-number.asm"}, strings.NewReader(""), &stdout, &stderr)
+			require.Equal(t, exitError(3), err)
+			out := stdout.String()
+			assert.True(t, strings.HasPrefix(out, "42\ncycles: "), out)
+			assert.Contains(t, out, "exit code: 3\n")
+			assert.Contains(t, out, "  a7            93  0x0000005d\n")
+			assert.Contains(t, out, "memory:\n  0x00000000: 2a 00 00 00\n")
+		})
+	}
+}
+
+func TestRunELF(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	err := execute([]string{"run", "-mvp", "mvp1", "../../res/elf-sum.elf"}, nil, &stdout, &stderr)
+	require.NoError(t, err)
+	assert.Contains(t, stdout.String(), "  a0           108  0x0000006c\n")
+}
+
+func TestRunLockstep(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	err := execute([]string{"run", "-mvp", "mvp6-1", "-lockstep", "../../res/elf-sum.elf"}, nil, &stdout, &stderr)
+	require.NoError(t, err)
+	assert.Contains(t, stdout.String(), "  a0           108  0x0000006c\n")
+}
+
+func TestRunMemoryHierarchy(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	err := execute([]string{"run", "-mvp", "mvp6-1", "-l2", "4096", "-l2-ways", "4", "-l3", "16384",
+		"../../res/elf-sum.elf"}, nil, &stdout, &stderr)
+	require.NoError(t, err)
+	assert.Contains(t, stdout.String(), "  a0           108  0x0000006c\n")
+	assert.Contains(t, stdout.String(), "  l2: ")
+	assert.Contains(t, stdout.String(), "  l3: ")
+}
+
+func TestRunPrefetch(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	err := execute([]string{"run", "-mvp", "mvp6-1", "-l1i-prefetch", "next-line", "-l1d-prefetch", "stride",
+		"-prefetch-degree", "2", "../../res/elf-sum.elf"}, nil, &stdout, &stderr)
+	require.NoError(t, err)
+	assert.Contains(t, stdout.String(), "  a0           108  0x0000006c\n")
+	assert.Contains(t, stdout.String(), "  l1i prefetch: ")
+}
+
+func TestRunBranchPrediction(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	err := execute([]string{"run", "-mvp", "mvp6-1", "-branch-prediction", "tournament", "-lockstep",
+		"../../res/elf-sum.elf"}, nil, &stdout, &stderr)
+	require.NoError(t, err)
+	assert.Contains(t, stdout.String(), "  a0           108  0x0000006c\n")
+	assert.Contains(t, stdout.String(), "  branches: ")
+}
+
+func TestRunReturnAddressStack(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	err := execute([]string{"run", "-mvp", "mvp5", "-ras-size", "2", "-lockstep",
+		"../../res/factorial.asm"}, nil, &stdout, &stderr)
+	require.NoError(t, err)
+	assert.Contains(t, stdout.String(), "  ras: ")
+}
+
+func TestRunBranchTargetBuffer(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	err := execute([]string{"run", "-mvp", "mvp6-1", "-btb-entries", "16", "-btb-ways", "2", "-btb-replacement", "plru",
+		"-btb-tag-bits", "2", "-lockstep", "../../res/elf-sum.elf"}, nil, &stdout, &stderr)
+	require.NoError(t, err)
+	assert.Contains(t, stdout.String(), "  a0           108  0x0000006c\n")
+	assert.Contains(t, stdout.String(), "  btb: ")
+}
+
+func TestRunSpeculation(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	err := execute([]string{"run", "-mvp", "mvp6-1", "-execute-units", "4", "-deep-speculation", "-load-barrier", "-no-speculative-fill", "-lockstep",
+		"../../res/elf-sum.elf"}, nil, &stdout, &stderr)
+	require.NoError(t, err)
+	assert.Contains(t, stdout.String(), "  a0           108  0x0000006c\n")
+}
+
+func TestRunInitFile(t *testing.T) {
+	dir := t.TempDir()
+	program := filepath.Join(dir, "program.asm")
+	require.NoError(t, os.WriteFile(program, []byte(`lw t0, 0x10(zero)
+add a0, a0, t0
+sw a0, 0x14(zero)`), 0o644))
+	init := filepath.Join(dir, "init.json")
+	require.NoError(t, os.WriteFile(init, []byte(`{"registers": {"a0": 1, "x11": 2}, "memory": {"0x10": 3}}`), 0o644))
+
+	var stdout, stderr bytes.Buffer
+	err := execute([]string{"run", "-mvp", "mvp3", "-memory", "64", "-init", init, "-reg", "a0=0x10",
+		"-dump", "0x10:8", program}, nil, &stdout, &stderr)
+	require.NoError(t, err)
+	assert.Contains(t, stdout.String(), "  a0            19  0x00000013\n")
+	assert.Contains(t, stdout.String(), "  a1             2  0x00000002\n")
+	assert.Contains(t, stdout.String(), "  0x00000010: 03 00 00 00 13 00 00 00\n")
+}
+
+func TestRunErrors(t *testing.T) {
+	tests := map[string][]string{
+		"no command":       {},
+		"unknown command":  {"foo"},
+		"no program":       {"run"},
+		"unknown mvp":      {"run", "-mvp", "mvp7", "../../res/print-number.asm"},
+		"invalid reg":      {"run", "-reg", "a0", "../../res/print-number.asm"},
+		"unknown reg":      {"run", "-reg", "foo=1", "../../res/print-number.asm"},
+		"invalid range":    {"run", "-memory", "64", "-dump", "60:8", "../../res/print-number.asm"},
+		"invalid l1d":      {"run", "-mvp", "mvp3", "-l1d", "100", "../../res/print-number.asm"},
+		"invalid l1 ways":  {"run", "-mvp", "mvp3", "-l1-ways", "3", "../../res/print-number.asm"},
+		"unknown policy":   {"run", "-mvp", "mvp3", "-l1-replacement", "mru", "../../res/print-number.asm"},
+		"unknown write":    {"run", "-mvp", "mvp3", "-l1d-write", "around", "../../res/print-number.asm"},
+		"unknown prefetch": {"run", "-mvp", "mvp3", "-l1d-prefetch", "markov", "../../res/print-number.asm"},
+		"invalid degree":   {"run", "-mvp", "mvp3", "-prefetch-degree", "-1", "../../res/print-number.asm"},
+		"invalid l2":       {"run", "-mvp", "mvp3", "-l2", "100", "../../res/print-number.asm"},
+		"l3 without l2":    {"run", "-mvp", "mvp3", "-l3", "1024", "../../res/print-number.asm"},
+		"invalid latency":  {"run", "-mvp", "mvp3", "-memory-latency", "-1", "../../res/print-number.asm"},
+		"unknown branch":   {"run", "-mvp", "mvp5", "-branch-prediction", "perceptron", "../../res/print-number.asm"},
+		"negative ras":     {"run", "-mvp", "mvp5", "-ras-size", "-1", "../../res/print-number.asm"},
+		"negative units":   {"run", "-mvp", "mvp6-1", "-execute-units", "-1", "../../res/print-number.asm"},
+		"invalid btb":      {"run", "-mvp", "mvp5", "-btb-entries", "6", "-btb-ways", "4", "../../res/print-number.asm"},
+		"unknown btb":      {"run", "-mvp", "mvp5", "-btb-replacement", "mru", "../../res/print-number.asm"},
+		"missing file":     {"run", "unknown.asm"},
+	}
+	for name, args := range tests {
+		t.Run(name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			assert.Error(t, execute(args, nil, &stdout, &stderr))
+		})
+	}
+}
+
+func TestRunTrace(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "trace.jsonl")
+	var stdout, stderr bytes.Buffer
+	err := execute([]string{"run", "-mvp", "mvp4", "-memory", "256", "-trace", file,
+		"../../res/print-number.asm"}, nil, &stdout, &stderr)
+	require.Equal(t, exitError(2), err)
+
+	data, err := os.ReadFile(file)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.NotEmpty(t, lines)
+	assert.Equal(t, `{"cycle":1,"unit":"MMU","event":"stall","pc":0,"reason":"L1I miss"}`, lines[0])
+	assert.Contains(t, string(data), `"unit":"FU","event":"fetch","pc":0}`)
+}
+
+func TestRunKanata(t *testing.T) {
+	dir := t.TempDir()
+	kanata := filepath.Join(dir, "pipeline.log")
+	jsonl := filepath.Join(dir, "trace.jsonl")
+	var stdout, stderr bytes.Buffer
+	err := execute([]string{"run", "-mvp", "mvp6-0", "-memory", "256", "-kanata", kanata, "-trace", jsonl,
+		"../../res/print-number.asm"}, nil, &stdout, &stderr)
+	require.Equal(t, exitError(2), err)
+
+	data, err := os.ReadFile(kanata)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(data), "Kanata\t0004\nC=\t1\n"), string(data))
+	assert.Contains(t, string(data), "I\t0\t0\t0\nL\t0\t0\t00000000\nS\t0\t0\tF\n")
+	data, err = os.ReadFile(jsonl)
+	require.NoError(t, err)
+	assert.NotEmpty(t, data)
+}
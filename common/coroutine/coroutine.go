@@ -5,6 +5,7 @@ type Coroutine[A, B any] struct {
 	current func(A) B
 	isStart bool
 	pre     func(A)
+	post    func(A, B)
 }
 
 func New[A, B any](f func(A) B) Coroutine[A, B] {
@@ -19,11 +20,19 @@ func (c *Coroutine[A, B]) Pre(f func(A)) {
 	c.pre = f
 }
 
+func (c *Coroutine[A, B]) Post(f func(A, B)) {
+	c.post = f
+}
+
 func (c *Coroutine[A, B]) Cycle(a A) B {
 	if c.pre != nil {
 		c.pre(a)
 	}
-	return c.current(a)
+	b := c.current(a)
+	if c.post != nil {
+		c.post(a, b)
+	}
+	return b
 }
 
 func (c *Coroutine[A, B]) Checkpoint(f func(A) B) {
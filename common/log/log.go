@@ -3,6 +3,7 @@ package log
 import (
 	"fmt"
 
+	"github.com/teivah/majorana/common/trace"
 	"github.com/teivah/majorana/risc"
 )
 
@@ -10,19 +11,76 @@ func Infoi(ctx *risc.Context, unit string, insType risc.InstructionType, pc int3
 	if !ctx.Debug {
 		return
 	}
-	fmt.Printf("\t%s: %s (pc=%d, ins=%s)\n", unit, fmt.Sprintf(detail, args...), pc/4, insType)
+	fmt.Fprintf(ctx.DebugWriter, "\t%s: %s (pc=%d, ins=%s)\n", unit, fmt.Sprintf(detail, args...), pc/4, insType)
 }
 
 func Infou(ctx *risc.Context, unit string, detail string, args ...any) {
 	if !ctx.Debug {
 		return
 	}
-	fmt.Printf("\t%s: %s\n", unit, fmt.Sprintf(detail, args...))
+	fmt.Fprintf(ctx.DebugWriter, "\t%s: %s\n", unit, fmt.Sprintf(detail, args...))
 }
 
 func Info(ctx *risc.Context, detail string, args ...any) {
 	if !ctx.Debug {
 		return
 	}
-	fmt.Printf("%s\n", fmt.Sprintf(detail, args...))
+	fmt.Fprintf(ctx.DebugWriter, "%s\n", fmt.Sprintf(detail, args...))
+}
+
+// Tracei records an event of a unit on an instruction.
+func Tracei(ctx *risc.Context, unit string, kind trace.Kind, insType risc.InstructionType, pc int32) {
+	if ctx.Tracer == nil {
+		return
+	}
+	ctx.Tracer.Trace(trace.Event{Cycle: ctx.Cycle, Unit: unit, Kind: kind, Pc: pc, Instruction: insType.String()})
+}
+
+// Tracepc records an event of a unit on an address not decoded yet.
+func Tracepc(ctx *risc.Context, unit string, kind trace.Kind, pc int32) {
+	if ctx.Tracer == nil {
+		return
+	}
+	ctx.Tracer.Trace(trace.Event{Cycle: ctx.Cycle, Unit: unit, Kind: kind, Pc: pc})
+}
+
+// Stalli records a unit waiting on an instruction.
+func Stalli(ctx *risc.Context, unit string, insType risc.InstructionType, pc int32, reason string) {
+	if ctx.Tracer == nil {
+		return
+	}
+	ctx.Tracer.Trace(trace.Event{Cycle: ctx.Cycle, Unit: unit, Kind: trace.Stall, Pc: pc, Instruction: insType.String(), Reason: reason})
+}
+
+// Stallpc records a unit waiting on an address not decoded yet.
+func Stallpc(ctx *risc.Context, unit string, pc int32, reason string) {
+	if ctx.Tracer == nil {
+		return
+	}
+	ctx.Tracer.Trace(trace.Event{Cycle: ctx.Cycle, Unit: unit, Kind: trace.Stall, Pc: pc, Reason: reason})
+}
+
+// Stallu records a unit waiting regardless of an instruction.
+func Stallu(ctx *risc.Context, unit string, reason string) {
+	if ctx.Tracer == nil {
+		return
+	}
+	ctx.Tracer.Trace(trace.Event{Cycle: ctx.Cycle, Unit: unit, Kind: trace.Stall, Pc: -1, Reason: reason})
+}
+
+// Forward records a register value forwarded to an instruction.
+func Forward(ctx *risc.Context, unit string, insType risc.InstructionType, pc int32, register risc.RegisterType) {
+	if ctx.Tracer == nil {
+		return
+	}
+	ctx.Tracer.Trace(trace.Event{Cycle: ctx.Cycle, Unit: unit, Kind: trace.Forward, Pc: pc, Instruction: insType.String(), Register: register.String()})
+}
+
+// Flush records a pipeline flush caused by the instruction at from, the
+// execution resumes at to.
+func Flush(ctx *risc.Context, unit string, from, to int32) {
+	if ctx.Tracer == nil {
+		return
+	}
+	ctx.Tracer.Trace(trace.Event{Cycle: ctx.Cycle, Unit: unit, Kind: trace.Flush, Pc: from, Target: &to})
 }
@@ -10,6 +10,10 @@ func (g *Gauge) Push(v int) {
 	g.count++
 }
 
+// Stats returns the average of the values pushed, 0 if none.
 func (g *Gauge) Stats() float64 {
+	if g.count == 0 {
+		return 0
+	}
 	return float64(g.sum) / float64(g.count)
 }
@@ -0,0 +1,161 @@
+package trace
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// Stages of an instruction in the Kanata log, in pipeline order.
+var kanataStages = map[Kind]struct {
+	order int
+	name  string
+}{
+	Fetch:     {0, "F"},
+	Decode:    {1, "D"},
+	Dispatch:  {2, "Ds"},
+	Execute:   {3, "X"},
+	Writeback: {4, "W"},
+}
+
+// instruction is an instruction in flight, a same pc may be fetched several
+// times before the first instance retires.
+type instruction struct {
+	id     int
+	pc     int32
+	stage  int
+	stall  string
+	retire bool
+}
+
+// Kanata writes the events in the Kanata log format (version 0004) read by
+// the Konata pipeline viewer. Each fetch creates an instruction that goes
+// through the F (fetch), D (decode), Ds (dispatch), X (execute) and W
+// (writeback) stages. The instructions fetched after the one causing a flush
+// are squashed. Close must be called once the application has run.
+type Kanata struct {
+	w        *bufio.Writer
+	started  bool
+	cycle    int
+	nextId   int
+	retireId int
+	inFlight []*instruction
+	err      error
+}
+
+func NewKanata(w io.Writer) *Kanata {
+	k := &Kanata{w: bufio.NewWriter(w)}
+	k.printf("Kanata\t0004\n")
+	return k
+}
+
+func (k *Kanata) Trace(e Event) {
+	k.advance(e.Cycle)
+	switch e.Kind {
+	case Fetch:
+		ins := &instruction{id: k.nextId, pc: e.Pc}
+		k.nextId++
+		k.inFlight = append(k.inFlight, ins)
+		k.printf("I\t%d\t%d\t0\n", ins.id, ins.id)
+		k.printf("L\t%d\t0\t%08x\n", ins.id, uint32(e.Pc))
+		k.printf("S\t%d\t0\t%s\n", ins.id, kanataStages[Fetch].name)
+	case Decode, Dispatch, Execute, Writeback:
+		stage := kanataStages[e.Kind]
+		ins := k.find(e.Pc, func(ins *instruction) bool { return ins.stage < stage.order })
+		if ins == nil {
+			return
+		}
+		if e.Kind == Decode {
+			k.printf("L\t%d\t0\t %s\n", ins.id, e.Instruction)
+		}
+		ins.stage = stage.order
+		ins.stall = ""
+		k.printf("S\t%d\t0\t%s\n", ins.id, stage.name)
+		if e.Kind == Writeback {
+			// Retired the next cycle so that the W stage is visible
+			ins.retire = true
+		}
+	case Stall:
+		if e.Instruction == "" {
+			// Not decoded yet
+			return
+		}
+		ins := k.find(e.Pc, func(ins *instruction) bool { return !ins.retire })
+		if ins == nil {
+			return
+		}
+		reason := e.Unit + ": " + e.Reason
+		if ins.stall == reason {
+			return
+		}
+		ins.stall = reason
+		k.printf("L\t%d\t1\tcycle %d, %s\n", ins.id, e.Cycle, reason)
+	case Flush:
+		from := k.find(e.Pc, func(*instruction) bool { return true })
+		if from == nil {
+			return
+		}
+		k.retire(func(ins *instruction) bool { return ins.id > from.id }, 1)
+	}
+}
+
+// advance moves the log to the cycle and retires the instructions written
+// back during the previous cycles.
+func (k *Kanata) advance(cycle int) {
+	if !k.started {
+		k.started = true
+		k.cycle = cycle
+		k.printf("C=\t%d\n", cycle)
+		return
+	}
+	if cycle <= k.cycle {
+		return
+	}
+	k.retire(func(ins *instruction) bool { return ins.retire }, 0)
+	k.printf("C\t%d\n", cycle-k.cycle)
+	k.cycle = cycle
+}
+
+// retire retires the instructions in flight matching f, flushed is 1 if the
+// instructions are squashed.
+func (k *Kanata) retire(f func(ins *instruction) bool, flushed int) {
+	remaining := k.inFlight[:0]
+	for _, ins := range k.inFlight {
+		if f(ins) {
+			k.printf("R\t%d\t%d\t%d\n", ins.id, k.retireId, flushed)
+			k.retireId++
+			continue
+		}
+		remaining = append(remaining, ins)
+	}
+	k.inFlight = remaining
+}
+
+// find returns the oldest instruction in flight at pc matching f.
+func (k *Kanata) find(pc int32, f func(ins *instruction) bool) *instruction {
+	for _, ins := range k.inFlight {
+		if ins.pc == pc && f(ins) {
+			return ins
+		}
+	}
+	return nil
+}
+
+func (k *Kanata) printf(format string, args ...any) {
+	if k.err != nil {
+		return
+	}
+	_, k.err = fmt.Fprintf(k.w, format, args...)
+}
+
+// Close retires the instructions still in flight and flushes the log. The
+// instructions executed are retired, the other ones are squashed.
+func (k *Kanata) Close() error {
+	k.printf("C\t1\n")
+	k.retire(func(ins *instruction) bool { return ins.stage >= kanataStages[Execute].order }, 0)
+	k.retire(func(*instruction) bool { return true }, 1)
+	if k.err != nil {
+		return k.err
+	}
+	return k.w.Flush()
+}
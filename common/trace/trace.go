@@ -0,0 +1,86 @@
+// Package trace records what the units of a processor do at each cycle.
+package trace
+
+import (
+	"encoding/json"
+	"io"
+)
+
+type Kind string
+
+const (
+	// Fetch is an instruction fetched by the fetch unit.
+	Fetch Kind = "fetch"
+	// Decode is an instruction decoded by the decode unit.
+	Decode Kind = "decode"
+	// Dispatch is an instruction pushed to the execute units.
+	Dispatch Kind = "dispatch"
+	// Stall is a unit waiting, the reason is set.
+	Stall Kind = "stall"
+	// Forward is a register value forwarded between two execute units.
+	Forward Kind = "forward"
+	// Execute is an executed instruction.
+	Execute Kind = "execute"
+	// Writeback is a result written to a register or to the memory.
+	Writeback Kind = "writeback"
+	// Flush is a pipeline flush, Target is the address fetched next.
+	Flush Kind = "flush"
+)
+
+// Event is what a unit did during a cycle. Pc is the address of the
+// instruction, -1 if the event isn't related to an instruction.
+type Event struct {
+	Cycle       int    `json:"cycle"`
+	Unit        string `json:"unit"`
+	Kind        Kind   `json:"event"`
+	Pc          int32  `json:"pc"`
+	Instruction string `json:"ins,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+	Register    string `json:"register,omitempty"`
+	Target      *int32 `json:"target,omitempty"`
+}
+
+// Tracer receives the events.
+type Tracer interface {
+	Trace(e Event)
+}
+
+// Tracers forwards the events to several tracers.
+type Tracers []Tracer
+
+func (t Tracers) Trace(e Event) {
+	for _, tracer := range t {
+		tracer.Trace(e)
+	}
+}
+
+// JSONLines writes each event as a JSON object on its own line.
+type JSONLines struct {
+	encoder *json.Encoder
+	err     error
+}
+
+func NewJSONLines(w io.Writer) *JSONLines {
+	return &JSONLines{encoder: json.NewEncoder(w)}
+}
+
+func (j *JSONLines) Trace(e Event) {
+	if j.err != nil {
+		return
+	}
+	j.err = j.encoder.Encode(e)
+}
+
+// Err returns the first error that occurred while writing the events.
+func (j *JSONLines) Err() error {
+	return j.err
+}
+
+// Recorder keeps the events in memory.
+type Recorder struct {
+	Events []Event
+}
+
+func (r *Recorder) Trace(e Event) {
+	r.Events = append(r.Events, e)
+}
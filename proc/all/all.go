@@ -0,0 +1,14 @@
+// Package all registers every microarchitecture:
+//
+//	import _ "github.com/teivah/majorana/proc/all"
+package all
+
+import (
+	_ "github.com/teivah/majorana/proc/mvp1"
+	_ "github.com/teivah/majorana/proc/mvp2"
+	_ "github.com/teivah/majorana/proc/mvp3"
+	_ "github.com/teivah/majorana/proc/mvp4"
+	_ "github.com/teivah/majorana/proc/mvp5"
+	_ "github.com/teivah/majorana/proc/mvp6-0"
+	_ "github.com/teivah/majorana/proc/mvp6-1"
+)
@@ -0,0 +1,173 @@
+package comp
+
+import (
+	"cmp"
+	"fmt"
+	"math/bits"
+)
+
+// BTBConfig is the geometry and the replacement policy of a branch target
+// buffer.
+type BTBConfig struct {
+	// Entries is the number of branches.
+	Entries int
+	// Ways is the number of entries per set, fully associative if 0. The
+	// number of sets must be a power of two.
+	Ways   int
+	Policy ReplacementPolicy
+	// TagBits is the number of bits of the tags, the low bits of the pc above
+	// the index. The branches whose pc only differ above them share their
+	// entry (aliasing). The tags are the whole pc above the index if 0.
+	TagBits int
+}
+
+// DefaultBTB is the branch target buffer of the microarchitectures with a
+// branch unit: 4 entries, evicting the oldest one.
+var DefaultBTB = BTBConfig{
+	Entries: 4,
+	Policy:  FIFO,
+}
+
+// Validate checks the geometry of the branch target buffer.
+func (c BTBConfig) Validate() error {
+	if c.Entries <= 0 {
+		return fmt.Errorf("BTB entries %d isn't positive", c.Entries)
+	}
+	ways := cmp.Or(c.Ways, c.Entries)
+	if ways < 0 || c.Entries%ways != 0 {
+		return fmt.Errorf("%d BTB entries can't be split into sets of %d", c.Entries, ways)
+	}
+	if sets := c.Entries / ways; bits.OnesCount(uint(sets)) != 1 {
+		return fmt.Errorf("%d BTB sets isn't a power of two", sets)
+	}
+	if _, exists := replacementPolicies[c.Policy]; !exists {
+		return fmt.Errorf("unknown replacement policy %v", c.Policy)
+	}
+	if c.Policy == PLRU && bits.OnesCount(uint(ways)) != 1 {
+		return fmt.Errorf("pseudo-LRU associativity %d isn't a power of two", ways)
+	}
+	if c.TagBits < 0 || c.TagBits > 30 {
+		return fmt.Errorf("BTB tag bits %d isn't between 0 and 30", c.TagBits)
+	}
+	return nil
+}
+
+// BTBStats are the lookups of a branch target buffer.
+type BTBStats struct {
+	Hits   int
+	Misses int
+	// Aliases are the hits on the entry of another branch, with the same
+	// index and tag. They are part of the hits.
+	Aliases int
+}
+
+// BranchTargetBuffer is a set-associative cache of the targets of the
+// branches. As the instructions are aligned on 4 bytes, a pc is decomposed
+// into a tag and the index of its set from its third bit.
+type BranchTargetBuffer struct {
+	config    BTBConfig
+	indexBits int
+	sets      [][]btbEntry
+	policy    replacement
+	stats     BTBStats
+}
+
+type btbEntry struct {
+	valid bool
+	tag   uint32
+	// pc is the branch which pushed the entry, it only counts the aliases
+	pc     int32
+	target int32
+}
+
+// NewBranchTargetBuffer creates a branch target buffer, it panics if the
+// configuration is invalid.
+func NewBranchTargetBuffer(config BTBConfig) *BranchTargetBuffer {
+	if err := config.Validate(); err != nil {
+		panic(err)
+	}
+	config.Ways = cmp.Or(config.Ways, config.Entries)
+	sets := config.Entries / config.Ways
+	b := &BranchTargetBuffer{
+		config:    config,
+		indexBits: bits.TrailingZeros(uint(sets)),
+		sets:      make([][]btbEntry, sets),
+		policy:    newReplacement(config.Policy, sets, config.Ways),
+	}
+	for i := range b.sets {
+		b.sets[i] = make([]btbEntry, config.Ways)
+	}
+	return b
+}
+
+func (b *BranchTargetBuffer) decompose(pc int32) (tag uint32, index int) {
+	u := uint32(pc) >> 2
+	index = int(u & (1<<b.indexBits - 1))
+	tag = u >> b.indexBits
+	if b.config.TagBits != 0 {
+		tag &= 1<<b.config.TagBits - 1
+	}
+	return tag, index
+}
+
+func (b *BranchTargetBuffer) find(pc int32) (*btbEntry, int, int) {
+	tag, index := b.decompose(pc)
+	for way := range b.sets[index] {
+		e := &b.sets[index][way]
+		if e.valid && e.tag == tag {
+			return e, index, way
+		}
+	}
+	return nil, index, -1
+}
+
+// Lookup returns the target of the branch at pc. With partial tags, it may be
+// the target of another branch.
+func (b *BranchTargetBuffer) Lookup(pc int32) (int32, bool) {
+	e, index, way := b.find(pc)
+	if e == nil {
+		b.stats.Misses++
+		return 0, false
+	}
+	b.stats.Hits++
+	if e.pc != pc {
+		b.stats.Aliases++
+	}
+	b.policy.touch(index, way)
+	return e.target, true
+}
+
+// Update records the target of the branch at pc once resolved, replacing the
+// entry of its tag if any.
+func (b *BranchTargetBuffer) Update(pc, target int32) {
+	tag, index := b.decompose(pc)
+	e, _, way := b.find(pc)
+	if e != nil {
+		e.pc = pc
+		e.target = target
+		b.policy.touch(index, way)
+		return
+	}
+	set := b.sets[index]
+	for i := range set {
+		if !set[i].valid {
+			way = i
+			break
+		}
+	}
+	if way == -1 {
+		way = b.policy.victim(index)
+	}
+	set[way] = btbEntry{
+		valid:  true,
+		tag:    tag,
+		pc:     pc,
+		target: target,
+	}
+	b.policy.insert(index, way)
+}
+
+// Stats returns the lookups.
+func (b *BranchTargetBuffer) Stats() BTBStats {
+	return b.stats
+}
@@ -0,0 +1,68 @@
+package comp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBTBConfig(t *testing.T) {
+	assert.NoError(t, DefaultBTB.Validate())
+	assert.NoError(t, BTBConfig{Entries: 16, Ways: 4, TagBits: 2}.Validate())
+	for _, c := range []BTBConfig{
+		{},
+		{Entries: 6, Ways: 4},
+		{Entries: 12, Ways: 4},
+		{Entries: 6, Ways: 6, Policy: PLRU},
+		{Entries: 4, Policy: Random + 1},
+		{Entries: 4, TagBits: 31},
+	} {
+		assert.Error(t, c.Validate(), c)
+	}
+}
+
+func TestBranchTargetBuffer(t *testing.T) {
+	// 2 sets of 2 entries
+	b := NewBranchTargetBuffer(BTBConfig{Entries: 4, Ways: 2})
+	_, exists := b.Lookup(0)
+	assert.False(t, exists)
+	b.Update(0, 100)
+	b.Update(16, 116)
+	b.Update(4, 104)
+	target, exists := b.Lookup(0)
+	assert.True(t, exists)
+	assert.Equal(t, int32(100), target)
+	// The least recently used entry of the first set is evicted, the second
+	// set is left untouched
+	b.Update(32, 132)
+	_, exists = b.Lookup(16)
+	assert.False(t, exists)
+	target, _ = b.Lookup(4)
+	assert.Equal(t, int32(104), target)
+	// Updated in place
+	b.Update(32, 200)
+	target, _ = b.Lookup(32)
+	assert.Equal(t, int32(200), target)
+	assert.Equal(t, BTBStats{Hits: 3, Misses: 2}, b.Stats())
+}
+
+func TestBranchTargetBufferAliasing(t *testing.T) {
+	// Direct-mapped with 2 sets and 1-bit tags: 0, 8 and 16 share the index,
+	// 0 and 16 the tag
+	b := NewBranchTargetBuffer(BTBConfig{Entries: 2, Ways: 1, TagBits: 1})
+	b.Update(0, 100)
+	target, exists := b.Lookup(16)
+	assert.True(t, exists)
+	assert.Equal(t, int32(100), target)
+	_, exists = b.Lookup(8)
+	assert.False(t, exists)
+	// The entry now belongs to 16
+	b.Update(16, 116)
+	target, _ = b.Lookup(0)
+	assert.Equal(t, int32(116), target)
+	// Evicted by another tag
+	b.Update(8, 108)
+	_, exists = b.Lookup(0)
+	assert.False(t, exists)
+	assert.Equal(t, BTBStats{Hits: 2, Misses: 2, Aliases: 2}, b.Stats())
+}
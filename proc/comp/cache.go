@@ -1,93 +1,507 @@
 package comp
 
 import (
+	"cmp"
 	"fmt"
+	"math/bits"
+	"math/rand"
 	"strings"
 )
 
-type LRUCache struct {
-	numberOfLines int
-	lineLength    int
-	cacheLength   int
-	lines         []Line
+// ReplacementPolicy selects the line of a set evicted when a line is pushed
+// into a full set.
+type ReplacementPolicy int
+
+const (
+	// LRU evicts the least recently used line.
+	LRU ReplacementPolicy = iota
+	// PLRU evicts a line approximating the least recently used one with a
+	// binary tree of bits per set, the associativity must be a power of two.
+	PLRU
+	// FIFO evicts the oldest pushed line.
+	FIFO
+	// Random evicts a random line.
+	Random
+)
+
+var replacementPolicies = map[ReplacementPolicy]string{
+	LRU:    "lru",
+	PLRU:   "plru",
+	FIFO:   "fifo",
+	Random: "random",
+}
+
+func (p ReplacementPolicy) String() string {
+	if s, exists := replacementPolicies[p]; exists {
+		return s
+	}
+	return fmt.Sprintf("ReplacementPolicy(%d)", int(p))
+}
+
+// ParseReplacementPolicy parses lru, plru, fifo or random.
+func ParseReplacementPolicy(s string) (ReplacementPolicy, error) {
+	for p, name := range replacementPolicies {
+		if name == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown replacement policy %q", s)
+}
+
+// WritePolicy selects when a write to a cached line reaches the memory.
+type WritePolicy int
+
+const (
+	// WriteBack writes a line to the memory once evicted or flushed, only if
+	// it was written (dirty).
+	WriteBack WritePolicy = iota
+	// WriteThrough writes to the memory along with the line, the lines are
+	// never dirty.
+	WriteThrough
+)
+
+var writePolicies = map[WritePolicy]string{
+	WriteBack:    "back",
+	WriteThrough: "through",
 }
 
+func (p WritePolicy) String() string {
+	if s, exists := writePolicies[p]; exists {
+		return s
+	}
+	return fmt.Sprintf("WritePolicy(%d)", int(p))
+}
+
+// ParseWritePolicy parses back or through.
+func ParseWritePolicy(s string) (WritePolicy, error) {
+	for p, name := range writePolicies {
+		if name == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown write policy %q", s)
+}
+
+// CacheConfig is the geometry and the policies of a cache.
+type CacheConfig struct {
+	// Size is the size in bytes.
+	Size int
+	// LineSize is the size of a line in bytes, a power of two.
+	LineSize int
+	// Associativity is the number of lines per set, fully associative if 0.
+	// The number of sets must be a power of two.
+	Associativity int
+	Policy        ReplacementPolicy
+	Write         WritePolicy
+	// NoWriteAllocate writes a write missing the cache directly to the
+	// memory, the lines are fetched first otherwise (write-allocate). It's up
+	// to the owner of the cache to apply it.
+	NoWriteAllocate bool
+}
+
+// CacheStats are the hits and misses of the reads of a cache.
+type CacheStats struct {
+	Hits   int
+	Misses int
+}
+
+// Cache is a set-associative cache. An address is decomposed into a tag, the
+// index of its set and the offset in its line, the lines are aligned on the
+// line size.
+type Cache struct {
+	config     CacheConfig
+	offsetBits int
+	indexBits  int
+	sets       [][]cacheLine
+	policy     replacement
+	stats      CacheStats
+}
+
+type cacheLine struct {
+	valid bool
+	dirty bool
+	tag   int32
+	data  []int8
+}
+
+// Line is a line of a cache.
 type Line struct {
+	// Boundary is the range of addresses [start, end) of the line.
 	Boundary [2]int32
 	Data     []int8
+	// Dirty is set if the line was written since it was pushed.
+	Dirty bool
 }
 
 func (l Line) String() string {
+	if l.Dirty {
+		return fmt.Sprintf("(%d-%d)*: %v", l.Boundary[0], l.Boundary[1], l.Data)
+	}
 	return fmt.Sprintf("(%d-%d): %v", l.Boundary[0], l.Boundary[1], l.Data)
 }
 
-func (l Line) get(addr int32) (int8, bool) {
-	if addr >= l.Boundary[0] && addr < l.Boundary[1] {
-		return l.Data[addr-l.Boundary[0]], true
+// Validate checks the geometry of the cache.
+func (c CacheConfig) Validate() error {
+	if c.LineSize <= 0 || bits.OnesCount(uint(c.LineSize)) != 1 {
+		return fmt.Errorf("cache line size %d isn't a power of two", c.LineSize)
 	}
-	return 0, false
+	if c.Size <= 0 || c.Size%c.LineSize != 0 {
+		return fmt.Errorf("cache size %d isn't a multiple of the %d bytes line", c.Size, c.LineSize)
+	}
+	lines := c.Size / c.LineSize
+	ways := cmp.Or(c.Associativity, lines)
+	if ways < 0 || lines%ways != 0 {
+		return fmt.Errorf("%d cache lines can't be split into sets of %d", lines, ways)
+	}
+	if sets := lines / ways; bits.OnesCount(uint(sets)) != 1 {
+		return fmt.Errorf("%d cache sets isn't a power of two", sets)
+	}
+	if _, exists := replacementPolicies[c.Policy]; !exists {
+		return fmt.Errorf("unknown replacement policy %v", c.Policy)
+	}
+	if c.Policy == PLRU && bits.OnesCount(uint(ways)) != 1 {
+		return fmt.Errorf("pseudo-LRU associativity %d isn't a power of two", ways)
+	}
+	if _, exists := writePolicies[c.Write]; !exists {
+		return fmt.Errorf("unknown write policy %v", c.Write)
+	}
+	return nil
+}
+
+// NewCache creates a cache, it panics if the configuration is invalid.
+func NewCache(config CacheConfig) *Cache {
+	if err := config.Validate(); err != nil {
+		panic(err)
+	}
+	lines := config.Size / config.LineSize
+	config.Associativity = cmp.Or(config.Associativity, lines)
+	sets := lines / config.Associativity
+	c := &Cache{
+		config:     config,
+		offsetBits: bits.TrailingZeros(uint(config.LineSize)),
+		indexBits:  bits.TrailingZeros(uint(sets)),
+		sets:       make([][]cacheLine, sets),
+		policy:     newReplacement(config.Policy, sets, config.Associativity),
+	}
+	for i := range c.sets {
+		c.sets[i] = make([]cacheLine, config.Associativity)
+	}
+	return c
+}
+
+// Config returns the configuration of the cache, with the associativity
+// resolved.
+func (c *Cache) Config() CacheConfig {
+	return c.config
+}
+
+func (c *Cache) decompose(addr int32) (tag int32, index int, offset int) {
+	u := uint32(addr)
+	offset = int(u & (1<<c.offsetBits - 1))
+	index = int(u >> c.offsetBits & (1<<c.indexBits - 1))
+	tag = int32(u >> (c.offsetBits + c.indexBits))
+	return tag, index, offset
 }
 
-func (l Line) set(addr int32, value int8) {
-	l.Data[addr-l.Boundary[0]] = value
+// LineAddress returns the address of the line containing addr.
+func (c *Cache) LineAddress(addr int32) int32 {
+	return addr &^ int32(c.config.LineSize-1)
 }
 
-func NewLRUCache(lineLength int, cacheLength int) *LRUCache {
-	if cacheLength%lineLength != 0 {
-		panic("cache length should be a multiple of the line length")
+func (c *Cache) find(addr int32) (*cacheLine, int, int, int) {
+	tag, index, offset := c.decompose(addr)
+	for way := range c.sets[index] {
+		l := &c.sets[index][way]
+		if l.valid && l.tag == tag {
+			return l, index, way, offset
+		}
 	}
-	return &LRUCache{
-		numberOfLines: cacheLength / lineLength,
-		lineLength:    lineLength,
-		cacheLength:   cacheLength,
+	return nil, index, -1, offset
+}
+
+// Contains returns whether the line containing addr is cached, it doesn't
+// count as a read.
+func (c *Cache) Contains(addr int32) bool {
+	l, _, _, _ := c.find(addr)
+	return l != nil
+}
+
+// Get returns the value at addr, it counts as a read.
+func (c *Cache) Get(addr int32) (int8, bool) {
+	memory, exists := c.Read([]int32{addr})
+	if !exists {
+		return 0, false
 	}
+	return memory[0], true
 }
 
-func (c *LRUCache) Get(addr int32) (int8, bool) {
-	for i, l := range c.lines {
-		if v, exists := l.get(addr); exists {
-			c.lines = append(append([]Line{l}, c.lines[:i]...), c.lines[i+1:]...)
-			return v, exists
+// Read returns the values at addrs if they are all cached, it counts as a
+// single read, hit or miss.
+func (c *Cache) Read(addrs []int32) ([]int8, bool) {
+	for _, addr := range addrs {
+		if !c.Contains(addr) {
+			c.stats.Misses++
+			return nil, false
 		}
 	}
-	return 0, false
+	c.stats.Hits++
+	return c.read(addrs), true
 }
 
-func (c *LRUCache) Write(addr int32, data []int8) {
-	for _, l := range c.lines {
-		if _, exists := l.get(addr); exists {
-			for i, v := range data {
-				l.set(addr+int32(i), v)
+// read returns the values at addrs, they must be cached. It doesn't count as
+// a read.
+func (c *Cache) read(addrs []int32) []int8 {
+	memory := make([]int8, 0, len(addrs))
+	for _, addr := range addrs {
+		l, index, way, offset := c.find(addr)
+		memory = append(memory, l.data[offset])
+		c.policy.touch(index, way)
+	}
+	return memory
+}
+
+// Write writes data from addr, the lines become dirty with write-back. It
+// panics if the lines aren't cached.
+func (c *Cache) Write(addr int32, data []int8) {
+	for i, v := range data {
+		l, index, way, offset := c.find(addr + int32(i))
+		if l == nil {
+			panic("cache line doesn't exist")
+		}
+		l.data[offset] = v
+		l.dirty = c.config.Write == WriteBack
+		c.policy.touch(index, way)
+	}
+}
+
+// PushLine caches the clean line containing addr. It returns the line evicted
+// from the set, if any, to be written back if dirty. A line already cached is
+// replaced without being returned.
+func (c *Cache) PushLine(addr int32, data []int8) (Line, bool) {
+	addr = c.LineAddress(addr)
+	tag, index, _ := c.decompose(addr)
+	set := c.sets[index]
+	way := -1
+	for i := range set {
+		if set[i].valid && set[i].tag == tag {
+			// Already cached, replaced
+			way = i
+			break
+		}
+	}
+	if way == -1 {
+		for i := range set {
+			if !set[i].valid {
+				way = i
+				break
 			}
-			return
 		}
 	}
-	panic("cache line doesn't exist")
+
+	var (
+		evicted    Line
+		hasEvicted bool
+	)
+	if way == -1 {
+		way = c.policy.victim(index)
+		evicted = c.line(index, set[way])
+		hasEvicted = true
+	}
+	set[way] = cacheLine{
+		valid: true,
+		tag:   tag,
+		data:  data,
+	}
+	c.policy.insert(index, way)
+	return evicted, hasEvicted
 }
 
-func (c *LRUCache) PushLine(addr int32, data []int8) []int8 {
-	newLine := Line{
-		Boundary: [2]int32{addr, addr + int32(c.lineLength)},
-		Data:     data,
+func (c *Cache) line(index int, l cacheLine) Line {
+	start := int32(uint32(l.tag)<<(c.offsetBits+c.indexBits) | uint32(index)<<c.offsetBits)
+	return Line{
+		Boundary: [2]int32{start, start + int32(c.config.LineSize)},
+		Data:     l.data,
+		Dirty:    l.dirty,
 	}
+}
 
-	c.lines = append([]Line{newLine}, c.lines...)
-	if len(c.lines) > c.numberOfLines {
-		c.lines = c.lines[:c.numberOfLines]
-		// Return the evicted line
-		return c.lines[len(c.lines)-1].Data
+// Lines returns the cached lines, set by set.
+func (c *Cache) Lines() []Line {
+	var lines []Line
+	for index, set := range c.sets {
+		for _, l := range set {
+			if l.valid {
+				lines = append(lines, c.line(index, l))
+			}
+		}
 	}
-	return nil
+	return lines
 }
 
-func (c *LRUCache) Lines() []Line {
-	return c.lines
+// Invalidate removes all the lines, the statistics are kept.
+func (c *Cache) Invalidate() {
+	for _, set := range c.sets {
+		for way := range set {
+			set[way] = cacheLine{}
+		}
+	}
+	c.policy = newReplacement(c.config.Policy, len(c.sets), c.config.Associativity)
+}
+
+// Stats returns the hits and misses of the reads.
+func (c *Cache) Stats() CacheStats {
+	return c.stats
 }
 
-func (c *LRUCache) String() string {
-	res := make([]string, 0, len(c.lines))
-	for _, line := range c.lines {
+func (c *Cache) String() string {
+	lines := c.Lines()
+	res := make([]string, 0, len(lines))
+	for _, line := range lines {
 		res = append(res, line.String())
 	}
 	return strings.Join(res, "\n")
 }
+
+// replacement tracks the use of the lines of each set.
+type replacement interface {
+	// insert is called when a line is pushed into a way.
+	insert(set, way int)
+	// touch is called when a way is accessed.
+	touch(set, way int)
+	// victim returns the way to evict from a full set.
+	victim(set int) int
+}
+
+func newReplacement(policy ReplacementPolicy, sets, ways int) replacement {
+	switch policy {
+	case LRU:
+		return newLRUReplacement(sets, ways)
+	case PLRU:
+		return newPLRUReplacement(sets, ways)
+	case FIFO:
+		return newFIFOReplacement(sets, ways)
+	case Random:
+		// Seeded so that the simulations are reproducible
+		return randomReplacement{rand.New(rand.NewSource(1)), ways}
+	}
+	panic(fmt.Sprintf("unknown replacement policy %v", policy))
+}
+
+// lruReplacement keeps the ways of each set from the most to the least
+// recently used.
+type lruReplacement struct {
+	order [][]int
+}
+
+func newLRUReplacement(sets, ways int) *lruReplacement {
+	r := &lruReplacement{order: make([][]int, sets)}
+	for i := range r.order {
+		r.order[i] = make([]int, ways)
+		for way := range r.order[i] {
+			r.order[i][way] = way
+		}
+	}
+	return r
+}
+
+func (r *lruReplacement) insert(set, way int) {
+	r.touch(set, way)
+}
+
+func (r *lruReplacement) touch(set, way int) {
+	order := r.order[set]
+	i := 0
+	for order[i] != way {
+		i++
+	}
+	copy(order[1:i+1], order[:i])
+	order[0] = way
+}
+
+func (r *lruReplacement) victim(set int) int {
+	order := r.order[set]
+	return order[len(order)-1]
+}
+
+// plruReplacement is a tree pseudo-LRU: each set has a binary tree of ways-1
+// bits stored in an array, each bit pointing to the half of its subtree to
+// evict next.
+type plruReplacement struct {
+	bits [][]bool
+	ways int
+}
+
+func newPLRUReplacement(sets, ways int) *plruReplacement {
+	r := &plruReplacement{bits: make([][]bool, sets), ways: ways}
+	for i := range r.bits {
+		r.bits[i] = make([]bool, max(ways-1, 1))
+	}
+	return r
+}
+
+func (r *plruReplacement) insert(set, way int) {
+	r.touch(set, way)
+}
+
+func (r *plruReplacement) touch(set, way int) {
+	// From the root, each bit points away from the accessed way
+	node, low, high := 0, 0, r.ways
+	for high-low > 1 {
+		mid := (low + high) / 2
+		if way < mid {
+			r.bits[set][node] = true
+			node, high = 2*node+1, mid
+		} else {
+			r.bits[set][node] = false
+			node, low = 2*node+2, mid
+		}
+	}
+}
+
+func (r *plruReplacement) victim(set int) int {
+	node, low, high := 0, 0, r.ways
+	for high-low > 1 {
+		mid := (low + high) / 2
+		if r.bits[set][node] {
+			node, low = 2*node+2, mid
+		} else {
+			node, high = 2*node+1, mid
+		}
+	}
+	return low
+}
+
+// fifoReplacement evicts the ways of each set in the order they were pushed.
+type fifoReplacement struct {
+	next []int
+	ways int
+}
+
+func newFIFOReplacement(sets, ways int) *fifoReplacement {
+	return &fifoReplacement{next: make([]int, sets), ways: ways}
+}
+
+func (r *fifoReplacement) insert(set, way int) {
+	if way == r.next[set] {
+		r.next[set] = (way + 1) % r.ways
+	}
+}
+
+func (r *fifoReplacement) touch(int, int) {}
+
+func (r *fifoReplacement) victim(set int) int {
+	return r.next[set]
+}
+
+type randomReplacement struct {
+	rand *rand.Rand
+	ways int
+}
+
+func (r randomReplacement) insert(int, int) {}
+
+func (r randomReplacement) touch(int, int) {}
+
+func (r randomReplacement) victim(int) int {
+	return r.rand.Intn(r.ways)
+}
@@ -4,10 +4,11 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestCache(t *testing.T) {
-	c := NewLRUCache(2, 6)
+	c := NewCache(CacheConfig{Size: 6 * 2, LineSize: 2, Associativity: 3})
 	as := getAssert(t, c)
 
 	as(0, 0, false)
@@ -28,7 +29,158 @@ func TestCache(t *testing.T) {
 	as(5, 5, true)
 }
 
-func getAssert(t *testing.T, c *LRUCache) func(int32, int8, bool) {
+func TestCacheAlignment(t *testing.T) {
+	c := NewCache(CacheConfig{Size: 8, LineSize: 4})
+	// The line is aligned on 4 bytes whatever the address pushed
+	c.PushLine(6, []int8{4, 5, 6, 7})
+	assert.Equal(t, int32(4), c.LineAddress(6))
+	assert.Equal(t, []Line{{Boundary: [2]int32{4, 8}, Data: []int8{4, 5, 6, 7}}}, c.Lines())
+
+	v, exists := c.Get(4)
+	assert.True(t, exists)
+	assert.Equal(t, int8(4), v)
+
+	// Across two lines
+	_, exists = c.Read([]int32{7, 8})
+	assert.False(t, exists)
+	c.PushLine(8, []int8{8, 9, 10, 11})
+	memory, exists := c.Read([]int32{7, 8})
+	assert.True(t, exists)
+	assert.Equal(t, []int8{7, 8}, memory)
+
+	c.Write(7, []int8{-7, -8})
+	memory, _ = c.Read([]int32{6, 7, 8, 9})
+	assert.Equal(t, []int8{6, -7, -8, 9}, memory)
+	assert.Panics(t, func() {
+		c.Write(11, []int8{0, 0})
+	})
+
+	// The writes aren't counted
+	assert.Equal(t, CacheStats{Hits: 3, Misses: 1}, c.Stats())
+	c.Invalidate()
+	assert.Empty(t, c.Lines())
+}
+
+func TestCacheSets(t *testing.T) {
+	// 4 lines of 4 bytes in 2 sets, the set of an address is bit 2
+	c := NewCache(CacheConfig{Size: 16, LineSize: 4, Associativity: 2})
+	c.PushLine(0, []int8{0, 0, 0, 0})
+	c.PushLine(8, []int8{8, 8, 8, 8})
+	c.PushLine(4, []int8{4, 4, 4, 4})
+
+	// Set 0 is full, line 0 is the least recently used
+	evicted, exists := c.PushLine(16, []int8{16, 16, 16, 16})
+	require.True(t, exists)
+	assert.Equal(t, Line{Boundary: [2]int32{0, 4}, Data: []int8{0, 0, 0, 0}}, evicted)
+
+	// Set 1 isn't full
+	_, exists = c.PushLine(12, []int8{12, 12, 12, 12})
+	assert.False(t, exists)
+
+	for _, addr := range []int32{4, 8, 12, 16} {
+		v, exists := c.Get(addr)
+		assert.True(t, exists, addr)
+		assert.Equal(t, int8(addr), v)
+	}
+}
+
+func TestCacheDirtyLines(t *testing.T) {
+	c := NewCache(CacheConfig{Size: 8, LineSize: 4})
+	c.PushLine(0, []int8{0, 1, 2, 3})
+	c.PushLine(4, []int8{4, 5, 6, 7})
+	c.Write(1, []int8{-1})
+	assert.Equal(t, []Line{
+		{Boundary: [2]int32{0, 4}, Data: []int8{0, -1, 2, 3}, Dirty: true},
+		{Boundary: [2]int32{4, 8}, Data: []int8{4, 5, 6, 7}},
+	}, c.Lines())
+	assert.True(t, c.Contains(3))
+	assert.False(t, c.Contains(8))
+
+	// The dirty line becomes the least recently used
+	c.Get(4)
+	evicted, exists := c.PushLine(8, []int8{8, 9, 10, 11})
+	require.True(t, exists)
+	assert.Equal(t, Line{Boundary: [2]int32{0, 4}, Data: []int8{0, -1, 2, 3}, Dirty: true}, evicted)
+	evicted, exists = c.PushLine(12, []int8{12, 13, 14, 15})
+	require.True(t, exists)
+	assert.False(t, evicted.Dirty)
+
+	// Never dirty with write-through
+	c = NewCache(CacheConfig{Size: 8, LineSize: 4, Write: WriteThrough})
+	c.PushLine(0, []int8{0, 1, 2, 3})
+	c.Write(0, []int8{-1})
+	assert.False(t, c.Lines()[0].Dirty)
+}
+
+// evictions pushes the lines in a single set and returns the evicted lines.
+func evictions(t *testing.T, policy ReplacementPolicy, accesses ...int32) []int32 {
+	t.Helper()
+	c := NewCache(CacheConfig{Size: 16, LineSize: 4, Policy: policy})
+	var res []int32
+	for _, addr := range accesses {
+		if _, exists := c.Get(addr); exists {
+			continue
+		}
+		if evicted, exists := c.PushLine(addr, make([]int8, 4)); exists {
+			res = append(res, evicted.Boundary[0])
+		}
+	}
+	return res
+}
+
+func TestCacheReplacementPolicies(t *testing.T) {
+	// 4 ways, line 0 is accessed again before the set is full
+	accesses := []int32{0, 4, 8, 0, 12, 16, 20}
+
+	assert.Equal(t, []int32{4, 8}, evictions(t, LRU, accesses...))
+	assert.Equal(t, []int32{0, 4}, evictions(t, FIFO, accesses...))
+	// Line 0 and 4 are in the same subtree, the last access to 12 points to
+	// it and the access to 0 to line 4
+	assert.Equal(t, []int32{4, 8}, evictions(t, PLRU, accesses...))
+	// Reproducible
+	random := evictions(t, Random, accesses...)
+	assert.Len(t, random, 2)
+	assert.Equal(t, random, evictions(t, Random, accesses...))
+}
+
+func TestCacheConfig(t *testing.T) {
+	for _, tc := range []struct {
+		config CacheConfig
+		valid  bool
+	}{
+		{CacheConfig{Size: 1024, LineSize: 64}, true},
+		{CacheConfig{Size: 1024, LineSize: 64, Associativity: 4, Policy: PLRU}, true},
+		{CacheConfig{Size: 1024, LineSize: 48}, false},
+		{CacheConfig{Size: 1000, LineSize: 64}, false},
+		{CacheConfig{Size: 1024, LineSize: 64, Associativity: 3}, false},
+		// 3 sets
+		{CacheConfig{Size: 768, LineSize: 64, Associativity: 4}, false},
+		{CacheConfig{Size: 192, LineSize: 64, Policy: PLRU}, false},
+		{CacheConfig{Size: 192, LineSize: 64, Policy: FIFO}, true},
+	} {
+		err := tc.config.Validate()
+		assert.Equal(t, tc.valid, err == nil, "%+v: %v", tc.config, err)
+	}
+
+	for _, s := range []string{"lru", "plru", "fifo", "random"} {
+		p, err := ParseReplacementPolicy(s)
+		require.NoError(t, err)
+		assert.Equal(t, s, p.String())
+	}
+	_, err := ParseReplacementPolicy("mru")
+	assert.Error(t, err)
+
+	for _, s := range []string{"back", "through"} {
+		p, err := ParseWritePolicy(s)
+		require.NoError(t, err)
+		assert.Equal(t, s, p.String())
+	}
+	_, err = ParseWritePolicy("around")
+	assert.Error(t, err)
+	assert.Error(t, CacheConfig{Size: 64, LineSize: 64, Write: 2}.Validate())
+}
+
+func getAssert(t *testing.T, c *Cache) func(int32, int8, bool) {
 	t.Helper()
 	return func(addr int32, i int8, b bool) {
 		val, exists := c.Get(addr)
@@ -0,0 +1,176 @@
+package comp
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+)
+
+// DRAMConfig is the geometry and the timing of a DRAM, in processor cycles.
+type DRAMConfig struct {
+	// Banks is the number of banks, a power of two. Each bank keeps its last
+	// row open in its row buffer.
+	Banks int
+	// RowSize is the size of a row in bytes, a power of two. The consecutive
+	// rows are interleaved across the banks.
+	RowSize int
+	// Controller is the latency of the memory controller for each request.
+	Controller int
+	// CAS is the latency of a column access to the open row (row hit).
+	CAS int
+	// RCD is the latency of activating a row, the row to column delay.
+	RCD int
+	// RP is the latency of precharging the open row of a bank before
+	// activating another one (row conflict).
+	RP int
+	// QueueSize is the number of requests in flight in the controller, a
+	// request waits for the oldest ones to complete when the queue is full.
+	QueueSize int
+}
+
+// DefaultDRAM is the DRAM of the microarchitectures with an MMU: a row hit
+// takes 30 cycles, a row miss 50 cycles and a row conflict 70 cycles.
+var DefaultDRAM = DRAMConfig{
+	Banks:      8,
+	RowSize:    2048,
+	Controller: 10,
+	CAS:        20,
+	RCD:        20,
+	RP:         20,
+	QueueSize:  8,
+}
+
+// Validate checks the geometry of the DRAM.
+func (c DRAMConfig) Validate() error {
+	if c.Banks <= 0 || bits.OnesCount(uint(c.Banks)) != 1 {
+		return fmt.Errorf("DRAM banks %d isn't a power of two", c.Banks)
+	}
+	if c.RowSize <= 0 || bits.OnesCount(uint(c.RowSize)) != 1 {
+		return fmt.Errorf("DRAM row size %d isn't a power of two", c.RowSize)
+	}
+	if c.Controller < 0 || c.CAS < 0 || c.RCD < 0 || c.RP < 0 {
+		return fmt.Errorf("negative DRAM latency")
+	}
+	if c.Controller+c.CAS == 0 {
+		return fmt.Errorf("DRAM row hit without latency")
+	}
+	if c.QueueSize <= 0 {
+		return fmt.Errorf("DRAM queue size %d isn't positive", c.QueueSize)
+	}
+	return nil
+}
+
+// DRAMStats are the accesses to the rows of a DRAM.
+type DRAMStats struct {
+	// RowHits are the accesses to the open row of a bank.
+	RowHits int
+	// RowMisses are the accesses to a bank without open row.
+	RowMisses int
+	// RowConflicts are the accesses to a bank with another row open.
+	RowConflicts int
+	// QueueCycles are the cycles the requests waited for a busy bank or for
+	// the queue.
+	QueueCycles int
+}
+
+// DRAM is a main memory with a timing depending on the open rows of its banks:
+// an access to the open row only takes a column access, an access to another
+// row precharges the bank and activates the row first. The requests of a
+// bank are served in order, the banks in parallel. The data are stored by a
+// Memory whose latency is ignored.
+type DRAM struct {
+	config DRAMConfig
+	memory *Memory
+	banks  []bank
+	// inFlight are the completion cycles of the requests in the queue
+	inFlight []int
+	stats    DRAMStats
+}
+
+type bank struct {
+	open      bool
+	row       uint32
+	busyUntil int
+}
+
+// NewDRAM creates a DRAM storing its data in memory, it panics if the
+// configuration is invalid.
+func NewDRAM(config DRAMConfig, memory *Memory) *DRAM {
+	if err := config.Validate(); err != nil {
+		panic(err)
+	}
+	return &DRAM{
+		config: config,
+		memory: memory,
+		banks:  make([]bank, config.Banks),
+	}
+}
+
+// Stats returns the accesses to the rows.
+func (d *DRAM) Stats() DRAMStats {
+	return d.stats
+}
+
+// access serves the requests to the rows of [addr, addr+n) from cycle at. It
+// returns the number of cycles taken.
+func (d *DRAM) access(addr int32, n int, at int) int {
+	cycles := 0
+	for from := 0; from < n; {
+		u := uint32(addr) + uint32(from)
+		row := u / uint32(d.config.RowSize)
+		cycles += d.request(row, at+cycles)
+		from += int((row+1)*uint32(d.config.RowSize) - u)
+	}
+	return cycles
+}
+
+// request serves a request to a row from cycle at.
+func (d *DRAM) request(row uint32, at int) int {
+	inFlight := d.inFlight[:0]
+	for _, end := range d.inFlight {
+		if end > at {
+			inFlight = append(inFlight, end)
+		}
+	}
+	d.inFlight = inFlight
+
+	start := at
+	if len(d.inFlight) >= d.config.QueueSize {
+		sort.Ints(d.inFlight)
+		start = d.inFlight[len(d.inFlight)-d.config.QueueSize]
+	}
+	b := &d.banks[row%uint32(d.config.Banks)]
+	start = max(start, b.busyUntil)
+	d.stats.QueueCycles += start - at
+
+	latency := d.config.Controller + d.config.CAS
+	switch {
+	case b.open && b.row == row:
+		d.stats.RowHits++
+	case b.open:
+		d.stats.RowConflicts++
+		latency += d.config.RP + d.config.RCD
+	default:
+		d.stats.RowMisses++
+		latency += d.config.RCD
+	}
+	b.open = true
+	b.row = row
+	b.busyUntil = start + latency
+	d.inFlight = append(d.inFlight, b.busyUntil)
+	return b.busyUntil - at
+}
+
+func (d *DRAM) Read(addr int32, n int, at int) ([]int8, int) {
+	data, _ := d.memory.Read(addr, n, at)
+	return data, d.access(addr, n, at)
+}
+
+func (d *DRAM) Write(addr int32, data []int8, at int) int {
+	d.memory.Write(addr, data, at)
+	return d.access(addr, len(data), at)
+}
+
+func (d *DRAM) Flush(int) int {
+	return 0
+}
@@ -0,0 +1,58 @@
+package comp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDRAM(t *testing.T) {
+	data := make([]int8, 256)
+	memory := NewMemory(0)
+	memory.Map(0, data)
+	// 2 banks of 32 bytes rows: rows 0, 2, 4... in bank 0, rows 1, 3, 5... in
+	// bank 1
+	d := NewDRAM(DRAMConfig{Banks: 2, RowSize: 32, Controller: 1, CAS: 2, RCD: 3, RP: 4, QueueSize: 4}, memory)
+
+	// Row miss then row hit
+	assert.Equal(t, 1+3+2, d.Write(0, []int8{1, 2}, 0))
+	v, cycles := d.Read(0, 4, 100)
+	assert.Equal(t, []int8{1, 2, 0, 0}, v)
+	assert.Equal(t, 1+2, cycles)
+	// Row conflict in bank 0
+	_, cycles = d.Read(64, 4, 200)
+	assert.Equal(t, 1+4+3+2, cycles)
+	// Across two rows, the second one missing bank 1
+	_, cycles = d.Read(60, 8, 300)
+	assert.Equal(t, 1+2+1+3+2, cycles)
+	assert.Equal(t, DRAMStats{RowHits: 2, RowMisses: 2, RowConflicts: 1}, d.Stats())
+
+	// The requests to a busy bank wait, the banks are accessed in parallel
+	_, cycles = d.Read(64, 4, 400)
+	assert.Equal(t, 3, cycles)
+	_, cycles = d.Read(64, 4, 400)
+	assert.Equal(t, 3+3, cycles)
+	_, cycles = d.Read(32, 4, 400)
+	assert.Equal(t, 3, cycles)
+	assert.Equal(t, 3, d.Stats().QueueCycles)
+
+	// With a single request in flight, the banks aren't accessed in parallel
+	d = NewDRAM(DRAMConfig{Banks: 2, RowSize: 32, Controller: 1, CAS: 2, RCD: 3, RP: 4, QueueSize: 1}, memory)
+	_, cycles = d.Read(0, 4, 0)
+	assert.Equal(t, 6, cycles)
+	_, cycles = d.Read(32, 4, 0)
+	assert.Equal(t, 6+6, cycles)
+}
+
+func TestDRAMConfig(t *testing.T) {
+	assert.NoError(t, DefaultDRAM.Validate())
+	for _, config := range []DRAMConfig{
+		{Banks: 3, RowSize: 1024, CAS: 1, QueueSize: 1},
+		{Banks: 4, RowSize: 1000, CAS: 1, QueueSize: 1},
+		{Banks: 4, RowSize: 1024, CAS: 1, RP: -1, QueueSize: 1},
+		{Banks: 4, RowSize: 1024, QueueSize: 1},
+		{Banks: 4, RowSize: 1024, CAS: 1},
+	} {
+		assert.Error(t, config.Validate(), "%+v", config)
+	}
+}
@@ -0,0 +1,195 @@
+package comp
+
+// MemoryLevel is a level of a memory hierarchy below the L1 caches: a cache
+// backed by a lower level or the memory itself. Each access is requested at a
+// cycle, the accesses of a level to the level below are requested once the
+// previous ones are complete.
+type MemoryLevel interface {
+	// Read returns the n bytes from addr and the number of cycles taken.
+	Read(addr int32, n int, at int) ([]int8, int)
+	// Write writes data from addr and returns the number of cycles taken.
+	Write(addr int32, data []int8, at int) int
+	// Flush writes the dirty lines back down to the memory and invalidates
+	// the caches, so that the memory can be accessed directly. It returns the
+	// number of cycles taken.
+	Flush(at int) int
+}
+
+// Memory is the main memory, the bottom of a memory hierarchy, each access
+// takes the same number of cycles. The data are mapped from addresses, the
+// bytes outside of the mappings are read as 0 and their writes are ignored.
+type Memory struct {
+	latency  int
+	segments []segment
+}
+
+type segment struct {
+	addr int32
+	data []int8
+}
+
+// NewMemory creates a memory without mapping.
+func NewMemory(latency int) *Memory {
+	return &Memory{latency: latency}
+}
+
+// Map maps data from addr, replacing the data mapped at the same address. The
+// data aren't copied, the writes are visible to the owner of the slice.
+func (m *Memory) Map(addr int32, data []int8) {
+	for i := range m.segments {
+		if m.segments[i].addr == addr {
+			m.segments[i].data = data
+			return
+		}
+	}
+	m.segments = append(m.segments, segment{addr: addr, data: data})
+}
+
+func (m *Memory) find(addr int32) ([]int8, int) {
+	for _, s := range m.segments {
+		offset := int(addr) - int(s.addr)
+		if offset >= 0 && offset < len(s.data) {
+			return s.data, offset
+		}
+	}
+	return nil, 0
+}
+
+func (m *Memory) Read(addr int32, n int, _ int) ([]int8, int) {
+	res := make([]int8, n)
+	for i := range res {
+		if data, offset := m.find(addr + int32(i)); data != nil {
+			res[i] = data[offset]
+		}
+	}
+	return res, m.latency
+}
+
+func (m *Memory) Write(addr int32, data []int8, _ int) int {
+	for i, v := range data {
+		if d, offset := m.find(addr + int32(i)); d != nil {
+			d[offset] = v
+		}
+	}
+	return m.latency
+}
+
+func (m *Memory) Flush(int) int {
+	return 0
+}
+
+// CacheLevel is a cache of a memory hierarchy backed by a lower level, each
+// access takes the latency of the level plus the accesses to the lower level.
+// A miss fetches the lines from the lower level, the dirty lines evicted are
+// written back to it. The writes follow the policies of the cache.
+type CacheLevel struct {
+	cache   *Cache
+	latency int
+	next    MemoryLevel
+}
+
+// NewCacheLevel creates a cache level, it panics if the configuration is
+// invalid.
+func NewCacheLevel(config CacheConfig, latency int, next MemoryLevel) *CacheLevel {
+	return &CacheLevel{
+		cache:   NewCache(config),
+		latency: latency,
+		next:    next,
+	}
+}
+
+// Cache returns the cache of the level.
+func (l *CacheLevel) Cache() *Cache {
+	return l.cache
+}
+
+// Next returns the lower level.
+func (l *CacheLevel) Next() MemoryLevel {
+	return l.next
+}
+
+// CacheLevels returns the cache levels from level down to the memory.
+func CacheLevels(level MemoryLevel) []*CacheLevel {
+	var res []*CacheLevel
+	for {
+		l, ok := level.(*CacheLevel)
+		if !ok {
+			return res
+		}
+		res = append(res, l)
+		level = l.next
+	}
+}
+
+// lines calls f with each part of [addr, addr+n) in a single line.
+func (l *CacheLevel) lines(addr int32, n int, f func(addr int32, from, to int)) {
+	for from := 0; from < n; {
+		end := l.cache.LineAddress(addr+int32(from)) + int32(l.cache.config.LineSize)
+		to := min(n, int(end-addr))
+		f(addr+int32(from), from, to)
+		from = to
+	}
+}
+
+// fill fetches the line containing addr from the lower level.
+func (l *CacheLevel) fill(addr int32, at int) int {
+	data, cycles := l.next.Read(l.cache.LineAddress(addr), l.cache.config.LineSize, at)
+	if evicted, exists := l.cache.PushLine(addr, data); exists && evicted.Dirty {
+		cycles += l.next.Write(evicted.Boundary[0], evicted.Data, at+cycles)
+	}
+	return cycles
+}
+
+// Read counts as a single read of the cache, a hit if all the lines are
+// cached.
+func (l *CacheLevel) Read(addr int32, n int, at int) ([]int8, int) {
+	cycles := l.latency
+	hit := true
+	res := make([]int8, 0, n)
+	l.lines(addr, n, func(addr int32, from, to int) {
+		if !l.cache.Contains(addr) {
+			hit = false
+			cycles += l.fill(addr, at+cycles)
+		}
+		addrs := make([]int32, 0, to-from)
+		for i := range to - from {
+			addrs = append(addrs, addr+int32(i))
+		}
+		res = append(res, l.cache.read(addrs)...)
+	})
+	if hit {
+		l.cache.stats.Hits++
+	} else {
+		l.cache.stats.Misses++
+	}
+	return res, cycles
+}
+
+func (l *CacheLevel) Write(addr int32, data []int8, at int) int {
+	cycles := l.latency
+	l.lines(addr, len(data), func(addr int32, from, to int) {
+		if !l.cache.Contains(addr) {
+			if l.cache.config.NoWriteAllocate {
+				cycles += l.next.Write(addr, data[from:to], at+cycles)
+				return
+			}
+			cycles += l.fill(addr, at+cycles)
+		}
+		l.cache.Write(addr, data[from:to])
+		if l.cache.config.Write == WriteThrough {
+			cycles += l.next.Write(addr, data[from:to], at+cycles)
+		}
+	})
+	return cycles
+}
+
+func (l *CacheLevel) Flush(at int) int {
+	cycles := 0
+	for _, line := range l.cache.Lines() {
+		if line.Dirty {
+			cycles += l.next.Write(line.Boundary[0], line.Data, at+cycles)
+		}
+	}
+	l.cache.Invalidate()
+	return cycles + l.next.Flush(at+cycles)
+}
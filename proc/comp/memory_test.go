@@ -0,0 +1,98 @@
+package comp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemory(t *testing.T) {
+	data := []int8{0, 1, 2, 3}
+	m := NewMemory(50)
+	m.Map(0, data)
+	m.Map(-8, []int8{-8, -7})
+
+	v, cycles := m.Read(2, 4, 0)
+	assert.Equal(t, []int8{2, 3, 0, 0}, v)
+	assert.Equal(t, 50, cycles)
+	v, _ = m.Read(-8, 2, 0)
+	assert.Equal(t, []int8{-8, -7}, v)
+
+	// The writes outside of the mappings are ignored
+	assert.Equal(t, 50, m.Write(3, []int8{-3, -4}, 0))
+	assert.Equal(t, []int8{0, 1, 2, -3}, data)
+
+	m.Map(0, []int8{4})
+	v, _ = m.Read(0, 1, 0)
+	assert.Equal(t, []int8{4}, v)
+	assert.Zero(t, m.Flush(0))
+}
+
+func TestCacheLevel(t *testing.T) {
+	data := make([]int8, 32)
+	for i := range data {
+		data[i] = int8(i)
+	}
+	memory := NewMemory(50)
+	memory.Map(0, data)
+	// 2 lines of 4 bytes
+	l3 := NewCacheLevel(CacheConfig{Size: 8, LineSize: 4}, 20, memory)
+	l2 := NewCacheLevel(CacheConfig{Size: 8, LineSize: 4}, 10, l3)
+	assert.Equal(t, []*CacheLevel{l2, l3}, CacheLevels(l2))
+	assert.Equal(t, l3, l2.Next())
+
+	v, cycles := l2.Read(0, 4, 0)
+	assert.Equal(t, []int8{0, 1, 2, 3}, v)
+	assert.Equal(t, 10+20+50, cycles)
+	// Across two lines, the first one hits the L2 and the second one the L3
+	l2.Read(8, 4, 0)
+	l2.Read(0, 4, 0)
+	v, cycles = l2.Read(2, 4, 0)
+	assert.Equal(t, []int8{2, 3, 4, 5}, v)
+	assert.Equal(t, 10+20+50, cycles)
+	v, cycles = l2.Read(8, 4, 0)
+	assert.Equal(t, []int8{8, 9, 10, 11}, v)
+	assert.Equal(t, 10+20, cycles)
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 4}, l2.Cache().Stats())
+
+	// Write-back, the memory is written once the dirty lines are evicted
+	assert.Equal(t, 10, l2.Write(9, []int8{-9}, 0))
+	assert.Equal(t, int8(9), data[9])
+	l2.Read(16, 4, 0)
+	l2.Read(20, 4, 0)
+	assert.Equal(t, int8(9), data[9])
+	l3.Read(24, 4, 0)
+	l3.Read(28, 4, 0)
+	assert.Equal(t, int8(-9), data[9])
+
+	// Flushed down to the memory, the line is allocated in the L3 first
+	l2.Write(16, []int8{-16}, 0)
+	assert.Equal(t, 20+50+50, l2.Flush(0))
+	assert.Equal(t, int8(-16), data[16])
+	assert.Empty(t, l2.Cache().Lines())
+	assert.Empty(t, l3.Cache().Lines())
+}
+
+func TestCacheLevelWritePolicies(t *testing.T) {
+	data := make([]int8, 16)
+	memory := NewMemory(50)
+	memory.Map(0, data)
+
+	l2 := NewCacheLevel(CacheConfig{Size: 8, LineSize: 4, Write: WriteThrough}, 10, memory)
+	// Allocated then written through
+	assert.Equal(t, 10+50+50, l2.Write(0, []int8{1}, 0))
+	assert.Equal(t, int8(1), data[0])
+	assert.Equal(t, 10+50, l2.Write(1, []int8{2}, 0))
+	assert.Equal(t, int8(2), data[1])
+	assert.Len(t, l2.Cache().Lines(), 1)
+
+	l2 = NewCacheLevel(CacheConfig{Size: 8, LineSize: 4, NoWriteAllocate: true}, 10, memory)
+	// Across two lines, only the cached one is written to the L2
+	l2.Read(4, 4, 0)
+	assert.Equal(t, 10+50, l2.Write(6, []int8{6, 7, 8}, 0))
+	assert.Equal(t, []int8{0, 0}, data[6:8])
+	assert.Equal(t, int8(8), data[8])
+	assert.Len(t, l2.Cache().Lines(), 1)
+	assert.Equal(t, 50, l2.Flush(0))
+	assert.Equal(t, []int8{6, 7, 8}, data[6:9])
+}
@@ -0,0 +1,245 @@
+package comp
+
+import (
+	"fmt"
+)
+
+// PredictorPolicy selects the direction predictor of the conditional
+// branches.
+type PredictorPolicy int
+
+const (
+	// NotTaken predicts the conditional branches as not taken, the next
+	// instructions being fetched sequentially.
+	NotTaken PredictorPolicy = iota
+	// Taken predicts the conditional branches as taken.
+	Taken
+	// BTFN predicts the backward branches as taken and the forward ones as
+	// not taken, the backward branches closing loops.
+	BTFN
+	// Bimodal predicts from a table of 2-bit saturating counters indexed by
+	// the pc of the branches.
+	Bimodal
+	// GShare predicts from a table of 2-bit saturating counters indexed by the
+	// pc of the branches xored with the global history, the directions of the
+	// last resolved branches.
+	GShare
+	// Tournament predicts with either a bimodal or a gshare predictor, chosen
+	// per branch by a table of 2-bit saturating counters tracking the most
+	// accurate one.
+	Tournament
+)
+
+var predictorPolicies = map[PredictorPolicy]string{
+	NotTaken:   "not-taken",
+	Taken:      "taken",
+	BTFN:       "btfn",
+	Bimodal:    "bimodal",
+	GShare:     "gshare",
+	Tournament: "tournament",
+}
+
+func (p PredictorPolicy) String() string {
+	if s, exists := predictorPolicies[p]; exists {
+		return s
+	}
+	return fmt.Sprintf("PredictorPolicy(%d)", int(p))
+}
+
+// ParsePredictorPolicy parses not-taken, taken, btfn, bimodal, gshare or
+// tournament.
+func ParsePredictorPolicy(s string) (PredictorPolicy, error) {
+	for p, name := range predictorPolicies {
+		if name == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown branch predictor %q", s)
+}
+
+// BranchPredictor predicts the direction of the conditional branches when
+// decoded. It is trained once they are resolved, the global history being
+// updated in the order of resolution. Until then, the global history is
+// extended with the directions predicted.
+type BranchPredictor interface {
+	// Predict returns whether the conditional branch at pc jumping to target
+	// is taken, and the global history it was predicted from.
+	Predict(pc, target int32) (bool, uint32)
+	// Update trains the predictor with the direction of the branch at pc
+	// predicted from history.
+	Update(pc int32, history uint32, taken bool)
+	// Recover discards the directions predicted for the branches not yet
+	// resolved, once flushed, but the ones of the survivors oldest.
+	Recover(survivors int)
+}
+
+// NewBranchPredictor creates the branch predictor of a policy.
+func NewBranchPredictor(policy PredictorPolicy) BranchPredictor {
+	switch policy {
+	case NotTaken:
+		return staticPredictor(func(int32, int32) bool { return false })
+	case Taken:
+		return staticPredictor(func(int32, int32) bool { return true })
+	case BTFN:
+		return staticPredictor(func(pc, target int32) bool { return target <= pc })
+	case Bimodal:
+		return newBimodalPredictor()
+	case GShare:
+		return newGSharePredictor()
+	case Tournament:
+		return &tournamentPredictor{
+			bimodal: newBimodalPredictor(),
+			gshare:  newGSharePredictor(),
+			chooser: newCounters(),
+		}
+	}
+	panic(fmt.Sprintf("unknown branch predictor %v", policy))
+}
+
+type staticPredictor func(pc, target int32) bool
+
+func (p staticPredictor) Predict(pc, target int32) (bool, uint32) {
+	return p(pc, target), 0
+}
+
+func (p staticPredictor) Update(int32, uint32, bool) {}
+
+func (p staticPredictor) Recover(int) {}
+
+const (
+	// predictorEntries is the number of counters of the tables.
+	predictorEntries = 1024
+	// historyLength is the number of branches in the global history.
+	historyLength = 10
+)
+
+// shiftHistory appends a direction to a global history.
+func shiftHistory(history uint32, taken bool) uint32 {
+	history <<= 1
+	if taken {
+		history |= 1
+	}
+	return history & (1<<historyLength - 1)
+}
+
+// counter is a 2-bit saturating counter, predicting taken from 2.
+type counter uint8
+
+func (c counter) taken() bool {
+	return c >= 2
+}
+
+func (c *counter) update(taken bool) {
+	if taken {
+		*c = min(*c+1, 3)
+	} else if *c > 0 {
+		*c--
+	}
+}
+
+// newCounters creates a table of counters, weakly not taken.
+func newCounters() []counter {
+	table := make([]counter, predictorEntries)
+	for i := range table {
+		table[i] = 1
+	}
+	return table
+}
+
+func predictorIndex(pc int32) uint32 {
+	return uint32(pc) / 4 % predictorEntries
+}
+
+type bimodalPredictor struct {
+	table []counter
+}
+
+func newBimodalPredictor() *bimodalPredictor {
+	return &bimodalPredictor{table: newCounters()}
+}
+
+func (p *bimodalPredictor) Predict(pc, _ int32) (bool, uint32) {
+	return p.table[predictorIndex(pc)].taken(), 0
+}
+
+func (p *bimodalPredictor) Update(pc int32, _ uint32, taken bool) {
+	p.table[predictorIndex(pc)].update(taken)
+}
+
+func (p *bimodalPredictor) Recover(int) {}
+
+type gsharePredictor struct {
+	table []counter
+	// history are the directions of the resolved branches
+	history uint32
+	// predicted are the directions predicted for the branches not yet
+	// resolved, the oldest first
+	predicted []bool
+}
+
+func newGSharePredictor() *gsharePredictor {
+	return &gsharePredictor{table: newCounters()}
+}
+
+func (p *gsharePredictor) counter(pc int32, history uint32) *counter {
+	return &p.table[(predictorIndex(pc)^history)%predictorEntries]
+}
+
+// lookup returns the direction of the branch at pc from the global history
+// extended with the directions predicted.
+func (p *gsharePredictor) lookup(pc int32) (bool, uint32) {
+	history := p.history
+	for _, taken := range p.predicted {
+		history = shiftHistory(history, taken)
+	}
+	return p.counter(pc, history).taken(), history
+}
+
+func (p *gsharePredictor) Predict(pc, _ int32) (bool, uint32) {
+	taken, history := p.lookup(pc)
+	p.predicted = append(p.predicted, taken)
+	return taken, history
+}
+
+func (p *gsharePredictor) Update(pc int32, history uint32, taken bool) {
+	p.counter(pc, history).update(taken)
+	p.history = shiftHistory(p.history, taken)
+	if len(p.predicted) > 0 {
+		p.predicted = p.predicted[1:]
+	}
+}
+
+func (p *gsharePredictor) Recover(survivors int) {
+	p.predicted = p.predicted[:survivors]
+}
+
+type tournamentPredictor struct {
+	bimodal *bimodalPredictor
+	gshare  *gsharePredictor
+	// chooser selects the gshare predictor from 2
+	chooser []counter
+}
+
+func (p *tournamentPredictor) Predict(pc, target int32) (bool, uint32) {
+	taken, _ := p.bimodal.Predict(pc, target)
+	gshare, history := p.gshare.lookup(pc)
+	if p.chooser[predictorIndex(pc)].taken() {
+		taken = gshare
+	}
+	p.gshare.predicted = append(p.gshare.predicted, taken)
+	return taken, history
+}
+
+func (p *tournamentPredictor) Update(pc int32, history uint32, taken bool) {
+	bimodal := p.bimodal.table[predictorIndex(pc)].taken() == taken
+	gshare := p.gshare.counter(pc, history).taken() == taken
+	if bimodal != gshare {
+		p.chooser[predictorIndex(pc)].update(gshare)
+	}
+	p.bimodal.Update(pc, history, taken)
+	p.gshare.Update(pc, history, taken)
+}
+
+func (p *tournamentPredictor) Recover(survivors int) {
+	p.gshare.Recover(survivors)
+}
@@ -0,0 +1,123 @@
+package comp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPredictorPolicy(t *testing.T) {
+	for p := range predictorPolicies {
+		parsed, err := ParsePredictorPolicy(p.String())
+		require.NoError(t, err)
+		assert.Equal(t, p, parsed)
+	}
+	_, err := ParsePredictorPolicy("perceptron")
+	assert.Error(t, err)
+}
+
+// mispredictions runs the directions of the branch at pc and returns the
+// number of mispredictions.
+func mispredictions(p BranchPredictor, pc int32, directions []bool) int {
+	res := 0
+	for _, taken := range directions {
+		predicted, history := p.Predict(pc, 0)
+		if predicted != taken {
+			res++
+		}
+		p.Update(pc, history, taken)
+	}
+	return res
+}
+
+func TestStaticPredictors(t *testing.T) {
+	taken, _ := NewBranchPredictor(NotTaken).Predict(8, 0)
+	assert.False(t, taken)
+	taken, _ = NewBranchPredictor(Taken).Predict(8, 16)
+	assert.True(t, taken)
+	p := NewBranchPredictor(BTFN)
+	taken, _ = p.Predict(8, 0)
+	assert.True(t, taken)
+	taken, _ = p.Predict(8, 16)
+	assert.False(t, taken)
+}
+
+func TestBimodalPredictor(t *testing.T) {
+	p := NewBranchPredictor(Bimodal)
+	// A loop of 4 iterations, run twice: the counter saturates and only the
+	// exits are mispredicted once learned
+	loop := []bool{true, true, true, false, true, true, true, false}
+	assert.Equal(t, 3, mispredictions(p, 0, loop))
+	// Another branch
+	taken, _ := p.Predict(4, 0)
+	assert.False(t, taken)
+	// Aliasing
+	taken, _ = p.Predict(4*predictorEntries, 0)
+	assert.True(t, taken)
+}
+
+func TestGSharePredictor(t *testing.T) {
+	// Alternating directions, learned from the history
+	alternating := make([]bool, 64)
+	for i := range alternating {
+		alternating[i] = i%2 == 0
+	}
+	// The bimodal counter oscillates between the weak states, always wrong
+	assert.Equal(t, 64, mispredictions(NewBranchPredictor(Bimodal), 0, alternating))
+	assert.Less(t, mispredictions(NewBranchPredictor(GShare), 0, alternating), 8)
+
+	// The counters trained are the ones of the history predicted from, even if
+	// other branches were resolved since
+	p := NewBranchPredictor(GShare)
+	_, history := p.Predict(0, 0)
+	p.Update(4, 0, true)
+	p.Update(0, history, true)
+	p.Update(0, history, true)
+	assert.True(t, p.(*gsharePredictor).counter(0, history).taken())
+	taken, _ := p.Predict(0, 0)
+	assert.False(t, taken)
+
+	// The branches not yet resolved extend the history with their predicted
+	// direction until recovered
+	p = NewBranchPredictor(GShare)
+	p.(*gsharePredictor).table[0] = 3
+	taken, _ = p.Predict(0, 0)
+	assert.True(t, taken)
+	_, history = p.Predict(4, 0)
+	assert.Equal(t, uint32(1), history)
+	p.Recover(0)
+	_, history = p.Predict(4, 0)
+	assert.Zero(t, history)
+
+	// A partial flush keeps the directions of the older branches in flight
+	p = NewBranchPredictor(GShare)
+	p.(*gsharePredictor).table[0] = 3
+	p.Predict(0, 0)
+	p.Predict(4, 0)
+	p.Recover(1)
+	_, history = p.Predict(4, 0)
+	assert.Equal(t, uint32(1), history)
+	// The older branch resolved, the younger one, predicted taken from the
+	// counter 0, still extends the history
+	p.Update(0, 0, true)
+	_, history = p.Predict(8, 0)
+	assert.Equal(t, uint32(3), history)
+}
+
+func TestTournamentPredictor(t *testing.T) {
+	alternating := make([]bool, 64)
+	for i := range alternating {
+		alternating[i] = i%2 == 0
+	}
+	assert.Less(t, mispredictions(NewBranchPredictor(Tournament), 0, alternating), 12)
+
+	// Biased branches interleaved with a random looking one: the bimodal
+	// predictor is chosen for the biased ones
+	p := NewBranchPredictor(Tournament).(*tournamentPredictor)
+	for i := 0; i < 256; i++ {
+		mispredictions(p, 0, []bool{true})
+		mispredictions(p, 4, []bool{i*7%5 < 2})
+	}
+	assert.Zero(t, mispredictions(p, 0, []bool{true, true, true, true}))
+}
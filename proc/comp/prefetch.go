@@ -0,0 +1,348 @@
+package comp
+
+import (
+	"fmt"
+)
+
+// PrefetchPolicy selects the prefetcher of a cache.
+type PrefetchPolicy int
+
+const (
+	// NoPrefetch only fetches the lines on demand.
+	NoPrefetch PrefetchPolicy = iota
+	// NextLine prefetches the lines following each accessed line.
+	NextLine
+	// Stride prefetches the lines ahead of the accesses of an instruction
+	// once it accessed the memory with the same stride twice in a row. The
+	// instructions are tracked in a table indexed by their pc.
+	Stride
+	// Stream prefetches the lines ahead of the sequences of accesses to
+	// consecutive lines, ascending or descending, once detected.
+	Stream
+)
+
+var prefetchPolicies = map[PrefetchPolicy]string{
+	NoPrefetch: "none",
+	NextLine:   "next-line",
+	Stride:     "stride",
+	Stream:     "stream",
+}
+
+func (p PrefetchPolicy) String() string {
+	if s, exists := prefetchPolicies[p]; exists {
+		return s
+	}
+	return fmt.Sprintf("PrefetchPolicy(%d)", int(p))
+}
+
+// ParsePrefetchPolicy parses none, next-line, stride or stream.
+func ParsePrefetchPolicy(s string) (PrefetchPolicy, error) {
+	for p, name := range prefetchPolicies {
+		if name == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown prefetch policy %q", s)
+}
+
+// Prefetcher predicts the lines of a cache accessed next from the demand
+// accesses.
+type Prefetcher interface {
+	// Access is called on each demand access to addr by the instruction at
+	// pc, hit or miss. It returns the addresses of the lines to prefetch.
+	Access(pc, addr int32, hit bool) []int32
+}
+
+// NewPrefetcher creates the prefetcher of a policy for a cache of lineSize
+// bytes lines, prefetching up to degree lines ahead. It returns nil with
+// NoPrefetch.
+func NewPrefetcher(policy PrefetchPolicy, lineSize, degree int) Prefetcher {
+	switch policy {
+	case NoPrefetch:
+		return nil
+	case NextLine:
+		return nextLinePrefetcher{lineSize: int32(lineSize), degree: degree}
+	case Stride:
+		return &stridePrefetcher{lineSize: int32(lineSize), degree: degree}
+	case Stream:
+		return &streamPrefetcher{lineSize: int32(lineSize), degree: degree}
+	}
+	panic(fmt.Sprintf("unknown prefetch policy %v", policy))
+}
+
+type nextLinePrefetcher struct {
+	lineSize int32
+	degree   int
+}
+
+func (p nextLinePrefetcher) Access(_, addr int32, _ bool) []int32 {
+	line := addr &^ (p.lineSize - 1)
+	res := make([]int32, 0, p.degree)
+	for i := 1; i <= p.degree; i++ {
+		res = append(res, line+int32(i)*p.lineSize)
+	}
+	return res
+}
+
+// strideEntries is the number of entries of the stride table.
+const strideEntries = 64
+
+type strideEntry struct {
+	valid  bool
+	pc     int32
+	last   int32
+	stride int32
+	// confidence is the number of times in a row the stride was observed,
+	// saturating at 3
+	confidence int
+}
+
+type stridePrefetcher struct {
+	lineSize int32
+	degree   int
+	table    [strideEntries]strideEntry
+}
+
+func (p *stridePrefetcher) Access(pc, addr int32, _ bool) []int32 {
+	e := &p.table[uint32(pc)/4%strideEntries]
+	if !e.valid || e.pc != pc {
+		*e = strideEntry{valid: true, pc: pc, last: addr}
+		return nil
+	}
+	stride := addr - e.last
+	e.last = addr
+	if stride == 0 {
+		return nil
+	}
+	if stride != e.stride {
+		e.stride = stride
+		e.confidence = 0
+		return nil
+	}
+	e.confidence = min(e.confidence+1, 3)
+	if e.confidence < 2 {
+		return nil
+	}
+
+	// At least a line ahead for the strides smaller than a line
+	step := stride
+	if step > -p.lineSize && step < p.lineSize {
+		step = p.lineSize
+		if stride < 0 {
+			step = -p.lineSize
+		}
+	}
+	res := make([]int32, 0, p.degree)
+	for i := 1; i <= p.degree; i++ {
+		res = append(res, (addr+int32(i)*step)&^(p.lineSize-1))
+	}
+	return res
+}
+
+// streamEntries is the number of streams tracked.
+const streamEntries = 4
+
+type stream struct {
+	valid bool
+	// line is the last line accessed
+	line int32
+	// direction is 1 for an ascending stream, -1 for a descending one and 0
+	// while not detected
+	direction int32
+}
+
+type streamPrefetcher struct {
+	lineSize int32
+	degree   int
+	streams  [streamEntries]stream
+	// next is the stream replaced by the next new stream
+	next int
+}
+
+func (p *streamPrefetcher) Access(_, addr int32, hit bool) []int32 {
+	line := addr &^ (p.lineSize - 1)
+	for i := range p.streams {
+		s := &p.streams[i]
+		if !s.valid {
+			continue
+		}
+		if line == s.line {
+			return nil
+		}
+		if s.direction == 0 && (line == s.line+p.lineSize || line == s.line-p.lineSize) {
+			s.direction = (line - s.line) / p.lineSize
+		}
+		if s.direction != 0 && line == s.line+s.direction*p.lineSize {
+			s.line = line
+			res := make([]int32, 0, p.degree)
+			for j := 1; j <= p.degree; j++ {
+				res = append(res, line+int32(j)*s.direction*p.lineSize)
+			}
+			return res
+		}
+	}
+	// A new stream starts on a miss
+	if !hit {
+		p.streams[p.next] = stream{valid: true, line: line}
+		p.next = (p.next + 1) % streamEntries
+	}
+	return nil
+}
+
+// PrefetchStats are the prefetches of a cache.
+type PrefetchStats struct {
+	// Issued are the lines prefetched from the lower level.
+	Issued int
+	// Useful are the prefetched lines accessed once in the cache.
+	Useful int
+	// Late are the prefetched lines accessed before being in the cache, the
+	// access waiting for the prefetch to complete.
+	Late int
+	// Polluting are the misses of the lines evicted by a prefetched line.
+	Polluting int
+}
+
+// Prefetch issues the prefetches of a Prefetcher to the lower level of a
+// cache. The prefetched lines are pushed into the cache once they arrive, the
+// dirty lines evicted being written back. The lower level is accessed from
+// offset, the address of the lines of the cache.
+type Prefetch struct {
+	prefetcher Prefetcher
+	cache      *Cache
+	next       MemoryLevel
+	offset     int32
+	// inFlight are the prefetches not arrived yet, in the order they were
+	// issued
+	inFlight []prefetch
+	// unused are the prefetched lines not accessed yet
+	unused map[int32]bool
+	// victims are the lines evicted by a prefetched line
+	victims map[int32]bool
+	stats   PrefetchStats
+}
+
+type prefetch struct {
+	line  int32
+	data  []int8
+	ready int
+}
+
+// NewPrefetch creates the prefetch unit of a cache, it doesn't prefetch
+// anything if prefetcher is nil.
+func NewPrefetch(prefetcher Prefetcher, cache *Cache, next MemoryLevel, offset int32) *Prefetch {
+	return &Prefetch{
+		prefetcher: prefetcher,
+		cache:      cache,
+		next:       next,
+		offset:     offset,
+		unused:     make(map[int32]bool),
+		victims:    make(map[int32]bool),
+	}
+}
+
+// Fill pushes the prefetched lines arrived at cycle at into the cache.
+func (p *Prefetch) Fill(at int) {
+	inFlight := p.inFlight[:0]
+	for _, f := range p.inFlight {
+		if f.ready > at {
+			inFlight = append(inFlight, f)
+			continue
+		}
+		if p.cache.Contains(f.line) {
+			continue
+		}
+		evicted, exists := p.cache.PushLine(f.line, f.data)
+		p.unused[f.line] = true
+		if !exists {
+			continue
+		}
+		if evicted.Dirty {
+			// Written back in the background
+			p.next.Write(p.offset+evicted.Boundary[0], evicted.Data, at)
+		}
+		delete(p.unused, evicted.Boundary[0])
+		p.victims[evicted.Boundary[0]] = true
+	}
+	p.inFlight = inFlight
+}
+
+// Hit records a demand access to the line containing addr found in the cache.
+func (p *Prefetch) Hit(addr int32) {
+	line := p.cache.LineAddress(addr)
+	if p.unused[line] {
+		delete(p.unused, line)
+		p.stats.Useful++
+	}
+}
+
+// Miss records a demand access to the line containing addr missing the cache
+// at cycle at. If the line is being prefetched, it returns its data and the
+// number of cycles before it arrives, the line being pushed by the caller.
+func (p *Prefetch) Miss(addr int32, at int) ([]int8, int, bool) {
+	line := p.cache.LineAddress(addr)
+	if p.victims[line] {
+		delete(p.victims, line)
+		p.stats.Polluting++
+	}
+	i := p.find(line)
+	if i == -1 {
+		return nil, 0, false
+	}
+	f := p.inFlight[i]
+	p.inFlight = append(p.inFlight[:i], p.inFlight[i+1:]...)
+	p.stats.Late++
+	return f.data, max(f.ready-at, 0), true
+}
+
+func (p *Prefetch) find(line int32) int {
+	for i, f := range p.inFlight {
+		if f.line == line {
+			return i
+		}
+	}
+	return -1
+}
+
+// Evicted records a line evicted by a demand access.
+func (p *Prefetch) Evicted(line Line) {
+	delete(p.unused, line.Boundary[0])
+}
+
+// Issue notifies the prefetcher of a demand access to addr by the instruction
+// at pc and issues the prefetches at cycle at, except for the lines cached or
+// already being prefetched.
+func (p *Prefetch) Issue(pc, addr int32, hit bool, at int) {
+	if p.prefetcher == nil {
+		return
+	}
+	for _, line := range p.prefetcher.Access(pc, addr, hit) {
+		line = p.cache.LineAddress(line)
+		if p.find(line) != -1 || p.cache.Contains(line) {
+			continue
+		}
+		data, cycles := p.next.Read(p.offset+line, p.cache.config.LineSize, at)
+		p.inFlight = append(p.inFlight, prefetch{line: line, data: data, ready: at + cycles})
+		p.stats.Issued++
+	}
+}
+
+// Cancel drops the prefetch of the line containing addr, its data being
+// outdated by a write to the lower level.
+func (p *Prefetch) Cancel(addr int32) {
+	if i := p.find(p.cache.LineAddress(addr)); i != -1 {
+		p.inFlight = append(p.inFlight[:i], p.inFlight[i+1:]...)
+	}
+}
+
+// Invalidate drops the prefetches in flight, the lower level being accessed
+// directly.
+func (p *Prefetch) Invalidate() {
+	p.inFlight = nil
+	clear(p.unused)
+	clear(p.victims)
+}
+
+// Stats returns the prefetches.
+func (p *Prefetch) Stats() PrefetchStats {
+	return p.stats
+}
@@ -0,0 +1,134 @@
+package comp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefetchPolicy(t *testing.T) {
+	for p := range prefetchPolicies {
+		parsed, err := ParsePrefetchPolicy(p.String())
+		require.NoError(t, err)
+		assert.Equal(t, p, parsed)
+	}
+	_, err := ParsePrefetchPolicy("markov")
+	assert.Error(t, err)
+	assert.Nil(t, NewPrefetcher(NoPrefetch, 64, 1))
+}
+
+func TestNextLinePrefetcher(t *testing.T) {
+	p := NewPrefetcher(NextLine, 64, 2)
+	assert.Equal(t, []int32{128, 192}, p.Access(0, 70, false))
+	assert.Equal(t, []int32{128, 192}, p.Access(4, 64, true))
+}
+
+func TestStridePrefetcher(t *testing.T) {
+	p := NewPrefetcher(Stride, 64, 1)
+	// The stride is observed twice before prefetching, at least a line ahead
+	assert.Nil(t, p.Access(8, 0, false))
+	assert.Nil(t, p.Access(8, 4, true))
+	assert.Nil(t, p.Access(8, 8, true))
+	assert.Equal(t, []int32{64}, p.Access(8, 12, true))
+	// Another instruction indexing the same entry
+	assert.Nil(t, p.Access(8+4*strideEntries, 1000, false))
+	assert.Nil(t, p.Access(8, 16, true))
+
+	// Strides larger than a line, descending
+	p = NewPrefetcher(Stride, 64, 2)
+	for _, addr := range []int32{1024, 768, 512} {
+		assert.Nil(t, p.Access(0, addr, false))
+	}
+	assert.Equal(t, []int32{0, -256}, p.Access(0, 256, false))
+	// A new stride resets the confidence
+	assert.Nil(t, p.Access(0, 260, false))
+}
+
+func TestStreamPrefetcher(t *testing.T) {
+	p := NewPrefetcher(Stream, 64, 2)
+	assert.Nil(t, p.Access(0, 0, false))
+	assert.Equal(t, []int32{128, 192}, p.Access(0, 64, false))
+	assert.Nil(t, p.Access(0, 70, true))
+	assert.Equal(t, []int32{192, 256}, p.Access(0, 128, true))
+
+	// Descending
+	assert.Nil(t, p.Access(0, 1000, false))
+	assert.Equal(t, []int32{832, 768}, p.Access(0, 900, false))
+	// A hit doesn't start a stream
+	assert.Nil(t, p.Access(0, 5000, true))
+	assert.Nil(t, p.Access(0, 5064, false))
+}
+
+func TestPrefetch(t *testing.T) {
+	data := make([]int8, 32)
+	for i := range data {
+		data[i] = int8(i)
+	}
+	memory := NewMemory(50)
+	memory.Map(0, data)
+	// 2 lines of 4 bytes
+	c := NewCache(CacheConfig{Size: 8, LineSize: 4})
+	p := NewPrefetch(NewPrefetcher(NextLine, 4, 1), c, memory, 0)
+
+	// Pushed once arrived
+	p.Issue(0, 0, false, 0)
+	p.Fill(49)
+	assert.False(t, c.Contains(4))
+	p.Fill(50)
+	v, _ := c.Read([]int32{4, 5})
+	assert.Equal(t, []int8{4, 5}, v)
+	p.Hit(5)
+	p.Hit(6)
+	assert.Equal(t, PrefetchStats{Issued: 1, Useful: 1}, p.Stats())
+
+	// Accessed while in flight
+	p.Issue(0, 4, true, 100)
+	v, cycles, late := p.Miss(9, 120)
+	assert.True(t, late)
+	assert.Equal(t, []int8{8, 9, 10, 11}, v)
+	assert.Equal(t, 30, cycles)
+	// Already cached
+	p.Issue(0, 0, true, 120)
+	assert.Equal(t, PrefetchStats{Issued: 2, Useful: 1, Late: 1}, p.Stats())
+
+	// Line 4 is the least recently used line, evicted by the prefetch of
+	// line 16
+	c.PushLine(0, make([]int8, 4))
+	p.Issue(0, 12, false, 200)
+	p.Fill(250)
+	assert.True(t, c.Contains(16))
+	_, _, late = p.Miss(4, 300)
+	assert.False(t, late)
+	assert.Equal(t, PrefetchStats{Issued: 3, Useful: 1, Late: 1, Polluting: 1}, p.Stats())
+
+	// Canceled and invalidated
+	p.Issue(0, 20, false, 300)
+	p.Cancel(25)
+	_, _, late = p.Miss(24, 400)
+	assert.False(t, late)
+	p.Issue(0, 20, false, 400)
+	p.Invalidate()
+	p.Fill(1000)
+	assert.False(t, c.Contains(24))
+}
+
+func TestPrefetchDirtyVictim(t *testing.T) {
+	data := make([]int8, 8)
+	memory := NewMemory(50)
+	memory.Map(0, data)
+	c := NewCache(CacheConfig{Size: 4, LineSize: 4})
+	p := NewPrefetch(NewPrefetcher(NextLine, 4, 1), c, memory, 0)
+
+	c.PushLine(0, make([]int8, 4))
+	c.Write(0, []int8{-1})
+	p.Issue(0, 0, true, 0)
+	p.Fill(50)
+	assert.Equal(t, int8(-1), data[0])
+	assert.True(t, c.Contains(4))
+
+	// Without prefetcher
+	p = NewPrefetch(nil, c, memory, 0)
+	p.Issue(0, 0, false, 0)
+	assert.Zero(t, p.Stats())
+}
@@ -0,0 +1,143 @@
+package comp
+
+// DefaultReturnAddressStackSize is the number of return addresses of a return
+// address stack.
+const DefaultReturnAddressStackSize = 8
+
+// RASStats are the returns predicted by a return address stack, once
+// resolved.
+type RASStats struct {
+	// Hits are the returns predicted with their target.
+	Hits int
+	// Misses are the returns predicted with another target, for example
+	// after an overflow.
+	Misses int
+	// Underflows are the returns not predicted, the stack being empty.
+	Underflows int
+	// Overflows are the calls whose return address replaced the oldest one,
+	// the stack being full.
+	Overflows int
+}
+
+// ReturnAddressStack predicts the targets of the returns: the return address
+// of each call is pushed when decoded and popped by the next return decoded.
+// As the calls and the returns decoded may be flushed, the stack is also
+// maintained with the resolved ones, from which it is recovered on a flush.
+type ReturnAddressStack struct {
+	speculative returnStack
+	committed   returnStack
+	// pending are the calls and returns decoded not yet resolved, the oldest
+	// first
+	pending []jump
+	stats   RASStats
+}
+
+// jump is a call pushing addr or a return.
+type jump struct {
+	call bool
+	addr int32
+}
+
+// returnStack is a circular stack, a push on a full stack replacing the oldest
+// address.
+type returnStack struct {
+	addrs []int32
+	// top is the index of the next address pushed
+	top   int
+	count int
+}
+
+func (s *returnStack) push(addr int32) bool {
+	s.addrs[s.top] = addr
+	s.top = (s.top + 1) % len(s.addrs)
+	if s.count == len(s.addrs) {
+		return false
+	}
+	s.count++
+	return true
+}
+
+func (s *returnStack) pop() (int32, bool) {
+	if s.count == 0 {
+		return 0, false
+	}
+	s.top = (s.top - 1 + len(s.addrs)) % len(s.addrs)
+	s.count--
+	return s.addrs[s.top], true
+}
+
+func (s *returnStack) copyFrom(o returnStack) {
+	copy(s.addrs, o.addrs)
+	s.top = o.top
+	s.count = o.count
+}
+
+// NewReturnAddressStack creates a return address stack of size addresses.
+func NewReturnAddressStack(size int) *ReturnAddressStack {
+	return &ReturnAddressStack{
+		speculative: returnStack{addrs: make([]int32, size)},
+		committed:   returnStack{addrs: make([]int32, size)},
+	}
+}
+
+// Push pushes the return address of a call when decoded.
+func (r *ReturnAddressStack) Push(addr int32) {
+	r.speculative.push(addr)
+	r.pending = append(r.pending, jump{call: true, addr: addr})
+}
+
+// Pop pops the target predicted for a return when decoded, false if the stack
+// is empty.
+func (r *ReturnAddressStack) Pop() (int32, bool) {
+	r.pending = append(r.pending, jump{})
+	return r.speculative.pop()
+}
+
+// Call records a call resolved with its return address.
+func (r *ReturnAddressStack) Call(addr int32) {
+	r.resolve()
+	if !r.committed.push(addr) {
+		r.stats.Overflows++
+	}
+}
+
+// Return records a return resolved to target. predicted is its target popped
+// when decoded, if the stack wasn't empty.
+func (r *ReturnAddressStack) Return(predicted int32, popped bool, target int32) {
+	r.resolve()
+	r.committed.pop()
+	switch {
+	case !popped:
+		r.stats.Underflows++
+	case predicted == target:
+		r.stats.Hits++
+	default:
+		r.stats.Misses++
+	}
+}
+
+// resolve discards the oldest call or return decoded, resolved.
+func (r *ReturnAddressStack) resolve() {
+	if len(r.pending) > 0 {
+		r.pending = r.pending[1:]
+	}
+}
+
+// Recover restores the stack of the calls and returns resolved, followed by
+// the survivors oldest ones decoded since, the younger ones being flushed.
+func (r *ReturnAddressStack) Recover(survivors int) {
+	r.pending = r.pending[:survivors]
+	r.speculative.copyFrom(r.committed)
+	for _, j := range r.pending {
+		if j.call {
+			r.speculative.push(j.addr)
+		} else {
+			r.speculative.pop()
+		}
+	}
+}
+
+// Stats returns the returns predicted.
+func (r *ReturnAddressStack) Stats() RASStats {
+	return r.stats
+}
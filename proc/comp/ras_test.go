@@ -0,0 +1,61 @@
+package comp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReturnAddressStack(t *testing.T) {
+	r := NewReturnAddressStack(2)
+	// Overflow, the oldest address is replaced
+	for _, addr := range []int32{4, 8, 12} {
+		r.Push(addr)
+		r.Call(addr)
+	}
+	for _, want := range []int32{12, 8} {
+		addr, ok := r.Pop()
+		assert.True(t, ok)
+		assert.Equal(t, want, addr)
+		r.Return(addr, ok, want)
+	}
+	// Underflow
+	_, ok := r.Pop()
+	assert.False(t, ok)
+	r.Return(0, ok, 4)
+	assert.Equal(t, RASStats{Hits: 2, Underflows: 1, Overflows: 1}, r.Stats())
+
+	// A call and a return decoded then flushed
+	r.Push(16)
+	r.Push(20)
+	addr, ok := r.Pop()
+	assert.True(t, ok)
+	assert.Equal(t, int32(20), addr)
+	r.Call(16)
+	r.Recover(0)
+	addr, ok = r.Pop()
+	assert.True(t, ok)
+	assert.Equal(t, int32(16), addr)
+	r.Return(addr, ok, 24)
+	assert.Equal(t, 1, r.Stats().Misses)
+	_, ok = r.Pop()
+	assert.False(t, ok)
+	r.Return(0, ok, 24)
+
+	// A partial flush keeps the calls and returns of the older instructions
+	// in flight
+	r = NewReturnAddressStack(2)
+	r.Push(4)
+	r.Call(4)
+	r.Push(8)
+	r.Pop()
+	r.Push(12)
+	r.Recover(2)
+	addr, ok = r.Pop()
+	assert.True(t, ok)
+	assert.Equal(t, int32(4), addr)
+	r.Recover(1)
+	addr, ok = r.Pop()
+	assert.True(t, ok)
+	assert.Equal(t, int32(8), addr)
+}
@@ -0,0 +1,148 @@
+package proc_test
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/teivah/majorana/proc"
+	_ "github.com/teivah/majorana/proc/all"
+	"github.com/teivah/majorana/risc"
+	"github.com/teivah/majorana/test"
+)
+
+// configurations are the options the machines are checked with, besides the
+// memory size.
+var configurations = map[string]proc.Options{
+	"": {},
+	"/deep": {
+		ExecuteUnits: 4,
+		Speculation:  proc.SpeculationOptions{Deep: true},
+	},
+}
+
+// runLockstep runs the instructions on the machine in lockstep, a panic of the
+// machine is returned as an error so that the program can be minimized.
+func runLockstep(t *testing.T, name string, opts proc.Options, instructions string) (err error) {
+	app, err := risc.Parse(instructions)
+	require.NoError(t, err, instructions)
+	opts.MemoryBytes = 1024
+	m, err := proc.New(name, opts)
+	require.NoError(t, err)
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	_, err = proc.RunLockstep(m, app)
+	return err
+}
+
+func TestMachinesRegressions(t *testing.T) {
+	// Programs minimized from the fuzzer
+	programs := []struct {
+		name         string
+		instructions string
+	}{
+		{"negative shift amount", `
+    li a1, -4
+    srl a1, a1, a1`},
+		{"empty application", ``},
+		{"branch to the end", `
+    beq zero, zero, L1
+    addi t0, t0, 1
+L1:`},
+		{"load before a taken branch", `
+    lbu t0, 4(zero)
+    beq zero, zero, L1
+    lw t1, 0(zero)
+L1:`},
+		{"branches flushing in the same cycle", `
+    lh a2, 4(zero)
+    lh a0, 14(zero)
+    bgeu a1, a0, L1
+    jal t1, L2
+L2:
+L1:`},
+		{"store after a mispredicted loop branch", `
+    li s1, 2
+L1:
+    addi s1, s1, -1
+    bnez s1, L1
+    sh a2, 18(s0)`},
+		{"store skipped by a mispredicted branch", `
+    li s1, 2
+L1:
+    bge t2, zero, L2
+    sh a0, 18(s0)
+L2:
+    addi s1, s1, -1
+    bnez s1, L1`},
+		{"store executed before an older load", `
+    li a2, -982
+    srai t1, zero, 30
+    lbu t0, 30(s0)
+    li s1, 1
+L1:
+    lbu a1, 18(s0)
+    li s2, 3
+L2:
+    lw a0, 20(s0)
+    sw a2, 20(s0)
+    addi s2, s2, -1
+    bnez s2, L2
+    addi s1, s1, -1
+    bnez s1, L1`},
+		{"stores executed out of order", `
+    lhu t1, 12(s0)
+    lhu t1, 10(s0)
+    bltu a2, t0, L1
+L1:
+    sb a1, 3(s0)
+    xori a1, t2, 4
+    lhu t1, 12(s0)
+    xori a2, zero, 0
+    sh a1, 0(s0)
+    sw zero, 0(s0)
+    lw t0, 0(s0)`},
+	}
+	for _, program := range programs {
+		for _, name := range proc.Names() {
+			for suffix, opts := range configurations {
+				t.Run(program.name+"/"+name+suffix, func(t *testing.T) {
+					require.NoError(t, runLockstep(t, name, opts, program.instructions))
+				})
+			}
+		}
+	}
+}
+
+// FuzzMachines runs the random programs on each machine in lockstep. Almost
+// every program reaches new states of the machines, so it is best run with
+// -fuzzminimizetime 0: by default, each of these programs is minimized for up
+// to a minute before fuzzing resumes, whereas a failing program is minimized
+// by the target itself.
+func FuzzMachines(f *testing.F) {
+	r := rand.New(rand.NewSource(0))
+	for i := 0; i < 8; i++ {
+		data := make([]byte, 256)
+		r.Read(data)
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		program := test.NewProgram(data)
+		for _, name := range proc.Names() {
+			for suffix, opts := range configurations {
+				err := runLockstep(t, name, opts, program.String())
+				if err == nil {
+					continue
+				}
+				minimized := program.Minimize(func(p test.Program) bool {
+					return runLockstep(t, name, opts, p.String()) != nil
+				})
+				t.Fatalf("%s%s: %v\n%s\nminimized to %v:\n%s", name, suffix, err, program, runLockstep(t, name, opts, minimized.String()), minimized)
+			}
+		}
+	})
+}
@@ -0,0 +1,242 @@
+package proc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"maps"
+	"sort"
+	"strings"
+
+	"github.com/teivah/majorana/common/trace"
+	"github.com/teivah/majorana/risc"
+)
+
+// lockstepWindow is the number of instructions a Machine may retire ahead of
+// an older instruction. The superscalar processors retire the instructions
+// written back by different units or directly in the L1D out of order.
+const lockstepWindow = 32
+
+// lockstepTimeout is the number of cycles without retired instruction after
+// which a Machine is considered stuck.
+const lockstepTimeout = 100_000
+
+// Retirement is an instruction retired with its architectural effects.
+type Retirement struct {
+	Pc        int32
+	Execution risc.Execution
+}
+
+func (r Retirement) String() string {
+	var effects []string
+	exe := r.Execution
+	if exe.RegisterChange {
+		effects = append(effects, fmt.Sprintf("%s=%d", strings.ToLower(exe.Register.String()), exe.RegisterValue))
+	}
+	if exe.MemoryChange {
+		addrs := make([]int32, 0, len(exe.MemoryChanges))
+		for addr := range exe.MemoryChanges {
+			addrs = append(addrs, addr)
+		}
+		sort.Slice(addrs, func(i, j int) bool {
+			return addrs[i] < addrs[j]
+		})
+		for _, addr := range addrs {
+			effects = append(effects, fmt.Sprintf("mem[%d]=%d", addr, exe.MemoryChanges[addr]))
+		}
+	}
+	if exe.PcChange {
+		effects = append(effects, fmt.Sprintf("pc=%d", exe.NextPc))
+	}
+	if exe.Return {
+		effects = append(effects, "return")
+	}
+	if len(effects) == 0 {
+		effects = append(effects, "no effect")
+	}
+	return fmt.Sprintf("pc %d (%s)", r.Pc, strings.Join(effects, ", "))
+}
+
+func (r Retirement) equal(o Retirement) bool {
+	a, b := r.Execution, o.Execution
+	return r.Pc == o.Pc &&
+		a.RegisterChange == b.RegisterChange &&
+		(!a.RegisterChange || a.Register == b.Register && a.RegisterValue == b.RegisterValue) &&
+		a.MemoryChange == b.MemoryChange &&
+		(!a.MemoryChange || maps.Equal(a.MemoryChanges, b.MemoryChanges)) &&
+		a.PcChange == b.PcChange &&
+		(!a.PcChange || a.NextPc == b.NextPc) &&
+		a.Return == b.Return
+}
+
+// Divergence is the first instruction retired by a Machine that differs from
+// the reference model. Expected is nil if the reference model didn't execute
+// the instruction, Actual is nil if the Machine didn't retire it.
+type Divergence struct {
+	Cycle    int
+	Pc       int32
+	Expected *Retirement
+	Actual   *Retirement
+}
+
+func (d *Divergence) Error() string {
+	expected, actual := "nothing", "nothing"
+	if d.Expected != nil {
+		expected = d.Expected.String()
+	}
+	if d.Actual != nil {
+		actual = d.Actual.String()
+	}
+	return fmt.Sprintf("divergence at cycle %d, pc %d: expected %s, got %s", d.Cycle, d.Pc, expected, actual)
+}
+
+// lockstep compares the instructions retired by a Machine with the ones
+// executed by the reference model.
+type lockstep struct {
+	ctx        *risc.Context
+	ref        *risc.Runner
+	pending    []Retirement
+	lastRetire int
+	divergence *Divergence
+	err        error
+}
+
+// lockstepAbort stops a Machine at the first divergence, it may not terminate
+// otherwise.
+type lockstepAbort struct{}
+
+// RunLockstep runs the application on m and, in lockstep, on the risc.Runner
+// reference model started from a copy of the context of m. Each instruction
+// retired by m is compared with the one executed by the reference model: the
+// pc, the register and memory written, the branch target and the return. The
+// first divergence, including a Machine not retiring anything for too long,
+// stops the run and is returned as a *Divergence error.
+func RunLockstep(m Machine, app risc.Application) (int, error) {
+	ctx := m.Context()
+	refCtx := risc.NewContext(false, len(ctx.Memory))
+	copy(refCtx.Memory, ctx.Memory)
+	maps.Copy(refCtx.Registers, ctx.Registers)
+	refCtx.Ecall = ctx.Ecall
+	if ctx.Stdin != nil {
+		// The reference model reads what the Machine has read, it never
+		// executes an environment call ahead of it
+		var stdin bytes.Buffer
+		ctx.Stdin = io.TeeReader(ctx.Stdin, &stdin)
+		refCtx.Stdin = &stdin
+	}
+	ref := &risc.Runner{Ctx: refCtx, App: app}
+	if err := ref.Start(); err != nil {
+		return 0, err
+	}
+
+	l := &lockstep{ctx: ctx, ref: ref}
+	tracer := ctx.Tracer
+	ctx.Retired = l.retire
+	// Traced to detect a Machine stuck without retiring anything
+	ctx.Tracer = l
+	if tracer != nil {
+		ctx.Tracer = trace.Tracers{tracer, l}
+	}
+	defer func() {
+		ctx.Retired = nil
+		ctx.Tracer = tracer
+	}()
+	cycles, err := l.run(m, app)
+	if err != nil {
+		return cycles, err
+	}
+	if l.err != nil {
+		return cycles, l.err
+	}
+	if l.divergence != nil {
+		return cycles, l.divergence
+	}
+	// Every instruction executed by the reference model must be retired
+	if len(l.pending) == 0 {
+		l.step()
+	}
+	if l.err != nil {
+		return cycles, l.err
+	}
+	if len(l.pending) != 0 {
+		expected := l.pending[0]
+		return cycles, &Divergence{Cycle: cycles, Pc: expected.Pc, Expected: &expected}
+	}
+	return cycles, nil
+}
+
+func (l *lockstep) run(m Machine, app risc.Application) (cycles int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(lockstepAbort); !ok {
+				panic(r)
+			}
+			cycles = l.ctx.Cycle
+		}
+	}()
+	return m.Run(app)
+}
+
+func (l *lockstep) Trace(e trace.Event) {
+	if e.Cycle-l.lastRetire <= lockstepTimeout {
+		return
+	}
+	if len(l.pending) == 0 {
+		l.step()
+	}
+	l.diverge(-1, nil)
+}
+
+func (l *lockstep) retire(pc int32, exe risc.Execution) {
+	l.lastRetire = l.ctx.Cycle
+	actual := Retirement{Pc: pc, Execution: exe}
+	for i := 0; ; i++ {
+		if i == len(l.pending) {
+			if len(l.pending) == lockstepWindow || !l.step() {
+				break
+			}
+		}
+		if l.pending[i].Pc != pc {
+			continue
+		}
+		expected := l.pending[i]
+		l.pending = append(l.pending[:i], l.pending[i+1:]...)
+		if !expected.equal(actual) {
+			l.divergence = &Divergence{Cycle: l.ctx.Cycle, Pc: pc, Expected: &expected, Actual: &actual}
+			panic(lockstepAbort{})
+		}
+		return
+	}
+
+	// The Machine retired an instruction the reference model didn't execute
+	l.diverge(pc, &actual)
+}
+
+// diverge aborts the Machine with the oldest instruction not retired yet as
+// the expected one.
+func (l *lockstep) diverge(pc int32, actual *Retirement) {
+	var expected *Retirement
+	if len(l.pending) != 0 {
+		expected = &l.pending[0]
+		if actual == nil {
+			pc = expected.Pc
+		}
+	}
+	l.divergence = &Divergence{Cycle: l.ctx.Cycle, Pc: pc, Expected: expected, Actual: actual}
+	panic(lockstepAbort{})
+}
+
+// step executes the next instruction of the reference model, it returns false
+// once the application has terminated.
+func (l *lockstep) step() bool {
+	pc, exe, ok, err := l.ref.Step()
+	if err != nil {
+		l.err = fmt.Errorf("reference model: %w", err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+	l.pending = append(l.pending, Retirement{Pc: pc, Execution: exe})
+	return true
+}
@@ -0,0 +1,136 @@
+package proc_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teivah/majorana/proc"
+	_ "github.com/teivah/majorana/proc/all"
+	"github.com/teivah/majorana/risc"
+	"github.com/teivah/majorana/test"
+)
+
+func TestRunLockstep(t *testing.T) {
+	withString := func(ctx *risc.Context) {
+		// String of 32 bytes at 512
+		for i := 0; i < 32; i++ {
+			ctx.Memory[512+i] = '1'
+		}
+	}
+	programs := []struct {
+		name         string
+		instructions string
+		init         func(ctx *risc.Context)
+	}{
+		{"factorial", test.ReadFile(t, "../res/factorial.asm"), func(ctx *risc.Context) {
+			ctx.Memory[0] = 5
+		}},
+		{"prime number", test.ReadFile(t, "../res/prime-number.asm"), func(ctx *risc.Context) {
+			ctx.Memory[0] = 97
+		}},
+		{"prime number 2", test.ReadFile(t, "../res/prime-number-2.asm"), func(ctx *risc.Context) {
+			ctx.Memory[0] = 91
+		}},
+		{"print number", test.ReadFile(t, "../res/print-number.asm"), func(ctx *risc.Context) {
+			ctx.Memory[0] = 123
+		}},
+		{"sum of array", fmt.Sprintf(test.ReadFile(t, "../res/array-sum.asm"), 32), func(ctx *risc.Context) {
+			for i := 0; i < 32; i++ {
+				ctx.Memory[512+4*i] = int8(i)
+			}
+			ctx.Registers[risc.A0] = 512
+			ctx.Registers[risc.A1] = 32
+		}},
+		{"string copy", test.ReadFile(t, "../res/string-copy.asm"), func(ctx *risc.Context) {
+			withString(ctx)
+			ctx.Registers[risc.A0] = 640
+			ctx.Registers[risc.A1] = 512
+			ctx.Registers[risc.A2] = 40
+		}},
+		{"string length", test.ReadFile(t, "../res/string-length.asm"), func(ctx *risc.Context) {
+			withString(ctx)
+			ctx.Registers[risc.A0] = 512
+		}},
+		{"unsigned max", test.ReadFile(t, "../res/unsigned-max.asm"), func(*risc.Context) {}},
+		{"data sum", test.ReadFile(t, "../res/data-sum.asm"), func(*risc.Context) {}},
+	}
+	for _, program := range programs {
+		app, err := risc.Parse(program.instructions)
+		require.NoError(t, err)
+		for _, name := range proc.Names() {
+			t.Run(program.name+"/"+name, func(t *testing.T) {
+				m, err := proc.New(name, proc.Options{MemoryBytes: 1024})
+				require.NoError(t, err)
+				program.init(m.Context())
+				_, err = proc.RunLockstep(m, app)
+				require.NoError(t, err)
+			})
+		}
+	}
+}
+
+// faultyMachine alters the instructions retired by a Machine.
+type faultyMachine struct {
+	proc.Machine
+	alter func(n int, pc int32, exe risc.Execution) (risc.Execution, bool)
+}
+
+func (m faultyMachine) Run(app risc.Application) (int, error) {
+	ctx := m.Context()
+	retired := ctx.Retired
+	n := 0
+	ctx.Retired = func(pc int32, exe risc.Execution) {
+		n++
+		if exe, ok := m.alter(n, pc, exe); ok {
+			retired(pc, exe)
+		}
+	}
+	return m.Machine.Run(app)
+}
+
+func TestRunLockstepDivergence(t *testing.T) {
+	app, err := risc.Parse(test.ReadFile(t, "../res/factorial.asm"))
+	require.NoError(t, err)
+	newMachine := func(alter func(n int, pc int32, exe risc.Execution) (risc.Execution, bool)) proc.Machine {
+		m, err := proc.New("mvp6-1", proc.Options{MemoryBytes: 256})
+		require.NoError(t, err)
+		m.Context().Memory[0] = 5
+		return faultyMachine{Machine: m, alter: alter}
+	}
+
+	t.Run("register", func(t *testing.T) {
+		m := newMachine(func(n int, pc int32, exe risc.Execution) (risc.Execution, bool) {
+			if n == 3 {
+				exe.RegisterValue++
+			}
+			return exe, true
+		})
+		_, err := proc.RunLockstep(m, app)
+		var divergence *proc.Divergence
+		require.True(t, errors.As(err, &divergence), err)
+		require.NotNil(t, divergence.Expected)
+		require.NotNil(t, divergence.Actual)
+		assert.Equal(t, divergence.Expected.Pc, divergence.Actual.Pc)
+		assert.Equal(t, divergence.Expected.Execution.RegisterValue+1, divergence.Actual.Execution.RegisterValue)
+		assert.Greater(t, divergence.Cycle, 0)
+		assert.True(t, strings.HasPrefix(err.Error(), "divergence at cycle "), err.Error())
+	})
+
+	t.Run("pc", func(t *testing.T) {
+		m := newMachine(func(n int, pc int32, exe risc.Execution) (risc.Execution, bool) {
+			if n == 3 {
+				return exe, false
+			}
+			return exe, true
+		})
+		_, err := proc.RunLockstep(m, app)
+		var divergence *proc.Divergence
+		require.True(t, errors.As(err, &divergence), err)
+		require.NotNil(t, divergence.Expected)
+		assert.Nil(t, divergence.Actual)
+	})
+}
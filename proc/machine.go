@@ -0,0 +1,360 @@
+// Package proc defines the virtual processors interface and the registry of
+// the microarchitectures. The microarchitectures register themselves when
+// their package is imported, proc/all imports all of them.
+package proc
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"math/bits"
+	"sort"
+	"time"
+
+	"github.com/teivah/majorana/common/trace"
+	"github.com/teivah/majorana/proc/comp"
+	"github.com/teivah/majorana/risc"
+)
+
+// DefaultClockFrequency is the clock frequency of an Apple M1 performance
+// core, in Hz.
+const DefaultClockFrequency = 3_200_000_000
+
+// cacheLineSize is the cache line size shared by the microarchitectures.
+const cacheLineSize = 64
+
+// DefaultL2Latency and DefaultL3Latency are the number of cycles of an access
+// to the L2 and the L3.
+const (
+	DefaultL2Latency = 8
+	DefaultL3Latency = 20
+)
+
+// Machine is a virtual processor running RISC-V applications.
+type Machine interface {
+	// Run runs the application and returns the number of cycles.
+	Run(app risc.Application) (int, error)
+	Context() *risc.Context
+	// ExitCode returns the code the application passed to the exit system
+	// call, 0 if it returned instead.
+	ExitCode() int32
+	// Stats returns the performance counters.
+	Stats() PerfCounters
+}
+
+// Options configures a Machine. The zero value of each option means the
+// default of the microarchitecture, except for MemoryBytes.
+type Options struct {
+	// MemoryBytes is the size of the main memory. It has no default: 0 means
+	// no memory, enough only for the applications which don't access it.
+	MemoryBytes int
+	// Debug receives the debug traces, they are disabled if nil.
+	Debug io.Writer
+	// Tracer receives the events of the units at each cycle, they are
+	// disabled if nil.
+	Tracer trace.Tracer
+	// L1ICacheSize and L1DCacheSize are the sizes of the caches in bytes,
+	// ignored by the microarchitectures without such caches.
+	L1ICacheSize int
+	L1DCacheSize int
+	// L1Associativity is the number of lines per set of the L1 caches, a
+	// power of two, fully associative if 0.
+	L1Associativity int
+	// L1Replacement is the replacement policy of the L1 caches.
+	L1Replacement comp.ReplacementPolicy
+	// L1DWritePolicy is the write policy of the L1D, write-back by default.
+	L1DWritePolicy comp.WritePolicy
+	// L1DNoWriteAllocate writes a store missing the L1D directly to the
+	// memory instead of fetching its lines first.
+	L1DNoWriteAllocate bool
+	// L1IPrefetch and L1DPrefetch are the prefetchers of the L1 caches, none
+	// by default. They are ignored by the microarchitectures without MMU.
+	L1IPrefetch comp.PrefetchPolicy
+	L1DPrefetch comp.PrefetchPolicy
+	// PrefetchDegree is the number of lines prefetched ahead, 1 if 0.
+	PrefetchDegree int
+	// L2 and L3 are the unified caches between the L1 caches and the memory,
+	// the L3 requires an L2. They are ignored by the microarchitectures
+	// without MMU.
+	L2 CacheLevelOptions
+	L3 CacheLevelOptions
+	// DRAM is the main memory of the microarchitectures with an MMU,
+	// comp.DefaultDRAM if zero.
+	DRAM comp.DRAMConfig
+	// MemoryLatency replaces the DRAM by a memory with a flat latency in
+	// cycles if set.
+	MemoryLatency int
+	// BranchPrediction is the direction predictor of the conditional branches,
+	// not taken by default. It is ignored by the microarchitectures without
+	// branch unit.
+	BranchPrediction comp.PredictorPolicy
+	// BTB is the branch target buffer of the microarchitectures with a branch
+	// unit, comp.DefaultBTB if zero.
+	BTB comp.BTBConfig
+	// ReturnAddressStackSize is the number of return addresses of the return
+	// address stack predicting the returns,
+	// comp.DefaultReturnAddressStackSize if 0. It is ignored by the
+	// microarchitectures without branch unit.
+	ReturnAddressStackSize int
+	// ExecuteUnits is the number of execute units of MVP-6.1, 2 if 0. It is
+	// ignored by the other microarchitectures.
+	ExecuteUnits int
+	// Speculation configures the execution past the predicted branches of
+	// MVP-6.0 and MVP-6.1.
+	Speculation SpeculationOptions
+	// ClockFrequency is the clock frequency in Hz, DefaultClockFrequency if
+	// not set.
+	ClockFrequency int64
+}
+
+// CacheLevelOptions configures a cache between the L1 caches and the memory,
+// with the cache line of the L1 caches.
+type CacheLevelOptions struct {
+	// Size is the size in bytes, no such cache if 0.
+	Size int
+	// Latency is the number of cycles of an access, the default of the level
+	// if 0.
+	Latency int
+	// Associativity is the number of lines per set, a power of two, fully
+	// associative if 0.
+	Associativity int
+	Replacement   comp.ReplacementPolicy
+	Write         comp.WritePolicy
+}
+
+func (c CacheLevelOptions) config() comp.CacheConfig {
+	return comp.CacheConfig{
+		Size:          c.Size,
+		LineSize:      cacheLineSize,
+		Associativity: min(c.Associativity, c.Size/cacheLineSize),
+		Policy:        c.Replacement,
+		Write:         c.Write,
+	}
+}
+
+func (c CacheLevelOptions) validate(name string) error {
+	if c.Size < 0 || c.Size%cacheLineSize != 0 {
+		return fmt.Errorf("%s size %d isn't a multiple of the %d bytes cache line", name, c.Size, cacheLineSize)
+	}
+	if c.Latency < 0 {
+		return fmt.Errorf("negative %s latency %d", name, c.Latency)
+	}
+	if c.Associativity < 0 || c.Associativity != 0 && bits.OnesCount(uint(c.Associativity)) != 1 {
+		return fmt.Errorf("%s associativity %d isn't a power of two", name, c.Associativity)
+	}
+	if c.Size == 0 {
+		return nil
+	}
+	return c.config().Validate()
+}
+
+// SpeculationOptions configures how far the instructions after a predicted
+// branch are executed before it is resolved, and the mitigations of the side
+// channels left by the ones discarded.
+type SpeculationOptions struct {
+	// Deep writes the registers of the speculative instructions right away,
+	// restoring them if discarded, so that the instructions depending on them
+	// are executed speculatively too. It is ignored by MVP-6.0, dispatching
+	// in order.
+	Deep bool
+	// LoadBarrier stalls the speculative loads until the branches predicted
+	// before them are resolved, as a speculation barrier after each branch.
+	LoadBarrier bool
+	// NoSpeculativeFill reads the lines missed by the speculative loads from
+	// the lower levels without caching them in the L1D.
+	NoSpeculativeFill bool
+}
+
+// NewContext creates the context of a machine.
+func (o Options) NewContext() *risc.Context {
+	ctx := risc.NewContext(o.Debug != nil, o.MemoryBytes)
+	if o.Debug != nil {
+		ctx.DebugWriter = o.Debug
+	}
+	ctx.Tracer = o.Tracer
+	return ctx
+}
+
+// L1ICache returns the configuration of the L1I of a microarchitecture from
+// its default size.
+func (o Options) L1ICache(defaultSize int) comp.CacheConfig {
+	return o.l1Cache(cmp.Or(o.L1ICacheSize, defaultSize))
+}
+
+// L1DCache returns the configuration of the L1D of a microarchitecture from
+// its default size.
+func (o Options) L1DCache(defaultSize int) comp.CacheConfig {
+	config := o.l1Cache(cmp.Or(o.L1DCacheSize, defaultSize))
+	config.Write = o.L1DWritePolicy
+	config.NoWriteAllocate = o.L1DNoWriteAllocate
+	return config
+}
+
+func (o Options) l1Cache(size int) comp.CacheConfig {
+	return comp.CacheConfig{
+		Size:     size,
+		LineSize: cacheLineSize,
+		// Fully associative if there are fewer lines than ways
+		Associativity: min(o.L1Associativity, size/cacheLineSize),
+		Policy:        o.L1Replacement,
+	}
+}
+
+// L1IPrefetcher returns the prefetcher of the L1I, nil without prefetch.
+func (o Options) L1IPrefetcher() comp.Prefetcher {
+	return comp.NewPrefetcher(o.L1IPrefetch, cacheLineSize, cmp.Or(o.PrefetchDegree, 1))
+}
+
+// L1DPrefetcher returns the prefetcher of the L1D, nil without prefetch.
+func (o Options) L1DPrefetcher() comp.Prefetcher {
+	return comp.NewPrefetcher(o.L1DPrefetch, cacheLineSize, cmp.Or(o.PrefetchDegree, 1))
+}
+
+// BranchPredictor returns the direction predictor of the conditional
+// branches.
+func (o Options) BranchPredictor() comp.BranchPredictor {
+	return comp.NewBranchPredictor(o.BranchPrediction)
+}
+
+// BranchTargetBuffer returns the branch target buffer of the microarchitectures
+// with a branch unit.
+func (o Options) BranchTargetBuffer() *comp.BranchTargetBuffer {
+	if o.BTB == (comp.BTBConfig{}) {
+		return comp.NewBranchTargetBuffer(comp.DefaultBTB)
+	}
+	return comp.NewBranchTargetBuffer(o.BTB)
+}
+
+// ReturnAddressStack returns the return address stack predicting the
+// returns.
+func (o Options) ReturnAddressStack() *comp.ReturnAddressStack {
+	return comp.NewReturnAddressStack(cmp.Or(o.ReturnAddressStackSize, comp.DefaultReturnAddressStackSize))
+}
+
+// MemoryHierarchy returns the levels below the L1 caches of a
+// microarchitecture: the L2 and the L3 if configured, backed by the DRAM
+// storing its data in memory. The memory is used directly if MemoryLatency is
+// set.
+func (o Options) MemoryHierarchy(memory *comp.Memory) comp.MemoryLevel {
+	var next comp.MemoryLevel = memory
+	if o.MemoryLatency == 0 {
+		next = comp.NewDRAM(o.dram(), memory)
+	}
+	if o.L3.Size != 0 {
+		next = comp.NewCacheLevel(o.L3.config(), cmp.Or(o.L3.Latency, DefaultL3Latency), next)
+	}
+	if o.L2.Size != 0 {
+		next = comp.NewCacheLevel(o.L2.config(), cmp.Or(o.L2.Latency, DefaultL2Latency), next)
+	}
+	return next
+}
+
+func (o Options) dram() comp.DRAMConfig {
+	if o.DRAM == (comp.DRAMConfig{}) {
+		return comp.DefaultDRAM
+	}
+	return o.DRAM
+}
+
+// Duration converts a number of cycles into a duration at the clock
+// frequency.
+func (o Options) Duration(cycles int) time.Duration {
+	frequency := cmp.Or(o.ClockFrequency, DefaultClockFrequency)
+	return time.Duration(float64(cycles) / float64(frequency) * float64(time.Second))
+}
+
+func (o Options) validate() error {
+	if o.MemoryBytes < 0 {
+		return fmt.Errorf("negative memory size %d", o.MemoryBytes)
+	}
+	if o.L1ICacheSize < 0 || o.L1ICacheSize%cacheLineSize != 0 {
+		return fmt.Errorf("L1I size %d isn't a multiple of the %d bytes cache line", o.L1ICacheSize, cacheLineSize)
+	}
+	if o.L1DCacheSize < 0 || o.L1DCacheSize%cacheLineSize != 0 {
+		return fmt.Errorf("L1D size %d isn't a multiple of the %d bytes cache line", o.L1DCacheSize, cacheLineSize)
+	}
+	if o.L1Associativity < 0 || o.L1Associativity != 0 && bits.OnesCount(uint(o.L1Associativity)) != 1 {
+		return fmt.Errorf("L1 associativity %d isn't a power of two", o.L1Associativity)
+	}
+	// Checked with a single line if the size is the default of the
+	// microarchitecture
+	for _, config := range []comp.CacheConfig{o.L1ICache(cacheLineSize), o.L1DCache(cacheLineSize)} {
+		if err := config.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, policy := range []comp.PrefetchPolicy{o.L1IPrefetch, o.L1DPrefetch} {
+		if policy < comp.NoPrefetch || policy > comp.Stream {
+			return fmt.Errorf("unknown prefetch policy %v", policy)
+		}
+	}
+	if o.PrefetchDegree < 0 {
+		return fmt.Errorf("negative prefetch degree %d", o.PrefetchDegree)
+	}
+	if o.BranchPrediction < comp.NotTaken || o.BranchPrediction > comp.Tournament {
+		return fmt.Errorf("unknown branch predictor %v", o.BranchPrediction)
+	}
+	if o.BTB != (comp.BTBConfig{}) {
+		if err := o.BTB.Validate(); err != nil {
+			return err
+		}
+	}
+	if o.ExecuteUnits < 0 {
+		return fmt.Errorf("negative number of execute units %d", o.ExecuteUnits)
+	}
+	if o.ReturnAddressStackSize < 0 {
+		return fmt.Errorf("negative return address stack size %d", o.ReturnAddressStackSize)
+	}
+	if err := o.L2.validate("L2"); err != nil {
+		return err
+	}
+	if err := o.L3.validate("L3"); err != nil {
+		return err
+	}
+	if o.L3.Size != 0 && o.L2.Size == 0 {
+		return fmt.Errorf("L3 without L2")
+	}
+	if err := o.dram().Validate(); err != nil {
+		return err
+	}
+	if o.MemoryLatency < 0 {
+		return fmt.Errorf("negative memory latency %d", o.MemoryLatency)
+	}
+	if o.ClockFrequency < 0 {
+		return fmt.Errorf("negative clock frequency %d", o.ClockFrequency)
+	}
+	return nil
+}
+
+var factories = make(map[string]func(Options) Machine)
+
+// Register makes a microarchitecture available by name. It panics if the name
+// is already registered.
+func Register(name string, factory func(Options) Machine) {
+	if _, exists := factories[name]; exists {
+		panic(fmt.Sprintf("microarchitecture %s registered twice", name))
+	}
+	factories[name] = factory
+}
+
+// New creates a machine of the named microarchitecture.
+func New(name string, opts Options) (Machine, error) {
+	factory, exists := factories[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown microarchitecture %q", name)
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	return factory(opts), nil
+}
+
+// Names returns the sorted names of the registered microarchitectures.
+func Names() []string {
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
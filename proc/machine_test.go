@@ -0,0 +1,548 @@
+package proc_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teivah/majorana/common/trace"
+	"github.com/teivah/majorana/proc"
+	_ "github.com/teivah/majorana/proc/all"
+	"github.com/teivah/majorana/proc/comp"
+	"github.com/teivah/majorana/risc"
+	"github.com/teivah/majorana/test"
+)
+
+func TestNames(t *testing.T) {
+	assert.Equal(t, []string{"mvp1", "mvp2", "mvp3", "mvp4", "mvp5", "mvp6-0", "mvp6-1"}, proc.Names())
+}
+
+func TestNew(t *testing.T) {
+	app, err := risc.Parse(test.ReadFile(t, "../res/factorial.asm"))
+	require.NoError(t, err)
+	for _, name := range proc.Names() {
+		t.Run(name, func(t *testing.T) {
+			var debug bytes.Buffer
+			m, err := proc.New(name, proc.Options{
+				MemoryBytes:  256,
+				Debug:        &debug,
+				L1ICacheSize: 128,
+				L1DCacheSize: 128,
+			})
+			require.NoError(t, err)
+			m.Context().Memory[0] = 5
+			_, err = m.Run(app)
+			require.NoError(t, err)
+			assert.Equal(t, int8(120), m.Context().Memory[4])
+			assert.NotEmpty(t, debug.String())
+			// The traces of the instructions too
+			assert.Contains(t, debug.String(), "Run: Lw")
+		})
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	_, err := proc.New("mvp7", proc.Options{})
+	assert.Error(t, err)
+	_, err = proc.New("mvp3", proc.Options{L1DCacheSize: 100})
+	assert.Error(t, err)
+	_, err = proc.New("mvp3", proc.Options{MemoryBytes: -1})
+	assert.Error(t, err)
+	_, err = proc.New("mvp6-1", proc.Options{ExecuteUnits: -1})
+	assert.Error(t, err)
+	_, err = proc.New("mvp3", proc.Options{L2: proc.CacheLevelOptions{Size: 100}})
+	assert.Error(t, err)
+	_, err = proc.New("mvp3", proc.Options{L2: proc.CacheLevelOptions{Size: 1024, Associativity: 3}})
+	assert.Error(t, err)
+	_, err = proc.New("mvp3", proc.Options{L2: proc.CacheLevelOptions{Size: 1024, Latency: -1}})
+	assert.Error(t, err)
+	_, err = proc.New("mvp3", proc.Options{L3: proc.CacheLevelOptions{Size: 1024}})
+	assert.Error(t, err)
+	_, err = proc.New("mvp3", proc.Options{L1DPrefetch: comp.PrefetchPolicy(-1)})
+	assert.Error(t, err)
+	_, err = proc.New("mvp3", proc.Options{PrefetchDegree: -1})
+	assert.Error(t, err)
+	_, err = proc.New("mvp5", proc.Options{BranchPrediction: comp.Tournament + 1})
+	assert.Error(t, err)
+	_, err = proc.New("mvp6-1", proc.Options{ReturnAddressStackSize: -1})
+	assert.Error(t, err)
+	_, err = proc.New("mvp6-1", proc.Options{BTB: comp.BTBConfig{Entries: 3, Ways: 1}})
+	assert.Error(t, err)
+}
+
+func TestDuration(t *testing.T) {
+	assert.Equal(t, time.Second, proc.Options{}.Duration(proc.DefaultClockFrequency))
+	assert.Equal(t, 2*time.Microsecond, proc.Options{ClockFrequency: 1_000_000}.Duration(2))
+}
+
+func TestTrace(t *testing.T) {
+	app, err := risc.Parse(test.ReadFile(t, "../res/factorial.asm"))
+	require.NoError(t, err)
+	for _, name := range proc.Names() {
+		t.Run(name, func(t *testing.T) {
+			recorder := &trace.Recorder{}
+			m, err := proc.New(name, proc.Options{MemoryBytes: 256, Tracer: recorder})
+			require.NoError(t, err)
+			m.Context().Memory[0] = 5
+			cycles, err := m.Run(app)
+			require.NoError(t, err)
+
+			kinds := make(map[trace.Kind]bool)
+			fetched := make(map[int32]bool)
+			previous := 0
+			for _, e := range recorder.Events {
+				kinds[e.Kind] = true
+				assert.GreaterOrEqual(t, e.Cycle, previous, "%+v", e)
+				assert.LessOrEqual(t, e.Cycle, cycles, "%+v", e)
+				previous = e.Cycle
+				switch e.Kind {
+				case trace.Fetch:
+					fetched[e.Pc] = true
+				case trace.Execute:
+					assert.True(t, fetched[e.Pc], "%+v executed before being fetched", e)
+					assert.NotEmpty(t, e.Instruction)
+				case trace.Stall:
+					assert.NotEmpty(t, e.Reason)
+				}
+			}
+			for _, kind := range []trace.Kind{trace.Fetch, trace.Decode, trace.Execute, trace.Writeback} {
+				assert.True(t, kinds[kind], "missing %s events", kind)
+			}
+		})
+	}
+}
+
+func TestTraceJSONLines(t *testing.T) {
+	app, err := risc.Parse(test.ReadFile(t, "../res/factorial.asm"))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	tracer := trace.NewJSONLines(&buf)
+	m, err := proc.New("mvp6-1", proc.Options{MemoryBytes: 256, Tracer: tracer})
+	require.NoError(t, err)
+	m.Context().Memory[0] = 5
+	_, err = m.Run(app)
+	require.NoError(t, err)
+	require.NoError(t, tracer.Err())
+
+	units := make(map[string]bool)
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var e trace.Event
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e), scanner.Text())
+		units[e.Unit] = true
+	}
+	for _, unit := range []string{"FU", "DU", "CU", "EU0", "EU1", "WU0", "WU1", "MMU"} {
+		assert.True(t, units[unit], "missing %s events", unit)
+	}
+}
+
+func TestKanata(t *testing.T) {
+	app, err := risc.Parse(test.ReadFile(t, "../res/factorial.asm"))
+	require.NoError(t, err)
+	for _, name := range proc.Names() {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			kanata := trace.NewKanata(&buf)
+			m, err := proc.New(name, proc.Options{MemoryBytes: 256, Tracer: kanata})
+			require.NoError(t, err)
+			m.Context().Memory[0] = 5
+			_, err = m.Run(app)
+			require.NoError(t, err)
+			require.NoError(t, kanata.Close())
+
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			require.Equal(t, "Kanata\t0004", lines[0])
+			require.True(t, strings.HasPrefix(lines[1], "C=\t"), lines[1])
+			created := make(map[string]bool)
+			retired := make(map[string]bool)
+			flushed := 0
+			for _, line := range lines[2:] {
+				fields := strings.Split(line, "\t")
+				switch fields[0] {
+				case "I":
+					created[fields[1]] = true
+				case "L", "S":
+					assert.True(t, created[fields[1]] && !retired[fields[1]], line)
+				case "R":
+					assert.True(t, created[fields[1]] && !retired[fields[1]], line)
+					retired[fields[1]] = true
+					if fields[3] == "1" {
+						flushed++
+					}
+				case "C":
+				default:
+					t.Errorf("unexpected command: %s", line)
+				}
+			}
+			assert.NotEmpty(t, created)
+			assert.Equal(t, created, retired)
+			if name != "mvp1" && name != "mvp2" && name != "mvp3" {
+				assert.NotZero(t, flushed)
+			}
+		})
+	}
+}
+
+// withMMU are the machines with an MMU, withBranchUnit the ones predicting the
+// branches.
+var (
+	withMMU        = []string{"mvp3", "mvp4", "mvp5", "mvp6-0", "mvp6-1"}
+	withBranchUnit = []string{"mvp5", "mvp6-0", "mvp6-1"}
+)
+
+// runEach runs the instructions in lockstep on a new machine of each of names,
+// in a subtest named after the machine, and calls check with the machine and
+// the number of cycles. The memory is 1 KB unless set in opts.
+func runEach(t *testing.T, names []string, opts proc.Options, instructions string, check func(t *testing.T, name string, m proc.Machine, cycles int)) {
+	app, err := risc.Parse(instructions)
+	require.NoError(t, err)
+	if opts.MemoryBytes == 0 {
+		opts.MemoryBytes = 1024
+	}
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) {
+			m, err := proc.New(name, opts)
+			require.NoError(t, err)
+			cycles, err := proc.RunLockstep(m, app)
+			require.NoError(t, err)
+			check(t, name, m, cycles)
+		})
+	}
+}
+
+func TestL1DWritePolicies(t *testing.T) {
+	// A store missing the L1D, a load and a store hitting it for each of the
+	// 8 lines, more than the 2 lines of the L1D
+	program := `
+    li t0, 8
+    li t1, 0
+L1:
+    sw t0, 0(t1)
+    lw t2, 0(t1)
+    sw t2, 4(t1)
+    addi t1, t1, 64
+    addi t0, t0, -1
+    bnez t0, L1`
+	policies := map[string]struct {
+		opts proc.Options
+		// Memory accesses charged to the stores and to the loads missing the
+		// L1D, including the dirty lines evicted
+		writes, reads int
+	}{
+		// 8 lines allocated, 6 dirty lines evicted
+		"write-back": {proc.Options{}, 14, 0},
+		// 8 stores written to the memory, 8 lines fetched by the loads and 6
+		// dirty lines evicted
+		"write-back no-write-allocate": {proc.Options{L1DNoWriteAllocate: true}, 8, 14},
+		// 8 lines allocated, 16 stores written through
+		"write-through": {proc.Options{L1DWritePolicy: comp.WriteThrough}, 24, 0},
+		// 8 stores written to the memory and 8 written through, 8 lines
+		// fetched by the loads
+		"write-through no-write-allocate": {proc.Options{L1DWritePolicy: comp.WriteThrough, L1DNoWriteAllocate: true}, 16, 8},
+	}
+	// A store across two lines, only the first one being cached, and a load
+	// of the first line
+	misaligned := `
+    li t0, 0x01020304
+    lw t1, 0(zero)
+    sw t0, 62(zero)
+    lw t2, 60(zero)`
+	for policy, tc := range policies {
+		t.Run(policy, func(t *testing.T) {
+			opts := tc.opts
+			opts.L1DCacheSize = 128
+			// A flat memory latency instead of the DRAM
+			opts.MemoryLatency = 50
+			runEach(t, proc.Names(), opts, program, func(t *testing.T, name string, m proc.Machine, _ int) {
+				// Including the dirty lines written back once flushed
+				for i := 0; i < 8; i++ {
+					assert.Equal(t, int8(8-i), m.Context().Memory[64*i], i)
+					assert.Equal(t, int8(8-i), m.Context().Memory[64*i+4], i)
+				}
+				if name == "mvp1" || name == "mvp2" {
+					return
+				}
+				perf := m.Stats()
+				assert.Equal(t, tc.writes*opts.MemoryLatency, perf.Stalls[proc.StallMemoryWrite])
+				assert.Equal(t, tc.reads*opts.MemoryLatency, perf.Stalls[proc.StallL1DMiss])
+			})
+			t.Run("misaligned", func(t *testing.T) {
+				runEach(t, proc.Names(), opts, misaligned, func(t *testing.T, _ string, m proc.Machine, _ int) {
+					assert.Equal(t, int32(0x03040000), m.Context().Registers[risc.T2])
+					assert.Equal(t, []int8{4, 3, 2, 1}, m.Context().Memory[62:66])
+				})
+			})
+		})
+	}
+}
+
+func TestMemoryHierarchy(t *testing.T) {
+	// The lines of the second pass were evicted from the L1D but are still
+	// in the L2
+	program := `
+    li t3, 2
+L0:
+    li t0, 8
+    li t1, 0
+L1:
+    sw t0, 0(t1)
+    lw t2, 0(t1)
+    sw t2, 4(t1)
+    addi t1, t1, 64
+    addi t0, t0, -1
+    bnez t0, L1
+    addi t3, t3, -1
+    bnez t3, L0`
+	hierarchies := map[string]proc.Options{
+		"L2": {L2: proc.CacheLevelOptions{Size: 1024}},
+		"L2 and L3": {
+			L2: proc.CacheLevelOptions{Size: 256, Associativity: 2},
+			L3: proc.CacheLevelOptions{Size: 1024, Latency: 10, Replacement: comp.FIFO},
+		},
+	}
+	opts := proc.Options{L1DCacheSize: 128, MemoryLatency: 50}
+	flat := make(map[string]int)
+	runEach(t, withMMU, opts, program, func(t *testing.T, name string, m proc.Machine, cycles int) {
+		flat[name] = cycles
+		assert.Zero(t, m.Stats().L2)
+	})
+	for hierarchy, levels := range hierarchies {
+		t.Run(hierarchy, func(t *testing.T) {
+			opts.L2, opts.L3 = levels.L2, levels.L3
+			runEach(t, withMMU, opts, program, func(t *testing.T, name string, m proc.Machine, cycles int) {
+				// The dirty lines are flushed down to the memory
+				for i := 0; i < 8; i++ {
+					assert.Equal(t, int8(8-i), m.Context().Memory[64*i], i)
+					assert.Equal(t, int8(8-i), m.Context().Memory[64*i+4], i)
+				}
+				assert.Less(t, cycles, flat[name])
+				perf := m.Stats()
+				// The 8 lines of the second pass and the code line
+				assert.GreaterOrEqual(t, perf.L2.Hits+perf.L3.Hits, 8)
+				assert.GreaterOrEqual(t, perf.L2.Misses, 9)
+			})
+		})
+	}
+}
+
+func TestDRAM(t *testing.T) {
+	// 32 loads stride bytes apart
+	program := func(stride int) string {
+		return fmt.Sprintf(`
+    li a0, %d
+    li t0, 32
+    li t1, 0
+L1:
+    lw t2, 0(t1)
+    add t1, t1, a0
+    addi t0, t0, -1
+    bnez t0, L1`, stride)
+	}
+	// The consecutive rows of a bank
+	bankStride := comp.DefaultDRAM.Banks * comp.DefaultDRAM.RowSize
+	opts := proc.Options{MemoryBytes: 32 * bankStride}
+	// Consecutive lines in the same row, and lines in the same bank but in
+	// different rows
+	sequential := make(map[string]int)
+	sequentialPerf := make(map[string]proc.PerfCounters)
+	runEach(t, withMMU, opts, program(64), func(t *testing.T, name string, m proc.Machine, cycles int) {
+		sequential[name], sequentialPerf[name] = cycles, m.Stats()
+	})
+	runEach(t, withMMU, opts, program(bankStride), func(t *testing.T, name string, m proc.Machine, cycles int) {
+		perf := m.Stats()
+		assert.Less(t, sequential[name], cycles)
+		assert.Greater(t, sequentialPerf[name].DRAM.RowHits, perf.DRAM.RowHits)
+		assert.GreaterOrEqual(t, perf.DRAM.RowConflicts, 31)
+	})
+}
+
+func TestPrefetch(t *testing.T) {
+	// 256 loads 4 bytes apart
+	program := `
+    li t0, 256
+    li t1, 0
+L1:
+    lw t2, 0(t1)
+    add t3, t3, t2
+    addi t1, t1, 4
+    addi t0, t0, -1
+    bnez t0, L1`
+	none := make(map[string]int)
+	stalls := make(map[string]int)
+	runEach(t, withMMU, proc.Options{}, program, func(t *testing.T, name string, m proc.Machine, cycles int) {
+		none[name], stalls[name] = cycles, m.Stats().Stalls[proc.StallL1DMiss]
+		assert.Zero(t, m.Stats().L1DPrefetch)
+	})
+	for _, policy := range []comp.PrefetchPolicy{comp.NextLine, comp.Stride, comp.Stream} {
+		t.Run(policy.String(), func(t *testing.T) {
+			opts := proc.Options{
+				L1IPrefetch:    comp.NextLine,
+				L1DPrefetch:    policy,
+				PrefetchDegree: 2,
+			}
+			runEach(t, withMMU, opts, program, func(t *testing.T, name string, m proc.Machine, cycles int) {
+				assert.Less(t, cycles, none[name])
+				perf := m.Stats()
+				assert.Less(t, perf.Stalls[proc.StallL1DMiss], stalls[name]/2)
+				// The 16 lines but the first ones, until the stride or the
+				// stream is detected, and the lines after the array
+				assert.GreaterOrEqual(t, perf.L1DPrefetch.Useful+perf.L1DPrefetch.Late, 14)
+				assert.Greater(t, perf.L1DPrefetch.Accuracy(), 0.8)
+				assert.NotZero(t, perf.L1IPrefetch.Issued)
+			})
+		})
+	}
+}
+
+func TestBranchPrediction(t *testing.T) {
+	// A backward branch taken 255 times out of 256 and a forward one taken
+	// every other iteration
+	program := `
+    li t0, 256
+    li t1, 0
+L1:
+    lw t2, 0(t1)
+    add t3, t3, t2
+    andi t4, t0, 1
+    beqz t4, L2
+    addi t1, t1, 4
+L2:
+    addi t0, t0, -1
+    bnez t0, L1`
+	mispredictions := make(map[string]map[comp.PredictorPolicy]int)
+	cycles := make(map[string]map[comp.PredictorPolicy]int)
+	for _, name := range withBranchUnit {
+		mispredictions[name] = make(map[comp.PredictorPolicy]int)
+		cycles[name] = make(map[comp.PredictorPolicy]int)
+	}
+	for policy := comp.NotTaken; policy <= comp.Tournament; policy++ {
+		t.Run(policy.String(), func(t *testing.T) {
+			runEach(t, withBranchUnit, proc.Options{BranchPrediction: policy}, program, func(t *testing.T, name string, m proc.Machine, c int) {
+				perf := m.Stats()
+				assert.Equal(t, 512, perf.Branches.Predictions)
+				mispredictions[name][policy] = perf.Branches.Mispredictions
+				cycles[name][policy] = c
+			})
+		})
+	}
+	for _, name := range withBranchUnit {
+		mispredictions, cycles := mispredictions[name], cycles[name]
+		// Not taken mispredicts the backward branch and half of the forward
+		// one, taken and BTFN the other half, the bimodal counter of the
+		// forward branch oscillates. A branch predicted taken is also
+		// mispredicted the first time, its target missing the BTB.
+		assert.Equal(t, 255+128, mispredictions[comp.NotTaken], name)
+		assert.Equal(t, 1+128+2, mispredictions[comp.Taken], name)
+		assert.Equal(t, 1+128+1, mispredictions[comp.BTFN], name)
+		assert.Equal(t, 2+256, mispredictions[comp.Bimodal], name)
+		// The directions of the forward branch are learned from the history
+		assert.Less(t, mispredictions[comp.GShare], 16, name)
+		assert.Less(t, mispredictions[comp.Tournament], 16, name)
+		assert.Less(t, cycles[comp.Tournament], cycles[comp.BTFN], name)
+		assert.Less(t, cycles[comp.BTFN], cycles[comp.NotTaken], name)
+	}
+}
+
+func TestReturnAddressStack(t *testing.T) {
+	// A function called from two sites, one of them calling it again
+	program := `
+    li t0, 64
+loop:
+    call f
+    call g
+    addi t0, t0, -1
+    bnez t0, loop
+    j end
+f:
+    addi sp, sp, -4
+    sw ra, 0(sp)
+    call g
+    lw ra, 0(sp)
+    addi sp, sp, 4
+    ret
+g:
+    addi t1, t1, 1
+    ret
+end:`
+	cycles := make(map[string]int)
+	runEach(t, withBranchUnit, proc.Options{}, program, func(t *testing.T, name string, m proc.Machine, c int) {
+		cycles[name] = c
+		assert.Equal(t, proc.RASCounters{Hits: 3 * 64}, m.Stats().RAS)
+		assert.Equal(t, 1.0, m.Stats().RAS.HitRate())
+	})
+	// The return address of f is replaced by the one of g, its return isn't
+	// predicted
+	runEach(t, withBranchUnit, proc.Options{ReturnAddressStackSize: 1}, program, func(t *testing.T, name string, m proc.Machine, c int) {
+		assert.Equal(t, proc.RASCounters{Hits: 2 * 64, Underflows: 64, Overflows: 64}, m.Stats().RAS)
+		assert.Less(t, cycles[name], c)
+	})
+}
+
+func TestBranchTargetBuffer(t *testing.T) {
+	// Two jumps and a conditional branch taken in a loop
+	program := `
+    li t0, 64
+L1:
+    addi t1, t1, 1
+    j L2
+L3:
+    addi t0, t0, -1
+    bnez t0, L1
+    j end
+L2:
+    addi t2, t2, 1
+    j L3
+end:`
+	cycles := make(map[string]int)
+	runEach(t, withBranchUnit, proc.Options{BranchPrediction: comp.BTFN}, program, func(t *testing.T, name string, m proc.Machine, c int) {
+		cycles[name] = c
+		perf := m.Stats()
+		assert.Zero(t, perf.BTB.Aliases)
+		assert.Greater(t, perf.BTB.HitRate(), 0.9)
+		// The first iteration, with the target missing the BTB, and the exit
+		assert.Equal(t, 2, perf.Branches.Mispredictions)
+	})
+	// A single entry with 1-bit tags, the first jump and the conditional
+	// branch sharing their tag
+	opts := proc.Options{BranchPrediction: comp.BTFN, BTB: comp.BTBConfig{Entries: 1, TagBits: 1}}
+	runEach(t, withBranchUnit, opts, program, func(t *testing.T, name string, m proc.Machine, c int) {
+		perf := m.Stats()
+		assert.NotZero(t, perf.BTB.Aliases)
+		assert.Greater(t, perf.Branches.Mispredictions, 2)
+		assert.Less(t, cycles[name], c)
+	})
+}
+
+func TestSpeculation(t *testing.T) {
+	// The forward branch is always taken but predicted not taken, the store
+	// after it being only executed on the wrong path
+	program := `
+    li t0, 8
+    li t1, 42
+L1:
+    addi t0, t0, -1
+    bgez t0, L2
+    sw t1, 0(zero)
+L2:
+    sb t0, 4(t2)
+    addi t2, t2, 1
+    bnez t0, L1`
+	runEach(t, withBranchUnit, proc.Options{BranchPrediction: comp.BTFN}, program, func(t *testing.T, name string, m proc.Machine, _ int) {
+		assert.Equal(t, []int8{0, 0, 0, 0}, m.Context().Memory[:4])
+		assert.Equal(t, []int8{7, 6, 5, 4, 3, 2, 1, 0}, m.Context().Memory[4:12])
+		// Each forward branch, and the backward one the first time, its
+		// target missing the BTB, and at the exit
+		assert.Equal(t, 8+2, m.Stats().Branches.Mispredictions)
+		if name == "mvp6-0" {
+			// The store reaches an execute unit before the branch is
+			// resolved, it waits until discarded
+			assert.NotZero(t, m.Stats().Stalls[proc.StallSpeculation])
+		}
+	})
+}
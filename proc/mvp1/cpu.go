@@ -3,6 +3,9 @@ package mvp1
 import (
 	"fmt"
 
+	"github.com/teivah/majorana/common/log"
+	"github.com/teivah/majorana/common/trace"
+	"github.com/teivah/majorana/proc"
 	"github.com/teivah/majorana/risc"
 )
 
@@ -15,31 +18,58 @@ const (
 type CPU struct {
 	ctx   *risc.Context
 	cycle int
+
+	perf       *proc.PerfCounters
+	busy       map[string]int
+	stageStart int
 }
 
-func NewCPU(debug bool, memoryBytes int) *CPU {
+func NewCPU(opts proc.Options) *CPU {
 	return &CPU{
-		ctx: risc.NewContext(debug, memoryBytes),
+		ctx:  opts.NewContext(),
+		perf: proc.NewPerfCounters(),
+		busy: make(map[string]int),
 	}
 }
 
+func init() {
+	proc.Register("mvp1", func(opts proc.Options) proc.Machine {
+		return NewCPU(opts)
+	})
+}
+
 func (m *CPU) Context() *risc.Context {
 	return m.ctx
 }
 
+func (m *CPU) ExitCode() int32 {
+	return m.ctx.ExitCode
+}
+
 func (m *CPU) Run(app risc.Application) (int, error) {
-loop:
-	var pc int32
+	if err := m.ctx.Load(app); err != nil {
+		return 0, err
+	}
+	pc := app.Entry
 	for pc/4 < int32(len(app.Instructions)) {
 		nextPc := m.fetchInstruction(pc)
+		m.stage("FU")
+		log.Tracepc(m.ctx, "FU", trace.Fetch, pc)
 		r := m.decode(app, nextPc)
+		m.stage("DU")
+		log.Tracei(m.ctx, "DU", trace.Decode, r.InstructionType(), pc)
 		exe, ins, err := m.execute(app, r, nextPc)
 		if err != nil {
 			return 0, err
 		}
+		m.stage("EU")
+		log.Tracei(m.ctx, "EU", trace.Execute, ins, pc)
+		m.perf.Instructions++
+		m.ctx.Retire(pc, exe)
 		if exe.Return {
 			return m.cycle, nil
 		}
+		current := pc
 		if exe.PcChange {
 			pc = exe.NextPc
 		} else {
@@ -49,24 +79,37 @@ loop:
 		if exe.RegisterChange {
 			m.ctx.WriteRegister(exe)
 			if m.ctx.Debug {
-				fmt.Println(ins, m.ctx.Registers)
+				fmt.Fprintln(m.ctx.DebugWriter, ins, m.ctx.Registers)
 			}
 			m.cycle += cyclesRegisterAccess
 		} else if exe.MemoryChange {
 			m.ctx.WriteMemory(exe)
 			m.cycle += cyclesMemoryAccess
 		}
-	}
-	if m.ctx.Registers[risc.Ra] != 0 {
-		pc = m.ctx.Registers[risc.Ra]
-		m.ctx.Registers[risc.Ra] = 0
-		goto loop
+		m.stage("WU")
+		log.Tracei(m.ctx, "WU", trace.Writeback, ins, current)
 	}
 	return m.cycle, nil
 }
 
-func (m *CPU) Stats() map[string]any {
-	return nil
+// stage attributes the cycles elapsed since the previous stage to the unit
+// and sets the cycle of the next events.
+func (m *CPU) stage(unit string) {
+	m.busy[unit] += m.cycle - m.stageStart
+	m.stageStart = m.cycle
+	m.ctx.Cycle = m.cycle
+}
+
+func (m *CPU) Stats() proc.PerfCounters {
+	perf := *m.perf
+	perf.Cycles = m.cycle
+	perf.Utilization = make(map[string]float64, len(m.busy))
+	for unit, cycles := range m.busy {
+		if m.cycle != 0 {
+			perf.Utilization[unit] = float64(cycles) / float64(m.cycle)
+		}
+	}
+	return perf
 }
 
 func (m *CPU) fetchInstruction(pc int32) int32 {
@@ -1,8 +1,12 @@
 package mvp2
 
 import (
+	"cmp"
 	"fmt"
 
+	"github.com/teivah/majorana/common/log"
+	"github.com/teivah/majorana/common/trace"
+	"github.com/teivah/majorana/proc"
 	"github.com/teivah/majorana/risc"
 )
 
@@ -19,33 +23,62 @@ type CPU struct {
 	cycle   int
 	li1From int32
 	li1To   int32
+	l1iSize int32
+
+	perf       *proc.PerfCounters
+	busy       map[string]int
+	stageStart int
 }
 
-func NewCPU(debug bool, memoryBytes int) *CPU {
+func NewCPU(opts proc.Options) *CPU {
 	return &CPU{
-		ctx:     risc.NewContext(debug, memoryBytes),
+		ctx:     opts.NewContext(),
 		li1From: -1,
 		li1To:   -1,
+		l1iSize: cmp.Or(int32(opts.L1ICacheSize), l1iSize),
+		perf:    proc.NewPerfCounters(),
+		busy:    make(map[string]int),
 	}
 }
 
+func init() {
+	proc.Register("mvp2", func(opts proc.Options) proc.Machine {
+		return NewCPU(opts)
+	})
+}
+
 func (m *CPU) Context() *risc.Context {
 	return m.ctx
 }
 
+func (m *CPU) ExitCode() int32 {
+	return m.ctx.ExitCode
+}
+
 func (m *CPU) Run(app risc.Application) (int, error) {
-loop:
-	var pc int32
+	if err := m.ctx.Load(app); err != nil {
+		return 0, err
+	}
+	pc := app.Entry
 	for pc/4 < int32(len(app.Instructions)) {
 		nextPc := m.fetchInstruction(pc)
+		m.stage("FU")
+		log.Tracepc(m.ctx, "FU", trace.Fetch, pc)
 		r := m.decode(app, nextPc)
+		m.stage("DU")
+		log.Tracei(m.ctx, "DU", trace.Decode, r.InstructionType(), pc)
 		exe, ins, err := m.execute(app, r, pc)
 		if err != nil {
 			return 0, err
 		}
+		m.stage("EU")
+		log.Tracei(m.ctx, "EU", trace.Execute, ins, pc)
+		m.perf.Instructions++
+		m.ctx.Retire(pc, exe)
 		if exe.Return {
 			return m.cycle, nil
 		}
+		current := pc
 		if exe.PcChange {
 			pc = exe.NextPc
 		} else {
@@ -55,31 +88,53 @@ loop:
 		if exe.RegisterChange {
 			m.ctx.WriteRegister(exe)
 			if m.ctx.Debug {
-				fmt.Println(ins, m.ctx.Registers)
+				fmt.Fprintln(m.ctx.DebugWriter, ins, m.ctx.Registers)
 			}
 			m.cycle += cyclesRegisterAccess
 		} else if exe.MemoryChange {
 			m.ctx.WriteMemory(exe)
 			m.cycle += cyclesMemoryAccess
 		}
+		m.stage("WU")
+		log.Tracei(m.ctx, "WU", trace.Writeback, ins, current)
 	}
-	if m.ctx.Registers[risc.Ra] != 0 {
-		pc = m.ctx.Registers[risc.Ra]
-		m.ctx.Registers[risc.Ra] = 0
-		goto loop
-	}
-
 	return m.cycle, nil
 }
 
-func (m *CPU) Stats() map[string]any {
-	return nil
+// trace sets the cycle of the next events.
+func (m *CPU) trace() {
+	m.ctx.Cycle = m.cycle
+}
+
+// stage attributes the cycles elapsed since the previous stage to the unit
+// and sets the cycle of the next events.
+func (m *CPU) stage(unit string) {
+	m.busy[unit] += m.cycle - m.stageStart
+	m.stageStart = m.cycle
+	m.ctx.Cycle = m.cycle
+}
+
+func (m *CPU) Stats() proc.PerfCounters {
+	perf := *m.perf
+	perf.Cycles = m.cycle
+	perf.Utilization = make(map[string]float64, len(m.busy))
+	for unit, cycles := range m.busy {
+		if m.cycle != 0 {
+			perf.Utilization[unit] = float64(cycles) / float64(m.cycle)
+		}
+	}
+	return perf
 }
 
 func (m *CPU) fetchInstruction(pc int32) int32 {
 	if m.isPresentInL1i(pc) {
+		m.perf.L1I.Hits++
 		m.cycle += cyclesL1Access
 	} else {
+		m.perf.L1I.Misses++
+		m.perf.Stalls[proc.StallL1IMiss] += cyclesMemoryAccess
+		m.trace()
+		log.Stallpc(m.ctx, "FU", pc, "L1I miss")
 		m.fetchL1i(pc)
 	}
 
@@ -93,7 +148,7 @@ func (m *CPU) isPresentInL1i(pc int32) bool {
 func (m *CPU) fetchL1i(pc int32) {
 	m.cycle += cyclesMemoryAccess
 	m.li1From = pc
-	m.li1To = pc + l1iSize
+	m.li1To = pc + m.l1iSize
 }
 
 func (m *CPU) decode(app risc.Application, pc int32) risc.InstructionRunner {
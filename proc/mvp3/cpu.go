@@ -3,6 +3,9 @@ package mvp3
 import (
 	"fmt"
 
+	"github.com/teivah/majorana/common/log"
+	"github.com/teivah/majorana/common/trace"
+	"github.com/teivah/majorana/proc"
 	"github.com/teivah/majorana/risc"
 )
 
@@ -24,32 +27,60 @@ type CPU struct {
 	ctx   *risc.Context
 	cycle int
 	mmu   *memoryManagementUnit
+
+	perf       *proc.PerfCounters
+	busy       map[string]int
+	stageStart int
 }
 
-func NewCPU(debug bool, memoryBytes int) *CPU {
-	ctx := risc.NewContext(debug, memoryBytes)
+func NewCPU(opts proc.Options) *CPU {
+	ctx := opts.NewContext()
 	return &CPU{
-		ctx: ctx,
-		mmu: newMemoryManagementUnit(ctx),
+		ctx:  ctx,
+		mmu:  newMemoryManagementUnit(ctx, opts),
+		perf: proc.NewPerfCounters(),
+		busy: make(map[string]int),
 	}
 }
 
+func init() {
+	proc.Register("mvp3", func(opts proc.Options) proc.Machine {
+		return NewCPU(opts)
+	})
+}
+
 func (m *CPU) Context() *risc.Context {
 	return m.ctx
 }
 
+func (m *CPU) ExitCode() int32 {
+	return m.ctx.ExitCode
+}
+
 func (m *CPU) Run(app risc.Application) (int, error) {
-	var pc int32
+	if err := m.ctx.Load(app); err != nil {
+		return 0, err
+	}
+	pc := app.Entry
 	for pc/4 < int32(len(app.Instructions)) {
-		nextPc := m.fetchInstruction(pc)
+		nextPc := m.fetchInstruction(app, pc)
+		m.stage("FU")
+		log.Tracepc(m.ctx, "FU", trace.Fetch, pc)
 		r := m.decode(app, nextPc)
+		m.stage("DU")
+		log.Tracei(m.ctx, "DU", trace.Decode, r.InstructionType(), pc)
 		exe, ins, err := m.execute(app, r, pc)
 		if err != nil {
 			return 0, err
 		}
+		m.stage("EU")
+		log.Tracei(m.ctx, "EU", trace.Execute, ins, pc)
+		m.perf.Instructions++
+		m.ctx.Retire(pc, exe)
 		if exe.Return {
 			break
 		}
+		current := pc
 		if exe.PcChange {
 			pc = exe.NextPc
 		} else {
@@ -59,38 +90,63 @@ func (m *CPU) Run(app risc.Application) (int, error) {
 		if exe.RegisterChange {
 			m.ctx.WriteRegister(exe)
 			if m.ctx.Debug {
-				fmt.Println(ins, m.ctx.Registers)
+				fmt.Fprintln(m.ctx.DebugWriter, ins, m.ctx.Registers)
 			}
 			m.cycle += cyclesRegisterAccess
 		} else if exe.MemoryChange {
-			if m.mmu.doesExecutionMemoryChangesExistsInL1D(exe) {
-				m.mmu.writeExecutionMemoryChangesToL1D(exe)
-				m.cycle += cyclesL1Access
+			hit, cycles := m.mmu.store(current, exe)
+			if hit {
+				m.perf.L1D.Hits++
 			} else {
-				m.ctx.WriteMemory(exe)
-				m.cycle += cyclesMemoryAccess
+				m.perf.L1D.Misses++
 			}
+			m.perf.Stalls[proc.StallMemoryWrite] += cycles
+			m.cycle += cyclesL1Access + cycles
 		}
+		m.stage("WU")
+		log.Tracei(m.ctx, "WU", trace.Writeback, ins, current)
 	}
-	//if m.ctx.Registers[risc.Ra] != 0 {
-	//	pc = m.ctx.Registers[risc.Ra]
-	//	m.ctx.Registers[risc.Ra] = 0
-	//	goto loop
-	//}
 	m.cycle += m.mmu.flush()
 	return m.cycle, nil
 }
 
-func (m *CPU) Stats() map[string]any {
-	return nil
+// trace sets the cycle of the next events.
+func (m *CPU) trace() {
+	m.ctx.Cycle = m.cycle
+}
+
+// stage attributes the cycles elapsed since the previous stage to the unit
+// and sets the cycle of the next events.
+func (m *CPU) stage(unit string) {
+	m.busy[unit] += m.cycle - m.stageStart
+	m.stageStart = m.cycle
+	m.ctx.Cycle = m.cycle
 }
 
-func (m *CPU) fetchInstruction(pc int32) int32 {
+func (m *CPU) Stats() proc.PerfCounters {
+	perf := *m.perf
+	perf.Cycles = m.cycle
+	m.mmu.counters(&perf)
+	perf.Utilization = make(map[string]float64, len(m.busy))
+	for unit, cycles := range m.busy {
+		if m.cycle != 0 {
+			perf.Utilization[unit] = float64(cycles) / float64(m.cycle)
+		}
+	}
+	return perf
+}
+
+func (m *CPU) fetchInstruction(app risc.Application, pc int32) int32 {
 	if _, exists := m.mmu.getFromL1I([]int32{pc}); exists {
+		m.perf.L1I.Hits++
 		m.cycle += cyclesL1Access
 	} else {
-		m.cycle += cyclesMemoryAccess
-		m.mmu.pushLineToL1I(pc, make([]int8, l1ICacheLineSize))
+		m.perf.L1I.Misses++
+		m.trace()
+		log.Stallpc(m.ctx, "MMU", pc, "L1I miss")
+		cycles := m.mmu.fetchInstructionLine(app, pc)
+		m.perf.Stalls[proc.StallL1IMiss] += cycles
+		m.cycle += cycles
 	}
 
 	return pc
@@ -103,22 +159,25 @@ func (m *CPU) decode(app risc.Application, pc int32) risc.InstructionRunner {
 }
 
 func (m *CPU) execute(app risc.Application, r risc.InstructionRunner, pc int32) (risc.Execution, risc.InstructionType, error) {
+	if r.InstructionType() == risc.Ecall {
+		// The handler accesses the memory directly
+		m.cycle += m.mmu.writeBack()
+	}
 	addrs := r.MemoryRead(m.ctx)
 	var memory []int8
 	if len(addrs) != 0 {
 		m.cycle += cyclesL1Access
-		if mem, exists := m.mmu.getFromL1D(addrs); exists {
-			memory = mem
+		mem, hit, cycles := m.mmu.load(pc, addrs)
+		if hit {
+			m.perf.L1D.Hits++
 		} else {
-			m.cycle += cyclesMemoryAccess
-			line := m.mmu.fetchCacheLine(addrs[0])
-			m.mmu.pushLineToL1D(addrs[0], line)
-			mem, exists := m.mmu.getFromL1D(addrs)
-			if !exists {
-				panic("cache line doesn't exist")
-			}
-			memory = mem
+			m.perf.L1D.Misses++
+			m.trace()
+			log.Stalli(m.ctx, "MMU", r.InstructionType(), pc, "L1D miss")
+			m.perf.Stalls[proc.StallL1DMiss] += cycles
+			m.cycle += cycles
 		}
+		memory = mem
 	}
 
 	exe, err := r.Run(m.ctx, app.Labels, pc, memory)
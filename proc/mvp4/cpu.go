@@ -3,6 +3,8 @@ package mvp4
 import (
 	"fmt"
 
+	"github.com/teivah/majorana/common/obs"
+	"github.com/teivah/majorana/proc"
 	"github.com/teivah/majorana/proc/comp"
 	"github.com/teivah/majorana/risc"
 )
@@ -29,43 +31,62 @@ type CPU struct {
 	writeUnit            *writeUnit
 	branchUnit           *simpleBranchUnit
 	memoryManagementUnit *memoryManagementUnit
+	perf                 *proc.PerfCounters
+	cycles               int
 }
 
-func NewCPU(debug bool, memoryBytes int) *CPU {
+func NewCPU(opts proc.Options) *CPU {
 	bu := &simpleBranchUnit{}
-	ctx := risc.NewContext(debug, memoryBytes)
-	mmu := newMemoryManagementUnit(ctx)
+	ctx := opts.NewContext()
+	perf := proc.NewPerfCounters()
+	mmu := newMemoryManagementUnit(ctx, opts)
 	return &CPU{
 		ctx:                  ctx,
-		fetchUnit:            newFetchUnit(mmu, cyclesMemoryAccess),
+		fetchUnit:            newFetchUnit(mmu, perf),
 		decodeBus:            &comp.SimpleBus[int32]{},
-		decodeUnit:           &decodeUnit{},
+		decodeUnit:           &decodeUnit{busy: &obs.Gauge{}},
 		executeBus:           &comp.SimpleBus[risc.InstructionRunnerPc]{},
-		executeUnit:          newExecuteUnit(bu, mmu),
+		executeUnit:          newExecuteUnit(bu, mmu, perf),
 		writeBus:             &comp.SimpleBus[risc.ExecutionContext]{},
-		writeUnit:            &writeUnit{},
+		writeUnit:            newWriteUnit(perf),
 		branchUnit:           bu,
 		memoryManagementUnit: mmu,
+		perf:                 perf,
 	}
 }
 
+func init() {
+	proc.Register("mvp4", func(opts proc.Options) proc.Machine {
+		return NewCPU(opts)
+	})
+}
+
 func (m *CPU) Context() *risc.Context {
 	return m.ctx
 }
 
+func (m *CPU) ExitCode() int32 {
+	return m.ctx.ExitCode
+}
+
 func (m *CPU) Run(app risc.Application) (int, error) {
+	if err := m.ctx.Load(app); err != nil {
+		return 0, err
+	}
+	m.fetchUnit.reset(app.Entry)
 	cycle := 0
 	for {
 		cycle += 1
+		m.ctx.Cycle = cycle
 		if m.ctx.Debug {
-			fmt.Printf("%d\n", int32(cycle))
+			fmt.Fprintf(m.ctx.DebugWriter, "%d\n", int32(cycle))
 		}
 
 		// Fetch
 		m.fetchUnit.cycle(app, m.ctx, m.decodeBus)
 
 		// Decode
-		m.decodeUnit.cycle(app, m.decodeBus, m.executeBus)
+		m.decodeUnit.cycle(app, m.ctx, m.decodeBus, m.executeBus)
 
 		// Create branch unit assertions
 
@@ -84,27 +105,34 @@ func (m *CPU) Run(app risc.Application) (int, error) {
 		if flush {
 			for !m.writeUnit.isEmpty() || !m.writeBus.IsEmpty() {
 				cycle++
+				m.ctx.Cycle = cycle
 				m.writeUnit.cycle(m.ctx, m.writeBus)
 			}
 			m.flush(pc)
+			m.perf.Flushes++
 			continue
 		}
 
 		if m.isComplete() {
-			//if m.ctx.Registers[risc.Ra] != 0 {
-			//	m.ctx.Registers[risc.Ra] = 0
-			//	m.fetchUnit.reset(m.ctx.Registers[risc.Ra])
-			//	continue
-			//}
 			break
 		}
 	}
 	cycle += m.memoryManagementUnit.flush()
+	m.cycles = cycle
 	return cycle, nil
 }
 
-func (m *CPU) Stats() map[string]any {
-	return nil
+func (m *CPU) Stats() proc.PerfCounters {
+	perf := *m.perf
+	perf.Cycles = m.cycles
+	m.memoryManagementUnit.counters(&perf)
+	perf.Utilization = map[string]float64{
+		"FU": m.fetchUnit.busy.Stats(),
+		"DU": m.decodeUnit.busy.Stats(),
+		"EU": m.executeUnit.busy.Stats(),
+		"WU": m.writeUnit.busy.Stats(),
+	}
+	return perf
 }
 
 func (m *CPU) flush(pc int32) {
@@ -1,13 +1,22 @@
 package mvp4
 
 import (
+	"github.com/teivah/majorana/common/log"
+	"github.com/teivah/majorana/common/obs"
+	"github.com/teivah/majorana/common/trace"
 	"github.com/teivah/majorana/proc/comp"
 	"github.com/teivah/majorana/risc"
 )
 
-type decodeUnit struct{}
+type decodeUnit struct {
+	busy *obs.Gauge
+}
 
-func (du *decodeUnit) cycle(app risc.Application, inBus *comp.SimpleBus[int32], outBus *comp.SimpleBus[risc.InstructionRunnerPc]) {
+func (du *decodeUnit) cycle(app risc.Application, ctx *risc.Context, inBus *comp.SimpleBus[int32], outBus *comp.SimpleBus[risc.InstructionRunnerPc]) {
+	busy := 0
+	defer func() {
+		du.busy.Push(busy)
+	}()
 	if !outBus.CanAdd() {
 		return
 	}
@@ -16,7 +25,9 @@ func (du *decodeUnit) cycle(app risc.Application, inBus *comp.SimpleBus[int32],
 	if !exists {
 		return
 	}
+	busy = 1
 	runner := app.Instructions[pc/4]
+	log.Tracei(ctx, "DU", trace.Decode, runner.InstructionType(), pc)
 	outBus.Add(risc.InstructionRunnerPc{
 		Runner: runner,
 		Pc:     pc,
@@ -3,23 +3,29 @@ package mvp4
 import (
 	"fmt"
 
+	"github.com/teivah/majorana/common/log"
+	"github.com/teivah/majorana/common/obs"
+	"github.com/teivah/majorana/common/trace"
+	"github.com/teivah/majorana/proc"
 	"github.com/teivah/majorana/proc/comp"
 	"github.com/teivah/majorana/risc"
 )
 
 type fetchUnit struct {
-	pc                 int32
-	mmu                *memoryManagementUnit
-	remainingCycles    int
-	complete           bool
-	processing         bool
-	cyclesMemoryAccess int
+	pc              int32
+	mmu             *memoryManagementUnit
+	remainingCycles int
+	complete        bool
+	processing      bool
+	perf            *proc.PerfCounters
+	busy            *obs.Gauge
 }
 
-func newFetchUnit(mmu *memoryManagementUnit, cyclesMemoryAccess int) *fetchUnit {
+func newFetchUnit(mmu *memoryManagementUnit, perf *proc.PerfCounters) *fetchUnit {
 	return &fetchUnit{
-		mmu:                mmu,
-		cyclesMemoryAccess: cyclesMemoryAccess,
+		mmu:  mmu,
+		perf: perf,
+		busy: &obs.Gauge{},
 	}
 }
 
@@ -29,24 +35,41 @@ func (fu *fetchUnit) reset(pc int32) {
 }
 
 func (fu *fetchUnit) cycle(app risc.Application, ctx *risc.Context, outBus *comp.SimpleBus[int32]) {
+	busy := 0
+	defer func() {
+		fu.busy.Push(busy)
+	}()
 	if fu.complete {
 		return
 	}
+	if fu.pc/4 >= int32(len(app.Instructions)) {
+		// Flushed to the end of the application
+		fu.complete = true
+		return
+	}
 
 	if !fu.processing {
 		fu.processing = true
 		if _, exists := fu.mmu.getFromL1I([]int32{fu.pc}); exists {
+			fu.perf.L1I.Hits++
 			fu.remainingCycles = 1
 		} else {
-			fu.remainingCycles = fu.cyclesMemoryAccess
-			fu.mmu.pushLineToL1I(fu.pc, make([]int8, l1ICacheLineSize))
+			fu.perf.L1I.Misses++
+			log.Stallpc(ctx, "MMU", fu.pc, "L1I miss")
+			cycles := fu.mmu.fetchInstructionLine(app, fu.pc)
+			fu.perf.Stalls[proc.StallL1IMiss] += cycles
+			fu.remainingCycles = cycles
 		}
 	}
 
+	busy = 1
 	fu.remainingCycles -= 1.0
 	if fu.remainingCycles == 0.0 {
 		if !outBus.CanAdd() {
+			log.Stallpc(ctx, "FU", fu.pc, "decode bus full")
+			fu.perf.Stalls[proc.StallStructuralHazard]++
 			fu.remainingCycles = 1.0
+			busy = 0
 			return
 		}
 
@@ -57,8 +80,9 @@ func (fu *fetchUnit) cycle(app risc.Application, ctx *risc.Context, outBus *comp
 			fu.complete = true
 		}
 		if ctx.Debug {
-			fmt.Printf("\tFU: Pushing new element from pc %d\n", currentPC/4)
+			fmt.Fprintf(ctx.DebugWriter, "\tFU: Pushing new element from pc %d\n", currentPC/4)
 		}
+		log.Tracepc(ctx, "FU", trace.Fetch, currentPC)
 		outBus.Add(currentPC)
 	}
 }
@@ -1,6 +1,10 @@
 package mvp4
 
 import (
+	"github.com/teivah/majorana/common/log"
+	"github.com/teivah/majorana/common/obs"
+	"github.com/teivah/majorana/common/trace"
+	"github.com/teivah/majorana/proc"
 	"github.com/teivah/majorana/proc/comp"
 	"github.com/teivah/majorana/risc"
 )
@@ -8,9 +12,19 @@ import (
 type writeUnit struct {
 	pendingMemoryWrite bool
 	cycles             int
+	perf               *proc.PerfCounters
+	busy               *obs.Gauge
+}
+
+func newWriteUnit(perf *proc.PerfCounters) *writeUnit {
+	return &writeUnit{perf: perf, busy: &obs.Gauge{}}
 }
 
 func (wu *writeUnit) cycle(ctx *risc.Context, inBus *comp.SimpleBus[risc.ExecutionContext]) {
+	busy := 1
+	defer func() {
+		wu.busy.Push(busy)
+	}()
 	if wu.pendingMemoryWrite {
 		wu.cycles--
 		if wu.cycles == 0 {
@@ -21,8 +35,12 @@ func (wu *writeUnit) cycle(ctx *risc.Context, inBus *comp.SimpleBus[risc.Executi
 
 	execution, exists := inBus.Get()
 	if !exists {
+		busy = 0
 		return
 	}
+	wu.perf.Instructions++
+	ctx.Retire(execution.Pc, execution.Execution)
+	log.Tracei(ctx, "WU", trace.Writeback, execution.InstructionType, execution.Pc)
 	if execution.Execution.RegisterChange {
 		ctx.WriteRegister(execution.Execution)
 		ctx.DeletePendingWriteRegisters(execution.WriteRegisters)
@@ -1,29 +1,88 @@
 package mvp5
 
 import (
+	"github.com/teivah/majorana/common/log"
+	"github.com/teivah/majorana/proc"
+	"github.com/teivah/majorana/proc/comp"
 	"github.com/teivah/majorana/risc"
 )
 
 type btbBranchUnit struct {
-	btb         *branchTargetBuffer
+	btb         *comp.BranchTargetBuffer
+	predictor   comp.BranchPredictor
+	ras         *comp.ReturnAddressStack
 	fu          *fetchUnit
 	du          *decodeUnit
+	perf        *proc.PerfCounters
 	toCheck     bool
 	expectation int32
 }
 
-func newBTBBranchUnit(btbSize int, fu *fetchUnit, du *decodeUnit) *btbBranchUnit {
+func newBTBBranchUnit(btb *comp.BranchTargetBuffer, predictor comp.BranchPredictor, ras *comp.ReturnAddressStack, fu *fetchUnit, du *decodeUnit, perf *proc.PerfCounters) *btbBranchUnit {
 	return &btbBranchUnit{
-		btb: newBranchTargetBuffer(btbSize),
-		fu:  fu,
-		du:  du,
+		btb:       btb,
+		predictor: predictor,
+		ras:       ras,
+		fu:        fu,
+		du:        du,
+		perf:      perf,
 	}
 }
 
-func (bu *btbBranchUnit) assert(runner risc.InstructionRunnerPc) {
+// predict predicts the direction of a conditional branch when decoded. If
+// predicted taken and its target is known, the fetch unit is redirected to it.
+func (bu *btbBranchUnit) predict(ctx *risc.Context, labels map[string]int32, runner risc.InstructionRunnerPc) risc.Prediction {
+	target, exists := risc.BranchTarget(runner.Runner, labels)
+	if !exists {
+		// The error is returned once executed
+		return risc.Prediction{}
+	}
+	taken, history := bu.predictor.Predict(runner.Pc, target)
+	if !taken {
+		return risc.Prediction{History: history}
+	}
+	// The target is the one of the branch target buffer, as if the branch was
+	// predicted when fetched
+	target, exists = bu.btb.Lookup(runner.Pc)
+	if !exists {
+		// Unknown target, the branch is fetched as not taken
+		return risc.Prediction{History: history}
+	}
+	bu.fu.reset(target, true)
+	log.Flush(ctx, "BU", runner.Pc, target)
+	return risc.Prediction{Taken: true, Target: target, History: history}
+}
+
+// predictJump predicts the target of an unconditional branch when decoded: the
+// return address of a call is pushed to the return address stack and the
+// target of a return is popped from it. If predicted, the fetch unit is
+// redirected to the target.
+func (bu *btbBranchUnit) predictJump(ctx *risc.Context, runner risc.InstructionRunnerPc) risc.Prediction {
+	if risc.IsCall(runner.Runner) {
+		bu.ras.Push(runner.Pc + 4)
+		return risc.Prediction{}
+	}
+	if !risc.IsReturn(runner.Runner) {
+		return risc.Prediction{}
+	}
+	target, exists := bu.ras.Pop()
+	if !exists {
+		return risc.Prediction{}
+	}
+	bu.fu.reset(target, true)
+	log.Flush(ctx, "BU", runner.Pc, target)
+	return risc.Prediction{Taken: true, Target: target}
+}
+
+func (bu *btbBranchUnit) assert(ctx *risc.Context, runner risc.InstructionRunnerPc) {
 	instructionType := runner.Runner.InstructionType()
-	if instructionType.IsUnconditionalBranch() {
-		nextPc, exists := bu.btb.get(runner.Pc)
+	if instructionType.IsUnconditionalBranch() && runner.Prediction.Taken {
+		// Return predicted by the return address stack, the fetch unit was
+		// already redirected
+		bu.toCheck = true
+		bu.expectation = runner.Prediction.Target
+	} else if instructionType.IsUnconditionalBranch() {
+		nextPc, exists := bu.btb.Lookup(runner.Pc)
 		if !exists {
 			// Unknown branch, it will lead to a pipeline flush
 			bu.toCheck = true
@@ -32,12 +91,11 @@ func (bu *btbBranchUnit) assert(runner risc.InstructionRunnerPc) {
 			// Known branch, no need to check
 			bu.toCheck = false
 			bu.fu.reset(nextPc, true)
+			log.Flush(ctx, "BU", runner.Pc, nextPc)
 		}
-	} else if instructionType.IsConditionalBranch() {
-		// Assuming next instruction
-		bu.toCheck = true
-		bu.expectation = runner.Pc + 4
 	} else {
+		// The conditional branches are checked against their prediction once
+		// resolved
 		bu.toCheck = false
 	}
 }
@@ -53,8 +111,62 @@ func (bu *btbBranchUnit) shouldFlushPipeline(pc int32) bool {
 	return bu.expectation != pc
 }
 
-func (bu *btbBranchUnit) notifyJumpAddressResolved(pc, pcTo int32) {
-	bu.btb.add(pc, pcTo)
+// resolve trains the predictor with the direction of a conditional branch
+// resolved to target if taken, and returns whether it was mispredicted.
+func (bu *btbBranchUnit) resolve(runner risc.InstructionRunnerPc, taken bool, target int32) bool {
+	bu.predictor.Update(runner.Pc, runner.Prediction.History, taken)
+	bu.perf.Branches.Predictions++
+	if taken {
+		bu.btb.Update(runner.Pc, target)
+	}
+	if runner.Prediction.Taken == taken && (!taken || runner.Prediction.Target == target) {
+		return false
+	}
+	bu.perf.Branches.Mispredictions++
+	return true
+}
+
+// resolveJump records an unconditional branch resolved to pcTo in the return
+// address stack.
+func (bu *btbBranchUnit) resolveJump(ctx *risc.Context, runner risc.InstructionRunnerPc, pcTo int32) {
+	if risc.IsCall(runner.Runner) {
+		bu.ras.Call(runner.Pc + 4)
+	} else if risc.IsReturn(runner.Runner) {
+		bu.ras.Return(runner.Prediction.Target, runner.Prediction.Taken, pcTo)
+	}
+	if runner.Prediction.Taken {
+		// The target was checked by assert
+		return
+	}
+	bu.notifyJumpAddressResolved(ctx, runner.Pc, pcTo)
+}
+
+func (bu *btbBranchUnit) notifyJumpAddressResolved(ctx *risc.Context, pc, pcTo int32) {
+	bu.btb.Update(pc, pcTo)
 	bu.fu.reset(pcTo, true)
+	log.Flush(ctx, "BU", pc, pcTo)
 	bu.du.notifyBranchResolved()
 }
+
+// flush discards the directions predicted for the branches not yet resolved
+// and recovers the return address stack from the calls and returns resolved.
+func (bu *btbBranchUnit) flush() {
+	bu.predictor.Recover(0)
+	bu.ras.Recover(0)
+}
+
+func (bu *btbBranchUnit) counters(perf *proc.PerfCounters) {
+	btb := bu.btb.Stats()
+	perf.BTB = proc.BTBCounters{
+		Hits:    btb.Hits,
+		Misses:  btb.Misses,
+		Aliases: btb.Aliases,
+	}
+	ras := bu.ras.Stats()
+	perf.RAS = proc.RASCounters{
+		Hits:       ras.Hits,
+		Misses:     ras.Misses,
+		Underflows: ras.Underflows,
+		Overflows:  ras.Overflows,
+	}
+}
@@ -3,6 +3,8 @@ package mvp5
 import (
 	"fmt"
 
+	"github.com/teivah/majorana/common/obs"
+	"github.com/teivah/majorana/proc"
 	"github.com/teivah/majorana/proc/comp"
 	"github.com/teivah/majorana/risc"
 )
@@ -29,40 +31,58 @@ type CPU struct {
 	writeUnit            *writeUnit
 	branchUnit           *btbBranchUnit
 	memoryManagementUnit *memoryManagementUnit
-
-	counterFlush int
+	perf                 *proc.PerfCounters
+	cycles               int
 }
 
-func NewCPU(debug bool, memoryBytes int) *CPU {
-	ctx := risc.NewContext(debug, memoryBytes)
-	mmu := newMemoryManagementUnit(ctx)
-	fu := newFetchUnit(mmu, cyclesMemoryAccess)
-	du := &decodeUnit{}
-	bu := newBTBBranchUnit(4, fu, du)
+func NewCPU(opts proc.Options) *CPU {
+	ctx := opts.NewContext()
+	perf := proc.NewPerfCounters()
+	mmu := newMemoryManagementUnit(ctx, opts)
+	fu := newFetchUnit(mmu, perf)
+	du := &decodeUnit{perf: perf, busy: &obs.Gauge{}}
+	bu := newBTBBranchUnit(opts.BranchTargetBuffer(), opts.BranchPredictor(), opts.ReturnAddressStack(), fu, du, perf)
+	du.bu = bu
 	return &CPU{
 		ctx:                  ctx,
 		fetchUnit:            fu,
 		decodeBus:            &comp.SimpleBus[int32]{},
 		decodeUnit:           du,
 		executeBus:           &comp.SimpleBus[risc.InstructionRunnerPc]{},
-		executeUnit:          newExecuteUnit(bu, mmu),
+		executeUnit:          newExecuteUnit(bu, mmu, perf),
 		writeBus:             &comp.SimpleBus[risc.ExecutionContext]{},
-		writeUnit:            &writeUnit{},
+		writeUnit:            newWriteUnit(perf),
 		branchUnit:           bu,
 		memoryManagementUnit: mmu,
+		perf:                 perf,
 	}
 }
 
+func init() {
+	proc.Register("mvp5", func(opts proc.Options) proc.Machine {
+		return NewCPU(opts)
+	})
+}
+
 func (m *CPU) Context() *risc.Context {
 	return m.ctx
 }
 
+func (m *CPU) ExitCode() int32 {
+	return m.ctx.ExitCode
+}
+
 func (m *CPU) Run(app risc.Application) (int, error) {
+	if err := m.ctx.Load(app); err != nil {
+		return 0, err
+	}
+	m.fetchUnit.reset(app.Entry, false)
 	cycle := 0
 	for {
 		cycle += 1
+		m.ctx.Cycle = cycle
 		if m.ctx.Debug {
-			fmt.Printf("%d\n", int32(cycle))
+			fmt.Fprintf(m.ctx.DebugWriter, "%d\n", int32(cycle))
 		}
 
 		// Fetch
@@ -80,7 +100,7 @@ func (m *CPU) Run(app risc.Application) (int, error) {
 		// Write back
 		m.writeUnit.cycle(m.ctx, m.writeBus)
 		if m.ctx.Debug {
-			fmt.Printf("\tRegisters: %v\n", m.ctx.Registers)
+			fmt.Fprintf(m.ctx.DebugWriter, "\tRegisters: %v\n", m.ctx.Registers)
 		}
 
 		if ret {
@@ -88,40 +108,46 @@ func (m *CPU) Run(app risc.Application) (int, error) {
 		}
 		if flush {
 			if m.ctx.Debug {
-				fmt.Printf("\tFlush to %d\n", pc/4)
+				fmt.Fprintf(m.ctx.DebugWriter, "\tFlush to %d\n", pc/4)
 			}
 			for !m.writeUnit.isEmpty() || !m.writeBus.IsEmpty() {
 				cycle++
+				m.ctx.Cycle = cycle
 				m.writeUnit.cycle(m.ctx, m.writeBus)
 			}
 			m.flush(pc)
-			m.counterFlush++
+			m.perf.Flushes++
 			continue
 		}
 
 		if m.isComplete() {
-			//if m.ctx.Registers[risc.Ra] != 0 {
-			//	m.ctx.Registers[risc.Ra] = 0
-			//	m.fetchUnit.reset(m.ctx.Registers[risc.Ra])
-			//	continue
-			//}
 			break
 		}
 	}
 	cycle += m.memoryManagementUnit.flush()
+	m.cycles = cycle
 	return cycle, nil
 }
 
-func (m *CPU) Stats() map[string]any {
-	return map[string]any{
-		"flush": m.counterFlush,
+func (m *CPU) Stats() proc.PerfCounters {
+	perf := *m.perf
+	perf.Cycles = m.cycles
+	m.memoryManagementUnit.counters(&perf)
+	m.branchUnit.counters(&perf)
+	perf.Utilization = map[string]float64{
+		"FU": m.fetchUnit.busy.Stats(),
+		"DU": m.decodeUnit.busy.Stats(),
+		"EU": m.executeUnit.busy.Stats(),
+		"WU": m.writeUnit.busy.Stats(),
 	}
+	return perf
 }
 
 func (m *CPU) flush(pc int32) {
 	m.fetchUnit.flush(pc)
 	m.decodeUnit.flush()
 	m.executeUnit.flush()
+	m.branchUnit.flush()
 	m.decodeBus.Flush()
 	m.executeBus.Flush()
 	m.writeBus.Flush()
@@ -3,16 +3,29 @@ package mvp5
 import (
 	"fmt"
 
+	"github.com/teivah/majorana/common/log"
+	"github.com/teivah/majorana/common/obs"
+	"github.com/teivah/majorana/common/trace"
+	"github.com/teivah/majorana/proc"
 	"github.com/teivah/majorana/proc/comp"
 	"github.com/teivah/majorana/risc"
 )
 
 type decodeUnit struct {
 	pendingBranchResolution bool
+	bu                      *btbBranchUnit
+	perf                    *proc.PerfCounters
+	busy                    *obs.Gauge
 }
 
 func (du *decodeUnit) cycle(app risc.Application, ctx *risc.Context, inBus *comp.SimpleBus[int32], outBus *comp.SimpleBus[risc.InstructionRunnerPc]) {
+	busy := 0
+	defer func() {
+		du.busy.Push(busy)
+	}()
 	if du.pendingBranchResolution {
+		log.Stallu(ctx, "DU", "branch resolution")
+		du.perf.Stalls[proc.StallControlHazard]++
 		return
 	}
 	if !outBus.CanAdd() {
@@ -24,16 +37,23 @@ func (du *decodeUnit) cycle(app risc.Application, ctx *risc.Context, inBus *comp
 		return
 	}
 	if ctx.Debug {
-		fmt.Printf("\tDU: Decoding instruction %d\n", pc/4)
+		fmt.Fprintf(ctx.DebugWriter, "\tDU: Decoding instruction %d\n", pc/4)
 	}
+	busy = 1
 	runner := app.Instructions[pc/4]
-	if runner.InstructionType().IsUnconditionalBranch() {
-		du.pendingBranchResolution = true
-	}
-	outBus.Add(risc.InstructionRunnerPc{
+	log.Tracei(ctx, "DU", trace.Decode, runner.InstructionType(), pc)
+	runnerPc := risc.InstructionRunnerPc{
 		Runner: runner,
 		Pc:     pc,
-	})
+	}
+	if runner.InstructionType().IsUnconditionalBranch() {
+		runnerPc.Prediction = du.bu.predictJump(ctx, runnerPc)
+		// A return predicted doesn't need to wait for its resolution
+		du.pendingBranchResolution = !runnerPc.Prediction.Taken
+	} else if runner.InstructionType().IsConditionalBranch() {
+		runnerPc.Prediction = du.bu.predict(ctx, app.Labels, runnerPc)
+	}
+	outBus.Add(runnerPc)
 }
 
 func (du *decodeUnit) notifyBranchResolved() {
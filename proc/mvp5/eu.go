@@ -3,6 +3,10 @@ package mvp5
 import (
 	"fmt"
 
+	"github.com/teivah/majorana/common/log"
+	"github.com/teivah/majorana/common/obs"
+	"github.com/teivah/majorana/common/trace"
+	"github.com/teivah/majorana/proc"
 	"github.com/teivah/majorana/proc/comp"
 	"github.com/teivah/majorana/risc"
 )
@@ -11,21 +15,37 @@ type executeUnit struct {
 	processing        bool
 	remainingCycles   int
 	pendingMemoryRead bool
-	addrs             []int32
-	memory            []int8
-	runner            risc.InstructionRunnerPc
-	bu                *btbBranchUnit
-	mmu               *memoryManagementUnit
+	// pendingMemoryWrite is a store retired waiting for the memory
+	pendingMemoryWrite bool
+	memory             []int8
+	runner             risc.InstructionRunnerPc
+	bu                 *btbBranchUnit
+	mmu                *memoryManagementUnit
+	perf               *proc.PerfCounters
+	busy               *obs.Gauge
 }
 
-func newExecuteUnit(bu *btbBranchUnit, mmu *memoryManagementUnit) *executeUnit {
+func newExecuteUnit(bu *btbBranchUnit, mmu *memoryManagementUnit, perf *proc.PerfCounters) *executeUnit {
 	return &executeUnit{
-		bu:  bu,
-		mmu: mmu,
+		bu:   bu,
+		mmu:  mmu,
+		perf: perf,
+		busy: &obs.Gauge{},
 	}
 }
 
 func (eu *executeUnit) cycle(ctx *risc.Context, app risc.Application, inBus *comp.SimpleBus[risc.InstructionRunnerPc], outBus *comp.SimpleBus[risc.ExecutionContext]) (bool, int32, bool, error) {
+	busy := 1
+	defer func() {
+		eu.busy.Push(busy)
+	}()
+	if eu.pendingMemoryWrite {
+		eu.remainingCycles--
+		if eu.remainingCycles == 0 {
+			eu.pendingMemoryWrite = false
+		}
+		return false, 0, false, nil
+	}
 	if eu.pendingMemoryRead {
 		eu.remainingCycles--
 		if eu.remainingCycles != 0 {
@@ -35,18 +55,7 @@ func (eu *executeUnit) cycle(ctx *risc.Context, app risc.Application, inBus *com
 		defer func() {
 			eu.runner = risc.InstructionRunnerPc{}
 		}()
-		var memory []int8
-		if eu.memory != nil {
-			memory = eu.memory
-		} else {
-			line := eu.mmu.fetchCacheLine(eu.addrs[0])
-			eu.mmu.pushLineToL1D(eu.addrs[0], line)
-			m, exists := eu.mmu.getFromL1D(eu.addrs)
-			if !exists {
-				panic("cache line doesn't exist")
-			}
-			memory = m
-		}
+		memory := eu.memory
 		eu.memory = nil
 		return eu.run(ctx, app, outBus, memory)
 	}
@@ -54,6 +63,7 @@ func (eu *executeUnit) cycle(ctx *risc.Context, app risc.Application, inBus *com
 	if !eu.processing {
 		runner, exists := inBus.Get()
 		if !exists {
+			busy = 0
 			return false, 0, false, nil
 		}
 		eu.runner = runner
@@ -67,36 +77,62 @@ func (eu *executeUnit) cycle(ctx *risc.Context, app risc.Application, inBus *com
 	}
 
 	if !outBus.CanAdd() {
+		log.Stalli(ctx, "EU", eu.runner.Runner.InstructionType(), eu.runner.Pc, "write bus full")
+		eu.perf.Stalls[proc.StallStructuralHazard]++
+		busy = 0
 		eu.remainingCycles = 1
 		return false, 0, false, nil
 	}
 
 	runner := eu.runner
 	// Create the branch unit assertions
-	eu.bu.assert(runner)
+	eu.bu.assert(ctx, runner)
 
 	// To avoid writeback hazard, if the pipeline contains read registers not
 	// written yet, we wait for it
 	if ctx.IsWriteDataHazard(runner.Runner.ReadRegisters()) {
+		log.Stalli(ctx, "EU", runner.Runner.InstructionType(), runner.Pc, "data hazard")
+		eu.perf.Stalls[proc.StallDataHazard]++
+		busy = 0
 		eu.remainingCycles = 1
 		return false, 0, false, nil
 	}
 
 	if ctx.Debug {
-		fmt.Printf("\tEU: Executing instruction %d\n", eu.runner.Pc/4)
+		fmt.Fprintf(ctx.DebugWriter, "\tEU: Executing instruction %d\n", eu.runner.Pc/4)
+	}
+
+	if runner.Runner.InstructionType() == risc.Ecall {
+		// The handler accesses the memory directly, so we wait for the previous
+		// memory changes to be written and the L1D to be written back
+		if !outBus.IsEmpty() {
+			log.Stalli(ctx, "EU", runner.Runner.InstructionType(), runner.Pc, "ecall")
+			eu.perf.Stalls[proc.StallEcall]++
+			busy = 0
+			eu.remainingCycles = 1
+			return false, 0, false, nil
+		}
+		if cycles := eu.mmu.writeBack(); cycles > 0 {
+			eu.perf.Stalls[proc.StallEcall] += cycles
+			eu.remainingCycles = cycles
+			return false, 0, false, nil
+		}
 	}
 
 	addrs := runner.Runner.MemoryRead(ctx)
 	if len(addrs) != 0 {
-		if m, exists := eu.mmu.getFromL1D(addrs); exists {
-			eu.memory = m
-			eu.pendingMemoryRead = true
+		m, hit, cycles := eu.mmu.load(runner.Pc, addrs)
+		if hit {
+			eu.perf.L1D.Hits++
 			eu.remainingCycles = cyclesL1Access
 		} else {
-			eu.addrs = addrs
-			eu.pendingMemoryRead = true
-			eu.remainingCycles = cyclesMemoryAccess
+			log.Stalli(ctx, "MMU", runner.Runner.InstructionType(), runner.Pc, "L1D miss")
+			eu.perf.L1D.Misses++
+			eu.perf.Stalls[proc.StallL1DMiss] += cycles
+			eu.remainingCycles = cycles
 		}
+		eu.memory = m
+		eu.pendingMemoryRead = true
 		return false, 0, false, nil
 	}
 
@@ -107,21 +143,38 @@ func (eu *executeUnit) cycle(ctx *risc.Context, app risc.Application, inBus *com
 }
 
 func (eu *executeUnit) run(ctx *risc.Context, app risc.Application, outBus *comp.SimpleBus[risc.ExecutionContext], memory []int8) (bool, int32, bool, error) {
+	log.Tracei(ctx, "EU", trace.Execute, eu.runner.Runner.InstructionType(), eu.runner.Pc)
 	execution, err := eu.runner.Runner.Run(ctx, app.Labels, eu.runner.Pc, memory)
 	if err != nil {
 		return false, 0, false, err
 	}
 	if execution.Return {
+		eu.perf.Instructions++
+		ctx.Retire(eu.runner.Pc, execution)
 		return false, 0, true, nil
 	}
 
 	eu.processing = false
-	if execution.MemoryChange && eu.mmu.doesExecutionMemoryChangesExistsInL1D(execution) {
-		eu.mmu.writeExecutionMemoryChangesToL1D(execution)
+	if execution.MemoryChange {
+		hit, cycles := eu.mmu.store(eu.runner.Pc, execution)
+		if hit {
+			eu.perf.L1D.Hits++
+		} else {
+			eu.perf.L1D.Misses++
+		}
+		eu.perf.Instructions++
+		ctx.Retire(eu.runner.Pc, execution)
+		log.Tracei(ctx, "MMU", trace.Writeback, eu.runner.Runner.InstructionType(), eu.runner.Pc)
+		if cycles > 0 {
+			log.Stalli(ctx, "MMU", eu.runner.Runner.InstructionType(), eu.runner.Pc, "memory write")
+			eu.perf.Stalls[proc.StallMemoryWrite] += cycles
+			eu.pendingMemoryWrite = true
+			eu.remainingCycles = cycles
+		}
 		return false, 0, false, nil
 	}
-
 	outBus.Add(risc.ExecutionContext{
+		Pc:              eu.runner.Pc,
 		Execution:       execution,
 		InstructionType: eu.runner.Runner.InstructionType(),
 		WriteRegisters:  eu.runner.Runner.WriteRegisters(),
@@ -130,12 +183,23 @@ func (eu *executeUnit) run(ctx *risc.Context, app risc.Application, outBus *comp
 	eu.processing = false
 
 	if eu.runner.Runner.InstructionType().IsUnconditionalBranch() {
-		eu.bu.notifyJumpAddressResolved(eu.runner.Pc, execution.NextPc)
+		eu.bu.resolveJump(ctx, eu.runner, execution.NextPc)
 	}
 
 	if execution.PcChange && eu.bu.shouldFlushPipeline(execution.NextPc) {
+		log.Flush(ctx, "BU", eu.runner.Pc, execution.NextPc)
+		eu.perf.Mispredictions++
 		return true, execution.NextPc, false, nil
 	}
+	if eu.runner.Runner.InstructionType().IsConditionalBranch() && eu.bu.resolve(eu.runner, execution.PcChange, execution.NextPc) {
+		nextPc := eu.runner.Pc + 4
+		if execution.PcChange {
+			nextPc = execution.NextPc
+		}
+		log.Flush(ctx, "BU", eu.runner.Pc, nextPc)
+		eu.perf.Mispredictions++
+		return true, nextPc, false, nil
+	}
 
 	return false, 0, false, nil
 }
@@ -146,5 +210,5 @@ func (eu *executeUnit) flush() {
 }
 
 func (eu *executeUnit) isEmpty() bool {
-	return !eu.processing
+	return !eu.processing && !eu.pendingMemoryWrite
 }
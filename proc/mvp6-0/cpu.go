@@ -2,6 +2,7 @@ package mvp6_0
 
 import (
 	"github.com/teivah/majorana/common/log"
+	"github.com/teivah/majorana/proc"
 	"github.com/teivah/majorana/proc/comp"
 	"github.com/teivah/majorana/risc"
 )
@@ -33,11 +34,11 @@ type CPU struct {
 	writeUnits           []*writeUnit
 	branchUnit           *btbBranchUnit
 	memoryManagementUnit *memoryManagementUnit
-
-	counterFlush int
+	perf                 *proc.PerfCounters
+	cycles               int
 }
 
-func NewCPU(debug bool, memoryBytes int) *CPU {
+func NewCPU(opts proc.Options) *CPU {
 	busSize := 2
 	multiplier := 1
 	decodeBus := comp.NewBufferedBus[int32](busSize*multiplier, busSize*multiplier)
@@ -45,44 +46,62 @@ func NewCPU(debug bool, memoryBytes int) *CPU {
 	executeBus := comp.NewBufferedBus[*risc.InstructionRunnerPc](busSize, busSize)
 	writeBus := comp.NewBufferedBus[risc.ExecutionContext](busSize, busSize)
 
-	ctx := risc.NewContext(debug, memoryBytes)
-	mmu := newMemoryManagementUnit(ctx)
-	fu := newFetchUnit(mmu, decodeBus)
-	du := newDecodeUnit(decodeBus, controlBus)
-	bu := newBTBBranchUnit(4, fu, du)
+	ctx := opts.NewContext()
+	mmu := newMemoryManagementUnit(ctx, opts)
+	perf := proc.NewPerfCounters()
+	fu := newFetchUnit(mmu, decodeBus, perf)
+	du := newDecodeUnit(decodeBus, controlBus, perf)
+	bu := newBTBBranchUnit(opts.BranchTargetBuffer(), opts.BranchPredictor(), opts.ReturnAddressStack(), fu, du, perf)
+	du.bu = bu
 	return &CPU{
 		ctx:         ctx,
 		fetchUnit:   fu,
 		decodeBus:   decodeBus,
 		decodeUnit:  du,
 		controlBus:  controlBus,
-		controlUnit: newControlUnit(controlBus, executeBus),
+		controlUnit: newControlUnit(controlBus, executeBus, perf),
 		executeBus:  executeBus,
 		executeUnits: []*executeUnit{
-			newExecuteUnit(bu, executeBus, writeBus, mmu),
-			newExecuteUnit(bu, executeBus, writeBus, mmu),
+			newExecuteUnit("EU0", bu, opts.Speculation, executeBus, writeBus, mmu, perf),
+			newExecuteUnit("EU1", bu, opts.Speculation, executeBus, writeBus, mmu, perf),
 		},
 		writeBus: writeBus,
 		writeUnits: []*writeUnit{
-			newWriteUnit(writeBus),
-			newWriteUnit(writeBus),
+			newWriteUnit("WU0", bu, writeBus, perf),
+			newWriteUnit("WU1", bu, writeBus, perf),
 		},
 		branchUnit:           bu,
 		memoryManagementUnit: mmu,
+		perf:                 perf,
 	}
 }
 
+func init() {
+	proc.Register("mvp6-0", func(opts proc.Options) proc.Machine {
+		return NewCPU(opts)
+	})
+}
+
 func (m *CPU) Context() *risc.Context {
 	return m.ctx
 }
 
+func (m *CPU) ExitCode() int32 {
+	return m.ctx.ExitCode
+}
+
 func (m *CPU) Run(app risc.Application) (int, error) {
+	if err := m.ctx.Load(app); err != nil {
+		return 0, err
+	}
+	m.fetchUnit.reset(app.Entry, false)
 	defer func() {
 		log.Infou(m.ctx, "L1d", m.memoryManagementUnit.l1d.String())
 	}()
 	cycle := 0
 	for {
 		cycle += 1
+		m.ctx.Cycle = cycle
 		log.Info(m.ctx, "Cycle %d", cycle)
 		m.decodeBus.Connect(cycle)
 		m.controlBus.Connect(cycle)
@@ -101,7 +120,7 @@ func (m *CPU) Run(app risc.Application) (int, error) {
 		// Execute
 		var (
 			flush bool
-			from  int32
+			from  int
 			pc    int32
 			ret   bool
 		)
@@ -110,12 +129,15 @@ func (m *CPU) Run(app risc.Application) (int, error) {
 			if err != nil {
 				return 0, err
 			}
-			if f {
-				from = fp
+			// A return isn't speculative so the instructions flushing are
+			// younger. Otherwise, the oldest instruction flushing determines
+			// the instructions to discard.
+			if r {
+				ret, from = true, fp
+			} else if f && !ret && (!flush || fp < from) {
+				from, pc = fp, p
 			}
 			flush = flush || f
-			pc = max(pc, p)
-			ret = ret || r
 		}
 
 		// Write back
@@ -124,16 +146,42 @@ func (m *CPU) Run(app risc.Application) (int, error) {
 		}
 		log.Info(m.ctx, "\tRegisters: %v", m.ctx.Registers)
 
+		// The instructions older than a flush or a return still executing are
+		// completed
+		for (flush || ret) && m.isExecutingBefore(from) {
+			cycle++
+			m.ctx.Cycle = cycle
+			m.writeBus.Connect(cycle)
+			for _, eu := range m.executeUnits {
+				if eu.isEmpty() || eu.runner.Sequence >= from {
+					continue
+				}
+				f, fp, p, r, err := eu.cycle(cycle, m.ctx, app)
+				if err != nil {
+					return 0, err
+				}
+				if r {
+					ret, from = true, fp
+				} else if f && !ret {
+					from, pc = fp, p
+				}
+			}
+			for _, wu := range m.writeUnits {
+				wu.cycle(m.ctx, from)
+			}
+		}
+
 		if ret {
 			log.Info(m.ctx, "\t🛑 Return")
-			m.counterFlush++
 			cycle++
+			m.ctx.Cycle = cycle
 			m.writeBus.Connect(cycle)
 			for !m.areWriteUnitsEmpty() || !m.writeBus.IsEmpty() {
 				for _, wu := range m.writeUnits {
-					wu.cycle(m.ctx, -1)
+					wu.cycle(m.ctx, from)
 				}
 				cycle++
+				m.ctx.Cycle = cycle
 				m.writeBus.Connect(cycle)
 			}
 			break
@@ -143,54 +191,59 @@ func (m *CPU) Run(app risc.Application) (int, error) {
 			for _, wu := range m.writeUnits {
 				for !wu.isEmpty() || !m.writeBus.IsEmpty() {
 					cycle++
+					m.ctx.Cycle = cycle
+					m.writeBus.Connect(cycle)
 					wu.cycle(m.ctx, from)
 				}
 			}
 
 			log.Info(m.ctx, "\t️⚠️ Flush to %d", pc/4)
-			m.flush(pc)
+			m.flush(from, pc)
+			m.perf.Flushes++
 			cycle += flushCycles
 			log.Info(m.ctx, "\tRegisters: %v", m.ctx.Registers)
 			continue
 		}
 
 		if m.isEmpty() {
-			//if m.ctx.Registers[risc.Ra] != 0 {
-			//	m.ctx.Registers[risc.Ra] = 0
-			//	m.fetchUnit.reset(m.ctx.Registers[risc.Ra], false)
-			//	continue
-			//}
 			break
 		}
 	}
 	cycle += m.memoryManagementUnit.flush()
+	m.cycles = cycle
 	return cycle, nil
 }
 
-func (m *CPU) Stats() map[string]any {
-	return map[string]any{
-		"flush":                  m.counterFlush,
-		"du_pending_read":        m.decodeUnit.pendingRead.Stats(),
-		"du_blocked":             m.decodeUnit.blocked.Stats(),
-		"du_pushed":              m.decodeUnit.pushed.Stats(),
-		"cu_push":                m.controlUnit.pushed.Stats(),
-		"cu_pending":             m.controlUnit.pending.Stats(),
-		"cu_pending_read":        m.controlUnit.pendingRead.Stats(),
-		"cu_blocked":             m.controlUnit.blocked.Stats(),
-		"cu_total":               m.controlUnit.total,
-		"cu_cant_add":            m.controlUnit.cantAdd,
-		"cu_blocked_branch":      m.controlUnit.blockedBranch,
-		"cu_blocked_data_hazard": m.controlUnit.blockedDataHazard,
+func (m *CPU) Stats() proc.PerfCounters {
+	perf := *m.perf
+	perf.Cycles = m.cycles
+	m.memoryManagementUnit.counters(&perf)
+	m.branchUnit.counters(&perf)
+	perf.Utilization = map[string]float64{
+		"FU": m.fetchUnit.busy.Stats(),
+		"DU": m.decodeUnit.busy.Stats(),
+		"CU": m.controlUnit.busy.Stats(),
+	}
+	for _, eu := range m.executeUnits {
+		perf.Utilization[eu.name] = eu.busy.Stats()
+	}
+	for _, wu := range m.writeUnits {
+		perf.Utilization[wu.name] = wu.busy.Stats()
 	}
+	return perf
 }
 
-func (m *CPU) flush(pc int32) {
+// flush discards the instructions from the one of sequence from and resumes
+// at pc.
+func (m *CPU) flush(from int, pc int32) {
 	m.fetchUnit.flush(pc)
 	m.decodeUnit.flush()
 	m.controlUnit.flush()
 	for _, executeUnit := range m.executeUnits {
 		executeUnit.flush()
 	}
+	m.branchUnit.flush(from)
+	m.memoryManagementUnit.squash(from)
 	m.decodeBus.Clean()
 	m.controlBus.Clean()
 	m.executeBus.Clean()
@@ -198,6 +251,15 @@ func (m *CPU) flush(pc int32) {
 	m.ctx.Flush()
 }
 
+func (m *CPU) isExecutingBefore(sequence int) bool {
+	for _, eu := range m.executeUnits {
+		if !eu.isEmpty() && eu.runner.Sequence < sequence {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *CPU) isEmpty() bool {
 	empty := m.fetchUnit.isEmpty() &&
 		m.decodeUnit.isEmpty() &&
@@ -226,3 +288,18 @@ func (m *CPU) areWriteUnitsEmpty() bool {
 	}
 	return true
 }
+
+// ProbeLoad reads the byte at addr through the memory hierarchy and returns
+// the number of cycles taken.
+func (m *CPU) ProbeLoad(addr int32) int {
+	_, hit, cycles := m.memoryManagementUnit.load(0, []int32{addr}, true)
+	if hit {
+		return cycleL1DAccess
+	}
+	return cycles
+}
+
+// FlushL1D writes the dirty L1D lines back and invalidates the L1D.
+func (m *CPU) FlushL1D() {
+	m.memoryManagementUnit.writeBack()
+}
@@ -3,6 +3,8 @@ package mvp6_0
 import (
 	"github.com/teivah/majorana/common/log"
 	"github.com/teivah/majorana/common/obs"
+	"github.com/teivah/majorana/common/trace"
+	"github.com/teivah/majorana/proc"
 	"github.com/teivah/majorana/proc/comp"
 	"github.com/teivah/majorana/risc"
 )
@@ -16,45 +18,37 @@ type controlUnit struct {
 	outBus   *comp.BufferedBus[*risc.InstructionRunnerPc]
 	pendings *comp.Queue[risc.InstructionRunnerPc]
 
-	pushed            *obs.Gauge
-	pending           *obs.Gauge
-	pendingRead       *obs.Gauge
-	blocked           *obs.Gauge
-	total             int
-	cantAdd           int
-	blockedBranch     int
-	blockedDataHazard int
+	perf *proc.PerfCounters
+	busy *obs.Gauge
+	// stall is the cause of the last stall during the current cycle
+	stall proc.StallCause
 }
 
-func newControlUnit(inBus *comp.BufferedBus[risc.InstructionRunnerPc], outBus *comp.BufferedBus[*risc.InstructionRunnerPc]) *controlUnit {
+func newControlUnit(inBus *comp.BufferedBus[risc.InstructionRunnerPc], outBus *comp.BufferedBus[*risc.InstructionRunnerPc], perf *proc.PerfCounters) *controlUnit {
 	return &controlUnit{
-		inBus:       inBus,
-		outBus:      outBus,
-		pendings:    comp.NewQueue[risc.InstructionRunnerPc](pendingLength),
-		pushed:      &obs.Gauge{},
-		pending:     &obs.Gauge{},
-		pendingRead: &obs.Gauge{},
-		blocked:     &obs.Gauge{},
+		inBus:    inBus,
+		outBus:   outBus,
+		pendings: comp.NewQueue[risc.InstructionRunnerPc](pendingLength),
+		perf:     perf,
+		busy:     &obs.Gauge{},
 	}
 }
 
 func (u *controlUnit) cycle(cycle int, ctx *risc.Context) {
 	pushed := 0
+	u.stall = ""
 	defer func() {
-		u.pushed.Push(pushed)
-		u.pending.Push(u.pendings.Length())
+		u.busy.Push(min(pushed, 1))
+		if pushed == 0 && u.stall != "" {
+			// Nothing was dispatched
+			u.perf.Stalls[u.stall]++
+		}
 	}()
-	u.pendingRead.Push(u.inBus.PendingRead())
-	if u.inBus.CanGet() {
-		u.blocked.Push(1)
-	} else {
-		u.blocked.Push(0)
-	}
-	u.total++
 
 	if !u.outBus.CanAdd() {
-		u.cantAdd++
 		log.Infou(ctx, "CU", "can't add")
+		log.Stallu(ctx, "CU", "execute bus full")
+		u.stall = proc.StallStructuralHazard
 		return
 	}
 
@@ -67,8 +61,6 @@ func (u *controlUnit) cycle(cycle int, ctx *risc.Context) {
 			u.pendings.Remove(elem)
 			remaining--
 			pushed++
-		} else {
-			u.blockedBranch++
 		}
 		if stop {
 			return
@@ -87,7 +79,6 @@ func (u *controlUnit) cycle(cycle int, ctx *risc.Context) {
 			pushed++
 		} else {
 			u.pendings.Push(runner)
-			u.blockedBranch++
 		}
 		if stop {
 			return
@@ -97,7 +88,18 @@ func (u *controlUnit) cycle(cycle int, ctx *risc.Context) {
 
 func (u *controlUnit) handleRunner(ctx *risc.Context, cycle int, pushed int, runner risc.InstructionRunnerPc) (push, stop bool) {
 	if pushed > 0 && runner.Runner.InstructionType().IsBranch() {
-		u.blockedBranch++
+		log.Stalli(ctx, "CU", runner.Runner.InstructionType(), runner.Pc, "branch")
+		u.stall = proc.StallControlHazard
+		return false, true
+	}
+
+	// An environment call is pushed once all the previous instructions are
+	// written back
+	if runner.Runner.InstructionType() == risc.Ecall &&
+		(pushed > 0 || len(ctx.PendingReadRegisters) > 0 || len(ctx.PendingWriteRegisters) > 0) {
+		log.Infoi(ctx, "CU", runner.Runner.InstructionType(), runner.Pc, "waiting for previous instructions")
+		log.Stalli(ctx, "CU", runner.Runner.InstructionType(), runner.Pc, "ecall")
+		u.stall = proc.StallEcall
 		return false, true
 	}
 
@@ -106,8 +108,9 @@ func (u *controlUnit) handleRunner(ctx *risc.Context, cycle int, pushed int, run
 		u.pushRunner(ctx, cycle, &runner)
 		return true, false
 	} else {
-		log.Infoi(ctx, "CU", runner.Runner.InstructionType(), runner.Pc, "data hazard: reason=%s", hazards)
-		u.blockedDataHazard++
+		log.Infoi(ctx, "CU", runner.Runner.InstructionType(), runner.Pc, "data hazard: reason=%+v", hazards)
+		log.Stalli(ctx, "CU", runner.Runner.InstructionType(), runner.Pc, "data hazard")
+		u.stall = proc.StallDataHazard
 		return false, true
 	}
 }
@@ -115,6 +118,7 @@ func (u *controlUnit) handleRunner(ctx *risc.Context, cycle int, pushed int, run
 func (u *controlUnit) pushRunner(ctx *risc.Context, cycle int, runner *risc.InstructionRunnerPc) {
 	u.outBus.Add(runner, cycle)
 	ctx.AddPendingRegisters(runner.Runner)
+	log.Tracei(ctx, "CU", trace.Dispatch, runner.Runner.InstructionType(), runner.Pc)
 	log.Infoi(ctx, "CU", runner.Runner.InstructionType(), runner.Pc, "pushing runner")
 }
 
@@ -2,64 +2,144 @@ package mvp6_0
 
 import (
 	"github.com/teivah/majorana/common/log"
+	"github.com/teivah/majorana/common/obs"
+	"github.com/teivah/majorana/common/trace"
+	"github.com/teivah/majorana/proc"
 	"github.com/teivah/majorana/proc/comp"
 	"github.com/teivah/majorana/risc"
 )
 
 type executeUnit struct {
+	name   string
 	bu     *btbBranchUnit
 	inBus  *comp.BufferedBus[*risc.InstructionRunnerPc]
 	outBus *comp.BufferedBus[risc.ExecutionContext]
 	mmu    *memoryManagementUnit
+	perf   *proc.PerfCounters
+	busy   *obs.Gauge
+	// speculation are the mitigations applied to the speculative loads
+	speculation proc.SpeculationOptions
+	// idle is set if no instruction progressed during the current cycle
+	idle bool
 
 	// Pending
-	coroutine func(cycle int, ctx *risc.Context, app risc.Application) (bool, int32, int32, bool, error)
+	coroutine func(cycle int, ctx *risc.Context, app risc.Application) (bool, int, int32, bool, error)
 	memory    []int8
 	runner    risc.InstructionRunnerPc
+	assertion assertion
 }
 
-func newExecuteUnit(bu *btbBranchUnit, inBus *comp.BufferedBus[*risc.InstructionRunnerPc], outBus *comp.BufferedBus[risc.ExecutionContext], mmu *memoryManagementUnit) *executeUnit {
+func newExecuteUnit(name string, bu *btbBranchUnit, speculation proc.SpeculationOptions, inBus *comp.BufferedBus[*risc.InstructionRunnerPc], outBus *comp.BufferedBus[risc.ExecutionContext], mmu *memoryManagementUnit, perf *proc.PerfCounters) *executeUnit {
 	return &executeUnit{
-		bu:     bu,
-		inBus:  inBus,
-		outBus: outBus,
-		mmu:    mmu,
+		name:        name,
+		bu:          bu,
+		speculation: speculation,
+		inBus:       inBus,
+		outBus:      outBus,
+		mmu:         mmu,
+		perf:        perf,
+		busy:        &obs.Gauge{},
 	}
 }
 
-func (u *executeUnit) cycle(cycle int, ctx *risc.Context, app risc.Application) (bool, int32, int32, bool, error) {
+func (u *executeUnit) cycle(cycle int, ctx *risc.Context, app risc.Application) (bool, int, int32, bool, error) {
+	u.idle = false
+	defer func() {
+		if u.idle {
+			u.busy.Push(0)
+		} else {
+			u.busy.Push(1)
+		}
+	}()
 	if u.coroutine != nil {
 		return u.coroutine(cycle, ctx, app)
 	}
 
 	runner, exists := u.inBus.Get()
 	if !exists {
+		u.idle = true
 		return false, 0, 0, false, nil
 	}
 	u.runner = *runner
+	if u.runner.Runner.InstructionType().IsMemoryWrite() {
+		u.mmu.issueStore(u.runner.Sequence)
+	} else if u.runner.Runner.InstructionType().IsMemoryRead() {
+		u.mmu.issueLoad(u.runner.Sequence)
+	}
 	u.coroutine = u.coPrepareRun
 	return u.coPrepareRun(cycle, ctx, app)
 }
 
-func (u *executeUnit) coPrepareRun(cycle int, ctx *risc.Context, app risc.Application) (bool, int32, int32, bool, error) {
+func (u *executeUnit) coPrepareRun(cycle int, ctx *risc.Context, app risc.Application) (bool, int, int32, bool, error) {
 	if !u.outBus.CanAdd() {
 		log.Infou(ctx, "EU", "can't add")
+		log.Stalli(ctx, u.name, u.runner.Runner.InstructionType(), u.runner.Pc, "write bus full")
+		u.perf.Stalls[proc.StallStructuralHazard]++
+		u.idle = true
+		return false, 0, 0, false, nil
+	}
+
+	// An environment call, and a load behind a load barrier, wait for the
+	// branches predicted before them to be resolved
+	if (u.runner.Runner.InstructionType() == risc.Ecall ||
+		u.speculation.LoadBarrier && u.runner.Runner.InstructionType().IsMemoryRead()) &&
+		u.bu.isSpeculative(u.runner.Speculation) {
+		log.Stalli(ctx, u.name, u.runner.Runner.InstructionType(), u.runner.Pc, "speculation")
+		u.perf.Stalls[proc.StallSpeculation]++
+		u.idle = true
+		return false, 0, 0, false, nil
+	}
+	if u.runner.Runner.InstructionType().IsMemoryRead() && u.mmu.isStorePendingBefore(u.runner.Sequence) {
+		// A load reads the memory once the older stores are performed
+		log.Stalli(ctx, u.name, u.runner.Runner.InstructionType(), u.runner.Pc, "pending store")
+		u.perf.Stalls[proc.StallDataHazard]++
+		u.idle = true
+		return false, 0, 0, false, nil
+	}
+	if u.runner.Runner.InstructionType().IsMemoryWrite() &&
+		(u.mmu.isLoadPendingBefore(u.runner.Sequence) || u.mmu.isStorePendingBefore(u.runner.Sequence)) {
+		// A store writes the memory once the older loads have read it and
+		// the older stores are performed
+		log.Stalli(ctx, u.name, u.runner.Runner.InstructionType(), u.runner.Pc, "pending memory access")
+		u.perf.Stalls[proc.StallDataHazard]++
+		u.idle = true
 		return false, 0, 0, false, nil
 	}
 
 	// Create the branch unit assertions
-	u.bu.assert(u.runner)
+	u.assertion = u.bu.assert(ctx, u.runner)
 
 	log.Infoi(ctx, "EU", u.runner.Runner.InstructionType(), u.runner.Pc, "executing")
 
+	if u.runner.Runner.InstructionType() == risc.Ecall {
+		// The handler accesses the memory directly so the L1D is written back
+		// first
+		remainingCycles := u.mmu.writeBack() - 1
+		if remainingCycles >= 0 {
+			u.perf.Stalls[proc.StallEcall] += remainingCycles + 1
+			u.coroutine = func(cycle int, ctx *risc.Context, app risc.Application) (bool, int, int32, bool, error) {
+				if remainingCycles > 0 {
+					remainingCycles--
+					return false, 0, 0, false, nil
+				}
+				return u.coRun(cycle, ctx, app)
+			}
+			return false, 0, 0, false, nil
+		}
+	}
+
 	addrs := u.runner.Runner.MemoryRead(ctx)
 	if len(addrs) != 0 {
-		if memory, exists := u.mmu.getFromL1D(addrs); exists {
-			u.memory = memory
+		fill := !u.speculation.NoSpeculativeFill || !u.bu.isSpeculative(u.runner.Speculation)
+		memory, hit, cycles := u.mmu.load(u.runner.Pc, addrs, fill)
+		u.mmu.performLoad(u.runner.Sequence)
+		u.memory = memory
+		if hit {
+			u.perf.L1D.Hits++
 			// As the coroutine is executed the next cycle, if a L1D access takes
 			// one cycle, we should be good to go during the next cycle
 			remainingCycles := cycleL1DAccess - 1
-			u.coroutine = func(cycle int, ctx *risc.Context, app risc.Application) (bool, int32, int32, bool, error) {
+			u.coroutine = func(cycle int, ctx *risc.Context, app risc.Application) (bool, int, int32, bool, error) {
 				if remainingCycles > 0 {
 					remainingCycles--
 					return false, 0, 0, false, nil
@@ -68,20 +148,16 @@ func (u *executeUnit) coPrepareRun(cycle int, ctx *risc.Context, app risc.Applic
 			}
 			return false, 0, 0, false, nil
 		} else {
-			remainingCycles := cyclesMemoryAccess - 1
+			log.Stalli(ctx, "MMU", u.runner.Runner.InstructionType(), u.runner.Pc, "L1D miss")
+			u.perf.L1D.Misses++
+			u.perf.Stalls[proc.StallL1DMiss] += cycles
+			remainingCycles := cycles - 1
 
-			u.coroutine = func(cycle int, ctx *risc.Context, app risc.Application) (bool, int32, int32, bool, error) {
+			u.coroutine = func(cycle int, ctx *risc.Context, app risc.Application) (bool, int, int32, bool, error) {
 				if remainingCycles > 0 {
 					remainingCycles--
 					return false, 0, 0, false, nil
 				}
-				line := u.mmu.fetchCacheLine(addrs[0])
-				u.mmu.pushLineToL1D(addrs[0], line)
-				m, exists := u.mmu.getFromL1D(addrs)
-				if !exists {
-					panic("cache line doesn't exist")
-				}
-				u.memory = m
 				return u.coRun(cycle, ctx, app)
 			}
 			return false, 0, 0, false, nil
@@ -90,44 +166,108 @@ func (u *executeUnit) coPrepareRun(cycle int, ctx *risc.Context, app risc.Applic
 	return u.coRun(cycle, ctx, app)
 }
 
-func (u *executeUnit) coRun(cycle int, ctx *risc.Context, app risc.Application) (bool, int32, int32, bool, error) {
+func (u *executeUnit) coRun(cycle int, ctx *risc.Context, app risc.Application) (bool, int, int32, bool, error) {
 	u.coroutine = nil
+	log.Tracei(ctx, u.name, trace.Execute, u.runner.Runner.InstructionType(), u.runner.Pc)
 	execution, err := u.runner.Runner.Run(ctx, app.Labels, u.runner.Pc, u.memory)
 	if err != nil {
 		return false, 0, 0, false, err
 	}
-	if execution.Return {
-		return false, 0, 0, true, nil
-	}
-
-	if execution.MemoryChange && u.mmu.doesExecutionMemoryChangesExistsInL1D(execution) {
-		u.mmu.writeExecutionMemoryChangesToL1D(execution)
-		ctx.DeletePendingRegisters(u.runner.Runner.ReadRegisters(), u.runner.Runner.WriteRegisters())
+	if execution.Return || execution.MemoryChange {
+		if !u.bu.isSpeculative(u.runner.Speculation) {
+			return u.perform(ctx, execution)
+		}
+		// The memory and the end of the program aren't changed until the
+		// branches predicted before are resolved
+		log.Stalli(ctx, u.name, u.runner.Runner.InstructionType(), u.runner.Pc, "speculation")
+		u.perf.Stalls[proc.StallSpeculation]++
+		u.coroutine = func(cycle int, ctx *risc.Context, app risc.Application) (bool, int, int32, bool, error) {
+			if u.bu.isSpeculative(u.runner.Speculation) {
+				log.Stalli(ctx, u.name, u.runner.Runner.InstructionType(), u.runner.Pc, "speculation")
+				u.perf.Stalls[proc.StallSpeculation]++
+				u.idle = true
+				return false, 0, 0, false, nil
+			}
+			u.coroutine = nil
+			return u.perform(ctx, execution)
+		}
 		return false, 0, 0, false, nil
 	}
-
 	u.outBus.Add(risc.ExecutionContext{
 		Pc:              u.runner.Pc,
 		Execution:       execution,
 		InstructionType: u.runner.Runner.InstructionType(),
 		WriteRegisters:  u.runner.Runner.WriteRegisters(),
 		ReadRegisters:   u.runner.Runner.ReadRegisters(),
+		Sequence:        u.runner.Sequence,
+		Speculation:     u.runner.Speculation,
 	}, cycle)
 
+	if u.runner.Runner.InstructionType() == risc.Ecall {
+		// The decode unit resumes after the environment call
+		log.Flush(ctx, u.name, u.runner.Pc, u.runner.Pc+4)
+		return true, u.runner.Sequence, u.runner.Pc + 4, false, nil
+	}
 	if u.runner.Runner.InstructionType().IsUnconditionalBranch() {
 		log.Infoi(ctx, "EU", u.runner.Runner.InstructionType(), u.runner.Pc,
 			"notify jump address resolved from %d to %d", u.runner.Pc/4, execution.NextPc/4)
-		u.bu.notifyJumpAddressResolved(u.runner.Pc, execution.NextPc)
+		u.bu.resolveJump(ctx, u.runner, execution.NextPc)
 	}
-	if execution.PcChange && u.bu.shouldFlushPipeline(execution.NextPc) {
+	if execution.PcChange && u.assertion.shouldFlushPipeline(execution.NextPc) {
 		log.Infoi(ctx, "EU", u.runner.Runner.InstructionType(), u.runner.Pc,
 			"should be a flush")
-		return true, u.runner.Pc, execution.NextPc, false, nil
+		log.Flush(ctx, "BU", u.runner.Pc, execution.NextPc)
+		u.perf.Mispredictions++
+		return true, u.runner.Sequence, execution.NextPc, false, nil
+	}
+	if u.runner.Runner.InstructionType().IsConditionalBranch() && u.bu.resolve(u.runner, execution.PcChange, execution.NextPc) {
+		nextPc := u.runner.Pc + 4
+		if execution.PcChange {
+			nextPc = execution.NextPc
+		}
+		log.Flush(ctx, "BU", u.runner.Pc, nextPc)
+		u.perf.Mispredictions++
+		return true, u.runner.Sequence, nextPc, false, nil
 	}
 
 	return false, 0, 0, false, nil
 }
 
+// perform ends the program or writes the memory once the instruction isn't
+// speculative anymore.
+func (u *executeUnit) perform(ctx *risc.Context, execution risc.Execution) (bool, int, int32, bool, error) {
+	if execution.Return {
+		u.perf.Instructions++
+		ctx.Retire(u.runner.Pc, execution)
+		return false, u.runner.Sequence, 0, true, nil
+	}
+
+	hit, cycles := u.mmu.store(u.runner.Pc, execution)
+	u.mmu.performStore(u.runner.Sequence)
+	if hit {
+		u.perf.L1D.Hits++
+	} else {
+		u.perf.L1D.Misses++
+	}
+	u.perf.Instructions++
+	ctx.Retire(u.runner.Pc, execution)
+	log.Tracei(ctx, "MMU", trace.Writeback, u.runner.Runner.InstructionType(), u.runner.Pc)
+	ctx.DeletePendingRegisters(u.runner.Runner.ReadRegisters(), u.runner.Runner.WriteRegisters())
+	if cycles > 0 {
+		log.Stalli(ctx, "MMU", u.runner.Runner.InstructionType(), u.runner.Pc, "memory write")
+		u.perf.Stalls[proc.StallMemoryWrite] += cycles
+		remainingCycles := cycles
+		u.coroutine = func(int, *risc.Context, risc.Application) (bool, int, int32, bool, error) {
+			remainingCycles--
+			if remainingCycles == 0 {
+				u.coroutine = nil
+			}
+			return false, 0, 0, false, nil
+		}
+	}
+	return false, 0, 0, false, nil
+}
+
 func (u *executeUnit) flush() {
 	u.coroutine = nil
 }
@@ -2,6 +2,9 @@ package mvp6_0
 
 import (
 	"github.com/teivah/majorana/common/log"
+	"github.com/teivah/majorana/common/obs"
+	"github.com/teivah/majorana/common/trace"
+	"github.com/teivah/majorana/proc"
 	"github.com/teivah/majorana/proc/comp"
 	"github.com/teivah/majorana/risc"
 )
@@ -12,15 +15,19 @@ type fetchUnit struct {
 	outBus         *comp.BufferedBus[int32]
 	complete       bool
 	mmu            *memoryManagementUnit
+	perf           *proc.PerfCounters
+	busy           *obs.Gauge
 	// Pending
 	coroutine       func(cycle int, app risc.Application, ctx *risc.Context)
 	remainingCycles int
 }
 
-func newFetchUnit(mmu *memoryManagementUnit, outBus *comp.BufferedBus[int32]) *fetchUnit {
+func newFetchUnit(mmu *memoryManagementUnit, outBus *comp.BufferedBus[int32], perf *proc.PerfCounters) *fetchUnit {
 	return &fetchUnit{
 		mmu:    mmu,
 		outBus: outBus,
+		perf:   perf,
+		busy:   &obs.Gauge{},
 	}
 }
 
@@ -32,24 +39,43 @@ func (u *fetchUnit) cycle(cycle int, app risc.Application, ctx *risc.Context) {
 		u.outBus.Clean()
 		u.toCleanPending = false
 	}
+	busy := 0
+	defer func() {
+		u.busy.Push(busy)
+	}()
 	if u.coroutine != nil {
+		if !u.complete {
+			busy = 1
+		}
 		u.coroutine(cycle, app, ctx)
 		return
 	}
 
-	u.coFetch(cycle, app, ctx)
+	if u.coFetch(cycle, app, ctx) {
+		busy = 1
+	}
 }
 
-func (u *fetchUnit) coFetch(cycle int, app risc.Application, ctx *risc.Context) {
+// coFetch returns whether at least one instruction was fetched or requested to
+// the memory.
+func (u *fetchUnit) coFetch(cycle int, app risc.Application, ctx *risc.Context) bool {
 	u.coroutine = nil
 	for i := 0; i < u.outBus.OutLength(); i++ {
 		if !u.outBus.CanAdd() {
 			log.Infou(ctx, "FU", "can't add")
-			return
+			log.Stallu(ctx, "FU", "decode bus full")
+			if i == 0 {
+				u.perf.Stalls[proc.StallStructuralHazard]++
+			}
+			return i > 0
 		}
 
 		if _, exists := u.mmu.getFromL1I([]int32{u.pc}); !exists {
-			u.remainingCycles = cyclesMemoryAccess - 1
+			log.Stallpc(ctx, "MMU", u.pc, "L1I miss")
+			u.perf.L1I.Misses++
+			cycles := u.mmu.fetchInstructionLine(app, u.pc)
+			u.perf.Stalls[proc.StallL1IMiss] += cycles
+			u.remainingCycles = cycles - 1
 			u.coroutine = func(cycle int, app risc.Application, ctx *risc.Context) {
 				if u.remainingCycles != 0 {
 					log.Infou(ctx, "FU", "pending memory access")
@@ -57,7 +83,6 @@ func (u *fetchUnit) coFetch(cycle int, app risc.Application, ctx *risc.Context)
 					return
 				}
 				u.coroutine = nil
-				u.mmu.pushLineToL1I(u.pc, make([]int8, l1ICacheLineSize))
 
 				currentPc := u.pc
 				u.pc += 4
@@ -66,11 +91,13 @@ func (u *fetchUnit) coFetch(cycle int, app risc.Application, ctx *risc.Context)
 					u.complete = true
 				}
 				log.Infou(ctx, "FU", "pushing new element from pc %d", currentPc/4)
+				log.Tracepc(ctx, "FU", trace.Fetch, currentPc)
 				u.outBus.Add(currentPc, cycle)
 			}
-			return
+			return true
 		}
 
+		u.perf.L1I.Hits++
 		currentPc := u.pc
 		u.pc += 4
 		if u.pc/4 >= int32(len(app.Instructions)) {
@@ -78,8 +105,10 @@ func (u *fetchUnit) coFetch(cycle int, app risc.Application, ctx *risc.Context)
 			u.complete = true
 		}
 		log.Infou(ctx, "FU", "pushing new element from pc %d", currentPc/4)
+		log.Tracepc(ctx, "FU", trace.Fetch, currentPc)
 		u.outBus.Add(currentPc, cycle)
 	}
+	return true
 }
 
 func (u *fetchUnit) reset(pc int32, cleanPending bool) {
@@ -1,52 +1,115 @@
 package mvp6_0
 
 import (
+	"math"
+	"slices"
 	"sort"
 
+	"github.com/teivah/majorana/proc"
 	"github.com/teivah/majorana/proc/comp"
 	"github.com/teivah/majorana/risc"
 )
 
+// codeAddress is the address of the machine code in the memory hierarchy, the
+// code and the data being in distinct address spaces.
+const codeAddress = math.MinInt32
+
 type memoryManagementUnit struct {
-	ctx *risc.Context
-	l1i *comp.LRUCache
-	l1d *comp.LRUCache
+	ctx    *risc.Context
+	l1i    *comp.Cache
+	l1d    *comp.Cache
+	memory *comp.Memory
+	// next is the level below the L1 caches
+	next        comp.MemoryLevel
+	l1iPrefetch *comp.Prefetch
+	l1dPrefetch *comp.Prefetch
+	// stores and loads are the sequences of the memory accesses executing
+	// and not yet performed
+	stores []int
+	loads  []int
 }
 
-func newMemoryManagementUnit(ctx *risc.Context) *memoryManagementUnit {
+func newMemoryManagementUnit(ctx *risc.Context, opts proc.Options) *memoryManagementUnit {
+	memory := comp.NewMemory(opts.MemoryLatency)
+	memory.Map(0, ctx.Memory)
+	l1i := comp.NewCache(opts.L1ICache(liICacheSize))
+	l1d := comp.NewCache(opts.L1DCache(liDCacheSize))
+	next := opts.MemoryHierarchy(memory)
 	return &memoryManagementUnit{
-		ctx: ctx,
-		l1i: comp.NewLRUCache(l1ICacheLineSize, liICacheSize),
-		l1d: comp.NewLRUCache(l1DCacheLineSize, liDCacheSize),
+		ctx:         ctx,
+		l1i:         l1i,
+		l1d:         l1d,
+		memory:      memory,
+		next:        next,
+		l1iPrefetch: comp.NewPrefetch(opts.L1IPrefetcher(), l1i, next, codeAddress),
+		l1dPrefetch: comp.NewPrefetch(opts.L1DPrefetcher(), l1d, next, 0),
 	}
 }
 
+// getFromL1I returns the machine code at addrs if cached, the L1I prefetcher
+// being notified of a hit.
 func (u *memoryManagementUnit) getFromL1I(addrs []int32) ([]int8, bool) {
-	memory := make([]int8, 0, len(addrs))
-	for _, addr := range addrs {
-		v, exists := u.l1i.Get(addr)
-		if !exists {
-			return nil, false
-		}
-		memory = append(memory, v)
+	u.l1iPrefetch.Fill(u.ctx.Cycle)
+	memory, exists := u.l1i.Read(addrs)
+	if exists {
+		u.l1iPrefetch.Hit(addrs[0])
+		u.l1iPrefetch.Issue(addrs[0], addrs[0], true, u.ctx.Cycle)
 	}
-	return memory, true
+	return memory, exists
 }
 
-func (u *memoryManagementUnit) pushLineToL1I(addr int32, line []int8) {
-	u.l1i.PushLine(addr, line)
+// fetchInstructionLine fetches the machine code line containing addr into the
+// L1I, the L1I prefetcher being notified of the miss. It returns the number
+// of cycles taken.
+func (u *memoryManagementUnit) fetchInstructionLine(app risc.Application, addr int32) int {
+	// The application isn't known when the unit is created
+	u.memory.Map(codeAddress, app.Code)
+	line, cycles, late := u.l1iPrefetch.Miss(addr, u.ctx.Cycle)
+	if !late {
+		line, cycles = u.next.Read(codeAddress+u.l1i.LineAddress(addr), l1ICacheLineSize, u.ctx.Cycle)
+	}
+	if evicted, exists := u.l1i.PushLine(addr, line); exists {
+		u.l1iPrefetch.Evicted(evicted)
+	}
+	u.l1iPrefetch.Issue(addr, addr, false, u.ctx.Cycle)
+	return cycles
 }
 
+// getFromL1D returns the values at addrs if they are all cached.
 func (u *memoryManagementUnit) getFromL1D(addrs []int32) ([]int8, bool) {
-	memory := make([]int8, 0, len(addrs))
-	for _, addr := range addrs {
-		v, exists := u.l1d.Get(addr)
+	u.l1dPrefetch.Fill(u.ctx.Cycle)
+	memory, exists := u.l1d.Read(addrs)
+	if exists {
+		for _, addr := range addrs {
+			u.l1dPrefetch.Hit(addr)
+		}
+	}
+	return memory, exists
+}
+
+// load returns the values at addrs read by the instruction at pc and whether
+// they were all cached. On a miss, the lines are fetched first, the number of
+// cycles taken is returned including the dirty lines evicted written back.
+// The L1D prefetcher is notified of the access. If fill is false, the lines
+// missed are read without being cached and the prefetcher isn't notified,
+// leaving no trace of the access in the L1D.
+func (u *memoryManagementUnit) load(pc int32, addrs []int32, fill bool) ([]int8, bool, int) {
+	memory, hit := u.getFromL1D(addrs)
+	cycles := 0
+	if !hit && !fill {
+		memory, cycles = u.readCacheLines(addrs)
+		return memory, false, cycles
+	}
+	if !hit {
+		cycles = u.fetchCacheLines(addrs)
+		m, exists := u.getFromL1D(addrs)
 		if !exists {
-			return nil, false
+			panic("cache line doesn't exist")
 		}
-		memory = append(memory, v)
+		memory = m
 	}
-	return memory, true
+	u.l1dPrefetch.Issue(pc, addrs[0], hit, u.ctx.Cycle)
+	return memory, hit, cycles
 }
 
 func (u *memoryManagementUnit) doesExecutionMemoryChangesExistsInL1D(execution risc.Execution) bool {
@@ -58,7 +121,8 @@ func (u *memoryManagementUnit) doesExecutionMemoryChangesExistsInL1D(execution r
 	return exists
 }
 
-func (u *memoryManagementUnit) writeExecutionMemoryChangesToL1D(execution risc.Execution) {
+// memoryChanges returns the contiguous memory changes of an execution.
+func memoryChanges(execution risc.Execution) (int32, []int8) {
 	type change struct {
 		addr   int32
 		change int8
@@ -77,57 +141,232 @@ func (u *memoryManagementUnit) writeExecutionMemoryChangesToL1D(execution risc.E
 	for _, c := range changes {
 		data = append(data, c.change)
 	}
-	u.writeToL1D(changes[0].addr, data)
+	return changes[0].addr, data
+}
+
+func (u *memoryManagementUnit) writeExecutionMemoryChangesToL1D(execution risc.Execution) {
+	u.writeToL1D(memoryChanges(execution))
+}
+
+// fetchCacheLines fetches the L1D lines containing addrs from the lower
+// levels or from the prefetches in flight, the lines already cached are kept.
+// It returns the number of cycles taken, including the dirty lines evicted
+// written back.
+func (u *memoryManagementUnit) fetchCacheLines(addrs []int32) int {
+	cycles := 0
+	for _, addr := range addrs {
+		if u.l1d.Contains(addr) {
+			continue
+		}
+		line, c, late := u.l1dPrefetch.Miss(addr, u.ctx.Cycle+cycles)
+		if !late {
+			line, c = u.next.Read(u.l1d.LineAddress(addr), l1DCacheLineSize, u.ctx.Cycle+cycles)
+		}
+		cycles += c
+		cycles += u.pushLineToL1D(addr, line, u.ctx.Cycle+cycles)
+	}
+	return cycles
 }
 
-func (u *memoryManagementUnit) getFromMemory(addrs []int32) []int8 {
+// readCacheLines reads the values at addrs from the L1D lines cached and
+// from the lower levels for the others, without caching them. It returns the
+// number of cycles taken.
+func (u *memoryManagementUnit) readCacheLines(addrs []int32) ([]int8, int) {
 	memory := make([]int8, 0, len(addrs))
+	lines := make(map[int32][]int8)
+	cycles := 0
 	for _, addr := range addrs {
-		memory = append(memory, u.ctx.Memory[addr])
+		if v, exists := u.l1d.Get(addr); exists {
+			memory = append(memory, v)
+			continue
+		}
+		lineAddr := u.l1d.LineAddress(addr)
+		line, exists := lines[lineAddr]
+		if !exists {
+			var c int
+			line, c = u.next.Read(lineAddr, l1DCacheLineSize, u.ctx.Cycle+cycles)
+			cycles += c
+			lines[lineAddr] = line
+		}
+		memory = append(memory, line[addr-lineAddr])
+	}
+	return memory, cycles
+}
+
+// pushLineToL1D pushes a line and writes back the line evicted if dirty from
+// cycle at. It returns the number of cycles taken.
+func (u *memoryManagementUnit) pushLineToL1D(addr int32, line []int8, at int) int {
+	evicted, exists := u.l1d.PushLine(addr, line)
+	if !exists {
+		return 0
 	}
-	return memory
+	u.l1dPrefetch.Evicted(evicted)
+	if !evicted.Dirty {
+		return 0
+	}
+	return u.next.Write(evicted.Boundary[0], evicted.Data, at)
 }
 
-func (u *memoryManagementUnit) fetchCacheLine(addr int32) []int8 {
-	memory := make([]int8, 0, l1DCacheLineSize)
-	for i := 0; i < l1DCacheLineSize; i++ {
-		if int(addr)+i >= len(u.ctx.Memory) {
-			memory = append(memory, 0)
-		} else {
-			memory = append(memory, u.ctx.Memory[int(addr)+i])
+// store writes the memory changes of an execution according to the write
+// policies of the L1D. A store missing a write-allocate L1D fetches its lines
+// first, a store missing a no-write-allocate L1D is written around it. The
+// L1D prefetcher is notified of the access by the
+// instruction at pc. It returns whether the lines were cached and the number
+// of cycles taken by the lower levels.
+func (u *memoryManagementUnit) store(pc int32, execution risc.Execution) (bool, int) {
+	hit := u.doesExecutionMemoryChangesExistsInL1D(execution)
+	addr, data := memoryChanges(execution)
+	cycles := 0
+	if !hit {
+		if u.l1d.Config().NoWriteAllocate {
+			// The prefetches of the lines written are outdated
+			u.l1dPrefetch.Cancel(addr)
+			u.l1dPrefetch.Cancel(addr + int32(len(data)) - 1)
+			cycles := u.writeAround(addr, data)
+			u.l1dPrefetch.Issue(pc, addr, false, u.ctx.Cycle)
+			return false, cycles
+		}
+		addrs := make([]int32, 0, len(execution.MemoryChanges))
+		for addr := range execution.MemoryChanges {
+			addrs = append(addrs, addr)
 		}
+		cycles += u.fetchCacheLines(addrs)
 	}
-	return memory
+	u.writeToL1D(addr, data)
+	if u.l1d.Config().Write == comp.WriteThrough {
+		cycles += u.next.Write(addr, data, u.ctx.Cycle+cycles)
+	}
+	u.l1dPrefetch.Issue(pc, addr, hit, u.ctx.Cycle)
+	return hit, cycles
+}
+
+// issueStore records a store starting its execution, the younger loads wait
+// for it to be performed.
+func (u *memoryManagementUnit) issueStore(sequence int) {
+	u.stores = append(u.stores, sequence)
+}
+
+// performStore records a store performed.
+func (u *memoryManagementUnit) performStore(sequence int) {
+	u.stores = slices.DeleteFunc(u.stores, func(s int) bool {
+		return s == sequence
+	})
+}
+
+// isStorePendingBefore returns whether a store older than the instruction of
+// sequence isn't performed yet.
+func (u *memoryManagementUnit) isStorePendingBefore(sequence int) bool {
+	return slices.ContainsFunc(u.stores, func(s int) bool {
+		return s < sequence
+	})
+}
+
+// issueLoad records a load starting its execution, the younger stores wait
+// for it to read the memory.
+func (u *memoryManagementUnit) issueLoad(sequence int) {
+	u.loads = append(u.loads, sequence)
+}
+
+// performLoad records a load having read the memory.
+func (u *memoryManagementUnit) performLoad(sequence int) {
+	u.loads = slices.DeleteFunc(u.loads, func(s int) bool {
+		return s == sequence
+	})
+}
+
+// isLoadPendingBefore returns whether a load older than the instruction of
+// sequence hasn't read the memory yet.
+func (u *memoryManagementUnit) isLoadPendingBefore(sequence int) bool {
+	return slices.ContainsFunc(u.loads, func(s int) bool {
+		return s < sequence
+	})
+}
+
+// squash discards the memory accesses younger than the instruction of
+// sequence from.
+func (u *memoryManagementUnit) squash(from int) {
+	younger := func(s int) bool {
+		return s > from
+	}
+	u.stores = slices.DeleteFunc(u.stores, younger)
+	u.loads = slices.DeleteFunc(u.loads, younger)
 }
 
-func (u *memoryManagementUnit) pushLineToL1D(addr int32, line []int8) {
-	evicted := u.l1d.PushLine(addr, line)
-	if len(evicted) == 0 {
-		return
+// writeAround writes data from addr without allocating its lines: the bytes
+// of a line cached are written to the L1D, and through if the L1D is
+// write-through, the others to the lower levels only. It returns the number of
+// cycles taken by the lower levels.
+func (u *memoryManagementUnit) writeAround(addr int32, data []int8) int {
+	cycles := 0
+	for len(data) > 0 {
+		n := min(len(data), int(u.l1d.LineAddress(addr)+l1DCacheLineSize-addr))
+		cached := u.l1d.Contains(addr)
+		if cached {
+			u.writeToL1D(addr, data[:n])
+		}
+		if !cached || u.l1d.Config().Write == comp.WriteThrough {
+			cycles += u.next.Write(addr, data[:n], u.ctx.Cycle+cycles)
+		}
+		addr += int32(n)
+		data = data[n:]
 	}
-	u.writeToMemory(addr, line)
+	return cycles
 }
 
 func (u *memoryManagementUnit) writeToL1D(addr int32, data []int8) {
 	u.l1d.Write(addr, data)
 }
 
-func (u *memoryManagementUnit) writeToMemory(addr int32, data []int8) {
-	for i, v := range data {
-		if int(addr)+i >= len(u.ctx.Memory) {
-			return
+// flush writes the dirty L1D lines back down to the memory. It returns the
+// number of cycles.
+func (u *memoryManagementUnit) flush() int {
+	cycles := 0
+	for _, line := range u.l1d.Lines() {
+		if line.Dirty {
+			cycles += u.next.Write(line.Boundary[0], line.Data, u.ctx.Cycle+cycles)
 		}
-		u.ctx.Memory[addr+int32(i)] = v
 	}
+	return cycles + u.next.Flush(u.ctx.Cycle+cycles)
 }
 
-func (u *memoryManagementUnit) flush() int {
-	additionalCycles := 0
-	for _, line := range u.l1d.Lines() {
-		additionalCycles += cyclesMemoryAccess
-		for i := 0; i < l1DCacheLineSize; i++ {
-			u.writeToMemory(line.Boundary[0], line.Data)
+// writeBack writes the dirty L1D lines back down to the memory and
+// invalidates the caches so that the memory can be accessed directly. It
+// returns the number of cycles.
+func (u *memoryManagementUnit) writeBack() int {
+	cycles := u.flush()
+	u.l1d.Invalidate()
+	u.l1dPrefetch.Invalidate()
+	return cycles
+}
+
+// counters sets the counters of the prefetchers, the L2, the L3 and the DRAM,
+// left to zero if missing.
+func (u *memoryManagementUnit) counters(perf *proc.PerfCounters) {
+	perf.L1IPrefetch = prefetchCounters(u.l1iPrefetch.Stats())
+	perf.L1DPrefetch = prefetchCounters(u.l1dPrefetch.Stats())
+	bottom := u.next
+	counters := []*proc.CacheCounters{&perf.L2, &perf.L3}
+	for i, level := range comp.CacheLevels(u.next) {
+		stats := level.Cache().Stats()
+		*counters[i] = proc.CacheCounters{Hits: stats.Hits, Misses: stats.Misses}
+		bottom = level.Next()
+	}
+	if dram, ok := bottom.(*comp.DRAM); ok {
+		stats := dram.Stats()
+		perf.DRAM = proc.DRAMCounters{
+			RowHits:      stats.RowHits,
+			RowMisses:    stats.RowMisses,
+			RowConflicts: stats.RowConflicts,
+			QueueCycles:  stats.QueueCycles,
 		}
 	}
-	return additionalCycles
+}
+
+func prefetchCounters(stats comp.PrefetchStats) proc.PrefetchCounters {
+	return proc.PrefetchCounters{
+		Issued:    stats.Issued,
+		Useful:    stats.Useful,
+		Late:      stats.Late,
+		Polluting: stats.Polluting,
+	}
 }
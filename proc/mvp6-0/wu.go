@@ -1,40 +1,96 @@
 package mvp6_0
 
 import (
+	"slices"
+
 	"github.com/teivah/majorana/common/log"
+	"github.com/teivah/majorana/common/obs"
+	"github.com/teivah/majorana/common/trace"
+	"github.com/teivah/majorana/proc"
 	"github.com/teivah/majorana/proc/comp"
 	"github.com/teivah/majorana/risc"
 )
 
 type writeUnit struct {
+	name        string
 	memoryWrite risc.ExecutionContext
+	bu          *btbBranchUnit
 	inBus       *comp.BufferedBus[risc.ExecutionContext]
+	perf        *proc.PerfCounters
+	busy        *obs.Gauge
+	// speculative are the executions written once the branches predicted
+	// before them are resolved
+	speculative []risc.ExecutionContext
 
 	// Pending
 	coroutine func(ctx *risc.Context)
 }
 
-func newWriteUnit(inBus *comp.BufferedBus[risc.ExecutionContext]) *writeUnit {
-	return &writeUnit{inBus: inBus}
+func newWriteUnit(name string, bu *btbBranchUnit, inBus *comp.BufferedBus[risc.ExecutionContext], perf *proc.PerfCounters) *writeUnit {
+	return &writeUnit{name: name, bu: bu, inBus: inBus, perf: perf, busy: &obs.Gauge{}}
 }
 
-func (u *writeUnit) cycle(ctx *risc.Context, before int32) {
+// cycle writes an execution back, before is the sequence of the last
+// instruction written, -1 if none.
+func (u *writeUnit) cycle(ctx *risc.Context, before int) {
+	busy := 1
+	defer func() {
+		u.busy.Push(busy)
+	}()
 	if u.coroutine != nil {
 		u.coroutine(ctx)
 		return
 	}
 
+	written := u.writeResolved(ctx, before)
 	execution, exists := u.inBus.Get()
 	if !exists {
+		if !written {
+			busy = 0
+		}
+		return
+	}
+	if before != -1 && execution.Sequence > before {
+		if !written {
+			busy = 0
+		}
 		return
 	}
-	if before != -1 && execution.Pc > before {
+	if u.bu.isSpeculative(execution.Speculation) {
+		log.Infoi(ctx, "WU", execution.InstructionType, execution.Pc, "speculative")
+		u.speculative = append(u.speculative, execution)
 		return
 	}
+	u.write(ctx, execution)
+}
+
+// writeResolved discards the speculative executions after before and writes
+// the ones whose predicted branches are resolved. It returns whether one was
+// written.
+func (u *writeUnit) writeResolved(ctx *risc.Context, before int) bool {
+	written := false
+	u.speculative = slices.DeleteFunc(u.speculative, func(execution risc.ExecutionContext) bool {
+		if before != -1 && execution.Sequence > before {
+			return true
+		}
+		if u.bu.isSpeculative(execution.Speculation) {
+			return false
+		}
+		u.write(ctx, execution)
+		written = true
+		return true
+	})
+	return written
+}
+
+func (u *writeUnit) write(ctx *risc.Context, execution risc.ExecutionContext) {
+	u.perf.Instructions++
+	ctx.Retire(execution.Pc, execution.Execution)
 	if execution.Execution.RegisterChange {
 		ctx.WriteRegister(execution.Execution)
 		ctx.DeletePendingRegisters(execution.ReadRegisters, execution.WriteRegisters)
 		log.Infoi(ctx, "WU", execution.InstructionType, -1, "write to register")
+		log.Tracei(ctx, u.name, trace.Writeback, execution.InstructionType, execution.Pc)
 	} else if execution.Execution.MemoryChange {
 		remainingCycle := cyclesMemoryAccess
 		log.Infoi(ctx, "WU", execution.InstructionType, -1, "pending memory write")
@@ -49,15 +105,17 @@ func (u *writeUnit) cycle(ctx *risc.Context, before int32) {
 			ctx.WriteMemory(u.memoryWrite.Execution)
 			ctx.DeletePendingRegisters(u.memoryWrite.ReadRegisters, u.memoryWrite.WriteRegisters)
 			log.Infoi(ctx, "WU", u.memoryWrite.InstructionType, -1, "write to memory")
+			log.Tracei(ctx, u.name, trace.Writeback, u.memoryWrite.InstructionType, u.memoryWrite.Pc)
 		}
 
 		u.memoryWrite = execution
 	} else {
 		ctx.DeletePendingRegisters(execution.ReadRegisters, execution.WriteRegisters)
 		log.Infoi(ctx, "WU", execution.InstructionType, -1, "cleaning")
+		log.Tracei(ctx, u.name, trace.Writeback, execution.InstructionType, execution.Pc)
 	}
 }
 
 func (u *writeUnit) isEmpty() bool {
-	return u.coroutine == nil
+	return u.coroutine == nil && len(u.speculative) == 0
 }
@@ -1,60 +1,245 @@
 package mvp6_1
 
 import (
+	"slices"
+
+	"github.com/teivah/majorana/common/log"
+	"github.com/teivah/majorana/proc"
+	"github.com/teivah/majorana/proc/comp"
 	"github.com/teivah/majorana/risc"
 )
 
 type btbBranchUnit struct {
-	btb         *branchTargetBuffer
-	fu          *fetchUnit
-	du          *decodeUnit
+	btb       *comp.BranchTargetBuffer
+	predictor comp.BranchPredictor
+	ras       *comp.ReturnAddressStack
+	fu        *fetchUnit
+	du        *decodeUnit
+	perf      *proc.PerfCounters
+	// sequence is the sequence of the last instruction decoded
+	sequence int
+	// unresolved are the sequences of the predicted branches not yet resolved,
+	// in decode order
+	unresolved []int
+	// directions are the sequences of the conditional branches whose
+	// predicted direction extends the global history until resolved, in
+	// decode order
+	directions []int
+	// jumps are the sequences of the calls and returns decoded not yet
+	// resolved, in decode order
+	jumps []int
+}
+
+// assertion is the next pc assumed for an instruction, each execute unit
+// checks its own as several branches may be executed at the same time.
+type assertion struct {
 	toCheck     bool
 	expectation int32
 }
 
-func newBTBBranchUnit(btbSize int, fu *fetchUnit, du *decodeUnit) *btbBranchUnit {
+func newBTBBranchUnit(btb *comp.BranchTargetBuffer, predictor comp.BranchPredictor, ras *comp.ReturnAddressStack, fu *fetchUnit, du *decodeUnit, perf *proc.PerfCounters) *btbBranchUnit {
 	return &btbBranchUnit{
-		btb: newBranchTargetBuffer(btbSize),
-		fu:  fu,
-		du:  du,
+		btb:       btb,
+		predictor: predictor,
+		ras:       ras,
+		fu:        fu,
+		du:        du,
+		perf:      perf,
+	}
+}
+
+// predict predicts the direction of a conditional branch when decoded. If
+// predicted taken and its target is known, the fetch unit is redirected to it.
+func (u *btbBranchUnit) predict(ctx *risc.Context, labels map[string]int32, runner risc.InstructionRunnerPc) risc.Prediction {
+	target, exists := risc.BranchTarget(runner.Runner, labels)
+	if !exists {
+		// The error is returned once executed
+		return risc.Prediction{}
+	}
+	taken, history := u.predictor.Predict(runner.Pc, target)
+	u.directions = append(u.directions, u.decoding())
+	if !taken {
+		return risc.Prediction{History: history}
+	}
+	// The target is the one of the branch target buffer, as if the branch was
+	// predicted when fetched
+	target, exists = u.btb.Lookup(runner.Pc)
+	if !exists {
+		// Unknown target, the branch is fetched as not taken
+		return risc.Prediction{History: history}
+	}
+	u.fu.reset(target, true)
+	log.Flush(ctx, "BU", runner.Pc, target)
+	return risc.Prediction{Taken: true, Target: target, History: history}
+}
+
+// predictJump predicts the target of an unconditional branch when decoded: the
+// return address of a call is pushed to the return address stack and the
+// target of a return is popped from it. If predicted, the fetch unit is
+// redirected to the target.
+func (u *btbBranchUnit) predictJump(ctx *risc.Context, runner risc.InstructionRunnerPc) risc.Prediction {
+	if risc.IsCall(runner.Runner) {
+		u.ras.Push(runner.Pc + 4)
+		u.jumps = append(u.jumps, u.decoding())
+		return risc.Prediction{}
+	}
+	if !risc.IsReturn(runner.Runner) {
+		return risc.Prediction{}
 	}
+	target, exists := u.ras.Pop()
+	u.jumps = append(u.jumps, u.decoding())
+	if !exists {
+		return risc.Prediction{}
+	}
+	u.fu.reset(target, true)
+	log.Flush(ctx, "BU", runner.Pc, target)
+	return risc.Prediction{Taken: true, Target: target}
+}
+
+// decoding returns the sequence of the instruction being decoded, tagged once
+// speculated.
+func (u *btbBranchUnit) decoding() int {
+	return u.sequence + 1
+}
+
+// speculate tags an instruction when decoded with its sequence and the youngest
+// predicted branch not yet resolved. A predicted branch is then tracked until
+// resolved: the conditional ones and the returns predicted by the return
+// address stack.
+func (u *btbBranchUnit) speculate(runner *risc.InstructionRunnerPc) {
+	u.sequence++
+	runner.Sequence = u.sequence
+	runner.Speculation = 0
+	if len(u.unresolved) > 0 {
+		runner.Speculation = u.unresolved[len(u.unresolved)-1]
+	}
+	if runner.Runner.InstructionType().IsConditionalBranch() || runner.Prediction.Taken {
+		u.unresolved = append(u.unresolved, runner.Sequence)
+	}
+}
+
+// isSpeculative returns whether a branch predicted before an instruction
+// tagged with speculation isn't resolved yet.
+func (u *btbBranchUnit) isSpeculative(speculation int) bool {
+	return len(u.unresolved) > 0 && u.unresolved[0] <= speculation
+}
+
+func (u *btbBranchUnit) resolved(sequence int) {
+	u.unresolved = remove(u.unresolved, sequence)
 }
 
-func (u *btbBranchUnit) assert(runner risc.InstructionRunnerPc) {
+// remove removes a sequence from sequences.
+func remove(sequences []int, sequence int) []int {
+	return slices.DeleteFunc(sequences, func(s int) bool {
+		return s == sequence
+	})
+}
+
+func (u *btbBranchUnit) assert(ctx *risc.Context, runner risc.InstructionRunnerPc) assertion {
 	instructionType := runner.Runner.InstructionType()
+	if instructionType.IsUnconditionalBranch() && runner.Prediction.Taken {
+		// Return predicted by the return address stack, the fetch unit was
+		// already redirected
+		return assertion{toCheck: true, expectation: runner.Prediction.Target}
+	}
 	if instructionType.IsUnconditionalBranch() {
-		nextPc, exists := u.btb.get(runner.Pc)
+		nextPc, exists := u.btb.Lookup(runner.Pc)
 		if !exists {
 			// Unknown branch, it will lead to a pipeline flush
-			u.toCheck = true
-			u.expectation = -1
-		} else {
-			// Known branch, no need to check
-			u.toCheck = false
-			u.fu.reset(nextPc, true)
+			return assertion{toCheck: true, expectation: -1}
 		}
-	} else if instructionType.IsConditionalBranch() {
-		// Assuming next instruction
-		u.toCheck = true
-		u.expectation = runner.Pc + 4
-	} else {
-		u.toCheck = false
+		// Known branch, no need to check
+		u.fu.reset(nextPc, true)
+		log.Flush(ctx, "BU", runner.Pc, nextPc)
+		return assertion{}
 	}
+	// The conditional branches are checked against their prediction once
+	// resolved
+	return assertion{}
 }
 
-func (u *btbBranchUnit) shouldFlushPipeline(pc int32) bool {
-	if !u.toCheck {
-		return false
-	}
-	u.toCheck = false
-
+func (a assertion) shouldFlushPipeline(pc int32) bool {
 	// If the expectation doesn't correspond to the current pc, we made a wrong
 	// assumption; therefore, we should flush
-	return u.expectation != pc
+	return a.toCheck && a.expectation != pc
+}
+
+// resolve trains the predictor with the direction of a conditional branch
+// resolved to target if taken, and returns whether it was mispredicted. A
+// mispredicted branch is kept unresolved until flushed so that the younger
+// instructions stay speculative.
+func (u *btbBranchUnit) resolve(runner risc.InstructionRunnerPc, taken bool, target int32) bool {
+	u.predictor.Update(runner.Pc, runner.Prediction.History, taken)
+	u.directions = remove(u.directions, runner.Sequence)
+	u.perf.Branches.Predictions++
+	if taken {
+		u.btb.Update(runner.Pc, target)
+	}
+	if runner.Prediction.Taken != taken || taken && runner.Prediction.Target != target {
+		u.perf.Branches.Mispredictions++
+		return true
+	}
+	u.resolved(runner.Sequence)
+	return false
+}
+
+// resolveJump records an unconditional branch resolved to pcTo in the return
+// address stack.
+func (u *btbBranchUnit) resolveJump(ctx *risc.Context, runner risc.InstructionRunnerPc, pcTo int32) {
+	if risc.IsCall(runner.Runner) {
+		u.ras.Call(runner.Pc + 4)
+		u.jumps = remove(u.jumps, runner.Sequence)
+	} else if risc.IsReturn(runner.Runner) {
+		u.ras.Return(runner.Prediction.Target, runner.Prediction.Taken, pcTo)
+		u.jumps = remove(u.jumps, runner.Sequence)
+	}
+	if runner.Prediction.Taken {
+		// The target is checked by the assertion
+		if runner.Prediction.Target == pcTo {
+			u.resolved(runner.Sequence)
+		}
+		return
+	}
+	u.notifyJumpAddressResolved(ctx, runner.Pc, pcTo)
 }
 
-func (u *btbBranchUnit) notifyJumpAddressResolved(pc, pcTo int32) {
-	u.btb.add(pc, pcTo)
+func (u *btbBranchUnit) notifyJumpAddressResolved(ctx *risc.Context, pc, pcTo int32) {
+	u.btb.Update(pc, pcTo)
 	u.fu.reset(pcTo, true)
+	log.Flush(ctx, "BU", pc, pcTo)
 	u.du.notifyBranchResolved()
 }
+
+// flush discards the predicted branches from the instruction of sequence from
+// and the directions predicted for them, and recovers the return address stack
+// from the calls and returns resolved and the older ones in flight.
+func (u *btbBranchUnit) flush(from int) {
+	u.unresolved = discard(u.unresolved, from)
+	u.directions = discard(u.directions, from)
+	u.jumps = discard(u.jumps, from)
+	u.predictor.Recover(len(u.directions))
+	u.ras.Recover(len(u.jumps))
+}
+
+// discard removes the sequences from the one of from.
+func discard(sequences []int, from int) []int {
+	return slices.DeleteFunc(sequences, func(s int) bool {
+		return s >= from
+	})
+}
+
+func (u *btbBranchUnit) counters(perf *proc.PerfCounters) {
+	btb := u.btb.Stats()
+	perf.BTB = proc.BTBCounters{
+		Hits:    btb.Hits,
+		Misses:  btb.Misses,
+		Aliases: btb.Aliases,
+	}
+	ras := u.ras.Stats()
+	perf.RAS = proc.RASCounters{
+		Hits:       ras.Hits,
+		Misses:     ras.Misses,
+		Underflows: ras.Underflows,
+		Overflows:  ras.Overflows,
+	}
+}
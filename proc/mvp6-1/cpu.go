@@ -1,7 +1,11 @@
 package mvp6_1
 
 import (
+	"cmp"
+	"fmt"
+
 	"github.com/teivah/majorana/common/log"
+	"github.com/teivah/majorana/proc"
 	"github.com/teivah/majorana/proc/comp"
 	"github.com/teivah/majorana/risc"
 )
@@ -13,6 +17,7 @@ const (
 	cyclesMemoryAccess = 50
 	cycleL1DAccess     = 1
 	flushCycles        = 1
+	executeUnits       = 2
 
 	l1ICacheLineSize = 64 * bytes
 	liICacheSize     = 1 * kilobytes
@@ -33,11 +38,12 @@ type CPU struct {
 	writeUnits           []*writeUnit
 	branchUnit           *btbBranchUnit
 	memoryManagementUnit *memoryManagementUnit
-
-	counterFlush int
+	history              *registerHistory
+	perf                 *proc.PerfCounters
+	cycles               int
 }
 
-func NewCPU(debug bool, memoryBytes int) *CPU {
+func NewCPU(opts proc.Options) *CPU {
 	busSize := 2
 	multiplier := 1
 	decodeBus := comp.NewBufferedBus[int32](busSize*multiplier, busSize*multiplier)
@@ -45,44 +51,67 @@ func NewCPU(debug bool, memoryBytes int) *CPU {
 	executeBus := comp.NewBufferedBus[*risc.InstructionRunnerPc](busSize, busSize)
 	writeBus := comp.NewBufferedBus[risc.ExecutionContext](busSize, busSize)
 
-	ctx := risc.NewContext(debug, memoryBytes)
-	mmu := newMemoryManagementUnit(ctx)
-	fu := newFetchUnit(mmu, decodeBus)
-	du := newDecodeUnit(decodeBus, controlBus)
-	bu := newBTBBranchUnit(4, fu, du)
-	return &CPU{
+	ctx := opts.NewContext()
+	mmu := newMemoryManagementUnit(ctx, opts)
+	perf := proc.NewPerfCounters()
+	fu := newFetchUnit(mmu, decodeBus, perf)
+	du := newDecodeUnit(decodeBus, controlBus, perf)
+	bu := newBTBBranchUnit(opts.BranchTargetBuffer(), opts.BranchPredictor(), opts.ReturnAddressStack(), fu, du, perf)
+	du.bu = bu
+	var history *registerHistory
+	if opts.Speculation.Deep {
+		history = &registerHistory{}
+	}
+	cpu := &CPU{
 		ctx:         ctx,
 		fetchUnit:   fu,
 		decodeBus:   decodeBus,
 		decodeUnit:  du,
 		controlBus:  controlBus,
-		controlUnit: newControlUnit(controlBus, executeBus),
+		controlUnit: newControlUnit(controlBus, executeBus, perf),
 		executeBus:  executeBus,
-		executeUnits: []*executeUnit{
-			newExecuteUnit(bu, executeBus, writeBus, mmu),
-			newExecuteUnit(bu, executeBus, writeBus, mmu),
-		},
-		writeBus: writeBus,
+		writeBus:    writeBus,
 		writeUnits: []*writeUnit{
-			newWriteUnit(writeBus),
-			newWriteUnit(writeBus),
+			newWriteUnit("WU0", bu, history, writeBus, perf),
+			newWriteUnit("WU1", bu, history, writeBus, perf),
 		},
 		branchUnit:           bu,
 		memoryManagementUnit: mmu,
+		history:              history,
+		perf:                 perf,
+	}
+	for i := 0; i < cmp.Or(opts.ExecuteUnits, executeUnits); i++ {
+		cpu.executeUnits = append(cpu.executeUnits, newExecuteUnit(fmt.Sprintf("EU%d", i), bu, opts.Speculation, executeBus, writeBus, mmu, perf))
 	}
+	return cpu
+}
+
+func init() {
+	proc.Register("mvp6-1", func(opts proc.Options) proc.Machine {
+		return NewCPU(opts)
+	})
 }
 
 func (m *CPU) Context() *risc.Context {
 	return m.ctx
 }
 
+func (m *CPU) ExitCode() int32 {
+	return m.ctx.ExitCode
+}
+
 func (m *CPU) Run(app risc.Application) (int, error) {
+	if err := m.ctx.Load(app); err != nil {
+		return 0, err
+	}
+	m.fetchUnit.reset(app.Entry, false)
 	defer func() {
 		log.Infou(m.ctx, "L1d", m.memoryManagementUnit.l1d.String())
 	}()
 	cycle := 0
 	for {
 		cycle += 1
+		m.ctx.Cycle = cycle
 		log.Info(m.ctx, "Cycle %d", cycle)
 		m.decodeBus.Connect(cycle)
 		m.controlBus.Connect(cycle)
@@ -101,7 +130,7 @@ func (m *CPU) Run(app risc.Application) (int, error) {
 		// Execute
 		var (
 			flush bool
-			from  int32
+			from  int
 			pc    int32
 			ret   bool
 		)
@@ -111,12 +140,15 @@ func (m *CPU) Run(app risc.Application) (int, error) {
 			if resp.err != nil {
 				return 0, resp.err
 			}
-			if resp.flush {
-				from = resp.from
+			// A return isn't speculative so the instructions flushing are
+			// younger. Otherwise, the oldest instruction flushing determines
+			// the instructions to discard.
+			if resp.isReturn {
+				ret, from = true, resp.from
+			} else if resp.flush && !ret && (!flush || resp.from < from) {
+				from, pc = resp.from, resp.pc
 			}
 			flush = flush || resp.flush
-			pc = max(pc, resp.pc)
-			ret = ret || resp.isReturn
 		}
 
 		// Write back
@@ -125,18 +157,45 @@ func (m *CPU) Run(app risc.Application) (int, error) {
 		}
 		log.Info(m.ctx, "\tRegisters: %v", m.ctx.Registers)
 
+		// The instructions older than a flush or a return still executing are
+		// completed
+		for (flush || ret) && m.isExecutingBefore(from) {
+			cycle++
+			m.ctx.Cycle = cycle
+			m.writeBus.Connect(cycle)
+			for _, eu := range m.executeUnits {
+				if eu.isEmpty() || eu.runner.Sequence >= from {
+					continue
+				}
+				resp := eu.Cycle(euReq{cycle, m.ctx, app})
+				if resp.err != nil {
+					return 0, resp.err
+				}
+				if resp.isReturn {
+					ret, from = true, resp.from
+				} else if resp.flush && !ret {
+					from, pc = resp.from, resp.pc
+				}
+			}
+			for _, wu := range m.writeUnits {
+				_ = wu.Cycle(wuReq{m.ctx, from})
+			}
+		}
+
 		if ret {
 			log.Info(m.ctx, "\t🛑 Return")
-			m.counterFlush++
 			cycle++
+			m.ctx.Cycle = cycle
 			m.writeBus.Connect(cycle)
 			for !m.areWriteUnitsEmpty() || !m.writeBus.IsEmpty() {
 				for _, wu := range m.writeUnits {
-					_ = wu.Cycle(wuReq{m.ctx, -1})
+					_ = wu.Cycle(wuReq{m.ctx, from})
 				}
 				cycle++
+				m.ctx.Cycle = cycle
 				m.writeBus.Connect(cycle)
 			}
+			m.restore(from)
 			break
 		}
 		if flush {
@@ -144,12 +203,15 @@ func (m *CPU) Run(app risc.Application) (int, error) {
 			for _, wu := range m.writeUnits {
 				for !wu.isEmpty() || !m.writeBus.IsEmpty() {
 					cycle++
+					m.ctx.Cycle = cycle
+					m.writeBus.Connect(cycle)
 					_ = wu.Cycle(wuReq{m.ctx, from})
 				}
 			}
 
 			log.Info(m.ctx, "\t️⚠️ Flush to %d", pc/4)
-			m.flush(pc)
+			m.flush(from, pc)
+			m.perf.Flushes++
 			cycle += flushCycles
 			log.Info(m.ctx, "\tRegisters: %v", m.ctx.Registers)
 			continue
@@ -160,34 +222,41 @@ func (m *CPU) Run(app risc.Application) (int, error) {
 		}
 	}
 	cycle += m.memoryManagementUnit.flush()
+	m.cycles = cycle
 	return cycle, nil
 }
 
-func (m *CPU) Stats() map[string]any {
-	return map[string]any{
-		"flush":                  m.counterFlush,
-		"du_pending_read":        m.decodeUnit.pendingRead.Stats(),
-		"du_blocked":             m.decodeUnit.blocked.Stats(),
-		"du_pushed":              m.decodeUnit.pushed.Stats(),
-		"cu_push":                m.controlUnit.pushed.Stats(),
-		"cu_pending":             m.controlUnit.pending.Stats(),
-		"cu_pending_read":        m.controlUnit.pendingRead.Stats(),
-		"cu_blocked":             m.controlUnit.blocked.Stats(),
-		"cu_forward":             m.controlUnit.forwarding,
-		"cu_total":               m.controlUnit.total,
-		"cu_cant_add":            m.controlUnit.cantAdd,
-		"cu_blocked_branch":      m.controlUnit.blockedBranch,
-		"cu_blocked_data_hazard": m.controlUnit.blockedDataHazard,
+func (m *CPU) Stats() proc.PerfCounters {
+	perf := *m.perf
+	perf.Cycles = m.cycles
+	m.memoryManagementUnit.counters(&perf)
+	m.branchUnit.counters(&perf)
+	perf.Utilization = map[string]float64{
+		"FU": m.fetchUnit.busy.Stats(),
+		"DU": m.decodeUnit.busy.Stats(),
+		"CU": m.controlUnit.busy.Stats(),
+	}
+	for _, eu := range m.executeUnits {
+		perf.Utilization[eu.name] = eu.busy.Stats()
+	}
+	for _, wu := range m.writeUnits {
+		perf.Utilization[wu.name] = wu.busy.Stats()
 	}
+	return perf
 }
 
-func (m *CPU) flush(pc int32) {
+// flush discards the instructions from the one of sequence from and resumes
+// at pc.
+func (m *CPU) flush(from int, pc int32) {
 	m.fetchUnit.flush(pc)
 	m.decodeUnit.flush()
 	m.controlUnit.flush()
 	for _, executeUnit := range m.executeUnits {
 		executeUnit.flush()
 	}
+	m.branchUnit.flush(from)
+	m.memoryManagementUnit.squash(from)
+	m.restore(from)
 	m.decodeBus.Clean()
 	m.controlBus.Clean()
 	m.executeBus.Clean()
@@ -195,6 +264,23 @@ func (m *CPU) flush(pc int32) {
 	m.ctx.Flush()
 }
 
+// restore restores the registers written speculatively by the instructions
+// younger than the one of sequence from.
+func (m *CPU) restore(from int) {
+	if m.history != nil {
+		m.history.restore(m.ctx, from)
+	}
+}
+
+func (m *CPU) isExecutingBefore(sequence int) bool {
+	for _, eu := range m.executeUnits {
+		if !eu.isEmpty() && eu.runner.Sequence < sequence {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *CPU) isEmpty() bool {
 	empty := m.fetchUnit.isEmpty() &&
 		m.decodeUnit.isEmpty() &&
@@ -223,3 +309,18 @@ func (m *CPU) areWriteUnitsEmpty() bool {
 	}
 	return true
 }
+
+// ProbeLoad reads the byte at addr through the memory hierarchy and returns
+// the number of cycles taken.
+func (m *CPU) ProbeLoad(addr int32) int {
+	_, hit, cycles := m.memoryManagementUnit.load(0, []int32{addr}, true)
+	if hit {
+		return cycleL1DAccess
+	}
+	return cycles
+}
+
+// FlushL1D writes the dirty L1D lines back and invalidates the L1D.
+func (m *CPU) FlushL1D() {
+	m.memoryManagementUnit.writeBack()
+}
@@ -3,6 +3,8 @@ package mvp6_1
 import (
 	"github.com/teivah/majorana/common/log"
 	"github.com/teivah/majorana/common/obs"
+	"github.com/teivah/majorana/common/trace"
+	"github.com/teivah/majorana/proc"
 	"github.com/teivah/majorana/proc/comp"
 	"github.com/teivah/majorana/risc"
 )
@@ -19,27 +21,19 @@ type controlUnit struct {
 	pushedRunnersInCurrentCycle  map[*risc.InstructionRunnerPc]bool
 	skippedInCurrentCycle        []risc.InstructionRunnerPc
 
-	pushed            *obs.Gauge
-	pending           *obs.Gauge
-	pendingRead       *obs.Gauge
-	blocked           *obs.Gauge
-	forwarding        int
-	total             int
-	cantAdd           int
-	blockedBranch     int
-	blockedDataHazard int
-	routeSecond       bool
+	perf *proc.PerfCounters
+	busy *obs.Gauge
+	// stall is the cause of the last stall during the current cycle
+	stall proc.StallCause
 }
 
-func newControlUnit(inBus *comp.BufferedBus[risc.InstructionRunnerPc], outBus *comp.BufferedBus[*risc.InstructionRunnerPc]) *controlUnit {
+func newControlUnit(inBus *comp.BufferedBus[risc.InstructionRunnerPc], outBus *comp.BufferedBus[*risc.InstructionRunnerPc], perf *proc.PerfCounters) *controlUnit {
 	return &controlUnit{
 		inBus:                        inBus,
 		outBus:                       outBus,
 		pendings:                     comp.NewQueue[risc.InstructionRunnerPc](pendingLength),
-		pushed:                       &obs.Gauge{},
-		pending:                      &obs.Gauge{},
-		pendingRead:                  &obs.Gauge{},
-		blocked:                      &obs.Gauge{},
+		perf:                         perf,
+		busy:                         &obs.Gauge{},
 		pushedRunnersInCurrentCycle:  make(map[*risc.InstructionRunnerPc]bool),
 		pushedRunnersInPreviousCycle: make(map[*risc.InstructionRunnerPc]bool),
 	}
@@ -48,23 +42,21 @@ func newControlUnit(inBus *comp.BufferedBus[risc.InstructionRunnerPc], outBus *c
 func (u *controlUnit) cycle(cycle int, ctx *risc.Context) {
 	pushedCount := 0
 	u.pushedRunnersInCurrentCycle = make(map[*risc.InstructionRunnerPc]bool)
+	u.stall = ""
 	defer func() {
-		u.pushed.Push(pushedCount)
-		u.pending.Push(u.pendings.Length())
+		u.busy.Push(min(pushedCount, 1))
+		if pushedCount == 0 && u.stall != "" {
+			// Nothing was dispatched
+			u.perf.Stalls[u.stall]++
+		}
 		u.pushedRunnersInPreviousCycle = u.pushedRunnersInCurrentCycle
 	}()
 	u.skippedInCurrentCycle = nil
-	u.pendingRead.Push(u.inBus.PendingRead())
-	if u.inBus.CanGet() {
-		u.blocked.Push(1)
-	} else {
-		u.blocked.Push(0)
-	}
-	u.total++
 
 	if !u.outBus.CanAdd() {
-		u.cantAdd++
 		log.Infou(ctx, "CU", "can't add")
+		log.Stallu(ctx, "CU", "execute bus full")
+		u.stall = proc.StallStructuralHazard
 		return
 	}
 
@@ -104,13 +96,37 @@ func (u *controlUnit) cycle(cycle int, ctx *risc.Context) {
 }
 
 func (u *controlUnit) handleRunner(ctx *risc.Context, cycle int, pushedCount int, runner *risc.InstructionRunnerPc) (push, stop bool) {
-	if pushedCount > 0 && runner.Runner.InstructionType().IsBranch() {
-		u.blockedBranch++
+	// A branch is pushed after the previous instructions so that a flush only
+	// discards the next ones
+	if (pushedCount > 0 || len(u.skippedInCurrentCycle) > 0) && runner.Runner.InstructionType().IsBranch() {
+		log.Stalli(ctx, "CU", runner.Runner.InstructionType(), runner.Pc, "branch")
+		u.stall = proc.StallControlHazard
+		return false, true
+	}
+
+	// The memory accesses are pushed in order so that a load reads the stores
+	// before it and not the ones after it
+	if len(u.skippedInCurrentCycle) > 0 &&
+		(runner.Runner.InstructionType().IsMemoryRead() || runner.Runner.InstructionType().IsMemoryWrite()) {
+		log.Stalli(ctx, "CU", runner.Runner.InstructionType(), runner.Pc, "memory ordering")
+		u.stall = proc.StallDataHazard
+		return false, false
+	}
+
+	// An environment call is pushed once all the previous instructions are
+	// written back
+	if runner.Runner.InstructionType() == risc.Ecall &&
+		(pushedCount > 0 || len(u.skippedInCurrentCycle) > 0 || len(ctx.PendingReadRegisters) > 0 || len(ctx.PendingWriteRegisters) > 0) {
+		log.Infoi(ctx, "CU", runner.Runner.InstructionType(), runner.Pc, "waiting for previous instructions")
+		log.Stalli(ctx, "CU", runner.Runner.InstructionType(), runner.Pc, "ecall")
+		u.stall = proc.StallEcall
 		return false, true
 	}
 
 	if u.isDataHazardWithSkippedRunners(runner) {
 		log.Infoi(ctx, "CU", runner.Runner.InstructionType(), runner.Pc, "hazard with skipped runner")
+		log.Stalli(ctx, "CU", runner.Runner.InstructionType(), runner.Pc, "data hazard")
+		u.stall = proc.StallDataHazard
 		return false, false
 	}
 
@@ -126,13 +142,16 @@ func (u *controlUnit) handleRunner(ctx *risc.Context, cycle int, pushedCount int
 
 	if u.isDataHazardWithSkippedRunners(runner) {
 		log.Infoi(ctx, "CU", runner.Runner.InstructionType(), runner.Pc, "data hazard with skipped runners")
+		log.Stalli(ctx, "CU", runner.Runner.InstructionType(), runner.Pc, "data hazard")
+		u.stall = proc.StallDataHazard
 		return false, false
 	}
 
 	if should, previousRunner, register := u.shouldUseForwarding(runner, hazards, hazardTypes); should {
 		ch := make(chan int32, 1)
+		// The forward register of the previous runner is left as is: it is the
+		// one it receives if it is forwarded to as well
 		previousRunner.Forwarder = ch
-		previousRunner.ForwardRegister = register
 		runner.Receiver = ch
 		runner.ForwardRegister = register
 
@@ -142,13 +161,14 @@ func (u *controlUnit) handleRunner(ctx *risc.Context, cycle int, pushedCount int
 		}
 		u.pushedRunnersInCurrentCycle[runner] = true
 		log.Infoi(ctx, "CU", runner.Runner.InstructionType(), runner.Pc, "forward runner on %s (source %d)", register, previousRunner.Pc/4)
-		u.forwarding++
+		u.perf.Forwards++
 		// TODO Return?
 		return true, true
 	}
 
 	log.Infoi(ctx, "CU", runner.Runner.InstructionType(), runner.Pc, "data hazard: reason=%+v, types=%+v", hazards, hazardTypes)
-	u.blockedDataHazard++
+	log.Stalli(ctx, "CU", runner.Runner.InstructionType(), runner.Pc, "data hazard")
+	u.stall = proc.StallDataHazard
 
 	return false, true
 }
@@ -221,12 +241,14 @@ func (u *controlUnit) shouldUseForwarding(runner *risc.InstructionRunnerPc, haza
 
 func (u *controlUnit) pushRunner(ctx *risc.Context, cycle int, runner *risc.InstructionRunnerPc) bool {
 	if !u.outBus.CanAdd() {
+		u.stall = proc.StallStructuralHazard
 		return false
 	}
 
 	u.outBus.Add(runner, cycle)
 	ctx.AddPendingRegisters(runner.Runner)
 	log.Infoi(ctx, "CU", runner.Runner.InstructionType(), runner.Pc, "pushing runner")
+	log.Tracei(ctx, "CU", trace.Dispatch, runner.Runner.InstructionType(), runner.Pc)
 	return true
 }
 
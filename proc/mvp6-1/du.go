@@ -5,48 +5,41 @@ import (
 
 	"github.com/teivah/majorana/common/log"
 	"github.com/teivah/majorana/common/obs"
+	"github.com/teivah/majorana/common/trace"
+	"github.com/teivah/majorana/proc"
 	"github.com/teivah/majorana/proc/comp"
 	"github.com/teivah/majorana/risc"
 )
 
 type decodeUnit struct {
-	ret                     bool
 	pendingBranchResolution bool
 	log                     string
+	bu                      *btbBranchUnit
 	inBus                   *comp.BufferedBus[int32]
 	outBus                  *comp.BufferedBus[risc.InstructionRunnerPc]
 
-	pushed      *obs.Gauge
-	pendingRead *obs.Gauge
-	blocked     *obs.Gauge
+	perf *proc.PerfCounters
+	busy *obs.Gauge
 }
 
-func newDecodeUnit(inBus *comp.BufferedBus[int32], outBus *comp.BufferedBus[risc.InstructionRunnerPc]) *decodeUnit {
+func newDecodeUnit(inBus *comp.BufferedBus[int32], outBus *comp.BufferedBus[risc.InstructionRunnerPc], perf *proc.PerfCounters) *decodeUnit {
 	return &decodeUnit{
-		inBus:       inBus,
-		outBus:      outBus,
-		pushed:      &obs.Gauge{},
-		pendingRead: &obs.Gauge{},
-		blocked:     &obs.Gauge{},
+		inBus:  inBus,
+		outBus: outBus,
+		perf:   perf,
+		busy:   &obs.Gauge{},
 	}
 }
 
 func (u *decodeUnit) cycle(cycle int, app risc.Application, ctx *risc.Context) {
 	pushed := 0
 	defer func() {
-		u.pushed.Push(pushed)
+		u.busy.Push(min(pushed, 1))
 	}()
-	u.pendingRead.Push(u.inBus.PendingRead())
-	if u.inBus.CanGet() {
-		u.blocked.Push(1)
-	} else {
-		u.blocked.Push(0)
-	}
-	if u.ret {
-		return
-	}
 	if u.pendingBranchResolution {
 		log.Infou(ctx, "DU", "blocked")
+		log.Stallu(ctx, "DU", "branch resolution")
+		u.perf.Stalls[proc.StallControlHazard]++
 		return
 	}
 
@@ -65,23 +58,39 @@ func (u *decodeUnit) cycle(cycle int, app risc.Application, ctx *risc.Context) {
 		// Clear forward
 		runner.Forward(risc.Forward{})
 		log.Infoi(ctx, "DU", runner.InstructionType(), pc, "decoding")
+		log.Tracei(ctx, "DU", trace.Decode, runner.InstructionType(), pc)
+		runnerPc := risc.InstructionRunnerPc{
+			Runner: runner,
+			Pc:     pc,
+		}
 		jump := false
 		if runner.InstructionType().IsUnconditionalBranch() {
+			runnerPc.Prediction = u.bu.predictJump(ctx, runnerPc)
+			if !runnerPc.Prediction.Taken {
+				// Unknown target, nothing is decoded until the branch is
+				// resolved
+				u.pendingBranchResolution = true
+				u.log = fmt.Sprintf("%v at %d", runner.InstructionType(), pc/4)
+			}
+			jump = true
+		} else if runner.InstructionType().IsConditionalBranch() {
+			runnerPc.Prediction = u.bu.predict(ctx, app.Labels, runnerPc)
+			// The fetch unit was redirected to the target, the instructions
+			// decoded from it are speculative
+			jump = runnerPc.Prediction.Taken
+		} else if runner.InstructionType() == risc.Ecall {
+			// Nothing is decoded after an environment call until the execute
+			// unit flushes the pipeline
 			u.pendingBranchResolution = true
 			u.log = fmt.Sprintf("%v at %d", runner.InstructionType(), pc/4)
 			jump = true
 		}
-		u.outBus.Add(risc.InstructionRunnerPc{
-			Runner: runner,
-			Pc:     pc,
-		}, cycle)
+		u.bu.speculate(&runnerPc)
+		u.outBus.Add(runnerPc, cycle)
 		pushed++
 		if jump {
 			return
 		}
-		if runner.InstructionType() == risc.Ret {
-			u.ret = true
-		}
 	}
 }
 
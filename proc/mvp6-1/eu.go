@@ -3,6 +3,9 @@ package mvp6_1
 import (
 	co "github.com/teivah/majorana/common/coroutine"
 	"github.com/teivah/majorana/common/log"
+	"github.com/teivah/majorana/common/obs"
+	"github.com/teivah/majorana/common/trace"
+	"github.com/teivah/majorana/proc"
 	"github.com/teivah/majorana/proc/comp"
 	"github.com/teivah/majorana/risc"
 )
@@ -14,8 +17,10 @@ type euReq struct {
 }
 
 type euResp struct {
-	flush    bool
-	from     int32
+	flush bool
+	// from is the sequence of the instruction flushing the pipeline or
+	// returning, the younger ones are discarded
+	from     int
 	pc       int32
 	isReturn bool
 	err      error
@@ -23,39 +28,97 @@ type euResp struct {
 
 type executeUnit struct {
 	co.Coroutine[euReq, euResp]
+	name   string
 	bu     *btbBranchUnit
 	inBus  *comp.BufferedBus[*risc.InstructionRunnerPc]
 	outBus *comp.BufferedBus[risc.ExecutionContext]
 	mmu    *memoryManagementUnit
+	perf   *proc.PerfCounters
+	busy   *obs.Gauge
+	// speculation are the mitigations applied to the speculative loads
+	speculation proc.SpeculationOptions
+	// idle is set if no instruction progressed during the current cycle
+	idle bool
 
 	// Pending
-	memory []int8
-	runner risc.InstructionRunnerPc
+	memory    []int8
+	runner    risc.InstructionRunnerPc
+	assertion assertion
 }
 
-func newExecuteUnit(bu *btbBranchUnit, inBus *comp.BufferedBus[*risc.InstructionRunnerPc], outBus *comp.BufferedBus[risc.ExecutionContext], mmu *memoryManagementUnit) *executeUnit {
+func newExecuteUnit(name string, bu *btbBranchUnit, speculation proc.SpeculationOptions, inBus *comp.BufferedBus[*risc.InstructionRunnerPc], outBus *comp.BufferedBus[risc.ExecutionContext], mmu *memoryManagementUnit, perf *proc.PerfCounters) *executeUnit {
 	eu := &executeUnit{
-		bu:     bu,
-		inBus:  inBus,
-		outBus: outBus,
-		mmu:    mmu,
+		name:        name,
+		bu:          bu,
+		speculation: speculation,
+		inBus:       inBus,
+		outBus:      outBus,
+		mmu:         mmu,
+		perf:        perf,
+		busy:        &obs.Gauge{},
 	}
 	eu.Coroutine = co.New(eu.start)
+	eu.Coroutine.Pre(func(euReq) {
+		eu.idle = false
+	})
+	eu.Coroutine.Post(func(euReq, euResp) {
+		if eu.idle {
+			eu.busy.Push(0)
+		} else {
+			eu.busy.Push(1)
+		}
+	})
 	return eu
 }
 
 func (u *executeUnit) start(r euReq) euResp {
 	runner, exists := u.inBus.Get()
 	if !exists {
+		u.idle = true
 		return euResp{}
 	}
 	u.runner = *runner
+	if u.runner.Runner.InstructionType().IsMemoryWrite() {
+		u.mmu.issueStore(u.runner.Sequence)
+	} else if u.runner.Runner.InstructionType().IsMemoryRead() {
+		u.mmu.issueLoad(u.runner.Sequence)
+	}
 	return u.ExecuteWithCheckpoint(r, u.prepareRun)
 }
 
 func (u *executeUnit) prepareRun(r euReq) euResp {
 	if !u.outBus.CanAdd() {
 		log.Infou(r.ctx, "EU", "can't add")
+		log.Stalli(r.ctx, u.name, u.runner.Runner.InstructionType(), u.runner.Pc, "write bus full")
+		u.perf.Stalls[proc.StallStructuralHazard]++
+		u.idle = true
+		return euResp{}
+	}
+
+	// An environment call, and a load behind a load barrier, wait for the
+	// branches predicted before them to be resolved
+	if (u.runner.Runner.InstructionType() == risc.Ecall ||
+		u.speculation.LoadBarrier && u.runner.Runner.InstructionType().IsMemoryRead()) &&
+		u.bu.isSpeculative(u.runner.Speculation) {
+		log.Stalli(r.ctx, u.name, u.runner.Runner.InstructionType(), u.runner.Pc, "speculation")
+		u.perf.Stalls[proc.StallSpeculation]++
+		u.idle = true
+		return euResp{}
+	}
+	if u.runner.Runner.InstructionType().IsMemoryRead() && u.mmu.isStorePendingBefore(u.runner.Sequence) {
+		// A load reads the memory once the older stores are performed
+		log.Stalli(r.ctx, u.name, u.runner.Runner.InstructionType(), u.runner.Pc, "pending store")
+		u.perf.Stalls[proc.StallDataHazard]++
+		u.idle = true
+		return euResp{}
+	}
+	if u.runner.Runner.InstructionType().IsMemoryWrite() &&
+		(u.mmu.isLoadPendingBefore(u.runner.Sequence) || u.mmu.isStorePendingBefore(u.runner.Sequence)) {
+		// A store writes the memory once the older loads have read it and
+		// the older stores are performed
+		log.Stalli(r.ctx, u.name, u.runner.Runner.InstructionType(), u.runner.Pc, "pending memory access")
+		u.perf.Stalls[proc.StallDataHazard]++
+		u.idle = true
 		return euResp{}
 	}
 
@@ -64,8 +127,12 @@ func (u *executeUnit) prepareRun(r euReq) euResp {
 		select {
 		case v := <-u.runner.Receiver:
 			log.Infoi(r.ctx, "EU", u.runner.Runner.InstructionType(), u.runner.Pc, "receive forward register value %d", v)
+			log.Forward(r.ctx, u.name, u.runner.Runner.InstructionType(), u.runner.Pc, u.runner.ForwardRegister)
 			value = v
 		default:
+			log.Stalli(r.ctx, u.name, u.runner.Runner.InstructionType(), u.runner.Pc, "forward")
+			u.perf.Stalls[proc.StallForward]++
+			u.idle = true
 			return euResp{}
 		}
 
@@ -73,14 +140,35 @@ func (u *executeUnit) prepareRun(r euReq) euResp {
 	}
 
 	// Create the branch unit assertions
-	u.bu.assert(u.runner)
+	u.assertion = u.bu.assert(r.ctx, u.runner)
 
 	log.Infoi(r.ctx, "EU", u.runner.Runner.InstructionType(), u.runner.Pc, "executing")
 
+	if u.runner.Runner.InstructionType() == risc.Ecall {
+		// The handler accesses the memory directly so the L1D is written back
+		// first
+		remainingCycles := u.mmu.writeBack() - 1
+		if remainingCycles >= 0 {
+			u.perf.Stalls[proc.StallEcall] += remainingCycles + 1
+			u.Checkpoint(func(r euReq) euResp {
+				if remainingCycles > 0 {
+					remainingCycles--
+					return euResp{}
+				}
+				return u.run(r)
+			})
+			return euResp{}
+		}
+	}
+
 	addrs := u.runner.Runner.MemoryRead(r.ctx)
 	if len(addrs) != 0 {
-		if memory, exists := u.mmu.getFromL1D(addrs); exists {
-			u.memory = memory
+		fill := !u.speculation.NoSpeculativeFill || !u.bu.isSpeculative(u.runner.Speculation)
+		memory, hit, cycles := u.mmu.load(u.runner.Pc, addrs, fill)
+		u.mmu.performLoad(u.runner.Sequence)
+		u.memory = memory
+		if hit {
+			u.perf.L1D.Hits++
 			// As the coroutine is executed the next cycle, if a L1D access takes
 			// one cycle, we should be good to go during the next cycle
 			remainingCycles := cycleL1DAccess - 1
@@ -94,7 +182,10 @@ func (u *executeUnit) prepareRun(r euReq) euResp {
 			})
 			return euResp{}
 		} else {
-			remainingCycles := cyclesMemoryAccess - 1
+			log.Stalli(r.ctx, "MMU", u.runner.Runner.InstructionType(), u.runner.Pc, "L1D miss")
+			u.perf.L1D.Misses++
+			u.perf.Stalls[proc.StallL1DMiss] += cycles
+			remainingCycles := cycles - 1
 
 			u.Checkpoint(func(r euReq) euResp {
 				if remainingCycles > 0 {
@@ -102,13 +193,6 @@ func (u *executeUnit) prepareRun(r euReq) euResp {
 					remainingCycles--
 					return euResp{}
 				}
-				line := u.mmu.fetchCacheLine(addrs[0])
-				u.mmu.pushLineToL1D(addrs[0], line)
-				m, exists := u.mmu.getFromL1D(addrs)
-				if !exists {
-					panic("cache line doesn't exist")
-				}
-				u.memory = m
 				return u.run(r)
 			})
 			return euResp{}
@@ -119,18 +203,30 @@ func (u *executeUnit) prepareRun(r euReq) euResp {
 
 func (u *executeUnit) run(r euReq) euResp {
 	u.Reset()
+	log.Tracei(r.ctx, u.name, trace.Execute, u.runner.Runner.InstructionType(), u.runner.Pc)
 	execution, err := u.runner.Runner.Run(r.ctx, r.app.Labels, u.runner.Pc, u.memory)
 	if err != nil {
 		return euResp{err: err}
 	}
 	log.Infoi(r.ctx, "EU", u.runner.Runner.InstructionType(), u.runner.Pc, "execution result: %+v", execution)
-	if execution.Return {
-		return euResp{isReturn: true}
-	}
-
-	if execution.MemoryChange && u.mmu.doesExecutionMemoryChangesExistsInL1D(execution) {
-		u.mmu.writeExecutionMemoryChangesToL1D(execution)
-		r.ctx.DeletePendingRegisters(u.runner.Runner.ReadRegisters(), u.runner.Runner.WriteRegisters())
+	if execution.Return || execution.MemoryChange {
+		if !u.bu.isSpeculative(u.runner.Speculation) {
+			return u.perform(r, execution)
+		}
+		// The memory and the end of the program aren't changed until the
+		// branches predicted before are resolved
+		log.Stalli(r.ctx, u.name, u.runner.Runner.InstructionType(), u.runner.Pc, "speculation")
+		u.perf.Stalls[proc.StallSpeculation]++
+		u.Checkpoint(func(r euReq) euResp {
+			if u.bu.isSpeculative(u.runner.Speculation) {
+				log.Stalli(r.ctx, u.name, u.runner.Runner.InstructionType(), u.runner.Pc, "speculation")
+				u.perf.Stalls[proc.StallSpeculation]++
+				u.idle = true
+				return euResp{}
+			}
+			u.Reset()
+			return u.perform(r, execution)
+		})
 		return euResp{}
 	}
 
@@ -140,17 +236,35 @@ func (u *executeUnit) run(r euReq) euResp {
 		InstructionType: u.runner.Runner.InstructionType(),
 		WriteRegisters:  u.runner.Runner.WriteRegisters(),
 		ReadRegisters:   u.runner.Runner.ReadRegisters(),
+		Sequence:        u.runner.Sequence,
+		Speculation:     u.runner.Speculation,
 	}, r.cycle)
 
+	if u.runner.Runner.InstructionType() == risc.Ecall {
+		// The decode unit resumes after the environment call
+		log.Flush(r.ctx, u.name, u.runner.Pc, u.runner.Pc+4)
+		return euResp{flush: true, from: u.runner.Sequence, pc: u.runner.Pc + 4}
+	}
 	if u.runner.Forwarder == nil {
 		if u.runner.Runner.InstructionType().IsUnconditionalBranch() {
 			log.Infoi(r.ctx, "EU", u.runner.Runner.InstructionType(), u.runner.Pc,
 				"notify jump address resolved from %d to %d", u.runner.Pc/4, execution.NextPc/4)
-			u.bu.notifyJumpAddressResolved(u.runner.Pc, execution.NextPc)
+			u.bu.resolveJump(r.ctx, u.runner, execution.NextPc)
 		}
-		if execution.PcChange && u.bu.shouldFlushPipeline(execution.NextPc) {
+		if execution.PcChange && u.assertion.shouldFlushPipeline(execution.NextPc) {
 			log.Infoi(r.ctx, "EU", u.runner.Runner.InstructionType(), u.runner.Pc, "should be a flush")
-			return euResp{flush: true, from: u.runner.Pc, pc: execution.NextPc}
+			log.Flush(r.ctx, "BU", u.runner.Pc, execution.NextPc)
+			u.perf.Mispredictions++
+			return euResp{flush: true, from: u.runner.Sequence, pc: execution.NextPc}
+		}
+		if u.runner.Runner.InstructionType().IsConditionalBranch() && u.bu.resolve(u.runner, execution.PcChange, execution.NextPc) {
+			nextPc := u.runner.Pc + 4
+			if execution.PcChange {
+				nextPc = execution.NextPc
+			}
+			log.Flush(r.ctx, "BU", u.runner.Pc, nextPc)
+			u.perf.Mispredictions++
+			return euResp{flush: true, from: u.runner.Sequence, pc: nextPc}
 		}
 	} else {
 		u.runner.Forwarder <- execution.RegisterValue
@@ -163,6 +277,41 @@ func (u *executeUnit) run(r euReq) euResp {
 	return euResp{}
 }
 
+// perform ends the program or writes the memory once the instruction isn't
+// speculative anymore.
+func (u *executeUnit) perform(r euReq, execution risc.Execution) euResp {
+	if execution.Return {
+		u.perf.Instructions++
+		r.ctx.Retire(u.runner.Pc, execution)
+		return euResp{isReturn: true, from: u.runner.Sequence}
+	}
+
+	hit, cycles := u.mmu.store(u.runner.Pc, execution)
+	u.mmu.performStore(u.runner.Sequence)
+	if hit {
+		u.perf.L1D.Hits++
+	} else {
+		u.perf.L1D.Misses++
+	}
+	u.perf.Instructions++
+	r.ctx.Retire(u.runner.Pc, execution)
+	log.Tracei(r.ctx, "MMU", trace.Writeback, u.runner.Runner.InstructionType(), u.runner.Pc)
+	r.ctx.DeletePendingRegisters(u.runner.Runner.ReadRegisters(), u.runner.Runner.WriteRegisters())
+	if cycles > 0 {
+		log.Stalli(r.ctx, "MMU", u.runner.Runner.InstructionType(), u.runner.Pc, "memory write")
+		u.perf.Stalls[proc.StallMemoryWrite] += cycles
+		remainingCycles := cycles
+		u.Checkpoint(func(euReq) euResp {
+			remainingCycles--
+			if remainingCycles == 0 {
+				u.Reset()
+			}
+			return euResp{}
+		})
+	}
+	return euResp{}
+}
+
 func (u *executeUnit) flush() {
 	u.Reset()
 }
@@ -3,6 +3,9 @@ package mvp6_1
 import (
 	co "github.com/teivah/majorana/common/coroutine"
 	"github.com/teivah/majorana/common/log"
+	"github.com/teivah/majorana/common/obs"
+	"github.com/teivah/majorana/common/trace"
+	"github.com/teivah/majorana/proc"
 	"github.com/teivah/majorana/proc/comp"
 	"github.com/teivah/majorana/risc"
 )
@@ -20,12 +23,18 @@ type fetchUnit struct {
 	outBus         *comp.BufferedBus[int32]
 	complete       bool
 	mmu            *memoryManagementUnit
+	perf           *proc.PerfCounters
+	busy           *obs.Gauge
+	// idle is set if nothing was fetched during the current cycle
+	idle bool
 }
 
-func newFetchUnit(mmu *memoryManagementUnit, outBus *comp.BufferedBus[int32]) *fetchUnit {
+func newFetchUnit(mmu *memoryManagementUnit, outBus *comp.BufferedBus[int32], perf *proc.PerfCounters) *fetchUnit {
 	fu := &fetchUnit{
 		mmu:    mmu,
 		outBus: outBus,
+		perf:   perf,
+		busy:   &obs.Gauge{},
 	}
 	fu.Coroutine = co.New(fu.start)
 	fu.Coroutine.Pre(func(r fuReq) {
@@ -36,6 +45,14 @@ func newFetchUnit(mmu *memoryManagementUnit, outBus *comp.BufferedBus[int32]) *f
 			fu.outBus.Clean()
 			fu.toCleanPending = false
 		}
+		fu.idle = fu.complete
+	})
+	fu.Coroutine.Post(func(fuReq, error) {
+		if fu.idle {
+			fu.busy.Push(0)
+		} else {
+			fu.busy.Push(1)
+		}
 	})
 	return fu
 }
@@ -44,11 +61,20 @@ func (u *fetchUnit) start(r fuReq) error {
 	for i := 0; i < u.outBus.OutLength(); i++ {
 		if !u.outBus.CanAdd() {
 			log.Infou(r.ctx, "FU", "can't add")
+			log.Stallu(r.ctx, "FU", "decode bus full")
+			if i == 0 {
+				u.perf.Stalls[proc.StallStructuralHazard]++
+				u.idle = true
+			}
 			return nil
 		}
 
 		if _, exists := u.mmu.getFromL1I([]int32{u.pc}); !exists {
-			remainingCycles := cyclesMemoryAccess - 1
+			log.Stallpc(r.ctx, "MMU", u.pc, "L1I miss")
+			u.perf.L1I.Misses++
+			cycles := u.mmu.fetchInstructionLine(r.app, u.pc)
+			u.perf.Stalls[proc.StallL1IMiss] += cycles
+			remainingCycles := cycles - 1
 			u.Checkpoint(func(r fuReq) error {
 				if remainingCycles != 0 {
 					log.Infou(r.ctx, "FU", "pending memory access")
@@ -56,7 +82,6 @@ func (u *fetchUnit) start(r fuReq) error {
 					return nil
 				}
 				u.Reset()
-				u.mmu.pushLineToL1I(u.pc, make([]int8, l1ICacheLineSize))
 
 				currentPc := u.pc
 				u.pc += 4
@@ -65,12 +90,14 @@ func (u *fetchUnit) start(r fuReq) error {
 					u.complete = true
 				}
 				log.Infou(r.ctx, "FU", "pushing new element from pc %d", currentPc/4)
+				log.Tracepc(r.ctx, "FU", trace.Fetch, currentPc)
 				u.outBus.Add(currentPc, r.cycle)
 				return nil
 			})
 			return nil
 		}
 
+		u.perf.L1I.Hits++
 		currentPc := u.pc
 		u.pc += 4
 		if u.pc/4 >= int32(len(r.app.Instructions)) {
@@ -78,6 +105,7 @@ func (u *fetchUnit) start(r fuReq) error {
 			u.complete = true
 		}
 		log.Infou(r.ctx, "FU", "pushing new element from pc %d", currentPc/4)
+		log.Tracepc(r.ctx, "FU", trace.Fetch, currentPc)
 		u.outBus.Add(currentPc, r.cycle)
 	}
 	return nil
@@ -1,43 +1,133 @@
 package mvp6_1
 
 import (
+	"slices"
+
 	co "github.com/teivah/majorana/common/coroutine"
 	"github.com/teivah/majorana/common/log"
+	"github.com/teivah/majorana/common/obs"
+	"github.com/teivah/majorana/common/trace"
+	"github.com/teivah/majorana/proc"
 	"github.com/teivah/majorana/proc/comp"
 	"github.com/teivah/majorana/risc"
 )
 
 type wuReq struct {
-	ctx    *risc.Context
-	before int32
+	ctx *risc.Context
+	// before is the sequence of the last instruction written, -1 if none
+	before int
 }
 
 type writeUnit struct {
 	co.Coroutine[wuReq, error]
+	name        string
 	memoryWrite risc.ExecutionContext
+	bu          *btbBranchUnit
 	inBus       *comp.BufferedBus[risc.ExecutionContext]
+	// speculative are the executions written once the branches predicted
+	// before them are resolved
+	speculative []risc.ExecutionContext
+	// history records the registers written by the speculative executions in
+	// deep mode, nil otherwise
+	history *registerHistory
+	perf    *proc.PerfCounters
+	busy    *obs.Gauge
+	// idle is set if no execution was written during the current cycle
+	idle bool
 }
 
-func newWriteUnit(inBus *comp.BufferedBus[risc.ExecutionContext]) *writeUnit {
+func newWriteUnit(name string, bu *btbBranchUnit, history *registerHistory, inBus *comp.BufferedBus[risc.ExecutionContext], perf *proc.PerfCounters) *writeUnit {
 	wu := &writeUnit{
-		inBus: inBus,
+		name:    name,
+		bu:      bu,
+		history: history,
+		inBus:   inBus,
+		perf:    perf,
+		busy:    &obs.Gauge{},
 	}
 	wu.Coroutine = co.New(wu.start)
+	wu.Coroutine.Pre(func(wuReq) {
+		wu.idle = false
+	})
+	wu.Coroutine.Post(func(wuReq, error) {
+		if wu.idle {
+			wu.busy.Push(0)
+		} else {
+			wu.busy.Push(1)
+		}
+	})
 	return wu
 }
 
 func (u *writeUnit) start(r wuReq) error {
+	written := u.writeResolved(r)
 	execution, exists := u.inBus.Get()
 	if !exists {
+		u.idle = !written
+		return nil
+	}
+	if r.before != -1 && execution.Sequence > r.before {
+		u.idle = !written
 		return nil
 	}
-	if r.before != -1 && execution.Pc > r.before {
+	if u.bu.isSpeculative(execution.Speculation) {
+		log.Infoi(r.ctx, "WU", execution.InstructionType, execution.Pc, "speculative")
+		if u.history != nil {
+			// The younger instructions read the register written right away,
+			// only the retirement waits
+			u.writeSpeculative(r, execution)
+		}
+		u.speculative = append(u.speculative, execution)
 		return nil
 	}
+	u.write(r, execution)
+	return nil
+}
+
+// writeResolved discards the speculative executions after before and writes
+// the ones whose predicted branches are resolved. It returns whether one was
+// written.
+func (u *writeUnit) writeResolved(r wuReq) bool {
+	written := false
+	u.speculative = slices.DeleteFunc(u.speculative, func(execution risc.ExecutionContext) bool {
+		if r.before != -1 && execution.Sequence > r.before {
+			return true
+		}
+		if u.bu.isSpeculative(execution.Speculation) {
+			return false
+		}
+		if u.history != nil {
+			u.history.commit(execution.Sequence)
+			u.perf.Instructions++
+			r.ctx.Retire(execution.Pc, execution.Execution)
+		} else {
+			u.write(r, execution)
+		}
+		written = true
+		return true
+	})
+	return written
+}
+
+// writeSpeculative writes the register of a speculative execution, the value
+// overwritten being recorded to be restored if it is discarded.
+func (u *writeUnit) writeSpeculative(r wuReq, execution risc.ExecutionContext) {
+	if execution.Execution.RegisterChange {
+		u.history.write(r.ctx, execution)
+		log.Infoi(r.ctx, "WU", execution.InstructionType, execution.Pc, "speculative write to register")
+	}
+	r.ctx.DeletePendingRegisters(execution.ReadRegisters, execution.WriteRegisters)
+	log.Tracei(r.ctx, u.name, trace.Writeback, execution.InstructionType, execution.Pc)
+}
+
+func (u *writeUnit) write(r wuReq, execution risc.ExecutionContext) {
+	u.perf.Instructions++
+	r.ctx.Retire(execution.Pc, execution.Execution)
 	if execution.Execution.RegisterChange {
 		r.ctx.WriteRegister(execution.Execution)
 		r.ctx.DeletePendingRegisters(execution.ReadRegisters, execution.WriteRegisters)
 		log.Infoi(r.ctx, "WU", execution.InstructionType, execution.Pc, "write to register")
+		log.Tracei(r.ctx, u.name, trace.Writeback, execution.InstructionType, execution.Pc)
 	} else if execution.Execution.MemoryChange {
 		remainingCycle := cyclesMemoryAccess
 		log.Infoi(r.ctx, "WU", execution.InstructionType, execution.Pc, "pending memory write")
@@ -52,6 +142,7 @@ func (u *writeUnit) start(r wuReq) error {
 			r.ctx.WriteMemory(u.memoryWrite.Execution)
 			r.ctx.DeletePendingRegisters(u.memoryWrite.ReadRegisters, u.memoryWrite.WriteRegisters)
 			log.Infoi(r.ctx, "WU", u.memoryWrite.InstructionType, execution.Pc, "write to memory")
+			log.Tracei(r.ctx, u.name, trace.Writeback, u.memoryWrite.InstructionType, execution.Pc)
 			return nil
 		})
 
@@ -59,10 +150,53 @@ func (u *writeUnit) start(r wuReq) error {
 	} else {
 		r.ctx.DeletePendingRegisters(execution.ReadRegisters, execution.WriteRegisters)
 		log.Infoi(r.ctx, "WU", execution.InstructionType, -1, "cleaning")
+		log.Tracei(r.ctx, u.name, trace.Writeback, execution.InstructionType, execution.Pc)
 	}
-	return nil
 }
 
 func (u *writeUnit) isEmpty() bool {
-	return u.IsStart()
+	return u.IsStart() && len(u.speculative) == 0
+}
+
+// registerHistory records the registers written by the speculative
+// instructions with the values they overwrote, in the order of the writes.
+type registerHistory struct {
+	writes []registerWrite
+}
+
+type registerWrite struct {
+	sequence int
+	register risc.RegisterType
+	value    int32
+}
+
+// write writes the register of a speculative execution.
+func (h *registerHistory) write(ctx *risc.Context, execution risc.ExecutionContext) {
+	h.writes = append(h.writes, registerWrite{
+		sequence: execution.Sequence,
+		register: execution.Execution.Register,
+		value:    ctx.Registers[execution.Execution.Register],
+	})
+	ctx.WriteRegister(execution.Execution)
+}
+
+// commit forgets the write of the instruction of sequence, not speculative
+// anymore.
+func (h *registerHistory) commit(sequence int) {
+	h.writes = slices.DeleteFunc(h.writes, func(w registerWrite) bool {
+		return w.sequence == sequence
+	})
+}
+
+// restore undoes the writes of the instructions younger than the one of
+// sequence from, the latest first.
+func (h *registerHistory) restore(ctx *risc.Context, from int) {
+	for i := len(h.writes) - 1; i >= 0; i-- {
+		if w := h.writes[i]; w.sequence > from {
+			ctx.Registers[w.register] = w.value
+		}
+	}
+	h.writes = slices.DeleteFunc(h.writes, func(w registerWrite) bool {
+		return w.sequence > from
+	})
 }
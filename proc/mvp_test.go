@@ -1,12 +1,16 @@
-package proc
+package proc_test
 
 import (
 	"fmt"
+	"math"
+	"os"
 	"sort"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/teivah/majorana/proc"
+	"github.com/teivah/majorana/proc/comp"
 	"github.com/teivah/majorana/proc/mvp1"
 	"github.com/teivah/majorana/proc/mvp2"
 	"github.com/teivah/majorana/proc/mvp3"
@@ -28,7 +32,7 @@ const (
 	testTo            = 200
 )
 
-func execute(t *testing.T, vm virtualMachine, instructions string) (int, error) {
+func execute(t *testing.T, vm proc.Machine, instructions string) (int, error) {
 	app, err := risc.Parse(instructions)
 	require.NoError(t, err)
 	cycles, err := vm.Run(app)
@@ -80,76 +84,198 @@ func strlen(bytes []byte) int {
 }
 
 func TestMvp1(t *testing.T) {
-	factory := func(memory int) virtualMachine {
-		return mvp1.NewCPU(false, memory)
+	factory := func(memory int) proc.Machine {
+		return mvp1.NewCPU(proc.Options{MemoryBytes: memory})
 	}
 	testPrime(t, factory, memory, testFrom, testTo, false)
 	testSums(t, factory, memory, testFrom, testTo, false)
 	testStringLength(t, factory, 1024, testTo, false)
 	testStringCopy(t, factory, testTo*2, testTo, false)
+	testELF(t, factory)
+	testData(t, factory)
+	testUnsigned(t, factory)
+	testFactorial(t, factory)
+	testPrintNumber(t, factory)
 }
 
 func TestMvp2(t *testing.T) {
-	factory := func(memory int) virtualMachine {
-		return mvp2.NewCPU(false, memory)
+	factory := func(memory int) proc.Machine {
+		return mvp2.NewCPU(proc.Options{MemoryBytes: memory})
 	}
 	testPrime(t, factory, memory, testFrom, testTo, false)
 	testSums(t, factory, memory, testFrom, testTo, false)
 	testStringLength(t, factory, 1024, testTo, false)
 	testStringCopy(t, factory, testTo*2, testTo, false)
+	testELF(t, factory)
+	testData(t, factory)
+	testUnsigned(t, factory)
+	testFactorial(t, factory)
+	testPrintNumber(t, factory)
 }
 
 func TestMvp3(t *testing.T) {
-	factory := func(memory int) virtualMachine {
-		return mvp3.NewCPU(false, memory)
+	factory := func(memory int) proc.Machine {
+		return mvp3.NewCPU(proc.Options{MemoryBytes: memory})
 	}
 	testPrime(t, factory, memory, testFrom, testTo, false)
 	testSums(t, factory, memory, testFrom, testTo, false)
 	testStringLength(t, factory, 1024, testTo, false)
 	testStringCopy(t, factory, testTo*2, testTo, false)
+	testELF(t, factory)
+	testData(t, factory)
+	testUnsigned(t, factory)
+	testFactorial(t, factory)
+	testPrintNumber(t, factory)
 }
 
 func TestMvp4(t *testing.T) {
-	factory := func(memory int) virtualMachine {
-		return mvp4.NewCPU(false, memory)
+	factory := func(memory int) proc.Machine {
+		return mvp4.NewCPU(proc.Options{MemoryBytes: memory})
 	}
 	testPrime(t, factory, memory, testFrom, testTo, false)
 	testSums(t, factory, memory, testFrom, testTo, false)
 	testStringLength(t, factory, 1024, testTo, false)
 	testStringCopy(t, factory, testTo*2, testTo, false)
+	testELF(t, factory)
+	testData(t, factory)
+	testUnsigned(t, factory)
+	testFactorial(t, factory)
+	testPrintNumber(t, factory)
 }
 
 func TestMvp5(t *testing.T) {
-	factory := func(memory int) virtualMachine {
-		return mvp5.NewCPU(false, memory)
+	factory := func(memory int) proc.Machine {
+		return mvp5.NewCPU(proc.Options{MemoryBytes: memory})
 	}
 	testPrime(t, factory, memory, testFrom, testTo, false)
 	testSums(t, factory, memory, testFrom, testTo, false)
 	testStringLength(t, factory, 1024, testTo, false)
 	testStringCopy(t, factory, testTo*2, testTo, false)
+	testELF(t, factory)
+	testData(t, factory)
+	testUnsigned(t, factory)
+	testFactorial(t, factory)
+	testPrintNumber(t, factory)
 }
 
 func TestMvp6_0(t *testing.T) {
-	factory := func(memory int) virtualMachine {
-		return mvp6_0.NewCPU(false, memory)
+	factory := func(memory int) proc.Machine {
+		return mvp6_0.NewCPU(proc.Options{MemoryBytes: memory})
 	}
 	testPrime(t, factory, memory, testFrom, testTo, false)
 	testSums(t, factory, memory, testFrom, testTo, false)
 	testStringLength(t, factory, 1024, testTo, false)
 	testStringCopy(t, factory, testTo*2, testTo, false)
+	testELF(t, factory)
+	testData(t, factory)
+	testUnsigned(t, factory)
+	testFactorial(t, factory)
+	testPrintNumber(t, factory)
 }
 
 func TestMvp6_1(t *testing.T) {
-	factory := func(memory int) virtualMachine {
-		return mvp6_1.NewCPU(false, memory)
+	factory := func(memory int) proc.Machine {
+		return mvp6_1.NewCPU(proc.Options{MemoryBytes: memory})
 	}
 	testPrime(t, factory, memory, testFrom, testTo, false)
 	testSums(t, factory, memory, testFrom, testTo, false)
 	testStringLength(t, factory, 1024, testTo, false)
 	testStringCopy(t, factory, testTo*2, testTo, false)
+	testELF(t, factory)
+	testData(t, factory)
+	testUnsigned(t, factory)
+	testFactorial(t, factory)
+	testPrintNumber(t, factory)
+	testForwarding(t, factory)
 }
 
-func testPrime(t *testing.T, factory func(int) virtualMachine, memory, from, to int, stats bool) {
+func testELF(t *testing.T, factory func(int) proc.Machine) {
+	t.Run("ELF", func(t *testing.T) {
+		f, err := os.Open("../res/elf-sum.elf")
+		require.NoError(t, err)
+		defer f.Close()
+		app, err := risc.ParseELF(f)
+		require.NoError(t, err)
+
+		vm := factory(4096)
+		_, err = vm.Run(app)
+		require.NoError(t, err)
+		assert.Equal(t, int32(108), vm.Context().Registers[risc.A0])
+		assert.Equal(t, int32(0), vm.Context().Registers[risc.S0])
+		assert.Equal(t, int32(4096), vm.Context().Registers[risc.Sp])
+	})
+}
+
+func testData(t *testing.T, factory func(int) proc.Machine) {
+	t.Run("Data", func(t *testing.T) {
+		vm := factory(64)
+		_, err := execute(t, vm, test.ReadFile(t, "../res/data-sum.asm"))
+		require.NoError(t, err)
+		sum := vm.Context().Memory[56:60]
+		length := vm.Context().Memory[60:64]
+		assert.Equal(t, int32(14), risc.I32FromBytes(sum[0], sum[1], sum[2], sum[3]))
+		assert.Equal(t, int32(28), risc.I32FromBytes(length[0], length[1], length[2], length[3]))
+	})
+}
+
+func testUnsigned(t *testing.T, factory func(int) proc.Machine) {
+	t.Run("Unsigned", func(t *testing.T) {
+		vm := factory(32)
+		_, err := execute(t, vm, test.ReadFile(t, "../res/unsigned-max.asm"))
+		require.NoError(t, err)
+		result := vm.Context().Memory[12:24]
+		assert.Equal(t, int32(255), risc.I32FromBytes(result[0], result[1], result[2], result[3]))
+		assert.Equal(t, int32(0xfffe), risc.I32FromBytes(result[4], result[5], result[6], result[7]))
+		assert.Equal(t, int32(1), risc.I32FromBytes(result[8], result[9], result[10], result[11]))
+	})
+}
+
+func testFactorial(t *testing.T, factory func(int) proc.Machine) {
+	expected := 1
+	for n := 1; n <= 10; n++ {
+		expected *= n
+		t.Run(fmt.Sprintf("Factorial - %d", n), func(t *testing.T) {
+			vm := factory(256)
+			bytes := risc.BytesFromLowBits(int32(n))
+			vm.Context().Memory[0] = bytes[0]
+			_, err := execute(t, vm, test.ReadFile(t, "../res/factorial.asm"))
+			require.NoError(t, err)
+			result := vm.Context().Memory[4:8]
+			assert.Equal(t, int32(expected), risc.I32FromBytes(result[0], result[1], result[2], result[3]))
+			assert.Equal(t, int32(256), vm.Context().Registers[risc.Sp])
+		})
+	}
+}
+
+func testPrintNumber(t *testing.T, factory func(int) proc.Machine) {
+	for _, n := range []int32{0, 7, 42, 65535, math.MaxInt32} {
+		t.Run(fmt.Sprintf("Print number - %d", n), func(t *testing.T) {
+			vm := factory(256)
+			bytes := risc.BytesFromLowBits(n)
+			copy(vm.Context().Memory, bytes[:])
+			_, err := execute(t, vm, test.ReadFile(t, "../res/print-number.asm"))
+			require.NoError(t, err)
+			expected := fmt.Sprintf("%d\n", n)
+			assert.Equal(t, expected, vm.Context().Stdout.String())
+			assert.Equal(t, int32(len(expected)), vm.Context().ExitCode)
+		})
+	}
+}
+
+func testForwarding(t *testing.T, factory func(int) proc.Machine) {
+	t.Run("Forwarding", func(t *testing.T) {
+		// ori receives t1 from addi and forwards a0 to sltu
+		vm := factory(1024)
+		_, err := execute(t, vm, `addi t1, zero, 7
+ori a0, t1, -4
+sltu a2, a1, a0
+andi t1, a2, -5`)
+		require.NoError(t, err)
+		assert.Equal(t, int32(-1), vm.Context().Registers[risc.A0])
+	})
+}
+
+func testPrime(t *testing.T, factory func(int) proc.Machine, memory, from, to int, stats bool) {
 	cache := make(map[int]bool, to-from+1)
 	for i := from; i < to; i++ {
 		cache[i] = isPrime(i)
@@ -178,9 +304,7 @@ func testPrime(t *testing.T, factory func(int) virtualMachine, memory, from, to
 
 			if stats {
 				t.Logf("Cycle: %d", cycle)
-				for k, v := range vm.Stats() {
-					t.Log(k, v)
-				}
+				t.Logf("Stats: %+v", vm.Stats())
 			}
 		})
 
@@ -206,16 +330,14 @@ func testPrime(t *testing.T, factory func(int) virtualMachine, memory, from, to
 
 			if stats {
 				t.Logf("Cycle: %d", cycle)
-				for k, v := range vm.Stats() {
-					t.Log(k, v)
-				}
+				t.Logf("Stats: %+v", vm.Stats())
 			}
 		})
 
 	}
 }
 
-func testSums(t *testing.T, factory func(int) virtualMachine, memory, from, to int, stats bool) {
+func testSums(t *testing.T, factory func(int) proc.Machine, memory, from, to int, stats bool) {
 	for i := from; i < to; i++ {
 		t.Run(fmt.Sprintf("Sums - %d", i), func(t *testing.T) {
 			vm := factory(memory)
@@ -243,15 +365,13 @@ func testSums(t *testing.T, factory func(int) virtualMachine, memory, from, to i
 
 			if stats {
 				t.Logf("Cycle: %d", cycle)
-				for k, v := range vm.Stats() {
-					t.Log(k, v)
-				}
+				t.Logf("Stats: %+v", vm.Stats())
 			}
 		})
 	}
 }
 
-func testStringLength(t *testing.T, factory func(int) virtualMachine, memory int, length int, stats bool) {
+func testStringLength(t *testing.T, factory func(int) proc.Machine, memory int, length int, stats bool) {
 	t.Run("String length", func(t *testing.T) {
 		vm := factory(memory)
 		for i := 0; i < length; i++ {
@@ -270,14 +390,12 @@ func testStringLength(t *testing.T, factory func(int) virtualMachine, memory int
 
 		if stats {
 			t.Logf("Cycle: %d", cycle)
-			for k, v := range vm.Stats() {
-				t.Log(k, v)
-			}
+			t.Logf("Stats: %+v", vm.Stats())
 		}
 	})
 }
 
-func testStringCopy(t *testing.T, factory func(int) virtualMachine, memory int, length int, stats bool) {
+func testStringCopy(t *testing.T, factory func(int) proc.Machine, memory int, length int, stats bool) {
 	t.Run("String copy", func(t *testing.T) {
 		vm := factory(memory)
 		for i := 0; i < length; i++ {
@@ -298,49 +416,47 @@ func testStringCopy(t *testing.T, factory func(int) virtualMachine, memory int,
 
 		if stats {
 			t.Logf("Cycle: %d", cycle)
-			for k, v := range vm.Stats() {
-				t.Log(k, v)
-			}
+			t.Logf("Stats: %+v", vm.Stats())
 		}
 	})
 }
 
 //func TestMvp1Jal(t *testing.T) {
-//	factory := func() virtualMachine {
-//		return mvp1.NewCPU(false, memory)
+//	factory := func() proc.Machine {
+//		return mvp1.NewCPU(proc.Options{MemoryBytes: memory})
 //	}
 //	testJal(t, factory)
 //}
 //
 //func TestMvp2Jal(t *testing.T) {
-//	factory := func() virtualMachine {
-//		return mvp2.NewCPU(false, memory)
+//	factory := func() proc.Machine {
+//		return mvp2.NewCPU(proc.Options{MemoryBytes: memory})
 //	}
 //	testJal(t, factory)
 //}
 //
 //func TestMvp3Jal(t *testing.T) {
-//	factory := func() virtualMachine {
-//		return mvp3.NewCPU(false, memory)
+//	factory := func() proc.Machine {
+//		return mvp3.NewCPU(proc.Options{MemoryBytes: memory})
 //	}
 //	testJal(t, factory)
 //}
 //
 //func TestMvp4Jal(t *testing.T) {
-//	factory := func() virtualMachine {
-//		return mvp4.NewCPU(false, memory)
+//	factory := func() proc.Machine {
+//		return mvp4.NewCPU(proc.Options{MemoryBytes: memory})
 //	}
 //	testJal(t, factory)
 //}
 //
 //func TestMvp5Jal(t *testing.T) {
-//	factory := func() virtualMachine {
-//		return mvp5.NewCPU(false, memory)
+//	factory := func() proc.Machine {
+//		return mvp5.NewCPU(proc.Options{MemoryBytes: memory})
 //	}
 //	testJal(t, factory)
 //}
 //
-//func testJal(t *testing.T, factory func() virtualMachine) {
+//func testJal(t *testing.T, factory func() proc.Machine) {
 //	vm := factory()
 //	_, err := execute(t, vm, `start:
 //	jal zero, func
@@ -353,40 +469,40 @@ func testStringCopy(t *testing.T, factory func(int) virtualMachine, memory int,
 
 func TestBenchmarks(t *testing.T) {
 	primeExpected := map[string]int{
-		"MVP-1":   13120170,
-		"MVP-2":   851554,
-		"MVP-3":   851556,
-		"MVP-4":   450937,
-		"MVP-5":   400864,
-		"MVP-6.0": 400824,
-		"MVP-6.1": 400824,
+		"MVP-1":   14722570,
+		"MVP-2":   2453954,
+		"MVP-3":   2454012,
+		"MVP-4":   2053396,
+		"MVP-5":   2003323,
+		"MVP-6.0": 400884,
+		"MVP-6.1": 400884,
 	}
 	sumsExpected := map[string]int{
 		"MVP-1":   1921287,
 		"MVP-2":   520260,
-		"MVP-3":   329332,
-		"MVP-4":   267356,
-		"MVP-5":   263261,
-		"MVP-6.0": 74853,
-		"MVP-6.1": 66406,
+		"MVP-3":   323319,
+		"MVP-4":   261616,
+		"MVP-5":   257521,
+		"MVP-6.0": 69113,
+		"MVP-6.1": 60666,
 	}
 	copyExpected := map[string]int{
 		"MVP-1":   5826769,
 		"MVP-2":   1833023,
-		"MVP-3":   1329999,
-		"MVP-4":   1165822,
-		"MVP-5":   1135105,
-		"MVP-6.0": 664073,
-		"MVP-6.1": 643593,
+		"MVP-3":   823682,
+		"MVP-4":   659682,
+		"MVP-5":   649443,
+		"MVP-6.0": 160288,
+		"MVP-6.1": 139971,
 	}
 	lengthExpected := map[string]int{
 		"MVP-1":   3707344,
 		"MVP-2":   1208542,
-		"MVP-3":   705519,
-		"MVP-4":   612961,
-		"MVP-5":   602722,
-		"MVP-6.0": 131695,
-		"MVP-6.1": 111051,
+		"MVP-3":   701471,
+		"MVP-4":   609141,
+		"MVP-5":   598902,
+		"MVP-6.0": 127823,
+		"MVP-6.1": 107179,
 	}
 
 	tableRow := map[string]int{
@@ -399,31 +515,32 @@ func TestBenchmarks(t *testing.T) {
 		"MVP-6.1": 6,
 	}
 
-	vms := map[string]func(m int) virtualMachine{
-		"MVP-1": func(m int) virtualMachine {
-			return mvp1.NewCPU(false, m)
+	vms := map[string]func(m int) proc.Machine{
+		"MVP-1": func(m int) proc.Machine {
+			return mvp1.NewCPU(proc.Options{MemoryBytes: m})
 		},
-		"MVP-2": func(m int) virtualMachine {
-			return mvp2.NewCPU(false, m)
+		"MVP-2": func(m int) proc.Machine {
+			return mvp2.NewCPU(proc.Options{MemoryBytes: m})
 		},
-		"MVP-3": func(m int) virtualMachine {
-			return mvp3.NewCPU(false, m)
+		"MVP-3": func(m int) proc.Machine {
+			return mvp3.NewCPU(proc.Options{MemoryBytes: m})
 		},
-		"MVP-4": func(m int) virtualMachine {
-			return mvp4.NewCPU(false, m)
+		"MVP-4": func(m int) proc.Machine {
+			return mvp4.NewCPU(proc.Options{MemoryBytes: m})
 		},
-		"MVP-5": func(m int) virtualMachine {
-			return mvp5.NewCPU(false, m)
+		"MVP-5": func(m int) proc.Machine {
+			return mvp5.NewCPU(proc.Options{MemoryBytes: m})
 		},
-		"MVP-6.0": func(m int) virtualMachine {
-			return mvp6_0.NewCPU(false, m)
+		"MVP-6.0": func(m int) proc.Machine {
+			return mvp6_0.NewCPU(proc.Options{MemoryBytes: m})
 		},
-		"MVP-6.1": func(m int) virtualMachine {
-			return mvp6_1.NewCPU(false, m)
+		"MVP-6.1": func(m int) proc.Machine {
+			return mvp6_1.NewCPU(proc.Options{MemoryBytes: m})
 		},
 	}
 
 	primeOutput := make([]string, len(tableRow))
+	primeIPC := make([]float64, len(tableRow))
 	t.Run("Prime", func(t *testing.T) {
 		for name, factory := range vms {
 			t.Run(name, func(t *testing.T) {
@@ -449,11 +566,13 @@ func TestBenchmarks(t *testing.T) {
 				}
 				assert.Equal(t, primeExpected[name], cycles)
 				primeOutput[tableRow[name]] = primeStats(cycles)
+				primeIPC[tableRow[name]] = vm.Stats().IPC()
 			})
 		}
 	})
 
 	sumsOutput := make([]string, len(tableRow))
+	sumsIPC := make([]float64, len(tableRow))
 	t.Run("Sum", func(t *testing.T) {
 		for name, factory := range vms {
 			t.Run(name, func(t *testing.T) {
@@ -483,11 +602,13 @@ func TestBenchmarks(t *testing.T) {
 
 				assert.Equal(t, sumsExpected[name], cycles)
 				sumsOutput[tableRow[name]] = sumStats(cycles)
+				sumsIPC[tableRow[name]] = vm.Stats().IPC()
 			})
 		}
 	})
 
 	cpyOutput := make([]string, len(tableRow))
+	cpyIPC := make([]float64, len(tableRow))
 	t.Run("String copy", func(t *testing.T) {
 		for name, factory := range vms {
 			t.Run(name, func(t *testing.T) {
@@ -516,11 +637,13 @@ func TestBenchmarks(t *testing.T) {
 				require.NoError(t, err)
 				assert.Equal(t, copyExpected[name], cycles)
 				cpyOutput[tableRow[name]] = stringCopyStats(cycles)
+				cpyIPC[tableRow[name]] = vm.Stats().IPC()
 			})
 		}
 	})
 
 	lengthOutput := make([]string, len(tableRow))
+	lengthIPC := make([]float64, len(tableRow))
 	t.Run("String length", func(t *testing.T) {
 		for name, factory := range vms {
 			t.Run(name, func(t *testing.T) {
@@ -546,6 +669,7 @@ func TestBenchmarks(t *testing.T) {
 
 				assert.Equal(t, lengthExpected[name], cycles)
 				lengthOutput[tableRow[name]] = stringLengthStats(cycles)
+				lengthIPC[tableRow[name]] = vm.Stats().IPC()
 			})
 		}
 	})
@@ -564,4 +688,266 @@ func TestBenchmarks(t *testing.T) {
 		output += fmt.Sprintf("| %s | %s | %s | %s | %s |\n", mvp, primeOutput[idx], sumsOutput[idx], cpyOutput[idx], lengthOutput[idx])
 	}
 	fmt.Println(output)
+
+	output = `| Machine | Prime number | Sum of array | String copy | String length |
+|:------:|:-----:|:-----:|:-----:|:-----:|
+`
+	for _, mvp := range keys {
+		idx := tableRow[mvp]
+		output += fmt.Sprintf("| %s | %.3f | %.3f | %.3f | %.3f |\n", mvp, primeIPC[idx], sumsIPC[idx], cpyIPC[idx], lengthIPC[idx])
+	}
+	fmt.Println(output)
+}
+
+func TestCacheSizes(t *testing.T) {
+	// The loops of the sum of array and string copy benchmarks, repeated so
+	// that the data can be reused
+	sums := `
+    li    t3, %d
+pass:
+    li    t0, 0
+    li    t1, 0
+loop:
+    bge   t1, a1, end
+    slli  t2, t1, 2
+    add   t2, a0, t2
+    lw    t2, 0(t2)
+    add   t0, t0, t2
+    addi  t1, t1, 1
+    jal   zero, loop
+end:
+    addi  t3, t3, -1
+    bnez  t3, pass
+    mv    a0, t0
+    ret`
+	cpy := `
+    li    t3, %d
+pass:
+    li    t0, 0
+loop:
+    bge   t0, a2, end
+    add   t1, a1, t0
+    lb    t1, 0(t1)
+    add   t2, a0, t0
+    sb    t1, 0(t2)
+    addi  t0, t0, 1
+    j     loop
+end:
+    addi  t3, t3, -1
+    bnez  t3, pass
+    ret`
+	hierarchies := []struct {
+		name string
+		opts proc.Options
+	}{
+		{"L1D 1 KB", proc.Options{}},
+		{"L1D 1 KB, L2 8 KB", proc.Options{L2: proc.CacheLevelOptions{Size: 8 * 1024, Associativity: 8}}},
+		{"L1D 1 KB, L2 32 KB", proc.Options{L2: proc.CacheLevelOptions{Size: 32 * 1024, Associativity: 8}}},
+		{"L1D 1 KB, L2 8 KB, L3 64 KB", proc.Options{
+			L2: proc.CacheLevelOptions{Size: 8 * 1024, Associativity: 8},
+			L3: proc.CacheLevelOptions{Size: 64 * 1024, Associativity: 16},
+		}},
+		{"L1D 32 KB", proc.Options{L1DCacheSize: 32 * 1024, L1Associativity: 8}},
+	}
+	const passes = 2
+
+	output := `| Hierarchy | Sum of array | Sum of array, 2 passes | String copy | String copy, 2 passes |
+|:------:|:-----:|:-----:|:-----:|:-----:|
+`
+	cycles := make([][4]int, len(hierarchies))
+	for i, hierarchy := range hierarchies {
+		t.Run(hierarchy.name, func(t *testing.T) {
+			for j, n := range []int{1, passes} {
+				opts := hierarchy.opts
+				opts.MemoryBytes = memory
+				vm := mvp6_1.NewCPU(opts)
+				for k := 0; k < benchSums; k++ {
+					bytes := risc.BytesFromLowBits(int32(k))
+					copy(vm.Context().Memory[4*k:], []int8{bytes[0], bytes[1], bytes[2], bytes[3]})
+				}
+				vm.Context().Registers[risc.A1] = benchSums
+				c, err := execute(t, vm, fmt.Sprintf(sums, n))
+				require.NoError(t, err)
+				assert.Equal(t, int32(benchSums*(benchSums-1)/2), vm.Context().Registers[risc.A0])
+				cycles[i][2*j] = c
+
+				opts.MemoryBytes = 2 * benchStringCopy
+				vm = mvp6_1.NewCPU(opts)
+				for k := 0; k < benchStringCopy; k++ {
+					vm.Context().Memory[k] = '1'
+				}
+				vm.Context().Registers[risc.A0] = benchStringCopy
+				vm.Context().Registers[risc.A2] = benchStringCopy
+				c, err = execute(t, vm, fmt.Sprintf(cpy, n))
+				require.NoError(t, err)
+				for _, v := range vm.Context().Memory {
+					require.Equal(t, int8('1'), v)
+				}
+				cycles[i][2*j+1] = c
+			}
+		})
+		output += fmt.Sprintf("| %s | %d cycles | %d cycles | %d cycles | %d cycles |\n", hierarchy.name,
+			cycles[i][0], cycles[i][2], cycles[i][1], cycles[i][3])
+	}
+
+	// A single pass only has compulsory misses, an L2 adds its latency
+	for i := 1; i < len(hierarchies); i++ {
+		assert.GreaterOrEqual(t, cycles[i][0], cycles[0][0], hierarchies[i].name)
+		assert.GreaterOrEqual(t, cycles[i][1], cycles[0][1], hierarchies[i].name)
+	}
+	// The data, 16 KB and 20 KB, fit in the 32 KB caches and thrash the 8 KB
+	// L2. The L3 only pays off after more passes, its misses adding to the
+	// memory latency.
+	assert.Less(t, cycles[2][2], cycles[0][2])
+	assert.Less(t, cycles[4][2], cycles[0][2])
+	assert.Less(t, cycles[4][3], cycles[0][3])
+	// The sequential lines of the string copy hit the open DRAM rows, barely
+	// slower than the 32 KB L2: its second pass is faster but doesn't make up
+	// for the L2 latency added to the misses of the first one yet.
+	assert.Less(t, cycles[2][3]-cycles[2][1], cycles[0][3]-cycles[0][1])
+	assert.GreaterOrEqual(t, cycles[1][2], cycles[0][2])
+	assert.Less(t, cycles[3][2], 2*cycles[3][0])
+	fmt.Println(output)
+}
+
+func TestPrefetchers(t *testing.T) {
+	sums := fmt.Sprintf(test.ReadFile(t, "../res/array-sum.asm"), "")
+	cpy := test.ReadFile(t, "../res/string-copy.asm")
+	length := test.ReadFile(t, "../res/string-length.asm")
+	// The cycles and the memory stalls, L1D misses and memory writes
+	run := func(t *testing.T, vm proc.Machine, instructions string) [2]int {
+		cycles, err := execute(t, vm, instructions)
+		require.NoError(t, err)
+		perf := vm.Stats()
+		return [2]int{cycles, perf.Stalls[proc.StallL1DMiss] + perf.Stalls[proc.StallMemoryWrite]}
+	}
+
+	output := `| Prefetcher | Sum of array | String copy | String length |
+|:------:|:-----:|:-----:|:-----:|
+`
+	policies := []comp.PrefetchPolicy{comp.NoPrefetch, comp.NextLine, comp.Stride, comp.Stream}
+	results := make([][3][2]int, len(policies))
+	for i, policy := range policies {
+		t.Run(policy.String(), func(t *testing.T) {
+			opts := proc.Options{MemoryBytes: memory, L1DPrefetch: policy, PrefetchDegree: 2}
+			vm := mvp6_1.NewCPU(opts)
+			for k := 0; k < benchSums; k++ {
+				bytes := risc.BytesFromLowBits(int32(k))
+				copy(vm.Context().Memory[4*k:], []int8{bytes[0], bytes[1], bytes[2], bytes[3]})
+			}
+			vm.Context().Registers[risc.A1] = benchSums
+			results[i][0] = run(t, vm, sums)
+			assert.Equal(t, int32(benchSums*(benchSums-1)/2), vm.Context().Registers[risc.A0])
+
+			opts.MemoryBytes = 2 * benchStringCopy
+			vm = mvp6_1.NewCPU(opts)
+			for k := 0; k < benchStringCopy; k++ {
+				vm.Context().Memory[k] = '1'
+			}
+			vm.Context().Registers[risc.A0] = benchStringCopy
+			vm.Context().Registers[risc.A2] = benchStringCopy
+			results[i][1] = run(t, vm, cpy)
+			for _, v := range vm.Context().Memory {
+				require.Equal(t, int8('1'), v)
+			}
+
+			opts.MemoryBytes = benchStringLength + 1
+			vm = mvp6_1.NewCPU(opts)
+			for k := 0; k < benchStringLength; k++ {
+				vm.Context().Memory[k] = '1'
+			}
+			results[i][2] = run(t, vm, length)
+			assert.Equal(t, int32(benchStringLength), risc.I32FromBytes(vm.Context().Memory[0], vm.Context().Memory[1], vm.Context().Memory[2], vm.Context().Memory[3]))
+		})
+		output += fmt.Sprintf("| %s |", policy)
+		for _, r := range results[i] {
+			output += fmt.Sprintf(" %d cycles, %d stalls |", r[0], r[1])
+		}
+		output += "\n"
+	}
+
+	// The accesses are sequential, the prefetchers hide most of the memory
+	// stalls
+	for i := 1; i < len(policies); i++ {
+		for j := range results[i] {
+			assert.Less(t, results[i][j][0], results[0][j][0], policies[i].String())
+			assert.Less(t, results[i][j][1], results[0][j][1]/10, policies[i].String())
+		}
+	}
+	fmt.Println(output)
+}
+
+func TestBranchPredictors(t *testing.T) {
+	prime := test.ReadFile(t, "../res/prime-number.asm")
+	sums := fmt.Sprintf(test.ReadFile(t, "../res/array-sum.asm"), "")
+	cpy := test.ReadFile(t, "../res/string-copy.asm")
+	length := test.ReadFile(t, "../res/string-length.asm")
+	run := func(t *testing.T, vm proc.Machine, instructions string) (int, proc.BranchCounters) {
+		cycles, err := execute(t, vm, instructions)
+		require.NoError(t, err)
+		return cycles, vm.Stats().Branches
+	}
+
+	output := `| Predictor | Prime number | Sum of array | String copy | String length |
+|:------:|:-----:|:-----:|:-----:|:-----:|
+`
+	policies := []comp.PredictorPolicy{comp.NotTaken, comp.Taken, comp.BTFN, comp.Bimodal, comp.GShare, comp.Tournament}
+	cycles := make([][4]int, len(policies))
+	branches := make([][4]proc.BranchCounters, len(policies))
+	for i, policy := range policies {
+		t.Run(policy.String(), func(t *testing.T) {
+			opts := proc.Options{MemoryBytes: 5, BranchPrediction: policy}
+			vm := mvp6_1.NewCPU(opts)
+			bytes := risc.BytesFromLowBits(int32(benchPrimeNumber))
+			copy(vm.Context().Memory, []int8{bytes[0], bytes[1], bytes[2], bytes[3]})
+			cycles[i][0], branches[i][0] = run(t, vm, prime)
+			assert.Equal(t, int8(1), vm.Context().Memory[4])
+
+			opts.MemoryBytes = memory
+			vm = mvp6_1.NewCPU(opts)
+			for k := 0; k < benchSums; k++ {
+				bytes := risc.BytesFromLowBits(int32(k))
+				copy(vm.Context().Memory[4*k:], []int8{bytes[0], bytes[1], bytes[2], bytes[3]})
+			}
+			vm.Context().Registers[risc.A1] = benchSums
+			cycles[i][1], branches[i][1] = run(t, vm, sums)
+			assert.Equal(t, int32(benchSums*(benchSums-1)/2), vm.Context().Registers[risc.A0])
+
+			opts.MemoryBytes = 2 * benchStringCopy
+			vm = mvp6_1.NewCPU(opts)
+			for k := 0; k < benchStringCopy; k++ {
+				vm.Context().Memory[k] = '1'
+			}
+			vm.Context().Registers[risc.A0] = benchStringCopy
+			vm.Context().Registers[risc.A2] = benchStringCopy
+			cycles[i][2], branches[i][2] = run(t, vm, cpy)
+			for _, v := range vm.Context().Memory {
+				require.Equal(t, int8('1'), v)
+			}
+
+			opts.MemoryBytes = benchStringLength + 1
+			vm = mvp6_1.NewCPU(opts)
+			for k := 0; k < benchStringLength; k++ {
+				vm.Context().Memory[k] = '1'
+			}
+			cycles[i][3], branches[i][3] = run(t, vm, length)
+			assert.Equal(t, int32(benchStringLength), risc.I32FromBytes(vm.Context().Memory[0], vm.Context().Memory[1], vm.Context().Memory[2], vm.Context().Memory[3]))
+		})
+		output += fmt.Sprintf("| %s |", policy)
+		for j := range cycles[i] {
+			output += fmt.Sprintf(" %d cycles, %d mispredicted |", cycles[i][j], branches[i][j].Mispredictions)
+		}
+		output += "\n"
+	}
+
+	// The loops of the benchmarks exit with a forward branch not taken until
+	// the last iteration: its target isn't in the BTB before, hence it is
+	// fetched as not taken whatever the direction predicted
+	for j := range cycles[0] {
+		for i := 1; i < len(policies); i++ {
+			assert.Equal(t, cycles[0][j], cycles[i][j], policies[i].String())
+			assert.Greater(t, branches[i][j].Accuracy(), 0.99, policies[i].String())
+		}
+	}
+	fmt.Println(output)
 }
@@ -0,0 +1,257 @@
+package proc
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// StallCause is the reason why a unit stalls.
+type StallCause string
+
+const (
+	// StallDataHazard is an instruction waiting for a register written by a
+	// previous instruction.
+	StallDataHazard StallCause = "data hazard"
+	// StallControlHazard is a unit waiting for a branch to be resolved.
+	StallControlHazard StallCause = "control hazard"
+	// StallStructuralHazard is a unit waiting for the next bus or unit to be
+	// available.
+	StallStructuralHazard StallCause = "structural hazard"
+	// StallForward is an instruction waiting for a forwarded register value.
+	StallForward StallCause = "forward"
+	// StallEcall is an environment call waiting for the previous instructions
+	// and the L1D write back.
+	StallEcall StallCause = "ecall"
+	// StallL1IMiss is a fetch waiting for the memory.
+	StallL1IMiss StallCause = "L1I miss"
+	// StallL1DMiss is a memory read waiting for the memory.
+	StallL1DMiss StallCause = "L1D miss"
+	// StallMemoryWrite is a store waiting for the memory: the lines fetched by
+	// a write-allocate L1D, the dirty lines evicted and the write-through.
+	StallMemoryWrite StallCause = "memory write"
+	// StallSpeculation is a store, a return or an environment call waiting for
+	// the branches predicted before it to be resolved.
+	StallSpeculation StallCause = "speculation"
+)
+
+// CacheCounters are the accesses to a cache.
+type CacheCounters struct {
+	Hits   int
+	Misses int
+}
+
+// HitRate returns the ratio of the accesses that were hits, 0 without access.
+func (c CacheCounters) HitRate() float64 {
+	if c.Hits+c.Misses == 0 {
+		return 0
+	}
+	return float64(c.Hits) / float64(c.Hits+c.Misses)
+}
+
+// PrefetchCounters are the prefetches of a cache: the lines prefetched
+// (issued), accessed once cached (useful), accessed while still being
+// prefetched (late) and the misses of the lines they evicted (polluting).
+type PrefetchCounters struct {
+	Issued    int
+	Useful    int
+	Late      int
+	Polluting int
+}
+
+// Accuracy returns the ratio of the prefetched lines that were accessed, 0
+// without prefetch.
+func (c PrefetchCounters) Accuracy() float64 {
+	if c.Issued == 0 {
+		return 0
+	}
+	return float64(c.Useful+c.Late) / float64(c.Issued)
+}
+
+// BranchCounters are the conditional branches whose direction was predicted
+// when decoded, once resolved, and the ones mispredicted.
+type BranchCounters struct {
+	Predictions    int
+	Mispredictions int
+}
+
+// Accuracy returns the ratio of the branches correctly predicted, 0 without
+// branch.
+func (c BranchCounters) Accuracy() float64 {
+	if c.Predictions == 0 {
+		return 0
+	}
+	return float64(c.Predictions-c.Mispredictions) / float64(c.Predictions)
+}
+
+// BTBCounters are the lookups of the branch target buffer. Aliases are the
+// hits on the entry of another branch, part of the hits.
+type BTBCounters struct {
+	Hits    int
+	Misses  int
+	Aliases int
+}
+
+// HitRate returns the ratio of the lookups hitting, 0 without lookup.
+func (c BTBCounters) HitRate() float64 {
+	if c.Hits+c.Misses == 0 {
+		return 0
+	}
+	return float64(c.Hits) / float64(c.Hits+c.Misses)
+}
+
+// RASCounters are the returns predicted by the return address stack: with
+// their target (hit), with another one (miss) or not predicted, the stack
+// being empty (underflow). Overflows are the calls whose return address
+// replaced the oldest one, the stack being full.
+type RASCounters struct {
+	Hits       int
+	Misses     int
+	Underflows int
+	Overflows  int
+}
+
+// HitRate returns the ratio of the returns predicted with their target, 0
+// without return.
+func (c RASCounters) HitRate() float64 {
+	if c.Hits+c.Misses+c.Underflows == 0 {
+		return 0
+	}
+	return float64(c.Hits) / float64(c.Hits+c.Misses+c.Underflows)
+}
+
+// DRAMCounters are the accesses to the rows of a DRAM: the open row of a bank
+// (hit), a bank without open row (miss) or with another row open (conflict).
+type DRAMCounters struct {
+	RowHits      int
+	RowMisses    int
+	RowConflicts int
+	// QueueCycles are the cycles the requests waited for a busy bank or for
+	// the queue of the memory controller.
+	QueueCycles int
+}
+
+// PerfCounters are the performance counters of a Machine since its creation. A
+// microarchitecture without a given component, for example an L1D or a
+// control unit, leaves its counters to zero.
+type PerfCounters struct {
+	Cycles int
+	// Instructions is the number of retired instructions, the squashed ones
+	// aren't counted.
+	Instructions int
+	L1I          CacheCounters
+	L1D          CacheCounters
+	// L1IPrefetch and L1DPrefetch are the prefetches of the L1 caches.
+	L1IPrefetch PrefetchCounters
+	L1DPrefetch PrefetchCounters
+	// L2 and L3 are the reads of the lower caches: the L1 lines fetched. The
+	// lines written back aren't counted.
+	L2 CacheCounters
+	L3 CacheCounters
+	// DRAM are the accesses to the rows of the main memory.
+	DRAM DRAMCounters
+	// Flushes is the number of pipeline flushes, including the ones caused by
+	// mispredictions and environment calls.
+	Flushes int
+	// Mispredictions is the number of flushes caused by a branch, conditional
+	// or not, whose next instruction wasn't the one fetched.
+	Mispredictions int
+	// Branches are the predictions of the conditional branches.
+	Branches BranchCounters
+	// BTB are the lookups of the targets of the branches.
+	BTB BTBCounters
+	// RAS are the predictions of the returns.
+	RAS RASCounters
+	// Forwards is the number of register values forwarded between execute
+	// units.
+	Forwards int
+	// Stalls is the number of cycles the units stalled, by cause. Two units
+	// stalling during the same cycle count for two cycles.
+	Stalls map[StallCause]int
+	// Utilization is the ratio of the cycles during which each unit was busy,
+	// by unit name.
+	Utilization map[string]float64
+}
+
+// NewPerfCounters returns counters ready to be incremented.
+func NewPerfCounters() *PerfCounters {
+	return &PerfCounters{
+		Stalls:      make(map[StallCause]int),
+		Utilization: make(map[string]float64),
+	}
+}
+
+// IPC returns the instructions per cycle, 0 without cycle.
+func (p PerfCounters) IPC() float64 {
+	if p.Cycles == 0 {
+		return 0
+	}
+	return float64(p.Instructions) / float64(p.Cycles)
+}
+
+// CPI returns the cycles per instruction, 0 without instruction.
+func (p PerfCounters) CPI() float64 {
+	if p.Instructions == 0 {
+		return 0
+	}
+	return float64(p.Cycles) / float64(p.Instructions)
+}
+
+// Write writes the counters, one per line, in a stable order.
+func (p PerfCounters) Write(w io.Writer) {
+	fmt.Fprintf(w, "  instructions: %d\n", p.Instructions)
+	fmt.Fprintf(w, "  ipc: %.3f\n", p.IPC())
+	fmt.Fprintf(w, "  cpi: %.3f\n", p.CPI())
+	fmt.Fprintf(w, "  l1i: %d hits, %d misses\n", p.L1I.Hits, p.L1I.Misses)
+	fmt.Fprintf(w, "  l1d: %d hits, %d misses\n", p.L1D.Hits, p.L1D.Misses)
+	if p.L1IPrefetch != (PrefetchCounters{}) {
+		fmt.Fprintf(w, "  l1i prefetch: %d issued, %d useful, %d late, %d polluting\n",
+			p.L1IPrefetch.Issued, p.L1IPrefetch.Useful, p.L1IPrefetch.Late, p.L1IPrefetch.Polluting)
+	}
+	if p.L1DPrefetch != (PrefetchCounters{}) {
+		fmt.Fprintf(w, "  l1d prefetch: %d issued, %d useful, %d late, %d polluting\n",
+			p.L1DPrefetch.Issued, p.L1DPrefetch.Useful, p.L1DPrefetch.Late, p.L1DPrefetch.Polluting)
+	}
+	if p.L2 != (CacheCounters{}) {
+		fmt.Fprintf(w, "  l2: %d hits, %d misses\n", p.L2.Hits, p.L2.Misses)
+	}
+	if p.L3 != (CacheCounters{}) {
+		fmt.Fprintf(w, "  l3: %d hits, %d misses\n", p.L3.Hits, p.L3.Misses)
+	}
+	if p.DRAM != (DRAMCounters{}) {
+		fmt.Fprintf(w, "  dram: %d row hits, %d row misses, %d row conflicts, %d queue cycles\n",
+			p.DRAM.RowHits, p.DRAM.RowMisses, p.DRAM.RowConflicts, p.DRAM.QueueCycles)
+	}
+	fmt.Fprintf(w, "  flushes: %d\n", p.Flushes)
+	fmt.Fprintf(w, "  mispredictions: %d\n", p.Mispredictions)
+	if p.Branches != (BranchCounters{}) {
+		fmt.Fprintf(w, "  branches: %d predicted, %d mispredicted, %.1f%% accuracy\n",
+			p.Branches.Predictions, p.Branches.Mispredictions, 100*p.Branches.Accuracy())
+	}
+	if p.BTB != (BTBCounters{}) {
+		fmt.Fprintf(w, "  btb: %d hits, %d misses, %d aliases, %.1f%% hit rate\n",
+			p.BTB.Hits, p.BTB.Misses, p.BTB.Aliases, 100*p.BTB.HitRate())
+	}
+	if p.RAS != (RASCounters{}) {
+		fmt.Fprintf(w, "  ras: %d hits, %d misses, %d underflows, %d overflows, %.1f%% hit rate\n",
+			p.RAS.Hits, p.RAS.Misses, p.RAS.Underflows, p.RAS.Overflows, 100*p.RAS.HitRate())
+	}
+	fmt.Fprintf(w, "  forwards: %d\n", p.Forwards)
+	for _, cause := range sortedKeys(p.Stalls) {
+		fmt.Fprintf(w, "  stalls (%s): %d\n", cause, p.Stalls[cause])
+	}
+	for _, unit := range sortedKeys(p.Utilization) {
+		fmt.Fprintf(w, "  utilization (%s): %.1f%%\n", unit, 100*p.Utilization[unit])
+	}
+}
+
+func sortedKeys[K ~string, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i] < keys[j]
+	})
+	return keys
+}
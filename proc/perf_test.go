@@ -0,0 +1,75 @@
+package proc_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teivah/majorana/proc"
+	_ "github.com/teivah/majorana/proc/all"
+	"github.com/teivah/majorana/risc"
+	"github.com/teivah/majorana/test"
+)
+
+func TestPerfCounters(t *testing.T) {
+	app, err := risc.Parse(test.ReadFile(t, "../res/factorial.asm"))
+	require.NoError(t, err)
+	instructions := 0
+	for _, name := range proc.Names() {
+		t.Run(name, func(t *testing.T) {
+			m, err := proc.New(name, proc.Options{MemoryBytes: 256})
+			require.NoError(t, err)
+			assert.Zero(t, m.Stats().IPC())
+
+			m.Context().Memory[0] = 5
+			cycles, err := m.Run(app)
+			require.NoError(t, err)
+			perf := m.Stats()
+			assert.Equal(t, cycles, perf.Cycles)
+			// The retired instructions don't depend on the microarchitecture
+			if instructions == 0 {
+				instructions = perf.Instructions
+			}
+			assert.Equal(t, instructions, perf.Instructions)
+			assert.InDelta(t, float64(perf.Instructions)/float64(cycles), perf.IPC(), 1e-9)
+			assert.InDelta(t, 1, perf.IPC()*perf.CPI(), 1e-9)
+			for unit, utilization := range perf.Utilization {
+				assert.Greater(t, utilization, 0.0, unit)
+				assert.LessOrEqual(t, utilization, 1.0, unit)
+			}
+			if name != "mvp1" {
+				assert.NotZero(t, perf.L1I.Misses)
+				assert.Greater(t, perf.L1I.HitRate(), 0.5)
+			}
+			if name != "mvp1" && name != "mvp2" {
+				assert.NotZero(t, perf.L1D.Hits+perf.L1D.Misses)
+				assert.NotZero(t, perf.Stalls[proc.StallL1DMiss])
+			}
+			if name == "mvp6-1" {
+				assert.NotZero(t, perf.Forwards)
+			}
+			switch name {
+			case "mvp5", "mvp6-0", "mvp6-1":
+				assert.NotZero(t, perf.Branches.Predictions)
+				assert.NotZero(t, perf.RAS.Hits)
+				assert.NotZero(t, perf.BTB.Hits)
+			}
+
+			var buf bytes.Buffer
+			perf.Write(&buf)
+			assert.Contains(t, buf.String(), "instructions: ")
+		})
+	}
+}
+
+func TestPerfCountersZero(t *testing.T) {
+	perf := proc.PerfCounters{}
+	assert.Zero(t, perf.IPC())
+	assert.Zero(t, perf.CPI())
+	assert.Zero(t, perf.L1I.HitRate())
+	assert.Zero(t, perf.L1DPrefetch.Accuracy())
+	assert.Zero(t, perf.Branches.Accuracy())
+	assert.Zero(t, perf.RAS.HitRate())
+	assert.Zero(t, perf.BTB.HitRate())
+}
@@ -0,0 +1,96 @@
+package proc
+
+import (
+	"fmt"
+
+	"github.com/teivah/majorana/risc"
+)
+
+// The memory layout of the victim of a bounds check bypass, res/spectre.asm.
+const (
+	spectreSizeAddr   = 0
+	spectreArray1Addr = 64
+	spectreArray1Size = 16
+	spectreArray2Addr = 1024
+	// spectreStride is the distance between the lines of array2 indexed by
+	// two consecutive values, a cache line
+	spectreStride = cacheLineSize
+	spectreValues = 256
+)
+
+// Prober is a Machine whose memory hierarchy can be probed after a run, as an
+// attacker timing its own loads would.
+type Prober interface {
+	Machine
+	// ProbeLoad loads the byte at addr and returns the number of cycles taken.
+	ProbeLoad(addr int32) int
+	// FlushL1D writes the dirty L1D lines back and invalidates the L1D.
+	FlushL1D()
+}
+
+// RecoverSecret runs a bounds check bypass (Spectre variant 1) against the
+// victim of res/spectre.asm to recover secret, placed right after array1. For
+// each byte, the victim is called on a new machine with each index of
+// training first, training the branch predictor, then the L1D is flushed and
+// the victim is called with the index of the byte out of bounds. The lines of
+// array2 are probed: the only one loaded as fast as array1, cached before the
+// call, is the one indexed by the byte during the speculative execution. The
+// L1D must hold array2. It returns the bytes recovered, -1 for the ones which
+// didn't leak.
+func RecoverSecret(name string, opts Options, victim risc.Application, training []int32, secret []byte) ([]int, error) {
+	if size := spectreArray2Addr + spectreValues*spectreStride; opts.MemoryBytes < size {
+		return nil, fmt.Errorf("memory size %d is below the %d bytes of the victim", opts.MemoryBytes, size)
+	}
+	if len(secret) > spectreArray2Addr-spectreArray1Addr-spectreArray1Size {
+		return nil, fmt.Errorf("secret of %d bytes overlaps array2", len(secret))
+	}
+	recovered := make([]int, 0, len(secret))
+	for i := range secret {
+		m, err := New(name, opts)
+		if err != nil {
+			return nil, err
+		}
+		p, ok := m.(Prober)
+		if !ok {
+			return nil, fmt.Errorf("%s can't be probed", name)
+		}
+		ctx := m.Context()
+		ctx.Memory[spectreSizeAddr] = spectreArray1Size
+		for j := 0; j < spectreArray1Size; j++ {
+			ctx.Memory[spectreArray1Addr+j] = int8(j)
+		}
+		for j, b := range secret {
+			ctx.Memory[spectreArray1Addr+spectreArray1Size+j] = int8(b)
+		}
+		for _, x := range training {
+			ctx.Registers[risc.A0] = x
+			if _, err := m.Run(victim); err != nil {
+				return nil, err
+			}
+		}
+		p.FlushL1D()
+		ctx.Registers[risc.A0] = int32(spectreArray1Size + i)
+		// array1 is cached again, as read by the previous calls of the victim
+		p.ProbeLoad(spectreArray1Addr)
+		if _, err := m.Run(victim); err != nil {
+			return nil, err
+		}
+		// The latency of a hit
+		hit := p.ProbeLoad(spectreArray1Addr)
+
+		value := -1
+		for v := 0; v < spectreValues; v++ {
+			if p.ProbeLoad(int32(spectreArray2Addr+v*spectreStride)) > hit {
+				continue
+			}
+			if value != -1 {
+				// Several lines are cached, nothing can be told
+				value = -1
+				break
+			}
+			value = v
+		}
+		recovered = append(recovered, value)
+	}
+	return recovered, nil
+}
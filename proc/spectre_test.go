@@ -0,0 +1,69 @@
+package proc_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teivah/majorana/proc"
+	"github.com/teivah/majorana/proc/comp"
+	"github.com/teivah/majorana/risc"
+	"github.com/teivah/majorana/test"
+)
+
+func TestRecoverSecret(t *testing.T) {
+	victim, err := risc.Parse(test.ReadFile(t, "../res/spectre.asm"))
+	require.NoError(t, err)
+	secret := []byte("majorana")
+	leaked := make([]int, len(secret))
+	for i, b := range secret {
+		leaked[i] = int(b)
+	}
+	none := []int{-1, -1, -1, -1, -1, -1, -1, -1}
+	deep := proc.SpeculationOptions{Deep: true}
+	inBounds := []int32{0, 1, 2, 3, 4, 5, 6, 7}
+	outOfBounds := []int32{16, 17, 18, 19, 20, 21, 22, 23}
+	for _, tc := range []struct {
+		name         string
+		mvp          string
+		executeUnits int
+		speculation  proc.SpeculationOptions
+		predictor    comp.PredictorPolicy
+		training     []int32
+		expected     []int
+	}{
+		{"deep speculation", "mvp6-1", 4, deep, comp.NotTaken, nil, leaked},
+		// The bimodal predictor trained with the calls in bounds predicts the
+		// bounds check not taken
+		{"trained predictor", "mvp6-1", 4, deep, comp.Bimodal, inBounds, leaked},
+		{"predictor trained out of bounds", "mvp6-1", 4, deep, comp.Bimodal, outOfBounds, none},
+		// The registers written speculatively wait for the bounds check, the
+		// gadget can't index array2
+		{"shallow speculation", "mvp6-1", 4, proc.SpeculationOptions{}, comp.NotTaken, nil, none},
+		// The load of the size and the bounds check waiting for it keep both
+		// execute units busy
+		{"two execute units", "mvp6-1", 2, deep, comp.NotTaken, nil, none},
+		// The control unit dispatches in order, the gadget waits for the
+		// bounds check
+		{"in-order dispatch", "mvp6-0", 0, deep, comp.NotTaken, nil, none},
+		{"load barrier", "mvp6-1", 4, proc.SpeculationOptions{Deep: true, LoadBarrier: true}, comp.NotTaken, nil, none},
+		{"no speculative fill", "mvp6-1", 4, proc.SpeculationOptions{Deep: true, NoSpeculativeFill: true}, comp.NotTaken, nil, none},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			recovered, err := proc.RecoverSecret(tc.mvp, proc.Options{
+				MemoryBytes:      32 * 1024,
+				L1DCacheSize:     32 * 1024,
+				ExecuteUnits:     tc.executeUnits,
+				Speculation:      tc.speculation,
+				BranchPrediction: tc.predictor,
+			}, victim, tc.training, secret)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, recovered)
+		})
+	}
+
+	_, err = proc.RecoverSecret("mvp6-1", proc.Options{MemoryBytes: 4 * 1024}, victim, nil, secret)
+	assert.Error(t, err)
+	_, err = proc.RecoverSecret("mvp3", proc.Options{MemoryBytes: 32 * 1024}, victim, nil, secret)
+	assert.Error(t, err)
+}
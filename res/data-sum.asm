@@ -0,0 +1,46 @@
+# Self-contained program: sums an array of words, computes the length of a
+# string and stores both results in .bss.
+    .equ   COUNT, 6
+    .equ   ELEMENT_SIZE, 4
+
+    .data
+array:
+    .word  1, 2, 3, 4, 5, -1
+    .section .rodata
+message:
+    .asciz "hello, world # not a comment"
+    .bss
+    .align 2
+sum:
+    .space ELEMENT_SIZE
+length:
+    .space 4
+
+    .text
+    .globl _start
+_start:
+    li     t0, 0             # sum = 0
+    li     t1, 0             # i = 0
+    li     t2, COUNT
+    li     a0, array
+loop:
+    bge    t1, t2, strlen
+    slli   t3, t1, 2         # Offset of array[i]
+    add    t3, a0, t3
+    lw     t3, 0(t3)
+    add    t0, t0, t3
+    addi   t1, t1, 1
+    j      loop
+strlen:
+    sw     t0, sum(zero)
+    li     a1, message
+    li     t1, 0             # i = 0
+next:
+    add    t3, a1, t1
+    lb     t3, 0(t3)
+    beqz   t3, end
+    addi   t1, t1, 1
+    j      next
+end:
+    sw     t1, length(zero)
+    ret
@@ -0,0 +1,38 @@
+# Sums a .rodata array, scales it by a .data word and stores the result in
+# .bss. The result is also returned in a0.
+    .text
+    .globl _start
+_start:
+    addi sp, sp, -16
+    sw   s0, 12(sp)
+    li   a0, 0x800         # array
+    li   a1, 8             # length
+    li   s0, 0             # sum
+    li   t1, 0             # i
+loop:
+    bge  t1, a1, done
+    slli t2, t1, 2
+    add  t2, a0, t2
+    lw   t3, 0(t2)
+    add  s0, s0, t3
+    addi t1, t1, 1
+    j    loop
+done:
+    li   t4, 0x820         # scale
+    lw   t5, 0(t4)
+    mul  s0, s0, t5
+    li   t6, 0x830         # result
+    sw   s0, 0(t6)
+    mv   a0, s0
+    lw   s0, 12(sp)
+    addi sp, sp, 16
+    ret
+
+    .section .rodata
+    .word 1, 2, 3, 4, 5, 6, 7, 8
+
+    .data
+    .word 3
+
+    .bss
+    .space 4
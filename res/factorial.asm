@@ -0,0 +1,31 @@
+# Recursive factorial: reads n from memory[0], stores n! in memory[4]. Each
+# call pushes the return address and n to the stack.
+    .text
+    .globl _start
+_start:
+    addi   sp, sp, -4
+    sw     ra, 0(sp)         # Return address to exit the program
+    lw     a0, 0(zero)       # n
+    call   factorial
+    sw     a0, 4(zero)
+    lw     ra, 0(sp)
+    addi   sp, sp, 4
+    ret
+
+factorial:
+    addi   sp, sp, -8
+    sw     ra, 4(sp)
+    sw     a0, 0(sp)
+    li     t0, 1
+    ble    a0, t0, base      # Stop if n <= 1
+    addi   a0, a0, -1
+    call   factorial         # factorial(n - 1)
+    lw     t1, 0(sp)
+    mul    a0, a0, t1        # n * factorial(n - 1)
+    j      done
+base:
+    li     a0, 1
+done:
+    lw     ra, 4(sp)
+    addi   sp, sp, 8
+    ret
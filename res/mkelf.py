@@ -0,0 +1,104 @@
+#!/usr/bin/env python3
+# Links a single RV32 relocatable object without relocations into a static
+# ELF32 executable. There is no RISC-V linker in CI, so the fixtures are built
+# once with:
+#
+#   llvm-mc -triple=riscv32 -mattr=+m,-relax,-c -filetype=obj elf-sum.s -o elf-sum.o
+#   python3 mkelf.py elf-sum.o elf-sum.elf
+#   llvm-objcopy --strip-sections elf-sum.elf elf-sum-stripped.elf
+import struct
+import sys
+
+LAYOUT = {'.text': 0x100, '.rodata': 0x800, '.data': 0x820, '.bss': 0x830}
+FLAGS = {'.text': 5, '.rodata': 4, '.data': 6, '.bss': 6}
+
+
+def read_sections(obj):
+    shoff, = struct.unpack_from('<I', obj, 0x20)
+    shnum, shstrndx = struct.unpack_from('<HH', obj, 0x30)
+    headers = [struct.unpack_from('<10I', obj, shoff + i * 40) for i in range(shnum)]
+    strtab = headers[shstrndx]
+
+    def name(off):
+        start = strtab[4] + off
+        return obj[start:obj.index(b'\0', start)].decode()
+
+    return [(name(h[0]), h) for h in headers]
+
+
+def main(src, dst):
+    obj = open(src, 'rb').read()
+    sections = read_sections(obj)
+    if any(h[1] in (4, 9) for _, h in sections):
+        sys.exit('relocations are not supported')
+
+    body = bytearray()
+    out = []
+    for idx, (name, h) in enumerate(sections):
+        if name not in LAYOUT:
+            continue
+        size = h[5]
+        data = b'' if h[1] == 8 else obj[h[4]:h[4] + size]
+        while (0x34 + 32 * len(LAYOUT) + len(body)) % 4:
+            body.append(0)
+        out.append((idx, name, h, 0x34 + 32 * len(LAYOUT) + len(body), size))
+        body += data
+
+    symtab = next(h for n, h in sections if h[1] == 2)
+    strtab = sections[symtab[6]][1]
+    index = {idx: (name, off) for idx, name, _, off, _ in out}
+    syms = bytearray(16)
+    strs = bytearray(b'\0')
+    first_global = 0
+    for i in range(1, symtab[5] // 16):
+        st_name, value, size, info, other, shndx = struct.unpack_from('<IIIBBH', obj, symtab[4] + i * 16)
+        if shndx not in index:
+            continue
+        start = strtab[4] + st_name
+        sym = obj[start:obj.index(b'\0', start)]
+        new_shndx = [o[0] for o in out].index(shndx) + 1
+        syms += struct.pack('<IIIBBH', len(strs), value + LAYOUT[index[shndx][0]], size, info, other, new_shndx)
+        strs += sym + b'\0'
+        if info >> 4 == 0:
+            first_global = len(syms) // 16
+
+    names = [''] + [o[1] for o in out] + ['.symtab', '.strtab', '.shstrtab']
+    shstr = bytearray(b'\0')
+    name_off = {'': 0}
+    for n in names[1:]:
+        name_off[n] = len(shstr)
+        shstr += n.encode() + b'\0'
+
+    base = 0x34 + 32 * len(LAYOUT)
+    while len(body) % 4:
+        body.append(0)
+    symoff = base + len(body)
+    body += syms
+    stroff = base + len(body)
+    body += strs
+    shstroff = base + len(body)
+    body += shstr
+    while len(body) % 4:
+        body.append(0)
+    shoff = base + len(body)
+
+    phdrs = bytearray()
+    for _, name, h, off, size in out:
+        filesz = 0 if name == '.bss' else size
+        phdrs += struct.pack('<8I', 1, off, LAYOUT[name], LAYOUT[name], filesz, size, FLAGS[name], 4)
+
+    shdrs = bytearray(40)
+    for _, name, h, off, size in out:
+        shdrs += struct.pack('<10I', name_off[name], h[1], h[2], LAYOUT[name], off, size, 0, 0, h[8], 0)
+    shdrs += struct.pack('<10I', name_off['.symtab'], 2, 0, 0, symoff, len(syms), len(out) + 2, first_global, 4, 16)
+    shdrs += struct.pack('<10I', name_off['.strtab'], 3, 0, 0, stroff, len(strs), 0, 0, 1, 0)
+    shdrs += struct.pack('<10I', name_off['.shstrtab'], 3, 0, 0, shstroff, len(shstr), 0, 0, 1, 0)
+
+    ident = b'\x7fELF' + bytes([1, 1, 1, 0]) + bytes(8)
+    header = ident + struct.pack('<HHIIIIIHHHHHH', 2, 243, 1, LAYOUT['.text'], 0x34, shoff, 0,
+                                 0x34, 32, len(out), 40, len(out) + 4, len(out) + 3)
+    open(dst, 'wb').write(header + phdrs + body + shdrs)
+
+
+if __name__ == '__main__':
+    main(sys.argv[1], sys.argv[2])
@@ -0,0 +1,30 @@
+# Prints the unsigned number from memory[0] to stdout followed by a newline and
+# exits with the number of bytes written. Like an unoptimized compiler output,
+# the number is kept on the stack next to the buffer the digits are stored to.
+    .text
+    .globl _start
+_start:
+    addi   sp, sp, -16
+    lw     a0, 0(zero)       # n
+    sw     a0, 0(sp)
+    addi   t1, sp, 16        # The digits are stored backward from the end
+    li     t2, 10
+    addi   t1, t1, -1
+    sb     t2, 0(t1)         # '\n'
+loop:
+    lw     a0, 0(sp)
+    remu   t3, a0, t2
+    divu   a0, a0, t2
+    sw     a0, 0(sp)
+    addi   t3, t3, '0'
+    addi   t1, t1, -1
+    sb     t3, 0(t1)
+    bnez   a0, loop
+    li     a0, 1             # stdout
+    mv     a1, t1
+    addi   a2, sp, 16
+    sub    a2, a2, t1        # Number of bytes
+    li     a7, 64            # write
+    ecall
+    li     a7, 93            # exit with the result of write
+    ecall
@@ -1,14 +1,17 @@
-# 3[1,2,3]______9
-# -
-# Array size
-#   ------      -
-#   Visible   Invisible
+# Bounds check bypass (Spectre variant 1). The victim reads array1[x], x being
+# passed in a0, and indexes array2 with it only if x is below the size of
+# array1. Called with x out of bounds while the size isn't cached, the branch
+# is predicted not taken and array1[x], a secret past array1, leaves the line
+# of array2 it indexes in the L1D before the misprediction is flushed.
 #
+# Memory layout:
+#   0     size of array1 (word)
+#   64    array1, followed by the secret
+#   1024  array2, 256 lines of 64 bytes
 main:
-  lw t0, 0(zero)   # t0 represents the array size
-  li t1, 1         # t1 represents the array
-  li t2, 9         # t2 represents the secret
-  bge t2, t0, end
-  sw t0, 4(t1)
+  lw t0, 0(zero)     # size of array1
+  bgeu a0, t0, end   # bounds check
+  lbu t1, 64(a0)     # array1[x]
+  slli t1, t1, 6
+  lbu t2, 1024(t1)   # array2[array1[x] * 64]
 end:
-  ret              # Value in memory[4]?
\ No newline at end of file
@@ -0,0 +1,45 @@
+# Self-contained program: computes the unsigned maximum of an array of bytes
+# and of an array of halfwords.
+    .data
+bytes:
+    .byte  0x7f, 0xff, 0x80, 0x10
+halves:
+    .half  0x1234, 0xfffe, 0x8000
+    .bss
+result:
+    .space 12
+
+    .text
+    .globl _start
+_start:
+    li     t0, 0             # max = 0
+    li     t1, 0             # i = 0
+    li     t2, 4
+byte:
+    bgeu   t1, t2, half
+    lbu    t3, bytes(t1)
+    bltu   t3, t0, next_byte # Skip if bytes[i] < max
+    mv     t0, t3
+next_byte:
+    addi   t1, t1, 1
+    j      byte
+half:
+    sw     t0, result(zero)
+    li     t0, 0             # max = 0
+    li     t1, 0             # Offset of halves[i]
+    li     t2, 6
+half_loop:
+    bgeu   t1, t2, end
+    lhu    t3, halves(t1)
+    bltu   t3, t0, next_half # Skip if halves[i] < max
+    mv     t0, t3
+next_half:
+    addi   t1, t1, 2
+    j      half_loop
+end:
+    sw     t0, result+4(zero)
+    fence
+    lw     t3, result(zero)
+    sltiu  t4, t3, 256       # Does the maximum fit in a byte?
+    sw     t4, result+8(zero)
+    ret
@@ -1,6 +1,14 @@
 package risc
 
-import "fmt"
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"github.com/teivah/majorana/common/trace"
+)
 
 type ExecutionContext struct {
 	Pc              int32
@@ -8,11 +16,29 @@ type ExecutionContext struct {
 	InstructionType InstructionType
 	WriteRegisters  []RegisterType
 	ReadRegisters   []RegisterType
+	// Sequence and Speculation are the ones of the instruction runner.
+	Sequence    int
+	Speculation int
 }
 
 type Application struct {
 	Instructions []InstructionRunner
 	Labels       map[string]int32
+	// Code is the little-endian machine code of the instructions.
+	Code []int8
+	// Entry is the address of the first instruction.
+	Entry int32
+	// Segments are copied into the memory before running the application.
+	Segments []Segment
+}
+
+// ExitAddress is the return address of the entry point. Jumping to it, usually
+// with a ret from the entry point, terminates the program.
+const ExitAddress int32 = math.MaxInt32 &^ 3
+
+type Segment struct {
+	Addr int32
+	Data []int8
 }
 
 type Context struct {
@@ -21,6 +47,26 @@ type Context struct {
 	PendingReadRegisters  map[RegisterType]int
 	Memory                []int8
 	Debug                 bool
+	// DebugWriter receives the debug traces, os.Stdout by default.
+	DebugWriter io.Writer
+	// Tracer receives the events of the units if set.
+	Tracer trace.Tracer
+	// Cycle is the current cycle, maintained by the processor for the events.
+	Cycle int
+	// Retired is called, if set, with each instruction retired by the
+	// processor. The instructions squashed by a flush aren't retired.
+	Retired func(pc int32, exe Execution)
+	// Ecall services the environment calls, LinuxEcall by default.
+	Ecall  EcallHandler
+	Stdin  io.Reader
+	Stdout bytes.Buffer
+	Stderr bytes.Buffer
+	// ExitCode is the code passed by the program to exit.
+	ExitCode int32
+	// Brk is the program break, the end of the heap which starts right after
+	// the segments.
+	Brk      int32
+	brkStart int32
 }
 
 func NewContext(debug bool, memoryBytes int) *Context {
@@ -30,7 +76,31 @@ func NewContext(debug bool, memoryBytes int) *Context {
 		PendingReadRegisters:  make(map[RegisterType]int),
 		Memory:                make([]int8, memoryBytes),
 		Debug:                 debug,
+		DebugWriter:           os.Stdout,
+		Ecall:                 LinuxEcall{},
+	}
+}
+
+// Load maps the application segments into the memory. If they weren't set
+// already, it points the stack pointer to the top of the memory and the return
+// address to ExitAddress. The program break is set after the last segment.
+func (ctx *Context) Load(app Application) error {
+	for _, segment := range app.Segments {
+		end := segment.Addr + int32(len(segment.Data))
+		if segment.Addr < 0 || int(end) > len(ctx.Memory) {
+			return fmt.Errorf("segment [%d, %d) exceeds memory size %d", segment.Addr, end, len(ctx.Memory))
+		}
+		copy(ctx.Memory[segment.Addr:], segment.Data)
+		ctx.brkStart = max(ctx.brkStart, end)
+	}
+	ctx.Brk = ctx.brkStart
+	if ctx.Registers[Sp] == 0 {
+		ctx.Registers[Sp] = int32(len(ctx.Memory) &^ 0xf)
 	}
+	if ctx.Registers[Ra] == 0 {
+		ctx.Registers[Ra] = ExitAddress
+	}
+	return nil
 }
 
 func (ctx *Context) Flush() {
@@ -38,6 +108,13 @@ func (ctx *Context) Flush() {
 	ctx.PendingReadRegisters = make(map[RegisterType]int)
 }
 
+// Retire notifies Retired of an instruction retired at pc.
+func (ctx *Context) Retire(pc int32, exe Execution) {
+	if ctx.Retired != nil {
+		ctx.Retired(pc, exe)
+	}
+}
+
 func (ctx *Context) WriteRegister(exe Execution) {
 	ctx.Registers[exe.Register] = exe.RegisterValue
 }
@@ -90,11 +167,13 @@ func (ctx *Context) DeletePendingRegisters(readRegisters, writeRegisters []Regis
 	}
 }
 
+// DeletePendingWriteRegisters releases registers pending to be written, their
+// values being left as is.
 func (ctx *Context) DeletePendingWriteRegisters(registers []RegisterType) {
 	for _, register := range registers {
 		ctx.PendingWriteRegisters[register]--
-		if ctx.Registers[register] <= 0 {
-			delete(ctx.Registers, register)
+		if ctx.PendingWriteRegisters[register] <= 0 {
+			delete(ctx.PendingWriteRegisters, register)
 		}
 	}
 }
@@ -208,5 +287,6 @@ type Execution struct {
 	MemoryChanges  map[int32]int8
 	NextPc         int32
 	PcChange       bool
-	Return         bool
+	// Return is set when the program terminates.
+	Return bool
 }
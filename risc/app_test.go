@@ -0,0 +1,20 @@
+package risc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeletePendingWriteRegisters(t *testing.T) {
+	ctx := NewContext(false, 0)
+	ctx.Registers[A0] = 42
+	ctx.AddPendingWriteRegisters([]RegisterType{A0, A0})
+
+	ctx.DeletePendingWriteRegisters([]RegisterType{A0})
+	assert.Equal(t, 1, ctx.PendingWriteRegisters[A0])
+	ctx.DeletePendingWriteRegisters([]RegisterType{A0})
+	assert.NotContains(t, ctx.PendingWriteRegisters, A0)
+	// The value of the register is kept
+	assert.Equal(t, int32(42), ctx.Registers[A0])
+}
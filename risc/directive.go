@@ -0,0 +1,354 @@
+package risc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const textSection = ".text"
+
+// source is the result of the first assembler pass: the instruction lines
+// located at their pc, and the symbols defined by labels and directives.
+type source struct {
+	instructions []string
+	labels       map[string]int32
+	symbols      map[string]int32
+	segments     []Segment
+}
+
+type dataSection struct {
+	name   string
+	data   []int8
+	align  int
+	base   int32
+	values []dataValue
+}
+
+// dataValue is a .word, .half or .byte value evaluated once all the symbols
+// are known.
+type dataValue struct {
+	offset int
+	size   int
+	expr   string
+}
+
+type dataLabel struct {
+	section *dataSection
+	offset  int
+}
+
+// textEntry is a label, an instruction or an alignment of the text section.
+// The text section is laid out once the data symbols are known, as the size of
+// a pseudo-instruction may depend on them.
+type textEntry struct {
+	label string
+	line  string
+	align int32
+}
+
+func assemble(s string) (source, error) {
+	src := source{
+		labels:  make(map[string]int32),
+		symbols: make(map[string]int32),
+	}
+	var sections []*dataSection
+	dataLabels := make(map[string]dataLabel)
+	var current *dataSection
+	var text []textEntry
+
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(stripComment(line))
+		if len(line) == 0 {
+			continue
+		}
+
+		// Labels
+		for {
+			firstWhitespace := strings.IndexAny(line, " \t")
+			token := line
+			if firstWhitespace != -1 {
+				token = line[:firstWhitespace]
+			}
+			if token[len(token)-1] != ':' {
+				break
+			}
+			label := token[:len(token)-1]
+			if current == nil {
+				text = append(text, textEntry{label: label})
+			} else {
+				dataLabels[label] = dataLabel{section: current, offset: len(current.data)}
+			}
+			line = strings.TrimSpace(line[len(token):])
+			if len(line) == 0 {
+				break
+			}
+		}
+		if len(line) == 0 {
+			continue
+		}
+
+		if line[0] != '.' {
+			if current != nil {
+				return source{}, fmt.Errorf("line %s: instruction outside of %s", line, textSection)
+			}
+			text = append(text, textEntry{line: line})
+			continue
+		}
+
+		directive := line
+		var args []string
+		if firstWhitespace := strings.IndexAny(line, " \t"); firstWhitespace != -1 {
+			directive = line[:firstWhitespace]
+			args = splitArgs(line[firstWhitespace+1:])
+		}
+
+		switch strings.ToLower(directive) {
+		case ".text", ".data", ".rodata", ".bss", ".section":
+			name := strings.ToLower(directive)
+			if name == ".section" {
+				if len(args) == 0 {
+					return source{}, fmt.Errorf("line %s: missing section name", line)
+				}
+				name = args[0]
+			}
+			if name == textSection || strings.HasPrefix(name, textSection+".") {
+				current = nil
+				continue
+			}
+			current = nil
+			for _, section := range sections {
+				if section.name == name {
+					current = section
+				}
+			}
+			if current == nil {
+				current = &dataSection{name: name, align: 4}
+				sections = append(sections, current)
+			}
+		case ".globl", ".global":
+			if len(args) == 0 {
+				return source{}, fmt.Errorf("line %s: missing symbol", line)
+			}
+		case ".equ":
+			if len(args) != 2 {
+				return source{}, fmt.Errorf("line %s: expected a symbol and a value", line)
+			}
+			v, err := evaluate(args[1], src.symbols)
+			if err != nil {
+				return source{}, fmt.Errorf("line %s: %v", line, err)
+			}
+			src.symbols[args[0]] = v
+		case ".align", ".p2align", ".balign":
+			if len(args) == 0 {
+				return source{}, fmt.Errorf("line %s: missing alignment", line)
+			}
+			n, err := evaluate(args[0], src.symbols)
+			if err != nil {
+				return source{}, fmt.Errorf("line %s: %v", line, err)
+			}
+			align := int(n)
+			if strings.ToLower(directive) != ".balign" {
+				align = 1 << n
+			}
+			if align <= 0 || align&(align-1) != 0 {
+				return source{}, fmt.Errorf("line %s: invalid alignment %d", line, align)
+			}
+			if current == nil {
+				text = append(text, textEntry{align: int32(align)})
+				continue
+			}
+			current.align = max(current.align, align)
+			for len(current.data)%align != 0 {
+				current.data = append(current.data, 0)
+			}
+		case ".word", ".half", ".byte":
+			if current == nil {
+				return source{}, fmt.Errorf("line %s: data outside of a data section", line)
+			}
+			size := map[string]int{".word": 4, ".half": 2, ".byte": 1}[strings.ToLower(directive)]
+			for _, arg := range args {
+				current.values = append(current.values, dataValue{offset: len(current.data), size: size, expr: arg})
+				current.data = append(current.data, make([]int8, size)...)
+			}
+		case ".ascii", ".asciz", ".string":
+			if current == nil {
+				return source{}, fmt.Errorf("line %s: data outside of a data section", line)
+			}
+			for _, arg := range args {
+				str, err := strconv.Unquote(arg)
+				if err != nil {
+					return source{}, fmt.Errorf("line %s: invalid string %s", line, arg)
+				}
+				for i := 0; i < len(str); i++ {
+					current.data = append(current.data, int8(str[i]))
+				}
+				if strings.ToLower(directive) != ".ascii" {
+					current.data = append(current.data, 0)
+				}
+			}
+		case ".space", ".zero":
+			if current == nil {
+				return source{}, fmt.Errorf("line %s: data outside of a data section", line)
+			}
+			if len(args) == 0 {
+				return source{}, fmt.Errorf("line %s: missing size", line)
+			}
+			n, err := evaluate(args[0], src.symbols)
+			if err != nil {
+				return source{}, fmt.Errorf("line %s: %v", line, err)
+			}
+			if n < 0 {
+				return source{}, fmt.Errorf("line %s: negative size", line)
+			}
+			current.data = append(current.data, make([]int8, n)...)
+		default:
+			return source{}, fmt.Errorf("line %s: unknown directive %s", line, directive)
+		}
+	}
+
+	// Data sections are laid out one after the other from address 0
+	var addr int32
+	for _, section := range sections {
+		for addr%int32(section.align) != 0 {
+			addr++
+		}
+		section.base = addr
+		addr += int32(len(section.data))
+	}
+	for label, l := range dataLabels {
+		src.symbols[label] = l.section.base + int32(l.offset)
+	}
+	for _, section := range sections {
+		for _, value := range section.values {
+			v, err := evaluate(value.expr, src.symbols, src.labels)
+			if err != nil {
+				return source{}, fmt.Errorf("section %s: %v", section.name, err)
+			}
+			bytes := BytesFromLowBits(v)
+			copy(section.data[value.offset:value.offset+value.size], bytes[:value.size])
+		}
+		if len(section.data) != 0 {
+			src.segments = append(src.segments, Segment{Addr: section.base, Data: section.data})
+		}
+	}
+
+	var pc int32
+	for _, entry := range text {
+		switch {
+		case entry.label != "":
+			src.labels[entry.label] = pc
+		case entry.align != 0:
+			for pc%entry.align != 0 {
+				src.instructions = append(src.instructions, "nop")
+				pc += 4
+			}
+		default:
+			lines, err := expand(entry.line, pc, src.symbols)
+			if err != nil {
+				return source{}, fmt.Errorf("line %s: %v", entry.line, err)
+			}
+			src.instructions = append(src.instructions, lines...)
+			pc += int32(4 * len(lines))
+		}
+	}
+	return src, nil
+}
+
+// evaluate returns the value of a number, a symbol or a symbol plus or minus
+// a number. %hi(expr) and %lo(expr) return the upper 20 bits and the
+// sign-extended lower 12 bits so that (%hi << 12) + %lo == expr.
+func evaluate(expr string, symbols ...map[string]int32) (int32, error) {
+	expr = strings.TrimSpace(expr)
+	for _, modifier := range []string{"%hi(", "%lo("} {
+		if !strings.HasPrefix(strings.ToLower(expr), modifier) || expr[len(expr)-1] != ')' {
+			continue
+		}
+		v, err := evaluate(expr[len(modifier):len(expr)-1], symbols...)
+		if err != nil {
+			return 0, err
+		}
+		if modifier == "%hi(" {
+			return int32(uint32(v+0x800) >> 12), nil
+		}
+		return v << 20 >> 20, nil
+	}
+	if len(expr) >= 3 && expr[0] == '\'' {
+		r, _, _, err := strconv.UnquoteChar(expr[1:len(expr)-1], '\'')
+		if err != nil {
+			return 0, fmt.Errorf("invalid character %s", expr)
+		}
+		return int32(r), nil
+	}
+	if i := strings.LastIndexAny(expr, "+-"); i > 0 {
+		left, err := evaluate(expr[:i], symbols...)
+		if err != nil {
+			return 0, err
+		}
+		right, err := evaluate(expr[i+1:], symbols...)
+		if err != nil {
+			return 0, err
+		}
+		if expr[i] == '+' {
+			return left + right, nil
+		}
+		return left - right, nil
+	}
+
+	if n, err := strconv.ParseInt(expr, 0, 64); err == nil {
+		if n < -(1<<31) || n >= 1<<32 {
+			return 0, fmt.Errorf("value %s out of 32-bit range", expr)
+		}
+		return int32(n), nil
+	}
+	for _, m := range symbols {
+		if v, exists := m[expr]; exists {
+			return v, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown symbol: %s", expr)
+}
+
+// stripComment removes a # comment that isn't part of a string or character
+// literal.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0 && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// splitArgs splits directive arguments on commas that aren't part of a
+// string.
+func splitArgs(s string) []string {
+	var args []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0 && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == ',':
+			args = append(args, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	if arg := strings.TrimSpace(s[start:]); arg != "" || len(args) != 0 {
+		args = append(args, arg)
+	}
+	return args
+}
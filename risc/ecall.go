@@ -0,0 +1,106 @@
+package risc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// EcallHandler services the environment calls of a program. The handler may
+// access the context memory directly: the processors write back their caches
+// before an environment call and invalidate them afterward.
+type EcallHandler interface {
+	// Ecall handles the call number with its arguments (a0-a5) and returns the
+	// execution to apply, usually the result written to a0.
+	Ecall(ctx *Context, number int32, args [6]int32) (Execution, error)
+}
+
+// Linux system call numbers of the RISC-V generic ABI.
+const (
+	SysRead      int32 = 63
+	SysWrite     int32 = 64
+	SysExit      int32 = 93
+	SysExitGroup int32 = 94
+	SysBrk       int32 = 214
+)
+
+// Linux error numbers, returned negated in a0.
+const (
+	ebadf  int32 = 9
+	efault int32 = 14
+)
+
+// LinuxEcall implements a small subset of the Linux system calls: exit,
+// exit_group, read from Context.Stdin, write to Context.Stdout and
+// Context.Stderr, and brk.
+type LinuxEcall struct{}
+
+func (LinuxEcall) Ecall(ctx *Context, number int32, args [6]int32) (Execution, error) {
+	switch number {
+	case SysExit, SysExitGroup:
+		ctx.ExitCode = args[0]
+		return Execution{Return: true}, nil
+	case SysRead:
+		fd, buf, count := args[0], args[1], args[2]
+		if fd != 0 {
+			return result(-ebadf), nil
+		}
+		if !ctx.isInMemory(buf, count) {
+			return result(-efault), nil
+		}
+		if ctx.Stdin == nil || count == 0 {
+			return result(0), nil
+		}
+		data := make([]byte, count)
+		n, err := ctx.Stdin.Read(data)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return Execution{}, fmt.Errorf("read stdin: %w", err)
+		}
+		for i := 0; i < n; i++ {
+			ctx.Memory[buf+int32(i)] = int8(data[i])
+		}
+		return result(int32(n)), nil
+	case SysWrite:
+		fd, buf, count := args[0], args[1], args[2]
+		var w io.Writer
+		switch fd {
+		case 1:
+			w = &ctx.Stdout
+		case 2:
+			w = &ctx.Stderr
+		default:
+			return result(-ebadf), nil
+		}
+		if !ctx.isInMemory(buf, count) {
+			return result(-efault), nil
+		}
+		data := make([]byte, count)
+		for i := range data {
+			data[i] = byte(ctx.Memory[buf+int32(i)])
+		}
+		_, _ = w.Write(data)
+		return result(count), nil
+	case SysBrk:
+		// Like Linux, an invalid break leaves it unchanged and the current one
+		// is returned
+		if addr := args[0]; addr >= ctx.brkStart && int(addr) <= len(ctx.Memory) {
+			ctx.Brk = addr
+		}
+		return result(ctx.Brk), nil
+	default:
+		return Execution{}, fmt.Errorf("unsupported environment call %d", number)
+	}
+}
+
+func result(v int32) Execution {
+	register, value := IsRegisterChange(A0, v)
+	return Execution{
+		RegisterChange: true,
+		Register:       register,
+		RegisterValue:  value,
+	}
+}
+
+func (ctx *Context) isInMemory(addr, count int32) bool {
+	return addr >= 0 && count >= 0 && int(addr)+int(count) <= len(ctx.Memory)
+}
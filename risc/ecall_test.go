@@ -0,0 +1,106 @@
+package risc
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEcallExit(t *testing.T) {
+	app, err := Parse(`li a0, 42
+li a7, 93
+ecall
+li a0, 1`)
+	require.NoError(t, err)
+	r := NewRunner(app, 0)
+	code, err := r.Run()
+	require.NoError(t, err)
+	assert.Equal(t, int32(42), code)
+	assert.Equal(t, int32(42), r.Ctx.Registers[A0])
+}
+
+func TestEcallWrite(t *testing.T) {
+	app, err := Parse(`.data
+msg: .string "hello"
+.text
+li a0, 1
+la a1, msg
+li a2, 5
+li a7, 64
+ecall
+mv s0, a0
+li a0, 2
+li a2, 2
+ecall
+li a0, 3
+ecall`)
+	require.NoError(t, err)
+	r := NewRunner(app, 16)
+	_, err = r.Run()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", r.Ctx.Stdout.String())
+	assert.Equal(t, "he", r.Ctx.Stderr.String())
+	assert.Equal(t, int32(5), r.Ctx.Registers[S0])
+	assert.Equal(t, -ebadf, r.Ctx.Registers[A0])
+}
+
+func TestEcallWriteOutOfMemory(t *testing.T) {
+	app, err := Parse(`li a0, 1
+li a1, 12
+li a2, 8
+li a7, 64
+ecall`)
+	require.NoError(t, err)
+	r := NewRunner(app, 16)
+	_, err = r.Run()
+	require.NoError(t, err)
+	assert.Equal(t, -efault, r.Ctx.Registers[A0])
+	assert.Empty(t, r.Ctx.Stdout.String())
+}
+
+func TestEcallRead(t *testing.T) {
+	app, err := Parse(`li a0, 0
+li a1, 4
+li a2, 8
+li a7, 63
+ecall
+mv s0, a0
+li a0, 0
+ecall`)
+	require.NoError(t, err)
+	r := NewRunner(app, 16)
+	r.Ctx.Stdin = strings.NewReader("abc")
+	_, err = r.Run()
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), r.Ctx.Registers[S0])
+	assert.Equal(t, int32(0), r.Ctx.Registers[A0])
+	assert.Equal(t, []int8{'a', 'b', 'c', 0}, r.Ctx.Memory[4:8])
+}
+
+func TestEcallBrk(t *testing.T) {
+	app, err := Parse(`.data
+.word 1, 2
+.text
+li a7, 214
+li a0, 0
+ecall
+mv s0, a0
+addi a0, a0, 16
+ecall
+mv s1, a0
+li a0, 4
+ecall
+mv s2, a0
+li a0, 2048
+ecall`)
+	require.NoError(t, err)
+	r := NewRunner(app, 64)
+	_, err = r.Run()
+	require.NoError(t, err)
+	assert.Equal(t, int32(8), r.Ctx.Registers[S0])
+	assert.Equal(t, int32(24), r.Ctx.Registers[S1])
+	assert.Equal(t, int32(24), r.Ctx.Registers[S2])
+	assert.Equal(t, int32(24), r.Ctx.Registers[A0])
+}
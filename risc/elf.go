@@ -0,0 +1,154 @@
+package risc
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// maxELFCode is the address the code of an ELF executable must end below, the
+// instructions being indexed by their address.
+const maxELFCode = 1 << 20
+
+// ParseELF loads a statically linked RV32 ELF executable. The loadable
+// segments (PT_LOAD) are mapped into the memory when the application is loaded
+// and the executable ones are decoded into instructions located at their
+// virtual address. If the section headers weren't stripped, only the
+// executable sections are decoded; otherwise the words of the executable
+// segments which aren't instructions are skipped, as read-only data. The
+// segments must be located below 2 GB and the code below 1 MB: the executables
+// linked at a higher address, such as the bare metal ones at 0x80000000, are
+// rejected.
+func ParseELF(r io.ReaderAt) (Application, error) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return Application{}, err
+	}
+	defer f.Close()
+
+	if f.Class != elf.ELFCLASS32 || f.Machine != elf.EM_RISCV || f.Data != elf.ELFDATA2LSB {
+		return Application{}, fmt.Errorf("not a little-endian RV32 executable: %v %v %v", f.Class, f.Machine, f.Data)
+	}
+	if f.Type != elf.ET_EXEC {
+		return Application{}, fmt.Errorf("not a statically linked executable: %v", f.Type)
+	}
+
+	var code []int8
+	var segments []Segment
+	// executables are the address ranges of the executable segments
+	var executables [][2]int32
+	for i, prog := range f.Progs {
+		if prog.Type != elf.PT_LOAD || prog.Memsz == 0 {
+			continue
+		}
+		if prog.Filesz > prog.Memsz {
+			return Application{}, fmt.Errorf("segment %d: file size %d above memory size %d", i, prog.Filesz, prog.Memsz)
+		}
+		end := uint64(prog.Vaddr) + prog.Memsz
+		if end > math.MaxInt32 {
+			return Application{}, fmt.Errorf("segment %d: [%#x, %#x) beyond the 2 GB address space", i, prog.Vaddr, end)
+		}
+
+		data := make([]byte, prog.Memsz)
+		if _, err := io.ReadFull(prog.Open(), data[:prog.Filesz]); err != nil {
+			return Application{}, fmt.Errorf("segment %d: %v", i, err)
+		}
+		segment := Segment{
+			Addr: int32(prog.Vaddr),
+			Data: make([]int8, len(data)),
+		}
+		for j, b := range data {
+			segment.Data[j] = int8(b)
+		}
+		segments = append(segments, segment)
+
+		if prog.Flags&elf.PF_X != 0 {
+			if prog.Vaddr%4 != 0 || prog.Memsz%4 != 0 {
+				return Application{}, fmt.Errorf("segment %d: misaligned code", i)
+			}
+			if end > maxELFCode {
+				return Application{}, fmt.Errorf("segment %d: code [%#x, %#x) beyond %#x", i, prog.Vaddr, end, maxELFCode)
+			}
+			if int(end) > len(code) {
+				code = append(code, make([]int8, int(end)-len(code))...)
+			}
+			copy(code[prog.Vaddr:], segment.Data)
+			executables = append(executables, [2]int32{int32(prog.Vaddr), int32(end)})
+		}
+	}
+	if len(executables) == 0 {
+		return Application{}, errors.New("no executable segment")
+	}
+	entry := int32(f.Entry)
+	if !contains(executables, entry) {
+		return Application{}, fmt.Errorf("entry point %#x outside of the executable segments", f.Entry)
+	}
+
+	labels := make(map[string]int32)
+	instructions := make([]InstructionRunner, len(code)/4)
+	decode := func(addr int32) error {
+		word := uint32(I32FromBytes(code[addr], code[addr+1], code[addr+2], code[addr+3]))
+		runner, err := DecodeInstruction(word, addr, labels)
+		if err != nil {
+			return err
+		}
+		instructions[addr/4] = runner
+		return nil
+	}
+	if len(f.Sections) == 0 {
+		for _, executable := range executables {
+			for addr := executable[0]; addr < executable[1]; addr += 4 {
+				// Not an instruction, read-only data
+				_ = decode(addr)
+			}
+		}
+	}
+	for _, section := range f.Sections {
+		if section.Flags&elf.SHF_EXECINSTR == 0 || section.Size == 0 {
+			continue
+		}
+		if section.Addr%4 != 0 || section.Size%4 != 0 {
+			return Application{}, fmt.Errorf("section %s: misaligned code", section.Name)
+		}
+		if section.Addr+section.Size > uint64(len(code)) ||
+			!contains(executables, int32(section.Addr)) || !contains(executables, int32(section.Addr+section.Size-4)) {
+			return Application{}, fmt.Errorf("section %s: outside of the executable segments", section.Name)
+		}
+		for addr := int32(section.Addr); addr < int32(section.Addr+section.Size); addr += 4 {
+			if err := decode(addr); err != nil {
+				return Application{}, fmt.Errorf("section %s: pc %d: %v", section.Name, addr, err)
+			}
+		}
+	}
+
+	symbols, err := f.Symbols()
+	if err != nil && !errors.Is(err, elf.ErrNoSymbols) {
+		return Application{}, err
+	}
+	for _, symbol := range symbols {
+		if symbol.Name != "" && symbol.Section != elf.SHN_UNDEF && int(symbol.Section) < len(f.Sections) &&
+			f.Sections[symbol.Section].Flags&elf.SHF_EXECINSTR != 0 {
+			labels[symbol.Name] = int32(symbol.Value)
+		}
+	}
+
+	return Application{
+		Instructions: instructions,
+		Labels:       labels,
+		Code:         code,
+		Entry:        entry,
+		Segments:     segments,
+	}, nil
+}
+
+// contains returns whether addr is in one of the ranges.
+func contains(ranges [][2]int32, addr int32) bool {
+	for _, r := range ranges {
+		if addr >= r[0] && addr < r[1] {
+			return true
+		}
+	}
+	return false
+}
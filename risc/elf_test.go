@@ -0,0 +1,85 @@
+package risc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseELF(t *testing.T) {
+	f, err := os.Open("../res/elf-sum.elf")
+	require.NoError(t, err)
+	defer f.Close()
+
+	app, err := ParseELF(f)
+	require.NoError(t, err)
+	assert.Equal(t, int32(0x100), app.Entry)
+	assert.Equal(t, int32(0x100), app.Labels["_start"])
+	assert.Nil(t, app.Instructions[0])
+	assert.Equal(t, Addi, app.Instructions[0x100/4].InstructionType())
+
+	r := NewRunner(app, 4096)
+	_, err = r.Run()
+	require.NoError(t, err)
+	assert.Equal(t, int32(108), r.Ctx.Registers[A0])
+	assert.Equal(t, int32(4096), r.Ctx.Registers[Sp])
+	assert.Equal(t, int32(108), I32FromBytes(r.Ctx.Memory[0x830], r.Ctx.Memory[0x831], r.Ctx.Memory[0x832], r.Ctx.Memory[0x833]))
+}
+
+func TestParseELFMemoryTooSmall(t *testing.T) {
+	f, err := os.Open("../res/elf-sum.elf")
+	require.NoError(t, err)
+	defer f.Close()
+
+	app, err := ParseELF(f)
+	require.NoError(t, err)
+
+	r := NewRunner(app, 1024)
+	_, err = r.Run()
+	assert.Error(t, err)
+}
+
+func TestParseELFStripped(t *testing.T) {
+	f, err := os.Open("../res/elf-sum-stripped.elf")
+	require.NoError(t, err)
+	defer f.Close()
+
+	// Without the section headers, the code is loaded from the segments
+	app, err := ParseELF(f)
+	require.NoError(t, err)
+	assert.Equal(t, Addi, app.Instructions[0x100/4].InstructionType())
+	assert.NotContains(t, app.Labels, "_start")
+
+	r := NewRunner(app, 4096)
+	_, err = r.Run()
+	require.NoError(t, err)
+	assert.Equal(t, int32(108), r.Ctx.Registers[A0])
+}
+
+func TestParseELFErrors(t *testing.T) {
+	exe, err := os.ReadFile("../res/elf-sum.elf")
+	require.NoError(t, err)
+	// relocated returns the executable with its code segment and entry point
+	// moved to addr
+	relocated := func(addr uint32) []byte {
+		res := bytes.Clone(exe)
+		binary.LittleEndian.PutUint32(res[0x18:], addr)
+		binary.LittleEndian.PutUint32(res[0x34+8:], addr)
+		return res
+	}
+	for name, data := range map[string][]byte{
+		"bare metal base": relocated(0x80000000),
+		"code too high":   relocated(0x10000000),
+		"misaligned code": relocated(0x102),
+		"truncated":       exe[:0x100],
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseELF(bytes.NewReader(data))
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,422 @@
+package risc
+
+import (
+	"fmt"
+)
+
+const (
+	opcodeLoad    uint32 = 0b0000011
+	opcodeOpImm   uint32 = 0b0010011
+	opcodeAuipc   uint32 = 0b0010111
+	opcodeStore   uint32 = 0b0100011
+	opcodeOp      uint32 = 0b0110011
+	opcodeLui     uint32 = 0b0110111
+	opcodeBranch  uint32 = 0b1100011
+	opcodeJalr    uint32 = 0b1100111
+	opcodeJal     uint32 = 0b1101111
+	opcodeMiscMem uint32 = 0b0001111
+	opcodeSystem  uint32 = 0b1110011
+
+	funct7Base uint32 = 0b0000000
+	funct7Alt  uint32 = 0b0100000
+	funct7Mul  uint32 = 0b0000001
+)
+
+// Encode returns the RV32 machine code of an application, one 32-bit word per
+// instruction. Labels are resolved to PC-relative offsets.
+func Encode(app Application) ([]uint32, error) {
+	words := make([]uint32, 0, len(app.Instructions))
+	for i, runner := range app.Instructions {
+		pc := int32(i * 4)
+		word, err := EncodeInstruction(runner, pc, app.Labels)
+		if err != nil {
+			return nil, fmt.Errorf("pc %d: %v", pc, err)
+		}
+		words = append(words, word)
+	}
+	return words, nil
+}
+
+// EncodeInstruction returns the 32-bit word of a single instruction located
+// at pc.
+func EncodeInstruction(runner InstructionRunner, pc int32, labels map[string]int32) (uint32, error) {
+	offset := func(label string) (int32, error) {
+		addr, exists := labels[label]
+		if !exists {
+			return 0, fmt.Errorf("label %s does not exist", label)
+		}
+		return addr - pc, nil
+	}
+
+	switch op := runner.(type) {
+	case *add:
+		return encodeR(opcodeOp, 0b000, funct7Base, op.rd, op.rs1, op.rs2), nil
+	case *sub:
+		return encodeR(opcodeOp, 0b000, funct7Alt, op.rd, op.rs1, op.rs2), nil
+	case *sll:
+		return encodeR(opcodeOp, 0b001, funct7Base, op.rd, op.rs1, op.rs2), nil
+	case *slt:
+		return encodeR(opcodeOp, 0b010, funct7Base, op.rd, op.rs1, op.rs2), nil
+	case *sltu:
+		return encodeR(opcodeOp, 0b011, funct7Base, op.rd, op.rs1, op.rs2), nil
+	case *xor:
+		return encodeR(opcodeOp, 0b100, funct7Base, op.rd, op.rs1, op.rs2), nil
+	case *srl:
+		return encodeR(opcodeOp, 0b101, funct7Base, op.rd, op.rs1, op.rs2), nil
+	case *sra:
+		return encodeR(opcodeOp, 0b101, funct7Alt, op.rd, op.rs1, op.rs2), nil
+	case *or:
+		return encodeR(opcodeOp, 0b110, funct7Base, op.rd, op.rs1, op.rs2), nil
+	case *and:
+		return encodeR(opcodeOp, 0b111, funct7Base, op.rd, op.rs1, op.rs2), nil
+	case *mul:
+		return encodeR(opcodeOp, 0b000, funct7Mul, op.rd, op.rs1, op.rs2), nil
+	case *mulh:
+		return encodeR(opcodeOp, 0b001, funct7Mul, op.rd, op.rs1, op.rs2), nil
+	case *mulhsu:
+		return encodeR(opcodeOp, 0b010, funct7Mul, op.rd, op.rs1, op.rs2), nil
+	case *mulhu:
+		return encodeR(opcodeOp, 0b011, funct7Mul, op.rd, op.rs1, op.rs2), nil
+	case *div:
+		return encodeR(opcodeOp, 0b100, funct7Mul, op.rd, op.rs1, op.rs2), nil
+	case *divu:
+		return encodeR(opcodeOp, 0b101, funct7Mul, op.rd, op.rs1, op.rs2), nil
+	case *rem:
+		return encodeR(opcodeOp, 0b110, funct7Mul, op.rd, op.rs1, op.rs2), nil
+	case *remu:
+		return encodeR(opcodeOp, 0b111, funct7Mul, op.rd, op.rs1, op.rs2), nil
+	case *addi:
+		return encodeI(opcodeOpImm, 0b000, op.rd, op.rs, op.imm)
+	case *slti:
+		return encodeI(opcodeOpImm, 0b010, op.rd, op.rs, op.imm)
+	case *sltiu:
+		return encodeI(opcodeOpImm, 0b011, op.rd, op.rs, op.imm)
+	case *xori:
+		return encodeI(opcodeOpImm, 0b100, op.rd, op.rs, op.imm)
+	case *ori:
+		return encodeI(opcodeOpImm, 0b110, op.rd, op.rs, op.imm)
+	case *andi:
+		return encodeI(opcodeOpImm, 0b111, op.rd, op.rs, op.imm)
+	case *slli:
+		return encodeShift(0b001, funct7Base, op.rd, op.rs, op.imm)
+	case *srli:
+		return encodeShift(0b101, funct7Base, op.rd, op.rs, op.imm)
+	case *srai:
+		return encodeShift(0b101, funct7Alt, op.rd, op.rs, op.imm)
+	case *li:
+		return encodeI(opcodeOpImm, 0b000, op.rd, Zero, op.imm)
+	case *mv:
+		return encodeI(opcodeOpImm, 0b000, op.rd, op.rs, 0)
+	case *nop:
+		return encodeI(opcodeOpImm, 0b000, Zero, Zero, 0)
+	case *lb:
+		return encodeI(opcodeLoad, 0b000, op.rd, op.rs, op.offset)
+	case *lh:
+		return encodeI(opcodeLoad, 0b001, op.rd, op.rs, op.offset)
+	case *lbu:
+		return encodeI(opcodeLoad, 0b100, op.rd, op.rs, op.offset)
+	case *lhu:
+		return encodeI(opcodeLoad, 0b101, op.rd, op.rs, op.offset)
+	case *lw:
+		return encodeI(opcodeLoad, 0b010, op.rd, op.rs, op.offset)
+	case *sb:
+		return encodeS(0b000, op.rs1, op.rs2, op.offset)
+	case *sh:
+		return encodeS(0b001, op.rs1, op.rs2, op.offset)
+	case *sw:
+		return encodeS(0b010, op.rs1, op.rs2, op.offset)
+	case *beq:
+		return encodeBranch(0b000, op.rs1, op.rs2, op.label, offset)
+	case *beqz:
+		return encodeBranch(0b000, op.rs, Zero, op.label, offset)
+	case *bne:
+		return encodeBranch(0b001, op.rs1, op.rs2, op.label, offset)
+	case *blt:
+		return encodeBranch(0b100, op.rs1, op.rs2, op.label, offset)
+	case *bge:
+		return encodeBranch(0b101, op.rs1, op.rs2, op.label, offset)
+	case *bltu:
+		return encodeBranch(0b110, op.rs1, op.rs2, op.label, offset)
+	case *bgeu:
+		return encodeBranch(0b111, op.rs1, op.rs2, op.label, offset)
+	case *lui:
+		return encodeU(opcodeLui, op.rd, op.imm)
+	case *auipc:
+		return encodeU(opcodeAuipc, op.rd, op.imm)
+	case *jal:
+		return encodeJump(op.rd, op.label, offset)
+	case *j:
+		return encodeJump(Zero, op.label, offset)
+	case *jalr:
+		return encodeI(opcodeJalr, 0b000, op.rd, op.rs, op.imm)
+	case *ret:
+		return encodeI(opcodeJalr, 0b000, Zero, Ra, 0)
+	case *fence:
+		return uint32(op.pred)<<24 | uint32(op.succ)<<20 | opcodeMiscMem, nil
+	case *ecall:
+		return opcodeSystem, nil
+	case *ebreak:
+		return 1<<20 | opcodeSystem, nil
+	default:
+		return 0, fmt.Errorf("unsupported instruction %T", runner)
+	}
+}
+
+func encodeR(opcode, funct3, funct7 uint32, rd, rs1, rs2 RegisterType) uint32 {
+	return funct7<<25 | uint32(rs2)<<20 | uint32(rs1)<<15 | funct3<<12 | uint32(rd)<<7 | opcode
+}
+
+func encodeI(opcode, funct3 uint32, rd, rs1 RegisterType, imm int32) (uint32, error) {
+	if imm < -2048 || imm > 2047 {
+		return 0, fmt.Errorf("immediate %d out of 12-bit range", imm)
+	}
+	return uint32(imm)<<20 | uint32(rs1)<<15 | funct3<<12 | uint32(rd)<<7 | opcode, nil
+}
+
+func encodeShift(funct3, funct7 uint32, rd, rs1 RegisterType, shamt int32) (uint32, error) {
+	if shamt < 0 || shamt > 31 {
+		return 0, fmt.Errorf("shift amount %d out of range", shamt)
+	}
+	return funct7<<25 | uint32(shamt)<<20 | uint32(rs1)<<15 | funct3<<12 | uint32(rd)<<7 | opcodeOpImm, nil
+}
+
+func encodeS(funct3 uint32, rs1, rs2 RegisterType, imm int32) (uint32, error) {
+	if imm < -2048 || imm > 2047 {
+		return 0, fmt.Errorf("offset %d out of 12-bit range", imm)
+	}
+	u := uint32(imm)
+	return (u>>5&0x7f)<<25 | uint32(rs2)<<20 | uint32(rs1)<<15 | funct3<<12 | (u&0x1f)<<7 | opcodeStore, nil
+}
+
+func encodeBranch(funct3 uint32, rs1, rs2 RegisterType, label string, offset func(string) (int32, error)) (uint32, error) {
+	imm, err := offset(label)
+	if err != nil {
+		return 0, err
+	}
+	if imm < -4096 || imm > 4094 || imm%2 != 0 {
+		return 0, fmt.Errorf("branch offset %d to %s out of range", imm, label)
+	}
+	u := uint32(imm)
+	return (u>>12&0x1)<<31 | (u>>5&0x3f)<<25 | uint32(rs2)<<20 | uint32(rs1)<<15 | funct3<<12 |
+		(u>>1&0xf)<<8 | (u>>11&0x1)<<7 | opcodeBranch, nil
+}
+
+func encodeU(opcode uint32, rd RegisterType, imm int32) (uint32, error) {
+	if imm < -(1<<19) || imm >= 1<<20 {
+		return 0, fmt.Errorf("immediate %d out of 20-bit range", imm)
+	}
+	return (uint32(imm)&0xfffff)<<12 | uint32(rd)<<7 | opcode, nil
+}
+
+func encodeJump(rd RegisterType, label string, offset func(string) (int32, error)) (uint32, error) {
+	imm, err := offset(label)
+	if err != nil {
+		return 0, err
+	}
+	if imm < -(1<<20) || imm >= 1<<20 || imm%2 != 0 {
+		return 0, fmt.Errorf("jump offset %d to %s out of range", imm, label)
+	}
+	u := uint32(imm)
+	return (u>>20&0x1)<<31 | (u>>1&0x3ff)<<21 | (u>>11&0x1)<<20 | (u>>12&0xff)<<12 |
+		uint32(rd)<<7 | opcodeJal, nil
+}
+
+// Decode turns RV32 machine code back into an application. Branch and jump
+// targets are exposed as synthetic labels named after their address.
+func Decode(words []uint32) (Application, error) {
+	instructions := make([]InstructionRunner, 0, len(words))
+	labels := make(map[string]int32)
+	for i, word := range words {
+		pc := int32(i * 4)
+		runner, err := DecodeInstruction(word, pc, labels)
+		if err != nil {
+			return Application{}, fmt.Errorf("pc %d: %v", pc, err)
+		}
+		instructions = append(instructions, runner)
+	}
+	app := Application{
+		Instructions: instructions,
+		Labels:       labels,
+	}
+	app.Code = wordsToBytes(words)
+	return app, nil
+}
+
+// DecodeInstruction decodes a single 32-bit word located at pc. The target of
+// a branch or a jump is added to labels.
+func DecodeInstruction(word uint32, pc int32, labels map[string]int32) (InstructionRunner, error) {
+	opcode := word & 0x7f
+	rd := RegisterType(word >> 7 & 0x1f)
+	funct3 := word >> 12 & 0x7
+	rs1 := RegisterType(word >> 15 & 0x1f)
+	rs2 := RegisterType(word >> 20 & 0x1f)
+	funct7 := word >> 25
+	immI := int32(word) >> 20
+
+	target := func(offset int32) string {
+		label := targetLabel(pc + offset)
+		labels[label] = pc + offset
+		return label
+	}
+
+	switch opcode {
+	case opcodeOp:
+		switch {
+		case funct7 == funct7Base && funct3 == 0b000:
+			return &add{rd: rd, rs1: rs1, rs2: rs2}, nil
+		case funct7 == funct7Alt && funct3 == 0b000:
+			return &sub{rd: rd, rs1: rs1, rs2: rs2}, nil
+		case funct7 == funct7Base && funct3 == 0b001:
+			return &sll{rd: rd, rs1: rs1, rs2: rs2}, nil
+		case funct7 == funct7Base && funct3 == 0b010:
+			return &slt{rd: rd, rs1: rs1, rs2: rs2}, nil
+		case funct7 == funct7Base && funct3 == 0b011:
+			return &sltu{rd: rd, rs1: rs1, rs2: rs2}, nil
+		case funct7 == funct7Base && funct3 == 0b100:
+			return &xor{rd: rd, rs1: rs1, rs2: rs2}, nil
+		case funct7 == funct7Base && funct3 == 0b101:
+			return &srl{rd: rd, rs1: rs1, rs2: rs2}, nil
+		case funct7 == funct7Alt && funct3 == 0b101:
+			return &sra{rd: rd, rs1: rs1, rs2: rs2}, nil
+		case funct7 == funct7Base && funct3 == 0b110:
+			return &or{rd: rd, rs1: rs1, rs2: rs2}, nil
+		case funct7 == funct7Base && funct3 == 0b111:
+			return &and{rd: rd, rs1: rs1, rs2: rs2}, nil
+		case funct7 == funct7Mul && funct3 == 0b000:
+			return &mul{rd: rd, rs1: rs1, rs2: rs2}, nil
+		case funct7 == funct7Mul && funct3 == 0b001:
+			return &mulh{rd: rd, rs1: rs1, rs2: rs2}, nil
+		case funct7 == funct7Mul && funct3 == 0b010:
+			return &mulhsu{rd: rd, rs1: rs1, rs2: rs2}, nil
+		case funct7 == funct7Mul && funct3 == 0b011:
+			return &mulhu{rd: rd, rs1: rs1, rs2: rs2}, nil
+		case funct7 == funct7Mul && funct3 == 0b100:
+			return &div{rd: rd, rs1: rs1, rs2: rs2}, nil
+		case funct7 == funct7Mul && funct3 == 0b101:
+			return &divu{rd: rd, rs1: rs1, rs2: rs2}, nil
+		case funct7 == funct7Mul && funct3 == 0b110:
+			return &rem{rd: rd, rs1: rs1, rs2: rs2}, nil
+		case funct7 == funct7Mul && funct3 == 0b111:
+			return &remu{rd: rd, rs1: rs1, rs2: rs2}, nil
+		}
+	case opcodeOpImm:
+		switch funct3 {
+		case 0b000:
+			switch {
+			case rd == Zero && rs1 == Zero && immI == 0:
+				return &nop{}, nil
+			case rs1 == Zero:
+				return &li{rd: rd, imm: immI}, nil
+			case immI == 0:
+				return &mv{rd: rd, rs: rs1}, nil
+			}
+			return &addi{rd: rd, rs: rs1, imm: immI}, nil
+		case 0b010:
+			return &slti{rd: rd, rs: rs1, imm: immI}, nil
+		case 0b011:
+			return &sltiu{rd: rd, rs: rs1, imm: immI}, nil
+		case 0b100:
+			return &xori{rd: rd, rs: rs1, imm: immI}, nil
+		case 0b110:
+			return &ori{rd: rd, rs: rs1, imm: immI}, nil
+		case 0b111:
+			return &andi{rd: rd, rs: rs1, imm: immI}, nil
+		case 0b001:
+			if funct7 == funct7Base {
+				return &slli{rd: rd, rs: rs1, imm: int32(rs2)}, nil
+			}
+		case 0b101:
+			switch funct7 {
+			case funct7Base:
+				return &srli{rd: rd, rs: rs1, imm: int32(rs2)}, nil
+			case funct7Alt:
+				return &srai{rd: rd, rs: rs1, imm: int32(rs2)}, nil
+			}
+		}
+	case opcodeLoad:
+		switch funct3 {
+		case 0b000:
+			return &lb{rd: rd, offset: immI, rs: rs1}, nil
+		case 0b001:
+			return &lh{rd: rd, offset: immI, rs: rs1}, nil
+		case 0b010:
+			return &lw{rd: rd, offset: immI, rs: rs1}, nil
+		case 0b100:
+			return &lbu{rd: rd, offset: immI, rs: rs1}, nil
+		case 0b101:
+			return &lhu{rd: rd, offset: immI, rs: rs1}, nil
+		}
+	case opcodeStore:
+		imm := int32(word)>>25<<5 | int32(word>>7&0x1f)
+		switch funct3 {
+		case 0b000:
+			return &sb{rs2: rs2, offset: imm, rs1: rs1}, nil
+		case 0b001:
+			return &sh{rs2: rs2, offset: imm, rs1: rs1}, nil
+		case 0b010:
+			return &sw{rs2: rs2, offset: imm, rs1: rs1}, nil
+		}
+	case opcodeBranch:
+		imm := int32(word)>>31<<12 | int32(word>>7&0x1)<<11 | int32(word>>25&0x3f)<<5 | int32(word>>8&0xf)<<1
+		switch funct3 {
+		case 0b000:
+			if rs2 == Zero {
+				return &beqz{rs: rs1, label: target(imm)}, nil
+			}
+			return &beq{rs1: rs1, rs2: rs2, label: target(imm)}, nil
+		case 0b001:
+			return &bne{rs1: rs1, rs2: rs2, label: target(imm)}, nil
+		case 0b100:
+			return &blt{rs1: rs1, rs2: rs2, label: target(imm)}, nil
+		case 0b101:
+			return &bge{rs1: rs1, rs2: rs2, label: target(imm)}, nil
+		case 0b110:
+			return &bltu{rs1: rs1, rs2: rs2, label: target(imm)}, nil
+		case 0b111:
+			return &bgeu{rs1: rs1, rs2: rs2, label: target(imm)}, nil
+		}
+	case opcodeLui:
+		return &lui{rd: rd, imm: int32(word >> 12)}, nil
+	case opcodeAuipc:
+		return &auipc{rd: rd, imm: int32(word >> 12)}, nil
+	case opcodeJal:
+		imm := int32(word)>>31<<20 | int32(word>>12&0xff)<<12 | int32(word>>20&0x1)<<11 | int32(word>>21&0x3ff)<<1
+		if rd == Zero {
+			return &j{label: target(imm)}, nil
+		}
+		return &jal{rd: rd, label: target(imm)}, nil
+	case opcodeJalr:
+		if funct3 != 0b000 {
+			break
+		}
+		if rd == Zero && rs1 == Ra && immI == 0 {
+			return &ret{}, nil
+		}
+		return &jalr{rd: rd, rs: rs1, imm: immI}, nil
+	case opcodeMiscMem:
+		if funct3 == 0b000 {
+			return &fence{pred: int32(word >> 24 & 0xf), succ: int32(word >> 20 & 0xf)}, nil
+		}
+	case opcodeSystem:
+		switch word {
+		case opcodeSystem:
+			return &ecall{}, nil
+		case 1<<20 | opcodeSystem:
+			return &ebreak{}, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported instruction 0x%08x", word)
+}
+
+func targetLabel(addr int32) string {
+	return fmt.Sprintf(".L%d", addr)
+}
+
+func wordsToBytes(words []uint32) []int8 {
+	code := make([]int8, 0, len(words)*4)
+	for _, word := range words {
+		bytes := BytesFromLowBits(int32(word))
+		code = append(code, bytes[:]...)
+	}
+	return code
+}
@@ -0,0 +1,163 @@
+package risc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teivah/majorana/test"
+)
+
+// Expected words produced by llvm-mc -triple=riscv32 -mattr=+m.
+func TestEncode(t *testing.T) {
+	app, err := Parse(`start:
+add t0, t1, t2
+sub a0, a1, a2
+sll s1, s2, s3
+slt t3, t4, t5
+sltu t0, t1, t2
+xor a0, a1, a2
+srl a3, a4, a5
+sra a6, a7, s2
+or s3, s4, s5
+and s6, s7, s8
+mul a0, a1, a2
+div t0, t1, t2
+rem t3, t4, t5
+addi t0, t1, -2048
+slti t0, t1, 2047
+xori a0, a1, -1
+ori a0, a1, 15
+andi a0, a1, 255
+slli t0, t1, 31
+srli t0, t1, 1
+srai t0, t1, 7
+lb t2, -4(t1)
+lh t2, 6(sp)
+lw a0, 12(sp)
+sb t0, -1(t1)
+sh t0, 2(t1)
+sw ra, 2044(sp)
+beq t0, t1, start
+bne t0, t1, end
+blt a0, a1, start
+bge a0, a1, end
+bltu a0, a1, start
+bgeu a0, a1, end
+lui t0, 1048575
+auipc a0, 1
+jal ra, start
+jalr ra, 8(t0)
+end:
+mulh a0, a1, a2
+mulhsu a0, a1, a2
+mulhu a0, a1, a2
+divu t0, t1, t2
+remu t3, t4, t5
+lbu t2, -4(t1)
+lhu t2, 6(sp)
+sltiu t0, t1, -1
+fence
+fence rw, w
+ecall
+ebreak`)
+	require.NoError(t, err)
+
+	words, err := Encode(app)
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{
+		0x007302b3, 0x40c58533, 0x013914b3, 0x01eeae33, 0x007332b3, 0x00c5c533,
+		0x00f756b3, 0x4128d833, 0x015a69b3, 0x018bfb33, 0x02c58533, 0x027342b3,
+		0x03eeee33, 0x80030293, 0x7ff32293, 0xfff5c513, 0x00f5e513, 0x0ff5f513,
+		0x01f31293, 0x00135293, 0x40735293, 0xffc30383, 0x00611383, 0x00c12503,
+		0xfe530fa3, 0x00531123, 0x7e112e23, 0xf8628ae3, 0x02629263, 0xf8b546e3,
+		0x00b55e63, 0xf8b562e3, 0x00b57a63, 0xfffff2b7, 0x00001517, 0xf75ff0ef,
+		0x008280e7, 0x02c59533, 0x02c5a533, 0x02c5b533, 0x027352b3, 0x03eefe33,
+		0xffc34383, 0x00615383, 0xfff33293, 0x0ff0000f, 0x0310000f, 0x00000073, 0x00100073,
+	}, words)
+	assert.Equal(t, []int8{-77, 2, 115, 0}, app.Code[:4])
+}
+
+func TestEncodePseudo(t *testing.T) {
+	app, err := Parse(`loop:
+li t0, -1
+mv a0, t0
+nop
+beqz a0, loop
+j loop
+ret`)
+	require.NoError(t, err)
+
+	words, err := Encode(app)
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{0xfff00293, 0x00028513, 0x00000013, 0xfe050ae3, 0xff1ff06f, 0x00008067}, words)
+}
+
+func TestExpandPseudo(t *testing.T) {
+	app, err := Parse(`start:
+li t0, 4096
+li t1, 0x12345678
+li t2, -2049
+li a0, 0x7ffff800
+not a0, a1
+neg a0, a1
+seqz a0, a1
+snez a0, a1
+sltz a0, a1
+sgtz a0, a1
+bnez a0, start
+bgez a0, start
+bltz a0, start
+blez a0, start
+bgtz a0, start
+bgt a0, a1, start
+ble a0, a1, start
+bgtu a0, a1, start
+bleu a0, a1, start
+jr t0
+jalr t0
+jal start`)
+	require.NoError(t, err)
+
+	words, err := Encode(app)
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{
+		0x000012b7, 0x12345337, 0x67830313, 0xfffff3b7, 0x7ff38393, 0x80000537,
+		0x80050513, 0xfff5c513, 0x40b00533, 0x0015b513, 0x00b03533, 0x0005a533,
+		0x00b02533, 0xfc0516e3, 0xfc0554e3, 0xfc0542e3, 0xfca050e3, 0xfaa04ee3,
+		0xfaa5cce3, 0xfaa5dae3, 0xfaa5e8e3, 0xfaa5f6e3, 0x00028067, 0x000280e7,
+		0xfa1ff0ef,
+	}, words)
+}
+
+func TestEncodeOutOfRange(t *testing.T) {
+	_, err := Parse(`addi t0, t1, 4096`)
+	assert.Error(t, err)
+
+	_, err = Parse(`slli t0, t1, 32`)
+	assert.Error(t, err)
+}
+
+func TestDecode(t *testing.T) {
+	for _, file := range []string{
+		"../res/prime-number.asm",
+		"../res/prime-number-2.asm",
+		"../res/string-copy.asm",
+		"../res/string-length.asm",
+	} {
+		t.Run(file, func(t *testing.T) {
+			app, err := Parse(test.ReadFile(t, file))
+			require.NoError(t, err)
+			words, err := Encode(app)
+			require.NoError(t, err)
+
+			decoded, err := Decode(words)
+			require.NoError(t, err)
+			assert.Equal(t, app.Code, decoded.Code)
+
+			reencoded, err := Encode(decoded)
+			require.NoError(t, err)
+			assert.Equal(t, words, reencoded)
+		})
+	}
+}
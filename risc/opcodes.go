@@ -1,6 +1,9 @@
 package risc
 
-import "fmt"
+import (
+	"fmt"
+	"math"
+)
 
 type InstructionRunnerPc struct {
 	Runner InstructionRunner
@@ -9,6 +12,76 @@ type InstructionRunnerPc struct {
 	Forwarder       chan<- int32
 	Receiver        <-chan int32
 	ForwardRegister RegisterType
+
+	// Prediction is the outcome predicted for a branch when decoded.
+	Prediction Prediction
+	// Sequence is the order in which the instruction was decoded, from 1.
+	Sequence int
+	// Speculation is the sequence of the youngest predicted branch not yet
+	// resolved when the instruction was decoded, 0 if none. The instruction
+	// is speculative until this branch and the older ones are resolved.
+	Speculation int
+}
+
+// Prediction is the outcome predicted for a branch.
+type Prediction struct {
+	// Taken is set if the instructions fetched after the branch are the ones
+	// of Target.
+	Taken  bool
+	Target int32
+	// History is the global branch history of the direction predictor of a
+	// conditional branch, the one it was predicted from.
+	History uint32
+}
+
+// IsCall returns whether runner is a call: a jal or a jalr writing the return
+// address to ra.
+func IsCall(runner InstructionRunner) bool {
+	switch op := runner.(type) {
+	case *jal:
+		return op.rd == Ra
+	case *jalr:
+		return op.rd == Ra
+	}
+	return false
+}
+
+// IsReturn returns whether runner is a return: a ret or a jalr to ra not
+// writing any register.
+func IsReturn(runner InstructionRunner) bool {
+	switch op := runner.(type) {
+	case *ret:
+		return true
+	case *jalr:
+		return op.rd == Zero && op.rs == Ra
+	}
+	return false
+}
+
+// BranchTarget returns the target of a conditional branch, false if runner
+// isn't a conditional branch or if its label doesn't exist.
+func BranchTarget(runner InstructionRunner, labels map[string]int32) (int32, bool) {
+	var label string
+	switch op := runner.(type) {
+	case *beq:
+		label = op.label
+	case *beqz:
+		label = op.label
+	case *bge:
+		label = op.label
+	case *bgeu:
+		label = op.label
+	case *blt:
+		label = op.label
+	case *bltu:
+		label = op.label
+	case *bne:
+		label = op.label
+	default:
+		return 0, false
+	}
+	addr, ok := labels[label]
+	return addr, ok
 }
 
 type Forward struct {
@@ -315,7 +388,7 @@ func (op *bge) Run(ctx *Context, labels map[string]int32, pc int32, memory []int
 			return Execution{}, fmt.Errorf("label %s does not exist", op.label)
 		}
 		if ctx.Debug {
-			fmt.Printf("\t\tRun: bge %d >= %d true %d\n", rs1, rs2, addr/4)
+			fmt.Fprintf(ctx.DebugWriter, "\t\tRun: bge %d >= %d true %d\n", rs1, rs2, addr/4)
 		}
 		return Execution{
 			NextPc:   addr,
@@ -323,7 +396,7 @@ func (op *bge) Run(ctx *Context, labels map[string]int32, pc int32, memory []int
 		}, nil
 	}
 	if ctx.Debug {
-		fmt.Printf("\t\tRun: bge %d >= %d false\n", rs1, rs2)
+		fmt.Fprintf(ctx.DebugWriter, "\t\tRun: bge %d >= %d false\n", rs1, rs2)
 	}
 	return Execution{}, nil
 }
@@ -358,7 +431,7 @@ type bgeu struct {
 func (op *bgeu) Run(ctx *Context, labels map[string]int32, pc int32, memory []int8) (Execution, error) {
 	rs1 := registerRead(ctx, op.forward, op.rs1)
 	rs2 := registerRead(ctx, op.forward, op.rs2)
-	if rs1 >= rs2 {
+	if uint32(rs1) >= uint32(rs2) {
 		addr, ok := labels[op.label]
 		if !ok {
 			return Execution{}, fmt.Errorf("label %s does not exist", op.label)
@@ -444,7 +517,7 @@ type bltu struct {
 func (op *bltu) Run(ctx *Context, labels map[string]int32, pc int32, memory []int8) (Execution, error) {
 	rs1 := registerRead(ctx, op.forward, op.rs1)
 	rs2 := registerRead(ctx, op.forward, op.rs2)
-	if rs1 < rs2 {
+	if uint32(rs1) < uint32(rs2) {
 		addr, ok := labels[op.label]
 		if !ok {
 			return Execution{}, fmt.Errorf("label %s does not exist", op.label)
@@ -530,10 +603,7 @@ type div struct {
 func (op *div) Run(ctx *Context, _ map[string]int32, pc int32, memory []int8) (Execution, error) {
 	rs1 := registerRead(ctx, op.forward, op.rs1)
 	rs2 := registerRead(ctx, op.forward, op.rs2)
-	if rs2 == 0 {
-		return Execution{}, fmt.Errorf("division by zero")
-	}
-	register, value := IsRegisterChange(op.rd, rs1/rs2)
+	register, value := IsRegisterChange(op.rd, divide(rs1, rs2))
 	return Execution{
 		RegisterChange: true,
 		Register:       register,
@@ -561,6 +631,138 @@ func (op *div) MemoryRead(ctx *Context) []int32 {
 	return nil
 }
 
+type divu struct {
+	rd      RegisterType
+	rs1     RegisterType
+	rs2     RegisterType
+	forward Forward
+}
+
+func (op *divu) Run(ctx *Context, _ map[string]int32, pc int32, memory []int8) (Execution, error) {
+	rs1 := registerRead(ctx, op.forward, op.rs1)
+	rs2 := registerRead(ctx, op.forward, op.rs2)
+	register, value := IsRegisterChange(op.rd, divideUnsigned(rs1, rs2))
+	return Execution{
+		RegisterChange: true,
+		Register:       register,
+		RegisterValue:  value,
+	}, nil
+}
+
+func (op *divu) InstructionType() InstructionType {
+	return Divu
+}
+
+func (op *divu) ReadRegisters() []RegisterType {
+	return []RegisterType{op.rs1, op.rs2}
+}
+
+func (op *divu) WriteRegisters() []RegisterType {
+	return []RegisterType{op.rd}
+}
+
+func (op *divu) Forward(forward Forward) {
+	op.forward = forward
+}
+
+func (op *divu) MemoryRead(ctx *Context) []int32 {
+	return nil
+}
+
+type ebreak struct{}
+
+func (op *ebreak) Run(_ *Context, _ map[string]int32, pc int32, memory []int8) (Execution, error) {
+	return Execution{}, fmt.Errorf("breakpoint at pc %d", pc)
+}
+
+func (op *ebreak) InstructionType() InstructionType {
+	return Ebreak
+}
+
+func (op *ebreak) ReadRegisters() []RegisterType {
+	return nil
+}
+
+func (op *ebreak) WriteRegisters() []RegisterType {
+	return nil
+}
+
+func (op *ebreak) Forward(forward Forward) {
+}
+
+func (op *ebreak) MemoryRead(ctx *Context) []int32 {
+	return nil
+}
+
+// ecall follows the Linux calling convention: the service number is in a7,
+// the arguments in a0-a5 and the result is written to a0. The call itself is
+// delegated to the context EcallHandler.
+type ecall struct {
+	forward Forward
+}
+
+func (op *ecall) Run(ctx *Context, _ map[string]int32, pc int32, memory []int8) (Execution, error) {
+	number := registerRead(ctx, op.forward, A7)
+	if ctx.Ecall == nil {
+		return Execution{}, fmt.Errorf("unsupported environment call %d", number)
+	}
+	var args [6]int32
+	for i, reg := range []RegisterType{A0, A1, A2, A3, A4, A5} {
+		args[i] = registerRead(ctx, op.forward, reg)
+	}
+	return ctx.Ecall.Ecall(ctx, number, args)
+}
+
+func (op *ecall) InstructionType() InstructionType {
+	return Ecall
+}
+
+func (op *ecall) ReadRegisters() []RegisterType {
+	return []RegisterType{A0, A1, A2, A3, A4, A5, A7}
+}
+
+func (op *ecall) WriteRegisters() []RegisterType {
+	return []RegisterType{A0}
+}
+
+func (op *ecall) Forward(forward Forward) {
+	op.forward = forward
+}
+
+func (op *ecall) MemoryRead(ctx *Context) []int32 {
+	return nil
+}
+
+// fence orders the memory accesses. As each hart executes its memory
+// accesses in order, it doesn't do anything besides being decoded.
+type fence struct {
+	pred int32
+	succ int32
+}
+
+func (op *fence) Run(_ *Context, _ map[string]int32, pc int32, memory []int8) (Execution, error) {
+	return Execution{}, nil
+}
+
+func (op *fence) InstructionType() InstructionType {
+	return Fence
+}
+
+func (op *fence) ReadRegisters() []RegisterType {
+	return nil
+}
+
+func (op *fence) WriteRegisters() []RegisterType {
+	return nil
+}
+
+func (op *fence) Forward(forward Forward) {
+}
+
+func (op *fence) MemoryRead(ctx *Context) []int32 {
+	return nil
+}
+
 type j struct {
 	label string
 }
@@ -606,8 +808,6 @@ func (op *jal) Run(ctx *Context, labels map[string]int32, pc int32, memory []int
 	if !ok {
 		return Execution{}, fmt.Errorf("label %s does not exist", op.label)
 	}
-	// TODO Shouldn't be a direct write
-	ctx.Registers[Ra] = pc
 	register, value := IsRegisterChange(op.rd, pc+4)
 	return Execution{
 		RegisterChange: true,
@@ -647,12 +847,16 @@ type jalr struct {
 
 func (op *jalr) Run(ctx *Context, _ map[string]int32, pc int32, memory []int8) (Execution, error) {
 	rs := registerRead(ctx, op.forward, op.rs)
+	target := (rs + op.imm) &^ 1
+	if target == ExitAddress {
+		return Execution{Return: true}, nil
+	}
 	register, value := IsRegisterChange(op.rd, pc+4)
 	return Execution{
 		RegisterChange: true,
 		Register:       register,
 		RegisterValue:  value,
-		NextPc:         rs + op.imm,
+		NextPc:         target,
 		PcChange:       true,
 	}, nil
 }
@@ -748,6 +952,44 @@ func (op *lb) MemoryRead(ctx *Context) []int32 {
 	return []int32{rs + op.offset}
 }
 
+type lbu struct {
+	rd      RegisterType
+	offset  int32
+	rs      RegisterType
+	forward Forward
+}
+
+func (op *lbu) Run(ctx *Context, _ map[string]int32, pc int32, memory []int8) (Execution, error) {
+	n := uint8(memory[0])
+	register, value := IsRegisterChange(op.rd, int32(n))
+	return Execution{
+		RegisterChange: true,
+		Register:       register,
+		RegisterValue:  value,
+	}, nil
+}
+
+func (op *lbu) InstructionType() InstructionType {
+	return Lbu
+}
+
+func (op *lbu) ReadRegisters() []RegisterType {
+	return []RegisterType{op.rs}
+}
+
+func (op *lbu) WriteRegisters() []RegisterType {
+	return []RegisterType{op.rd}
+}
+
+func (op *lbu) Forward(forward Forward) {
+	op.forward = forward
+}
+
+func (op *lbu) MemoryRead(ctx *Context) []int32 {
+	rs := registerRead(ctx, op.forward, op.rs)
+	return []int32{rs + op.offset}
+}
+
 type lh struct {
 	rd      RegisterType
 	offset  int32
@@ -756,7 +998,7 @@ type lh struct {
 }
 
 func (op *lh) Run(ctx *Context, _ map[string]int32, pc int32, memory []int8) (Execution, error) {
-	n := I32FromBytes(memory[0], memory[1], 0, 0)
+	n := int32(int16(I32FromBytes(memory[0], memory[1], 0, 0)))
 	register, value := IsRegisterChange(op.rd, n)
 	return Execution{
 		RegisterChange: true,
@@ -770,11 +1012,11 @@ func (op *lh) InstructionType() InstructionType {
 }
 
 func (op *lh) ReadRegisters() []RegisterType {
-	return []RegisterType{op.rs, op.rd}
+	return []RegisterType{op.rs}
 }
 
 func (op *lh) WriteRegisters() []RegisterType {
-	return nil
+	return []RegisterType{op.rd}
 }
 
 func (op *lh) Forward(forward Forward) {
@@ -787,6 +1029,45 @@ func (op *lh) MemoryRead(ctx *Context) []int32 {
 	return []int32{idx, idx + 1}
 }
 
+type lhu struct {
+	rd      RegisterType
+	offset  int32
+	rs      RegisterType
+	forward Forward
+}
+
+func (op *lhu) Run(ctx *Context, _ map[string]int32, pc int32, memory []int8) (Execution, error) {
+	n := I32FromBytes(memory[0], memory[1], 0, 0)
+	register, value := IsRegisterChange(op.rd, n)
+	return Execution{
+		RegisterChange: true,
+		Register:       register,
+		RegisterValue:  value,
+	}, nil
+}
+
+func (op *lhu) InstructionType() InstructionType {
+	return Lhu
+}
+
+func (op *lhu) ReadRegisters() []RegisterType {
+	return []RegisterType{op.rs}
+}
+
+func (op *lhu) WriteRegisters() []RegisterType {
+	return []RegisterType{op.rd}
+}
+
+func (op *lhu) Forward(forward Forward) {
+	op.forward = forward
+}
+
+func (op *lhu) MemoryRead(ctx *Context) []int32 {
+	rs := registerRead(ctx, op.forward, op.rs)
+	idx := rs + op.offset
+	return []int32{idx, idx + 1}
+}
+
 type li struct {
 	rd  RegisterType
 	imm int32
@@ -831,7 +1112,7 @@ func (op *lw) Run(ctx *Context, _ map[string]int32, pc int32, memory []int8) (Ex
 	n := I32FromBytes(memory[0], memory[1], memory[2], memory[3])
 	register, value := IsRegisterChange(op.rd, n)
 	if ctx.Debug {
-		fmt.Printf("\t\tRun: Lw %s %d\n", register, value)
+		fmt.Fprintf(ctx.DebugWriter, "\t\tRun: Lw %s %d\n", register, value)
 	}
 	return Execution{
 		RegisterChange: true,
@@ -925,6 +1206,120 @@ func (op *mul) MemoryRead(ctx *Context) []int32 {
 	return nil
 }
 
+type mulh struct {
+	rd      RegisterType
+	rs1     RegisterType
+	rs2     RegisterType
+	forward Forward
+}
+
+func (op *mulh) Run(ctx *Context, _ map[string]int32, pc int32, memory []int8) (Execution, error) {
+	rs1 := registerRead(ctx, op.forward, op.rs1)
+	rs2 := registerRead(ctx, op.forward, op.rs2)
+	register, value := IsRegisterChange(op.rd, int32((int64(rs1)*int64(rs2))>>32))
+	return Execution{
+		RegisterChange: true,
+		Register:       register,
+		RegisterValue:  value,
+	}, nil
+}
+
+func (op *mulh) InstructionType() InstructionType {
+	return Mulh
+}
+
+func (op *mulh) ReadRegisters() []RegisterType {
+	return []RegisterType{op.rs1, op.rs2}
+}
+
+func (op *mulh) WriteRegisters() []RegisterType {
+	return []RegisterType{op.rd}
+}
+
+func (op *mulh) Forward(forward Forward) {
+	op.forward = forward
+}
+
+func (op *mulh) MemoryRead(ctx *Context) []int32 {
+	return nil
+}
+
+type mulhsu struct {
+	rd      RegisterType
+	rs1     RegisterType
+	rs2     RegisterType
+	forward Forward
+}
+
+func (op *mulhsu) Run(ctx *Context, _ map[string]int32, pc int32, memory []int8) (Execution, error) {
+	rs1 := registerRead(ctx, op.forward, op.rs1)
+	rs2 := registerRead(ctx, op.forward, op.rs2)
+	register, value := IsRegisterChange(op.rd, int32((int64(rs1)*int64(uint32(rs2)))>>32))
+	return Execution{
+		RegisterChange: true,
+		Register:       register,
+		RegisterValue:  value,
+	}, nil
+}
+
+func (op *mulhsu) InstructionType() InstructionType {
+	return Mulhsu
+}
+
+func (op *mulhsu) ReadRegisters() []RegisterType {
+	return []RegisterType{op.rs1, op.rs2}
+}
+
+func (op *mulhsu) WriteRegisters() []RegisterType {
+	return []RegisterType{op.rd}
+}
+
+func (op *mulhsu) Forward(forward Forward) {
+	op.forward = forward
+}
+
+func (op *mulhsu) MemoryRead(ctx *Context) []int32 {
+	return nil
+}
+
+type mulhu struct {
+	rd      RegisterType
+	rs1     RegisterType
+	rs2     RegisterType
+	forward Forward
+}
+
+func (op *mulhu) Run(ctx *Context, _ map[string]int32, pc int32, memory []int8) (Execution, error) {
+	rs1 := registerRead(ctx, op.forward, op.rs1)
+	rs2 := registerRead(ctx, op.forward, op.rs2)
+	register, value := IsRegisterChange(op.rd, int32((uint64(uint32(rs1))*uint64(uint32(rs2)))>>32))
+	return Execution{
+		RegisterChange: true,
+		Register:       register,
+		RegisterValue:  value,
+	}, nil
+}
+
+func (op *mulhu) InstructionType() InstructionType {
+	return Mulhu
+}
+
+func (op *mulhu) ReadRegisters() []RegisterType {
+	return []RegisterType{op.rs1, op.rs2}
+}
+
+func (op *mulhu) WriteRegisters() []RegisterType {
+	return []RegisterType{op.rd}
+}
+
+func (op *mulhu) Forward(forward Forward) {
+	op.forward = forward
+}
+
+func (op *mulhu) MemoryRead(ctx *Context) []int32 {
+	return nil
+}
+
 type mv struct {
 	rd      RegisterType
 	rs      RegisterType
@@ -1047,9 +1442,9 @@ func (op *rem) Run(ctx *Context, _ map[string]int32, pc int32, memory []int8) (E
 	rs1 := registerRead(ctx, op.forward, op.rs1)
 	rs2 := registerRead(ctx, op.forward, op.rs2)
 	if ctx.Debug {
-		fmt.Printf("\t\tRun: Rem %d %d\n", rs1, rs2)
+		fmt.Fprintf(ctx.DebugWriter, "\t\tRun: Rem %d %d\n", rs1, rs2)
 	}
-	register, value := IsRegisterChange(op.rd, rs1%rs2)
+	register, value := IsRegisterChange(op.rd, remainder(rs1, rs2))
 	return Execution{
 		RegisterChange: true,
 		Register:       register,
@@ -1077,10 +1472,58 @@ func (op *rem) MemoryRead(ctx *Context) []int32 {
 	return nil
 }
 
-type ret struct{}
+type remu struct {
+	rd      RegisterType
+	rs1     RegisterType
+	rs2     RegisterType
+	forward Forward
+}
 
-func (op *ret) Run(_ *Context, _ map[string]int32, _ int32, memory []int8) (Execution, error) {
-	return Execution{Return: true}, nil
+func (op *remu) Run(ctx *Context, _ map[string]int32, pc int32, memory []int8) (Execution, error) {
+	rs1 := registerRead(ctx, op.forward, op.rs1)
+	rs2 := registerRead(ctx, op.forward, op.rs2)
+	register, value := IsRegisterChange(op.rd, remainderUnsigned(rs1, rs2))
+	return Execution{
+		RegisterChange: true,
+		Register:       register,
+		RegisterValue:  value,
+	}, nil
+}
+
+func (op *remu) InstructionType() InstructionType {
+	return Remu
+}
+
+func (op *remu) ReadRegisters() []RegisterType {
+	return []RegisterType{op.rs1, op.rs2}
+}
+
+func (op *remu) WriteRegisters() []RegisterType {
+	return []RegisterType{op.rd}
+}
+
+func (op *remu) Forward(forward Forward) {
+	op.forward = forward
+}
+
+func (op *remu) MemoryRead(ctx *Context) []int32 {
+	return nil
+}
+
+// ret is jalr zero, 0(ra).
+type ret struct {
+	forward Forward
+}
+
+func (op *ret) Run(ctx *Context, _ map[string]int32, _ int32, memory []int8) (Execution, error) {
+	ra := registerRead(ctx, op.forward, Ra) &^ 1
+	if ra == ExitAddress {
+		return Execution{Return: true}, nil
+	}
+	return Execution{
+		NextPc:   ra,
+		PcChange: true,
+	}, nil
 }
 
 func (op *ret) InstructionType() InstructionType {
@@ -1088,7 +1531,7 @@ func (op *ret) InstructionType() InstructionType {
 }
 
 func (op *ret) ReadRegisters() []RegisterType {
-	return nil
+	return []RegisterType{Ra}
 }
 
 func (op *ret) WriteRegisters() []RegisterType {
@@ -1096,6 +1539,7 @@ func (op *ret) WriteRegisters() []RegisterType {
 }
 
 func (op *ret) Forward(forward Forward) {
+	op.forward = forward
 }
 
 func (op *ret) MemoryRead(ctx *Context) []int32 {
@@ -1192,7 +1636,7 @@ type sll struct {
 func (op *sll) Run(ctx *Context, _ map[string]int32, pc int32, memory []int8) (Execution, error) {
 	rs1 := registerRead(ctx, op.forward, op.rs1)
 	rs2 := registerRead(ctx, op.forward, op.rs2)
-	register, value := IsRegisterChange(op.rd, rs1<<uint(rs2))
+	register, value := IsRegisterChange(op.rd, rs1<<(rs2&0x1f))
 	return Execution{
 		RegisterChange: true,
 		Register:       register,
@@ -1313,7 +1757,7 @@ func (op *sltu) Run(ctx *Context, _ map[string]int32, pc int32, memory []int8) (
 	var value int32
 	rs1 := registerRead(ctx, op.forward, op.rs1)
 	rs2 := registerRead(ctx, op.forward, op.rs2)
-	if rs1 < rs2 {
+	if uint32(rs1) < uint32(rs2) {
 		register, value = IsRegisterChange(op.rd, 1)
 	} else {
 		register, value = IsRegisterChange(op.rd, 0)
@@ -1388,6 +1832,50 @@ func (op *slti) MemoryRead(ctx *Context) []int32 {
 	return nil
 }
 
+type sltiu struct {
+	rd      RegisterType
+	rs      RegisterType
+	imm     int32
+	forward Forward
+}
+
+func (op *sltiu) Run(ctx *Context, _ map[string]int32, pc int32, memory []int8) (Execution, error) {
+	var register RegisterType
+	var value int32
+	rs := registerRead(ctx, op.forward, op.rs)
+	// The immediate is sign-extended, then compared as an unsigned number
+	if uint32(rs) < uint32(op.imm) {
+		register, value = IsRegisterChange(op.rd, 1)
+	} else {
+		register, value = IsRegisterChange(op.rd, 0)
+	}
+	return Execution{
+		RegisterChange: true,
+		Register:       register,
+		RegisterValue:  value,
+	}, nil
+}
+
+func (op *sltiu) InstructionType() InstructionType {
+	return Sltiu
+}
+
+func (op *sltiu) ReadRegisters() []RegisterType {
+	return []RegisterType{op.rs}
+}
+
+func (op *sltiu) WriteRegisters() []RegisterType {
+	return []RegisterType{op.rd}
+}
+
+func (op *sltiu) Forward(forward Forward) {
+	op.forward = forward
+}
+
+func (op *sltiu) MemoryRead(ctx *Context) []int32 {
+	return nil
+}
+
 type sra struct {
 	rd      RegisterType
 	rs1     RegisterType
@@ -1398,7 +1886,7 @@ type sra struct {
 func (op *sra) Run(ctx *Context, _ map[string]int32, pc int32, memory []int8) (Execution, error) {
 	rs1 := registerRead(ctx, op.forward, op.rs1)
 	rs2 := registerRead(ctx, op.forward, op.rs2)
-	register, value := IsRegisterChange(op.rd, rs1>>rs2)
+	register, value := IsRegisterChange(op.rd, rs1>>(rs2&0x1f))
 	return Execution{
 		RegisterChange: true,
 		Register:       register,
@@ -1473,7 +1961,7 @@ type srl struct {
 func (op *srl) Run(ctx *Context, _ map[string]int32, pc int32, memory []int8) (Execution, error) {
 	rs1 := registerRead(ctx, op.forward, op.rs1)
 	rs2 := registerRead(ctx, op.forward, op.rs2)
-	register, value := IsRegisterChange(op.rd, rs1>>rs2)
+	register, value := IsRegisterChange(op.rd, int32(uint32(rs1)>>(rs2&0x1f)))
 	return Execution{
 		RegisterChange: true,
 		Register:       register,
@@ -1510,7 +1998,7 @@ type srli struct {
 
 func (op *srli) Run(ctx *Context, _ map[string]int32, pc int32, memory []int8) (Execution, error) {
 	rs := registerRead(ctx, op.forward, op.rs)
-	register, value := IsRegisterChange(op.rd, rs>>op.imm)
+	register, value := IsRegisterChange(op.rd, int32(uint32(rs)>>op.imm))
 	return Execution{
 		RegisterChange: true,
 		Register:       register,
@@ -1590,7 +2078,7 @@ func (op *sw) Run(ctx *Context, _ map[string]int32, pc int32, memory []int8) (Ex
 	n := rs2
 	bytes := BytesFromLowBits(n)
 	if ctx.Debug {
-		fmt.Printf("\t\tRun: Sw %d to %d\n", idx, n)
+		fmt.Fprintf(ctx.DebugWriter, "\t\tRun: Sw %d to %d\n", idx, n)
 	}
 	return Execution{
 		MemoryChange: true,
@@ -1697,3 +2185,41 @@ func (op *xori) Forward(forward Forward) {
 func (op *xori) MemoryRead(ctx *Context) []int32 {
 	return nil
 }
+
+// divide follows the RISC-V semantics: a division by zero returns -1 and the
+// overflow of the most negative value divided by -1 returns the dividend.
+func divide(rs1, rs2 int32) int32 {
+	if rs2 == 0 {
+		return -1
+	}
+	if rs1 == math.MinInt32 && rs2 == -1 {
+		return rs1
+	}
+	return rs1 / rs2
+}
+
+// remainder follows the RISC-V semantics: a division by zero returns the
+// dividend and an overflow returns zero.
+func remainder(rs1, rs2 int32) int32 {
+	if rs2 == 0 {
+		return rs1
+	}
+	if rs1 == math.MinInt32 && rs2 == -1 {
+		return 0
+	}
+	return rs1 % rs2
+}
+
+func divideUnsigned(rs1, rs2 int32) int32 {
+	if rs2 == 0 {
+		return -1
+	}
+	return int32(uint32(rs1) / uint32(rs2))
+}
+
+func remainderUnsigned(rs1, rs2 int32) int32 {
+	if rs2 == 0 {
+		return rs1
+	}
+	return int32(uint32(rs1) % uint32(rs2))
+}
@@ -1,6 +1,7 @@
 package risc
 
 import (
+	"math"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -18,7 +19,7 @@ func runAssert(t *testing.T, initRegisters map[RegisterType]int32, memoryBytes i
 		r.Ctx.Memory[k] = v
 	}
 
-	err = r.Run()
+	_, err = r.Run()
 	require.NoError(t, err)
 
 	for k, v := range assertionsRegisters {
@@ -101,6 +102,13 @@ addi t1, zero, 1`, map[RegisterType]int32{T0: 0, T1: 1}, map[int]int8{})
 addi t0, zero, 2
 foo:
 addi t1, zero, 1`, map[RegisterType]int32{T0: 2, T1: 1}, map[int]int8{})
+
+	// Unsigned comparison
+	runAssert(t, map[RegisterType]int32{T0: -1, T1: 10}, 0, map[int]int8{},
+		`bgeu t0, t1, foo
+addi t0, zero, 2
+foo:
+addi t1, zero, 1`, map[RegisterType]int32{T0: -1, T1: 1}, map[int]int8{})
 }
 
 func TestBlt(t *testing.T) {
@@ -119,16 +127,23 @@ addi t1, zero, 1`, map[RegisterType]int32{T0: 0, T1: 1}, map[int]int8{})
 
 func TestBltu(t *testing.T) {
 	runAssert(t, map[RegisterType]int32{}, 0, map[int]int8{},
-		`blt t0, t1, foo
+		`bltu t0, t1, foo
 addi t0, zero, 2
 foo:
 addi t1, zero, 1`, map[RegisterType]int32{T0: 2, T1: 1}, map[int]int8{})
 
 	runAssert(t, map[RegisterType]int32{T1: 10}, 0, map[int]int8{},
-		`blt t0, t1, foo
+		`bltu t0, t1, foo
 addi t0, zero, 2
 foo:
 addi t1, zero, 1`, map[RegisterType]int32{T0: 0, T1: 1}, map[int]int8{})
+
+	// Unsigned comparison
+	runAssert(t, map[RegisterType]int32{T0: 10, T1: -1}, 0, map[int]int8{},
+		`bltu t0, t1, foo
+addi t0, zero, 2
+foo:
+addi t1, zero, 1`, map[RegisterType]int32{T0: 10, T1: 1}, map[int]int8{})
 }
 
 func TestBne(t *testing.T) {
@@ -145,12 +160,102 @@ foo:
 addi t1, zero, 1`, map[RegisterType]int32{T0: 1, T1: 1}, map[int]int8{})
 }
 
+func TestBranchTarget(t *testing.T) {
+	app, err := Parse(`foo:
+beqz t0, bar
+bgt t0, t1, foo
+bar:
+j foo`)
+	require.NoError(t, err)
+	target, ok := BranchTarget(app.Instructions[0], app.Labels)
+	assert.True(t, ok)
+	assert.Equal(t, int32(8), target)
+	target, ok = BranchTarget(app.Instructions[1], app.Labels)
+	assert.True(t, ok)
+	assert.Equal(t, int32(0), target)
+	// Unconditional branch
+	_, ok = BranchTarget(app.Instructions[2], app.Labels)
+	assert.False(t, ok)
+	_, ok = BranchTarget(app.Instructions[0], nil)
+	assert.False(t, ok)
+}
+
+func TestIsCallReturn(t *testing.T) {
+	app, err := Parse(`foo:
+call foo
+jal ra, foo
+jalr ra, 0(t0)
+j foo
+jal t0, foo
+jalr zero, 0(ra)
+ret`)
+	require.NoError(t, err)
+	// call is expanded into an auipc and a jalr
+	calls := []bool{false, true, true, true, false, false, false, false}
+	returns := []bool{false, false, false, false, false, false, true, true}
+	for i := range app.Instructions {
+		assert.Equal(t, calls[i], IsCall(app.Instructions[i]), i)
+		assert.Equal(t, returns[i], IsReturn(app.Instructions[i]), i)
+	}
+}
+
 func TestDiv(t *testing.T) {
 	runAssert(t, map[RegisterType]int32{T1: 4, T2: 2}, 0, map[int]int8{},
 		`div t0, t1, t2`, map[RegisterType]int32{T0: 2}, map[int]int8{})
 
 	runAssert(t, map[RegisterType]int32{T1: 4, T2: 3}, 0, map[int]int8{},
 		`div t0, t1, t2`, map[RegisterType]int32{T0: 1}, map[int]int8{})
+
+	runAssert(t, map[RegisterType]int32{T1: -7, T2: 2}, 0, map[int]int8{},
+		`div t0, t1, t2`, map[RegisterType]int32{T0: -3}, map[int]int8{})
+
+	// Division by zero
+	runAssert(t, map[RegisterType]int32{T1: 4, T2: 0}, 0, map[int]int8{},
+		`div t0, t1, t2`, map[RegisterType]int32{T0: -1}, map[int]int8{})
+
+	// Overflow
+	runAssert(t, map[RegisterType]int32{T1: math.MinInt32, T2: -1}, 0, map[int]int8{},
+		`div t0, t1, t2`, map[RegisterType]int32{T0: math.MinInt32}, map[int]int8{})
+}
+
+func TestDivu(t *testing.T) {
+	runAssert(t, map[RegisterType]int32{T1: 4, T2: 3}, 0, map[int]int8{},
+		`divu t0, t1, t2`, map[RegisterType]int32{T0: 1}, map[int]int8{})
+
+	runAssert(t, map[RegisterType]int32{T1: -2, T2: 2}, 0, map[int]int8{},
+		`divu t0, t1, t2`, map[RegisterType]int32{T0: math.MaxInt32}, map[int]int8{})
+
+	// Division by zero
+	runAssert(t, map[RegisterType]int32{T1: 4, T2: 0}, 0, map[int]int8{},
+		`divu t0, t1, t2`, map[RegisterType]int32{T0: -1}, map[int]int8{})
+}
+
+func TestEbreak(t *testing.T) {
+	app, err := Parse(`addi t0, zero, 1
+ebreak
+addi t0, zero, 2`)
+	require.NoError(t, err)
+	r := NewRunner(app, 0)
+	_, err = r.Run()
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), r.Ctx.Registers[T0])
+}
+
+func TestEcall(t *testing.T) {
+	app, err := Parse(`ecall`)
+	require.NoError(t, err)
+	r := NewRunner(app, 0)
+	r.Ctx.Registers[A7] = 1000
+	_, err = r.Run()
+	assert.Error(t, err)
+}
+
+func TestFence(t *testing.T) {
+	runAssert(t, map[RegisterType]int32{T0: 1, T1: 2}, 8, map[int]int8{},
+		`sw t0, 0(t1)
+fence
+fence rw, w
+lw t2, 0(t1)`, map[RegisterType]int32{T2: 1}, map[int]int8{2: 1})
 }
 
 func TestJal(t *testing.T) {
@@ -158,7 +263,7 @@ func TestJal(t *testing.T) {
 		`jal t0, foo
 addi t1, zero, 1
 foo:
-addi t2, zero, 2`, map[RegisterType]int32{T0: 4, T1: 0, T2: 2}, map[int]int8{})
+addi t2, zero, 2`, map[RegisterType]int32{T0: 4, T1: 0, T2: 2, Ra: ExitAddress}, map[int]int8{})
 }
 
 func TestJalr(t *testing.T) {
@@ -191,6 +296,33 @@ func TestMul(t *testing.T) {
 		`mul t0, t1, t2`, map[RegisterType]int32{T0: 8}, map[int]int8{})
 }
 
+func TestMulh(t *testing.T) {
+	runAssert(t, map[RegisterType]int32{T1: 0x40000000, T2: 8}, 0, map[int]int8{},
+		`mulh t0, t1, t2`, map[RegisterType]int32{T0: 2}, map[int]int8{})
+
+	runAssert(t, map[RegisterType]int32{T1: -1, T2: 1}, 0, map[int]int8{},
+		`mulh t0, t1, t2`, map[RegisterType]int32{T0: -1}, map[int]int8{})
+
+	runAssert(t, map[RegisterType]int32{T1: math.MinInt32, T2: math.MinInt32}, 0, map[int]int8{},
+		`mulh t0, t1, t2`, map[RegisterType]int32{T0: 0x40000000}, map[int]int8{})
+}
+
+func TestMulhsu(t *testing.T) {
+	runAssert(t, map[RegisterType]int32{T1: -1, T2: -1}, 0, map[int]int8{},
+		`mulhsu t0, t1, t2`, map[RegisterType]int32{T0: -1}, map[int]int8{})
+
+	runAssert(t, map[RegisterType]int32{T1: 2, T2: -1}, 0, map[int]int8{},
+		`mulhsu t0, t1, t2`, map[RegisterType]int32{T0: 1}, map[int]int8{})
+}
+
+func TestMulhu(t *testing.T) {
+	runAssert(t, map[RegisterType]int32{T1: -1, T2: -1}, 0, map[int]int8{},
+		`mulhu t0, t1, t2`, map[RegisterType]int32{T0: -2}, map[int]int8{})
+
+	runAssert(t, map[RegisterType]int32{T1: 0x10000, T2: 0x10000}, 0, map[int]int8{},
+		`mulhu t0, t1, t2`, map[RegisterType]int32{T0: 1}, map[int]int8{})
+}
+
 func TestOr(t *testing.T) {
 	runAssert(t, map[RegisterType]int32{T1: 1, T2: 2}, 0, map[int]int8{},
 		`or t0, t1, t2`, map[RegisterType]int32{T0: 3}, map[int]int8{})
@@ -207,11 +339,60 @@ func TestRem(t *testing.T) {
 
 	runAssert(t, map[RegisterType]int32{T1: 4, T2: 3}, 0, map[int]int8{},
 		`rem t0, t1, t2`, map[RegisterType]int32{T0: 1}, map[int]int8{})
+
+	runAssert(t, map[RegisterType]int32{T1: -7, T2: 2}, 0, map[int]int8{},
+		`rem t0, t1, t2`, map[RegisterType]int32{T0: -1}, map[int]int8{})
+
+	// Division by zero
+	runAssert(t, map[RegisterType]int32{T1: 4, T2: 0}, 0, map[int]int8{},
+		`rem t0, t1, t2`, map[RegisterType]int32{T0: 4}, map[int]int8{})
+
+	// Overflow
+	runAssert(t, map[RegisterType]int32{T1: math.MinInt32, T2: -1}, 0, map[int]int8{},
+		`rem t0, t1, t2`, map[RegisterType]int32{T0: 0}, map[int]int8{})
+}
+
+func TestRemu(t *testing.T) {
+	runAssert(t, map[RegisterType]int32{T1: 4, T2: 3}, 0, map[int]int8{},
+		`remu t0, t1, t2`, map[RegisterType]int32{T0: 1}, map[int]int8{})
+
+	runAssert(t, map[RegisterType]int32{T1: -1, T2: 10}, 0, map[int]int8{},
+		`remu t0, t1, t2`, map[RegisterType]int32{T0: 5}, map[int]int8{})
+
+	// Division by zero
+	runAssert(t, map[RegisterType]int32{T1: -4, T2: 0}, 0, map[int]int8{},
+		`remu t0, t1, t2`, map[RegisterType]int32{T0: -4}, map[int]int8{})
+}
+
+func TestRet(t *testing.T) {
+	runAssert(t, map[RegisterType]int32{}, 0, map[int]int8{},
+		`jal ra, foo
+addi t1, zero, 1
+j end
+foo:
+addi t0, zero, 2
+ret
+end:`, map[RegisterType]int32{T0: 2, T1: 1, Ra: 4}, map[int]int8{})
+
+	// Returning to the exit address terminates the program
+	runAssert(t, map[RegisterType]int32{}, 0, map[int]int8{},
+		`addi t0, zero, 1
+ret
+addi t0, zero, 2`, map[RegisterType]int32{T0: 1, Ra: ExitAddress}, map[int]int8{})
+
+	runAssert(t, map[RegisterType]int32{}, 0, map[int]int8{},
+		`addi t0, zero, 1
+jalr zero, 0(ra)
+addi t0, zero, 2`, map[RegisterType]int32{T0: 1}, map[int]int8{})
 }
 
 func TestSll(t *testing.T) {
 	runAssert(t, map[RegisterType]int32{T1: 1, T2: 2}, 0, map[int]int8{},
 		`sll t0, t1, t2`, map[RegisterType]int32{T0: 4}, map[int]int8{})
+
+	// Only the lower 5 bits of rs2 are the shift amount
+	runAssert(t, map[RegisterType]int32{T1: 1, T2: -30}, 0, map[int]int8{},
+		`sll t0, t1, t2`, map[RegisterType]int32{T0: 4}, map[int]int8{})
 }
 
 func TestSlli(t *testing.T) {
@@ -232,11 +413,29 @@ func TestSlti(t *testing.T) {
 func TestSltu(t *testing.T) {
 	runAssert(t, map[RegisterType]int32{T1: 2, T2: 3}, 0, map[int]int8{},
 		`sltu t0, t1, t2`, map[RegisterType]int32{T0: 1}, map[int]int8{})
+
+	runAssert(t, map[RegisterType]int32{T1: -1, T2: 3}, 0, map[int]int8{},
+		`sltu t0, t1, t2`, map[RegisterType]int32{T0: 0}, map[int]int8{})
+}
+
+func TestSltiu(t *testing.T) {
+	runAssert(t, map[RegisterType]int32{T1: 2}, 0, map[int]int8{},
+		`sltiu t0, t1, 5`, map[RegisterType]int32{T0: 1}, map[int]int8{})
+
+	runAssert(t, map[RegisterType]int32{T1: -2}, 0, map[int]int8{},
+		`sltiu t0, t1, 5`, map[RegisterType]int32{T0: 0}, map[int]int8{})
+
+	// The immediate is sign-extended to 0xffffffff
+	runAssert(t, map[RegisterType]int32{T1: 5}, 0, map[int]int8{},
+		`sltiu t0, t1, -1`, map[RegisterType]int32{T0: 1}, map[int]int8{})
 }
 
 func TestSra(t *testing.T) {
 	runAssert(t, map[RegisterType]int32{T1: 2, T2: 1}, 0, map[int]int8{},
 		`sra t0, t1, t2`, map[RegisterType]int32{T0: 1}, map[int]int8{})
+
+	runAssert(t, map[RegisterType]int32{T1: -8, T2: 33}, 0, map[int]int8{},
+		`sra t0, t1, t2`, map[RegisterType]int32{T0: -4}, map[int]int8{})
 }
 
 func TestSrai(t *testing.T) {
@@ -247,11 +446,18 @@ func TestSrai(t *testing.T) {
 func TestSrl(t *testing.T) {
 	runAssert(t, map[RegisterType]int32{T1: 4, T2: 2}, 0, map[int]int8{},
 		`srl t0, t1, t2`, map[RegisterType]int32{T0: 1}, map[int]int8{})
+
+	// Zeros are shifted in
+	runAssert(t, map[RegisterType]int32{T1: -4, T2: -4}, 0, map[int]int8{},
+		`srl t0, t1, t2`, map[RegisterType]int32{T0: 15}, map[int]int8{})
 }
 
 func TestSrli(t *testing.T) {
 	runAssert(t, map[RegisterType]int32{T1: 4}, 0, map[int]int8{},
 		`srli t0, t1, 2`, map[RegisterType]int32{T0: 1}, map[int]int8{})
+
+	runAssert(t, map[RegisterType]int32{T1: -1}, 0, map[int]int8{},
+		`srli t0, t1, 4`, map[RegisterType]int32{T0: 0x0fffffff}, map[int]int8{})
 }
 
 func TestSub(t *testing.T) {
@@ -269,6 +475,12 @@ func TestSbLb(t *testing.T) {
 lb t2, 2, t1`, map[RegisterType]int32{T2: -1}, map[int]int8{4: -1})
 }
 
+func TestSbLbu(t *testing.T) {
+	runAssert(t, map[RegisterType]int32{T0: 2047, T1: 2}, 8, map[int]int8{},
+		`sb t0, 2(t1)
+lbu t2, 2(t1)`, map[RegisterType]int32{T2: 255}, map[int]int8{4: -1})
+}
+
 func TestShLh(t *testing.T) {
 	runAssert(t, map[RegisterType]int32{T0: 64, T1: 2}, 8, map[int]int8{4: 1, 5: 1},
 		`sh t0, 2, t1
@@ -277,6 +489,16 @@ lh t2, 2, t1`, map[RegisterType]int32{T2: 64}, map[int]int8{4: 64, 5: 0})
 	runAssert(t, map[RegisterType]int32{T0: 2047, T1: 2}, 8, map[int]int8{4: 1, 5: 1},
 		`sh t0, 2, t1
 lh t2, 2, t1`, map[RegisterType]int32{T2: 2047}, map[int]int8{4: -1, 5: 7})
+
+	runAssert(t, map[RegisterType]int32{T0: -2, T1: 2}, 8, map[int]int8{},
+		`sh t0, 2(t1)
+lh t2, 2(t1)`, map[RegisterType]int32{T2: -2}, map[int]int8{4: -2, 5: -1})
+}
+
+func TestShLhu(t *testing.T) {
+	runAssert(t, map[RegisterType]int32{T0: -2, T1: 2}, 8, map[int]int8{},
+		`sh t0, 2(t1)
+lhu t2, 2(t1)`, map[RegisterType]int32{T2: 0xfffe}, map[int]int8{4: -2, 5: -1})
 }
 
 func TestSwLw(t *testing.T) {
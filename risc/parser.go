@@ -7,30 +7,24 @@ import (
 )
 
 func Parse(s string) (Application, error) {
+	src, err := assemble(s)
+	if err != nil {
+		return Application{}, err
+	}
+
 	var instructions []InstructionRunner
-	labels := make(map[string]int32)
+	labels := src.labels
+	symbols := src.symbols
 	var pc int32
 
-	for _, line := range strings.Split(s, "\n") {
-		line = strings.TrimSpace(line)
-		if len(line) == 0 || line[0] == '#' {
-			continue
-		}
-
-		firstWhitespace := strings.Index(line, " ")
-		lastCharacters := line[len(line)-1]
-		if firstWhitespace == -1 && lastCharacters != ':' {
-			return Application{}, fmt.Errorf("invalid line: %s", line)
-		} else if firstWhitespace == -1 && lastCharacters == ':' {
-			labels[line[:len(line)-1]] = pc
-			continue
-		}
-
-		remainingLine := line[firstWhitespace+1:]
-		comment := strings.Index(remainingLine, "#")
-		if comment != -1 {
-			remainingLine = strings.TrimSpace(remainingLine[:comment])
+	for _, line := range src.instructions {
+		firstWhitespace := strings.IndexAny(line, " \t")
+		if firstWhitespace == -1 {
+			// Instruction without operands
+			line += " "
+			firstWhitespace = len(line) - 1
 		}
+		remainingLine := strings.TrimSpace(line[firstWhitespace+1:])
 
 		elements := strings.Split(remainingLine, ",")
 
@@ -89,7 +83,7 @@ func Parse(s string) (Application, error) {
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
-			imm, err := strconv.ParseInt(strings.TrimSpace(elements[2]), 10, 32)
+			imm, err := parseImmediate(strings.TrimSpace(elements[2]), symbols, labels)
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
@@ -110,7 +104,7 @@ func Parse(s string) (Application, error) {
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
-			imm, err := strconv.ParseInt(strings.TrimSpace(elements[2]), 10, 32)
+			imm, err := parseImmediate(strings.TrimSpace(elements[2]), symbols, labels)
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
@@ -127,7 +121,7 @@ func Parse(s string) (Application, error) {
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
-			imm, err := strconv.ParseInt(strings.TrimSpace(elements[1]), 10, 32)
+			imm, err := parseImmediate(strings.TrimSpace(elements[1]), symbols, labels)
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
@@ -277,6 +271,51 @@ func Parse(s string) (Application, error) {
 				rs1: rs1,
 				rs2: rs2,
 			})
+		case "divu":
+			if err := validateArgs(3, elements, remainingLine); err != nil {
+				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+			}
+			rd, err := parseRegister(strings.TrimSpace(elements[0]))
+			if err != nil {
+				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+			}
+			rs1, err := parseRegister(strings.TrimSpace(elements[1]))
+			if err != nil {
+				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+			}
+			rs2, err := parseRegister(strings.TrimSpace(elements[2]))
+			if err != nil {
+				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+			}
+			instructions = append(instructions, &divu{
+				rd:  rd,
+				rs1: rs1,
+				rs2: rs2,
+			})
+		case "ebreak":
+			instructions = append(instructions, &ebreak{})
+		case "ecall":
+			instructions = append(instructions, &ecall{})
+		case "fence":
+			pred, succ := int32(0b1111), int32(0b1111)
+			if remainingLine != "" {
+				if err := validateArgs(2, elements, remainingLine); err != nil {
+					return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+				}
+				var err error
+				pred, err = parseFenceSet(strings.TrimSpace(elements[0]))
+				if err != nil {
+					return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+				}
+				succ, err = parseFenceSet(strings.TrimSpace(elements[1]))
+				if err != nil {
+					return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+				}
+			}
+			instructions = append(instructions, &fence{
+				pred: pred,
+				succ: succ,
+			})
 		case "j":
 			if err := validateArgs(1, elements, remainingLine); err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
@@ -299,25 +338,35 @@ func Parse(s string) (Application, error) {
 				rd:    rd,
 			})
 		case "jalr":
-			if err := validateArgs(3, elements, remainingLine); err != nil {
+			if err := validateArgsInterval(2, 3, elements, remainingLine); err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
 			rd, err := parseRegister(strings.TrimSpace(elements[0]))
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
-			rs, err := parseRegister(strings.TrimSpace(elements[1]))
-			if err != nil {
-				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
-			}
-			imm, err := strconv.ParseInt(strings.TrimSpace(elements[2]), 10, 32)
-			if err != nil {
-				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+			var imm int32
+			var rs RegisterType
+			if len(elements) == 2 {
+				imm, rs, err = parseOffsetReg(strings.TrimSpace(elements[1]), symbols, labels)
+				if err != nil {
+					return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+				}
+			} else {
+				rs, err = parseRegister(strings.TrimSpace(elements[1]))
+				if err != nil {
+					return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+				}
+				i, err := parseImmediate(strings.TrimSpace(elements[2]), symbols, labels)
+				if err != nil {
+					return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+				}
+				imm = int32(i)
 			}
 			instructions = append(instructions, &jalr{
 				rd:  rd,
 				rs:  rs,
-				imm: int32(imm),
+				imm: imm,
 			})
 		case "lui":
 			if err := validateArgs(2, elements, remainingLine); err != nil {
@@ -327,7 +376,7 @@ func Parse(s string) (Application, error) {
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
-			imm, err := strconv.ParseInt(strings.TrimSpace(elements[1]), 10, 32)
+			imm, err := parseImmediate(strings.TrimSpace(elements[1]), symbols, labels)
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
@@ -336,14 +385,14 @@ func Parse(s string) (Application, error) {
 				imm: int32(imm),
 			})
 		case "lb":
-			if err := validateArgs(2, elements, remainingLine); err != nil {
+			if err := validateArgsInterval(2, 3, elements, remainingLine); err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
 			rd, err := parseRegister(strings.TrimSpace(elements[0]))
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
-			offset, rs, err := parseOffsetReg(strings.TrimSpace(elements[1]))
+			offset, rs, err := parseMemoryOperand(elements[1:], symbols, labels)
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
@@ -352,15 +401,32 @@ func Parse(s string) (Application, error) {
 				offset: offset,
 				rs:     rs,
 			})
+		case "lbu":
+			if err := validateArgsInterval(2, 3, elements, remainingLine); err != nil {
+				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+			}
+			rd, err := parseRegister(strings.TrimSpace(elements[0]))
+			if err != nil {
+				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+			}
+			offset, rs, err := parseMemoryOperand(elements[1:], symbols, labels)
+			if err != nil {
+				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+			}
+			instructions = append(instructions, &lbu{
+				rd:     rd,
+				offset: offset,
+				rs:     rs,
+			})
 		case "lh":
-			if err := validateArgs(2, elements, remainingLine); err != nil {
+			if err := validateArgsInterval(2, 3, elements, remainingLine); err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
 			rd, err := parseRegister(strings.TrimSpace(elements[0]))
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
-			offset, rs, err := parseOffsetReg(strings.TrimSpace(elements[1]))
+			offset, rs, err := parseMemoryOperand(elements[1:], symbols, labels)
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
@@ -369,6 +435,23 @@ func Parse(s string) (Application, error) {
 				offset: offset,
 				rs:     rs,
 			})
+		case "lhu":
+			if err := validateArgsInterval(2, 3, elements, remainingLine); err != nil {
+				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+			}
+			rd, err := parseRegister(strings.TrimSpace(elements[0]))
+			if err != nil {
+				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+			}
+			offset, rs, err := parseMemoryOperand(elements[1:], symbols, labels)
+			if err != nil {
+				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+			}
+			instructions = append(instructions, &lhu{
+				rd:     rd,
+				offset: offset,
+				rs:     rs,
+			})
 		case "li":
 			if err := validateArgs(2, elements, remainingLine); err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
@@ -377,7 +460,7 @@ func Parse(s string) (Application, error) {
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
-			imm, err := strconv.ParseInt(strings.TrimSpace(elements[1]), 10, 32)
+			imm, err := parseImmediate(strings.TrimSpace(elements[1]), symbols, labels)
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
@@ -386,14 +469,14 @@ func Parse(s string) (Application, error) {
 				imm: int32(imm),
 			})
 		case "lw":
-			if err := validateArgs(2, elements, remainingLine); err != nil {
+			if err := validateArgsInterval(2, 3, elements, remainingLine); err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
 			rd, err := parseRegister(strings.TrimSpace(elements[0]))
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
-			offset, rs, err := parseOffsetReg(strings.TrimSpace(elements[1]))
+			offset, rs, err := parseMemoryOperand(elements[1:], symbols, labels)
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
@@ -425,6 +508,69 @@ func Parse(s string) (Application, error) {
 				rs1: rs1,
 				rs2: rs2,
 			})
+		case "mulh":
+			if err := validateArgs(3, elements, remainingLine); err != nil {
+				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+			}
+			rd, err := parseRegister(strings.TrimSpace(elements[0]))
+			if err != nil {
+				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+			}
+			rs1, err := parseRegister(strings.TrimSpace(elements[1]))
+			if err != nil {
+				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+			}
+			rs2, err := parseRegister(strings.TrimSpace(elements[2]))
+			if err != nil {
+				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+			}
+			instructions = append(instructions, &mulh{
+				rd:  rd,
+				rs1: rs1,
+				rs2: rs2,
+			})
+		case "mulhsu":
+			if err := validateArgs(3, elements, remainingLine); err != nil {
+				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+			}
+			rd, err := parseRegister(strings.TrimSpace(elements[0]))
+			if err != nil {
+				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+			}
+			rs1, err := parseRegister(strings.TrimSpace(elements[1]))
+			if err != nil {
+				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+			}
+			rs2, err := parseRegister(strings.TrimSpace(elements[2]))
+			if err != nil {
+				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+			}
+			instructions = append(instructions, &mulhsu{
+				rd:  rd,
+				rs1: rs1,
+				rs2: rs2,
+			})
+		case "mulhu":
+			if err := validateArgs(3, elements, remainingLine); err != nil {
+				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+			}
+			rd, err := parseRegister(strings.TrimSpace(elements[0]))
+			if err != nil {
+				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+			}
+			rs1, err := parseRegister(strings.TrimSpace(elements[1]))
+			if err != nil {
+				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+			}
+			rs2, err := parseRegister(strings.TrimSpace(elements[2]))
+			if err != nil {
+				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+			}
+			instructions = append(instructions, &mulhu{
+				rd:  rd,
+				rs1: rs1,
+				rs2: rs2,
+			})
 		case "mv":
 			if err := validateArgs(2, elements, remainingLine); err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
@@ -474,7 +620,7 @@ func Parse(s string) (Application, error) {
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
-			imm, err := strconv.ParseInt(strings.TrimSpace(elements[2]), 10, 32)
+			imm, err := parseImmediate(strings.TrimSpace(elements[2]), symbols, labels)
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
@@ -504,17 +650,38 @@ func Parse(s string) (Application, error) {
 				rs1: rs1,
 				rs2: rs2,
 			})
+		case "remu":
+			if err := validateArgs(3, elements, remainingLine); err != nil {
+				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+			}
+			rd, err := parseRegister(strings.TrimSpace(elements[0]))
+			if err != nil {
+				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+			}
+			rs1, err := parseRegister(strings.TrimSpace(elements[1]))
+			if err != nil {
+				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+			}
+			rs2, err := parseRegister(strings.TrimSpace(elements[2]))
+			if err != nil {
+				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+			}
+			instructions = append(instructions, &remu{
+				rd:  rd,
+				rs1: rs1,
+				rs2: rs2,
+			})
 		case "ret":
 			instructions = append(instructions, &ret{})
 		case "sb":
-			if err := validateArgs(2, elements, remainingLine); err != nil {
+			if err := validateArgsInterval(2, 3, elements, remainingLine); err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
 			rs2, err := parseRegister(strings.TrimSpace(elements[0]))
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
-			offset, rs1, err := parseOffsetReg(strings.TrimSpace(elements[1]))
+			offset, rs1, err := parseMemoryOperand(elements[1:], symbols, labels)
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
@@ -524,24 +691,20 @@ func Parse(s string) (Application, error) {
 				rs1:    rs1,
 			})
 		case "sh":
-			if err := validateArgs(3, elements, remainingLine); err != nil {
+			if err := validateArgsInterval(2, 3, elements, remainingLine); err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
 			rs2, err := parseRegister(strings.TrimSpace(elements[0]))
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
-			offset, err := strconv.ParseInt(strings.TrimSpace(elements[1]), 10, 32)
-			if err != nil {
-				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
-			}
-			rs1, err := parseRegister(strings.TrimSpace(elements[2]))
+			offset, rs1, err := parseMemoryOperand(elements[1:], symbols, labels)
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
 			instructions = append(instructions, &sh{
 				rs2:    rs2,
-				offset: int32(offset),
+				offset: offset,
 				rs1:    rs1,
 			})
 
@@ -579,7 +742,7 @@ func Parse(s string) (Application, error) {
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
-			imm, err := strconv.ParseInt(strings.TrimSpace(elements[2]), 10, 32)
+			imm, err := parseImmediate(strings.TrimSpace(elements[2]), symbols, labels)
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
@@ -644,7 +807,7 @@ func Parse(s string) (Application, error) {
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
-			imm, err := strconv.ParseInt(strings.TrimSpace(elements[2]), 10, 32)
+			imm, err := parseImmediate(strings.TrimSpace(elements[2]), symbols, labels)
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
@@ -653,6 +816,27 @@ func Parse(s string) (Application, error) {
 				rs:  rs,
 				imm: int32(imm),
 			})
+		case "sltiu":
+			if err := validateArgs(3, elements, remainingLine); err != nil {
+				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+			}
+			rd, err := parseRegister(strings.TrimSpace(elements[0]))
+			if err != nil {
+				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+			}
+			rs, err := parseRegister(strings.TrimSpace(elements[1]))
+			if err != nil {
+				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+			}
+			imm, err := parseImmediate(strings.TrimSpace(elements[2]), symbols, labels)
+			if err != nil {
+				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
+			}
+			instructions = append(instructions, &sltiu{
+				rd:  rd,
+				rs:  rs,
+				imm: int32(imm),
+			})
 		case "sra":
 			if err := validateArgs(3, elements, remainingLine); err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
@@ -686,7 +870,7 @@ func Parse(s string) (Application, error) {
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
-			imm, err := strconv.ParseInt(strings.TrimSpace(elements[2]), 10, 32)
+			imm, err := parseImmediate(strings.TrimSpace(elements[2]), symbols, labels)
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
@@ -728,7 +912,7 @@ func Parse(s string) (Application, error) {
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
-			imm, err := strconv.ParseInt(strings.TrimSpace(elements[2]), 10, 32)
+			imm, err := parseImmediate(strings.TrimSpace(elements[2]), symbols, labels)
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
@@ -760,14 +944,14 @@ func Parse(s string) (Application, error) {
 			})
 
 		case "sw":
-			if err := validateArgs(2, elements, remainingLine); err != nil {
+			if err := validateArgsInterval(2, 3, elements, remainingLine); err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
 			rs2, err := parseRegister(strings.TrimSpace(elements[0]))
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
-			offset, rs1, err := parseOffsetReg(strings.TrimSpace(elements[1]))
+			offset, rs1, err := parseMemoryOperand(elements[1:], symbols, labels)
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
@@ -810,7 +994,7 @@ func Parse(s string) (Application, error) {
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
-			imm, err := strconv.ParseInt(strings.TrimSpace(elements[2]), 10, 32)
+			imm, err := parseImmediate(strings.TrimSpace(elements[2]), symbols, labels)
 			if err != nil {
 				return Application{}, fmt.Errorf("line %s: %v", remainingLine, err)
 			}
@@ -825,10 +1009,20 @@ func Parse(s string) (Application, error) {
 		pc += 4
 	}
 
-	return Application{
+	app := Application{
 		Instructions: instructions,
 		Labels:       labels,
-	}, nil
+		Segments:     src.segments,
+	}
+	if entry, exists := labels["_start"]; exists {
+		app.Entry = entry
+	}
+	words, err := Encode(app)
+	if err != nil {
+		return Application{}, err
+	}
+	app.Code = wordsToBytes(words)
+	return app, nil
 }
 
 func validateArgs(expected int, args []string, line string) error {
@@ -845,6 +1039,17 @@ func validateArgsInterval(min, max int, args []string, line string) error {
 	return fmt.Errorf("invalid line: expected between %d and %d arguments, got %d: %v", min, max, len(args), line)
 }
 
+// ParseRegister returns a register from its ABI name (a0) or its number (x10).
+func ParseRegister(s string) (RegisterType, error) {
+	s = strings.ToLower(s)
+	if number, found := strings.CutPrefix(s, "x"); found {
+		if n, err := strconv.Atoi(number); err == nil && n >= 0 && n <= int(T6) {
+			return RegisterType(n), nil
+		}
+	}
+	return parseRegister(s)
+}
+
 func parseRegister(s string) (RegisterType, error) {
 	switch s {
 	case "zero", "$zero":
@@ -916,24 +1121,76 @@ func parseRegister(s string) (RegisterType, error) {
 	}
 }
 
-func parseOffsetReg(s string) (int32, RegisterType, error) {
-	firstParenthesis := strings.IndexRune(s, '(')
-	if firstParenthesis == -1 {
-		return 0, 0, fmt.Errorf("invalid offset register: %s", s)
+// parseMemoryOperand accepts both the offset(reg) and the offset, reg forms.
+func parseMemoryOperand(elements []string, symbols ...map[string]int32) (int32, RegisterType, error) {
+	if len(elements) == 1 {
+		return parseOffsetReg(strings.TrimSpace(elements[0]), symbols...)
 	}
 
-	immString := strings.TrimSpace(s[:firstParenthesis])
-	imm, err := strconv.ParseInt(immString, 10, 32)
+	imm, err := parseImmediate(strings.TrimSpace(elements[0]), symbols...)
 	if err != nil {
 		return 0, 0, err
 	}
+	reg, err := parseRegister(strings.TrimSpace(elements[1]))
+	if err != nil {
+		return 0, 0, err
+	}
+	return imm, reg, nil
+}
+
+func parseOffsetReg(s string, symbols ...map[string]int32) (int32, RegisterType, error) {
+	// The offset may itself contain parentheses, e.g. %lo(symbol)(reg)
+	lastParenthesis := strings.LastIndex(s, "(")
+	if lastParenthesis == -1 || s[len(s)-1] != ')' {
+		return 0, 0, fmt.Errorf("invalid offset register: %s", s)
+	}
+
+	var imm int32
+	immString := strings.TrimSpace(s[:lastParenthesis])
+	if immString != "" {
+		var err error
+		imm, err = parseImmediate(immString, symbols...)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
 
-	regString := strings.TrimSpace(s[firstParenthesis+1 : len(s)-1])
+	regString := strings.TrimSpace(s[lastParenthesis+1 : len(s)-1])
 
 	reg, err := parseRegister(regString)
 	if err != nil {
 		return 0, 0, err
 	}
 
-	return int32(imm), reg, nil
+	return imm, reg, nil
+}
+
+// parseImmediate parses a number (decimal, hexadecimal, binary or character)
+// or a symbol defined by .equ or a label.
+func parseImmediate(s string, symbols ...map[string]int32) (int32, error) {
+	return evaluate(s, symbols...)
+}
+
+// parseFenceSet parses a fence predecessor or successor set made of the i, o,
+// r and w flags.
+func parseFenceSet(s string) (int32, error) {
+	var set int32
+	for _, c := range strings.ToLower(s) {
+		switch c {
+		case 'i':
+			set |= 0b1000
+		case 'o':
+			set |= 0b0100
+		case 'r':
+			set |= 0b0010
+		case 'w':
+			set |= 0b0001
+		default:
+			return 0, fmt.Errorf("invalid fence set %s", s)
+		}
+	}
+	if set == 0 {
+		return 0, fmt.Errorf("empty fence set")
+	}
+	return set, nil
 }
@@ -0,0 +1,128 @@
+package risc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teivah/majorana/test"
+)
+
+func TestParseDirectives(t *testing.T) {
+	app, err := Parse(`
+	.equ   SIZE, 0x10
+	.data
+word:   .word 0x01020304, half
+half:   .half 0x102
+byte:   .byte 'A', SIZE+1
+	.align 3
+str:    .ascii "a,b"
+	.asciz "c#"
+	.section .bss
+buf:    .space SIZE
+	.text
+start:
+	li   t0, SIZE
+	addi t1, zero, str
+	lw   t2, word(zero)
+	lh   t3, half(zero)
+	lb   t4, str+3(zero)`)
+	require.NoError(t, err)
+
+	require.Len(t, app.Segments, 2)
+	assert.Equal(t, int32(0), app.Segments[0].Addr)
+	assert.Equal(t, []int8{
+		4, 3, 2, 1, 8, 0, 0, 0,
+		2, 1,
+		'A', 17,
+		0, 0, 0, 0,
+		'a', ',', 'b', 'c', '#', 0,
+	}, app.Segments[0].Data)
+	assert.Equal(t, int32(24), app.Segments[1].Addr)
+	assert.Equal(t, make([]int8, 16), app.Segments[1].Data)
+
+	r := NewRunner(app, 64)
+	_, err = r.Run()
+	require.NoError(t, err)
+	assert.Equal(t, int32(16), r.Ctx.Registers[T0])
+	assert.Equal(t, int32(16), r.Ctx.Registers[T1])
+	assert.Equal(t, int32(0x01020304), r.Ctx.Registers[T2])
+	assert.Equal(t, int32(0x102), r.Ctx.Registers[T3])
+	assert.Equal(t, int32('c'), r.Ctx.Registers[T4])
+}
+
+func TestParseLargeLi(t *testing.T) {
+	app, err := Parse(`
+	.equ   BIG, 0x12345
+	li     t0, BIG
+	li     t1, 4097
+end:
+	j      end`)
+	require.NoError(t, err)
+
+	assert.Len(t, app.Instructions, 5)
+	assert.Equal(t, int32(16), app.Labels["end"])
+}
+
+func TestParseDirectivesErrors(t *testing.T) {
+	for _, s := range []string{
+		".word 1",
+		".data\naddi t0, t0, 1",
+		".equ SIZE",
+		".data\n.word unknown",
+		".foo",
+		"li t0, UNKNOWN",
+		"not t0",
+		"bgt t0, t1",
+	} {
+		_, err := Parse(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestParsePseudo(t *testing.T) {
+	app, err := Parse(`
+	.data
+	.space 8
+value:
+	.word 7
+	.text
+	la   a0, value
+	lw   a1, 0(a0)
+	li   a2, 0x12345678
+	li   t0, done
+	call inc
+	tail done
+inc:
+	addi a1, a1, 1
+	jr   ra
+done:
+	neg  a3, a1
+	seqz a4, a3
+	snez a5, a3`)
+	require.NoError(t, err)
+
+	r := NewRunner(app, 16)
+	_, err = r.Run()
+	require.NoError(t, err)
+	assert.Equal(t, int32(8), r.Ctx.Registers[A0])
+	assert.Equal(t, int32(8), r.Ctx.Registers[A1])
+	assert.Equal(t, int32(0x12345678), r.Ctx.Registers[A2])
+	assert.Equal(t, int32(-8), r.Ctx.Registers[A3])
+	assert.Equal(t, int32(0), r.Ctx.Registers[A4])
+	assert.Equal(t, int32(1), r.Ctx.Registers[A5])
+	assert.Equal(t, app.Labels["done"], r.Ctx.Registers[T0])
+}
+
+func TestParseData(t *testing.T) {
+	app, err := Parse(test.ReadFile(t, "../res/data-sum.asm"))
+	require.NoError(t, err)
+
+	r := NewRunner(app, 64)
+	_, err = r.Run()
+	require.NoError(t, err)
+	sum := r.Ctx.Memory[56:60]
+	length := r.Ctx.Memory[60:64]
+	assert.Equal(t, int32(14), I32FromBytes(sum[0], sum[1], sum[2], sum[3]))
+	assert.Equal(t, int32(28), I32FromBytes(length[0], length[1], length[2], length[3]))
+}
@@ -0,0 +1,124 @@
+package risc
+
+import (
+	"fmt"
+	"strings"
+)
+
+// expand returns the base instructions of a pseudo-instruction the same way
+// the GNU assembler does, or the line itself if it isn't a pseudo-instruction.
+// nop, li (12-bit), mv, j, beqz and ret have their own instruction and are kept
+// as is.
+//
+// As the code and the data aren't in the same address space, la and lla load
+// the absolute address of a symbol instead of a PC-relative one. call and tail
+// are PC-relative as they target the code.
+func expand(line string, pc int32, symbols map[string]int32) ([]string, error) {
+	mnemonic, operands := line, ""
+	if firstWhitespace := strings.IndexAny(line, " \t"); firstWhitespace != -1 {
+		mnemonic = line[:firstWhitespace]
+		operands = strings.TrimSpace(line[firstWhitespace+1:])
+	}
+	var args []string
+	if operands != "" {
+		args = strings.Split(operands, ",")
+		for i := range args {
+			args[i] = strings.TrimSpace(args[i])
+		}
+	}
+
+	expected := map[string]int{
+		"la": 2, "lla": 2, "call": 1, "tail": 1, "jr": 1,
+		"not": 2, "neg": 2, "seqz": 2, "snez": 2, "sltz": 2, "sgtz": 2,
+		"bnez": 2, "bgez": 2, "bltz": 2, "blez": 2, "bgtz": 2,
+		"bgt": 3, "ble": 3, "bgtu": 3, "bleu": 3,
+	}
+	mnemonic = strings.ToLower(mnemonic)
+	if n, exists := expected[mnemonic]; exists {
+		if err := validateArgs(n, args, operands); err != nil {
+			return nil, err
+		}
+	}
+
+	switch mnemonic {
+	case "li":
+		if len(args) != 2 {
+			break
+		}
+		v, err := evaluate(args[1], symbols)
+		if err != nil {
+			// The value depends on a code label, we can't know its size yet
+			return []string{
+				fmt.Sprintf("lui %s, %%hi(%s)", args[0], args[1]),
+				fmt.Sprintf("addi %s, %s, %%lo(%s)", args[0], args[0], args[1]),
+			}, nil
+		}
+		if v >= -2048 && v <= 2047 {
+			break
+		}
+		hi, lo := int32(uint32(v+0x800)>>12), v<<20>>20
+		if lo == 0 {
+			return []string{fmt.Sprintf("lui %s, %d", args[0], hi)}, nil
+		}
+		return []string{
+			fmt.Sprintf("lui %s, %d", args[0], hi),
+			fmt.Sprintf("addi %s, %s, %d", args[0], args[0], lo),
+		}, nil
+	case "la", "lla":
+		return []string{
+			fmt.Sprintf("lui %s, %%hi(%s)", args[0], args[1]),
+			fmt.Sprintf("addi %s, %s, %%lo(%s)", args[0], args[0], args[1]),
+		}, nil
+	case "call":
+		return []string{
+			fmt.Sprintf("auipc ra, %%hi(%s-%d)", args[0], pc),
+			fmt.Sprintf("jalr ra, %%lo(%s-%d)(ra)", args[0], pc),
+		}, nil
+	case "tail":
+		return []string{
+			fmt.Sprintf("auipc t1, %%hi(%s-%d)", args[0], pc),
+			fmt.Sprintf("jalr zero, %%lo(%s-%d)(t1)", args[0], pc),
+		}, nil
+	case "jal":
+		if len(args) == 1 {
+			return []string{fmt.Sprintf("jal ra, %s", args[0])}, nil
+		}
+	case "jalr":
+		if len(args) == 1 {
+			return []string{fmt.Sprintf("jalr ra, 0(%s)", args[0])}, nil
+		}
+	case "jr":
+		return []string{fmt.Sprintf("jalr zero, 0(%s)", args[0])}, nil
+	case "not":
+		return []string{fmt.Sprintf("xori %s, %s, -1", args[0], args[1])}, nil
+	case "neg":
+		return []string{fmt.Sprintf("sub %s, zero, %s", args[0], args[1])}, nil
+	case "seqz":
+		return []string{fmt.Sprintf("sltiu %s, %s, 1", args[0], args[1])}, nil
+	case "snez":
+		return []string{fmt.Sprintf("sltu %s, zero, %s", args[0], args[1])}, nil
+	case "sltz":
+		return []string{fmt.Sprintf("slt %s, %s, zero", args[0], args[1])}, nil
+	case "sgtz":
+		return []string{fmt.Sprintf("slt %s, zero, %s", args[0], args[1])}, nil
+	case "bnez":
+		return []string{fmt.Sprintf("bne %s, zero, %s", args[0], args[1])}, nil
+	case "bgez":
+		return []string{fmt.Sprintf("bge %s, zero, %s", args[0], args[1])}, nil
+	case "bltz":
+		return []string{fmt.Sprintf("blt %s, zero, %s", args[0], args[1])}, nil
+	case "blez":
+		return []string{fmt.Sprintf("bge zero, %s, %s", args[0], args[1])}, nil
+	case "bgtz":
+		return []string{fmt.Sprintf("blt zero, %s, %s", args[0], args[1])}, nil
+	case "bgt":
+		return []string{fmt.Sprintf("blt %s, %s, %s", args[1], args[0], args[2])}, nil
+	case "ble":
+		return []string{fmt.Sprintf("bge %s, %s, %s", args[1], args[0], args[2])}, nil
+	case "bgtu":
+		return []string{fmt.Sprintf("bltu %s, %s, %s", args[1], args[0], args[2])}, nil
+	case "bleu":
+		return []string{fmt.Sprintf("bgeu %s, %s, %s", args[1], args[0], args[2])}, nil
+	}
+	return []string{line}, nil
+}
@@ -124,20 +124,30 @@ const (
 	Bltu
 	Bne
 	Div
+	Divu
+	Ebreak
+	Ecall
+	Fence
 	J
 	Jal
 	Jalr
 	Lui
 	Lb
+	Lbu
 	Lh
+	Lhu
 	Li
 	Lw
 	Nop
 	Mul
+	Mulh
+	Mulhsu
+	Mulhu
 	Mv
 	Or
 	Ori
 	Rem
+	Remu
 	Ret
 	Sb
 	Sh
@@ -146,6 +156,7 @@ const (
 	Slt
 	Sltu
 	Slti
+	Sltiu
 	Sra
 	Srai
 	Srl
@@ -184,6 +195,14 @@ func (ins InstructionType) String() string {
 		return "Bne"
 	case Div:
 		return "Div"
+	case Divu:
+		return "Divu"
+	case Ebreak:
+		return "Ebreak"
+	case Ecall:
+		return "Ecall"
+	case Fence:
+		return "Fence"
 	case J:
 		return "J"
 	case Jal:
@@ -194,8 +213,12 @@ func (ins InstructionType) String() string {
 		return "Lui"
 	case Lb:
 		return "Lb"
+	case Lbu:
+		return "Lbu"
 	case Lh:
 		return "Lh"
+	case Lhu:
+		return "Lhu"
 	case Li:
 		return "Li"
 	case Lw:
@@ -204,6 +227,12 @@ func (ins InstructionType) String() string {
 		return "Nop"
 	case Mul:
 		return "Mul"
+	case Mulh:
+		return "Mulh"
+	case Mulhsu:
+		return "Mulhsu"
+	case Mulhu:
+		return "Mulhu"
 	case Mv:
 		return "Mv"
 	case Or:
@@ -212,6 +241,8 @@ func (ins InstructionType) String() string {
 		return "Ori"
 	case Rem:
 		return "Rem"
+	case Remu:
+		return "Remu"
 	case Ret:
 		return "Ret"
 	case Sb:
@@ -228,6 +259,8 @@ func (ins InstructionType) String() string {
 		return "Sltu"
 	case Slti:
 		return "Slti"
+	case Sltiu:
+		return "Sltiu"
 	case Sra:
 		return "Sra"
 	case Srai:
@@ -276,6 +309,15 @@ func (ins InstructionType) Cycles() int {
 	case Bne:
 		return 1
 	case Div:
+		// Iterative divider, one bit per cycle
+		return 33
+	case Divu:
+		return 33
+	case Ebreak:
+		return 1
+	case Ecall:
+		return 1
+	case Fence:
 		return 1
 	case J:
 		return 1
@@ -287,8 +329,12 @@ func (ins InstructionType) Cycles() int {
 		return 1
 	case Lb:
 		return 50
+	case Lbu:
+		return 50
 	case Lh:
 		return 50
+	case Lhu:
+		return 50
 	case Li:
 		return 1
 	case Lw:
@@ -296,7 +342,14 @@ func (ins InstructionType) Cycles() int {
 	case Nop:
 		return 1
 	case Mul:
-		return 1
+		// Pipelined multiplier
+		return 3
+	case Mulh:
+		return 3
+	case Mulhsu:
+		return 3
+	case Mulhu:
+		return 3
 	case Mv:
 		return 1
 	case Or:
@@ -304,7 +357,9 @@ func (ins InstructionType) Cycles() int {
 	case Ori:
 		return 1
 	case Rem:
-		return 1
+		return 33
+	case Remu:
+		return 33
 	case Ret:
 		return 1
 	case Sb:
@@ -323,6 +378,8 @@ func (ins InstructionType) Cycles() int {
 		return 1
 	case Slti:
 		return 1
+	case Sltiu:
+		return 1
 	case Sra:
 		return 1
 	case Srai:
@@ -364,7 +421,7 @@ func (ins InstructionType) IsMemoryWrite() bool {
 
 func (ins InstructionType) IsMemoryRead() bool {
 	switch ins {
-	case Lb, Lw, Lh:
+	case Lb, Lbu, Lh, Lhu, Lw:
 		return true
 	}
 	return false
@@ -372,7 +429,7 @@ func (ins InstructionType) IsMemoryRead() bool {
 
 func (ins InstructionType) IsUnconditionalBranch() bool {
 	switch ins {
-	case J, Jal, Jalr:
+	case J, Jal, Jalr, Ret:
 		return true
 	}
 	return false
@@ -380,7 +437,7 @@ func (ins InstructionType) IsUnconditionalBranch() bool {
 
 func (ins InstructionType) IsConditionalBranch() bool {
 	switch ins {
-	case Beq, Beqz, Bne, Blt, Bge, Bgeu:
+	case Beq, Beqz, Bne, Blt, Bltu, Bge, Bgeu:
 		return true
 	}
 	return false
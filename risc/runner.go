@@ -3,6 +3,9 @@ package risc
 type Runner struct {
 	Ctx *Context
 	App Application
+
+	pc   int32
+	done bool
 }
 
 func NewRunner(app Application, memoryBytes int) *Runner {
@@ -12,25 +15,63 @@ func NewRunner(app Application, memoryBytes int) *Runner {
 	}
 }
 
-func (r *Runner) Run() error {
-	var pc int32
-	for pc/4 < int32(len(r.App.Instructions)) {
-		runner := r.App.Instructions[pc/4]
-		exe, err := runner.Run(r.Ctx, r.App.Labels, pc, nil)
+// Run executes the application and returns its exit code.
+func (r *Runner) Run() (int32, error) {
+	if err := r.Start(); err != nil {
+		return 0, err
+	}
+	for {
+		_, _, ok, err := r.Step()
 		if err != nil {
-			return err
+			return 0, err
 		}
-		if exe.RegisterChange {
-			r.Ctx.WriteRegister(exe)
-		} else if exe.MemoryChange {
-			r.Ctx.WriteMemory(exe)
+		if !ok {
+			return r.Ctx.ExitCode, nil
 		}
+	}
+}
 
-		if exe.PcChange {
-			pc = exe.NextPc
-		} else {
-			pc += 4
-		}
+// Start loads the application so that it can be executed with Step.
+func (r *Runner) Start() error {
+	if err := r.Ctx.Load(r.App); err != nil {
+		return err
 	}
+	r.pc = r.App.Entry
+	r.done = false
 	return nil
 }
+
+// Step executes the next instruction and returns its pc and execution. It
+// returns false once the application has terminated.
+func (r *Runner) Step() (int32, Execution, bool, error) {
+	if r.done || r.pc/4 >= int32(len(r.App.Instructions)) {
+		r.done = true
+		return 0, Execution{}, false, nil
+	}
+	pc := r.pc
+	runner := r.App.Instructions[pc/4]
+	var memory []int8
+	for _, addr := range runner.MemoryRead(r.Ctx) {
+		memory = append(memory, r.Ctx.Memory[addr])
+	}
+	exe, err := runner.Run(r.Ctx, r.App.Labels, pc, memory)
+	if err != nil {
+		return 0, Execution{}, false, err
+	}
+	if exe.Return {
+		r.done = true
+		return pc, exe, true, nil
+	}
+	if exe.RegisterChange {
+		r.Ctx.WriteRegister(exe)
+	} else if exe.MemoryChange {
+		r.Ctx.WriteMemory(exe)
+	}
+
+	if exe.PcChange {
+		r.pc = exe.NextPc
+	} else {
+		r.pc += 4
+	}
+	return pc, exe, true, nil
+}
@@ -0,0 +1,308 @@
+package test
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// DataAddress is the base address of the loads and stores of a Program,
+	// held in s0. The programs access the 32 bytes from DataAddress.
+	DataAddress = 512
+	dataBytes   = 32
+
+	maxInstructions = 64
+	maxDepth        = 2
+	// maxCalls is the maximum number of nested calls
+	maxCalls = 2
+	// frameBytes is the size of the stack frame of a function, holding its
+	// return address
+	frameBytes = 16
+)
+
+var (
+	// Few registers so that most instructions depend on each other
+	registers = []string{"zero", "t0", "t1", "t2", "a0", "a1", "a2"}
+	// Loop counters, one per depth, never written by the loop bodies
+	counters = []string{"s1", "s2"}
+)
+
+type blockKind int
+
+const (
+	instructionBlock blockKind = iota
+	// branchBlock is a forward branch skipping its body if taken
+	branchBlock
+	// loopBlock is a body executed a fixed number of times
+	loopBlock
+	// callBlock is a function called with jal, saving its return address on
+	// the stack, and skipped once returned
+	callBlock
+)
+
+type block struct {
+	kind blockKind
+	// instruction is the instruction, the forward branch or the return
+	instruction string
+	label       string
+	// end is the label after the function of a call
+	end        string
+	counter    string
+	iterations int
+	body       []block
+}
+
+// Program is a random RV32IM program that always terminates. It contains
+// dense chains of register dependencies, loads and stores to overlapping
+// addresses, forward branches, jumps, loops and nested calls.
+type Program struct {
+	blocks []block
+}
+
+// NewProgram generates a program from random data, the same data always
+// generates the same program. It is meant to be used with fuzzing, the data
+// are read as a sequence of choices and 0 is chosen once they are exhausted.
+func NewProgram(data []byte) Program {
+	g := &generator{data: data}
+	var blocks []block
+	blocks = append(blocks, block{instruction: fmt.Sprintf("li s0, %d", DataAddress)})
+	// Non-trivial initial values
+	for _, register := range registers[1:] {
+		blocks = append(blocks, block{instruction: fmt.Sprintf("li %s, %d", register, g.immediate())})
+	}
+	blocks = append(blocks, g.blocks(0, 4+g.intn(maxInstructions))...)
+	return Program{blocks: blocks}
+}
+
+func (p Program) String() string {
+	var sb strings.Builder
+	write(&sb, p.blocks)
+	return sb.String()
+}
+
+func write(sb *strings.Builder, blocks []block) {
+	for _, b := range blocks {
+		switch b.kind {
+		case instructionBlock:
+			fmt.Fprintf(sb, "    %s\n", b.instruction)
+		case branchBlock:
+			fmt.Fprintf(sb, "    %s, %s\n", b.instruction, b.label)
+			write(sb, b.body)
+			fmt.Fprintf(sb, "%s:\n", b.label)
+		case loopBlock:
+			fmt.Fprintf(sb, "    li %s, %d\n", b.counter, b.iterations)
+			fmt.Fprintf(sb, "%s:\n", b.label)
+			write(sb, b.body)
+			fmt.Fprintf(sb, "    addi %s, %s, -1\n", b.counter, b.counter)
+			fmt.Fprintf(sb, "    bnez %s, %s\n", b.counter, b.label)
+		case callBlock:
+			fmt.Fprintf(sb, "    jal ra, %s\n", b.label)
+			fmt.Fprintf(sb, "    j %s\n", b.end)
+			fmt.Fprintf(sb, "%s:\n", b.label)
+			fmt.Fprintf(sb, "    addi sp, sp, -%d\n", frameBytes)
+			fmt.Fprintf(sb, "    sw ra, 0(sp)\n")
+			write(sb, b.body)
+			fmt.Fprintf(sb, "    lw ra, 0(sp)\n")
+			fmt.Fprintf(sb, "    addi sp, sp, %d\n", frameBytes)
+			fmt.Fprintf(sb, "    %s\n", b.instruction)
+			fmt.Fprintf(sb, "%s:\n", b.end)
+		}
+	}
+}
+
+// Minimize returns the smallest program derived from p which still fails,
+// removing instructions, branches, loops and calls or replacing them with their
+// body. fails must return true for p.
+func (p Program) Minimize(fails func(Program) bool) Program {
+	for {
+		reduced := false
+		for _, candidate := range reductions(p.blocks) {
+			if c := (Program{blocks: candidate}); fails(c) {
+				p = c
+				reduced = true
+				break
+			}
+		}
+		if !reduced {
+			return p
+		}
+	}
+}
+
+// reductions returns the blocks with one block removed or flattened, the
+// biggest reductions first.
+func reductions(blocks []block) [][]block {
+	var res [][]block
+	for i, b := range blocks {
+		res = append(res, splice(blocks, i, nil))
+		if b.kind != instructionBlock {
+			res = append(res, splice(blocks, i, b.body))
+		}
+	}
+	for i, b := range blocks {
+		for _, body := range reductions(b.body) {
+			b.body = body
+			res = append(res, splice(blocks, i, []block{b}))
+		}
+	}
+	return res
+}
+
+// splice returns a copy of blocks with the block at i replaced.
+func splice(blocks []block, i int, replacement []block) []block {
+	res := make([]block, 0, len(blocks)-1+len(replacement))
+	res = append(res, blocks[:i]...)
+	res = append(res, replacement...)
+	return append(res, blocks[i+1:]...)
+}
+
+type generator struct {
+	data   []byte
+	labels int
+	// calls is the number of calls the blocks generated are nested in
+	calls int
+}
+
+func (g *generator) byte() byte {
+	if len(g.data) == 0 {
+		return 0
+	}
+	b := g.data[0]
+	g.data = g.data[1:]
+	return b
+}
+
+// intn returns an int in [0, n).
+func (g *generator) intn(n int) int {
+	v := int(g.byte())<<8 | int(g.byte())
+	return v % n
+}
+
+func (g *generator) register() string {
+	return registers[g.intn(len(registers))]
+}
+
+// destination returns a register to write, rarely zero.
+func (g *generator) destination() string {
+	return registers[1+g.intn(len(registers)-1)]
+}
+
+// immediate returns a 12-bit signed immediate, often a small one.
+func (g *generator) immediate() int {
+	if g.intn(2) == 0 {
+		return g.intn(16) - 8
+	}
+	return g.intn(4096) - 2048
+}
+
+func (g *generator) label() string {
+	g.labels++
+	return fmt.Sprintf("L%d", g.labels)
+}
+
+// blocks generates n blocks at a loop depth.
+func (g *generator) blocks(depth, n int) []block {
+	var blocks []block
+	for i := 0; i < n; i++ {
+		blocks = append(blocks, g.block(depth))
+	}
+	return blocks
+}
+
+func (g *generator) block(depth int) block {
+	switch g.intn(18) {
+	case 0, 1, 2:
+		return block{instruction: g.load()}
+	case 3, 4:
+		return block{instruction: g.store()}
+	case 5, 6:
+		branches := []string{"beq", "bne", "blt", "bge", "bltu", "bgeu"}
+		return block{
+			kind:        branchBlock,
+			instruction: fmt.Sprintf("%s %s, %s", branches[g.intn(len(branches))], g.register(), g.register()),
+			label:       g.label(),
+			body:        g.blocks(depth, 1+g.intn(4)),
+		}
+	case 7:
+		// Unconditional jump writing the return address
+		return block{
+			kind:        branchBlock,
+			instruction: fmt.Sprintf("jal %s", g.destination()),
+			label:       g.label(),
+			body:        g.blocks(depth, g.intn(3)),
+		}
+	case 8:
+		if depth < maxDepth {
+			return block{
+				kind:       loopBlock,
+				label:      g.label(),
+				counter:    counters[depth],
+				iterations: 1 + g.intn(4),
+				body:       g.blocks(depth+1, 1+g.intn(6)),
+			}
+		}
+	case 9, 10, 11:
+		ops := []string{"addi", "andi", "ori", "xori", "slti", "sltiu"}
+		return block{instruction: fmt.Sprintf("%s %s, %s, %d", ops[g.intn(len(ops))], g.destination(), g.register(), g.immediate())}
+	case 12:
+		ops := []string{"slli", "srli", "srai"}
+		return block{instruction: fmt.Sprintf("%s %s, %s, %d", ops[g.intn(len(ops))], g.destination(), g.register(), g.intn(32))}
+	case 13:
+		if g.intn(2) == 0 {
+			return block{instruction: fmt.Sprintf("lui %s, %d", g.destination(), g.intn(1<<20))}
+		}
+		return block{instruction: fmt.Sprintf("auipc %s, %d", g.destination(), g.intn(16))}
+	case 14:
+		ops := []string{"mul", "mulh", "mulhsu", "mulhu", "div", "divu", "rem", "remu"}
+		return block{instruction: fmt.Sprintf("%s %s, %s, %s", ops[g.intn(len(ops))], g.destination(), g.register(), g.register())}
+	case 15:
+		if g.calls < maxCalls {
+			return g.call(depth)
+		}
+	}
+	ops := []string{"add", "sub", "and", "or", "xor", "sll", "srl", "sra", "slt", "sltu"}
+	return block{instruction: fmt.Sprintf("%s %s, %s, %s", ops[g.intn(len(ops))], g.destination(), g.register(), g.register())}
+}
+
+// call generates a call to a function whose body is generated at a loop
+// depth, so that its loops don't reuse the counters of the loops around the
+// call.
+func (g *generator) call(depth int) block {
+	returns := []string{"ret", "jalr zero, 0(ra)"}
+	b := block{
+		kind:        callBlock,
+		instruction: returns[g.intn(len(returns))],
+		label:       g.label(),
+		end:         g.label(),
+	}
+	g.calls++
+	b.body = g.blocks(depth, 1+g.intn(6))
+	g.calls--
+	return b
+}
+
+func (g *generator) load() string {
+	switch g.intn(5) {
+	case 0:
+		return fmt.Sprintf("lw %s, %d(s0)", g.destination(), 4*g.intn(dataBytes/4))
+	case 1:
+		return fmt.Sprintf("lh %s, %d(s0)", g.destination(), 2*g.intn(dataBytes/2))
+	case 2:
+		return fmt.Sprintf("lhu %s, %d(s0)", g.destination(), 2*g.intn(dataBytes/2))
+	case 3:
+		return fmt.Sprintf("lb %s, %d(s0)", g.destination(), g.intn(dataBytes))
+	default:
+		return fmt.Sprintf("lbu %s, %d(s0)", g.destination(), g.intn(dataBytes))
+	}
+}
+
+func (g *generator) store() string {
+	switch g.intn(3) {
+	case 0:
+		return fmt.Sprintf("sw %s, %d(s0)", g.register(), 4*g.intn(dataBytes/4))
+	case 1:
+		return fmt.Sprintf("sh %s, %d(s0)", g.register(), 2*g.intn(dataBytes/2))
+	default:
+		return fmt.Sprintf("sb %s, %d(s0)", g.register(), g.intn(dataBytes))
+	}
+}